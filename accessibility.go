@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// wheelchair_accessible (trips.txt) and wheelchair_boarding (stops.txt)
+// values. An empty value means the same as WheelchairUnknown.
+const (
+	WheelchairUnknown = "0"
+	WheelchairYes     = "1"
+	WheelchairNo      = "2"
+)
+
+// inheritWheelchairBoarding applies the GTFS rule that a stop without a
+// wheelchair_boarding value takes the one of its parent station, following
+// up to two parents for boarding areas.
+func inheritWheelchairBoarding(stops []Stop) {
+	byID := make(map[string]Stop, len(stops))
+	for _, stop := range stops {
+		byID[stop.StopID] = stop
+	}
+
+	for i := range stops {
+		stop := &stops[i]
+		if stop.WheelchairBoarding != "" && stop.WheelchairBoarding != WheelchairUnknown {
+			continue
+		}
+		parent := stop.ParentStation
+		for depth := 0; depth < 2 && parent != ""; depth++ {
+			boarding := byID[parent].WheelchairBoarding
+			if boarding == WheelchairYes || boarding == WheelchairNo {
+				stop.WheelchairBoarding = boarding
+				break
+			}
+			parent = byID[parent].ParentStation
+		}
+	}
+}
+
+// parseAccessibleFilter reads the accessible query parameter, which restricts
+// a response to options usable by wheelchair users.
+func parseAccessibleFilter(r *http.Request) (accessible bool, ok bool) {
+	value := r.URL.Query().Get("accessible")
+	if value == "" {
+		return false, true
+	}
+	accessible, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, false
+	}
+	return accessible, true
+}
+
+// stepFreeBoarding reports whether a stop can be boarded by wheelchair users.
+func stepFreeBoarding(stop Stop) bool {
+	return stop.WheelchairBoarding == WheelchairYes
+}
+
+func accessibleStops(stops []Stop) []Stop {
+	filtered := make([]Stop, 0, len(stops))
+	for _, stop := range stops {
+		if stepFreeBoarding(stop) {
+			filtered = append(filtered, stop)
+		}
+	}
+	return filtered
+}
+
+func accessibleBuses(buses []BusPosition) []BusPosition {
+	filtered := make([]BusPosition, 0, len(buses))
+	for _, bus := range buses {
+		if bus.WheelchairAccessible == WheelchairYes {
+			filtered = append(filtered, bus)
+		}
+	}
+	return filtered
+}
+
+func accessibleDepartures(departures []StationDeparture) []StationDeparture {
+	filtered := make([]StationDeparture, 0, len(departures))
+	for _, departure := range departures {
+		if departure.Accessible {
+			filtered = append(filtered, departure)
+		}
+	}
+	return filtered
+}
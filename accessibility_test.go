@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInheritWheelchairBoarding(t *testing.T) {
+	stops := []Stop{
+		{StopID: "S", LocationType: LocationStation, WheelchairBoarding: WheelchairYes},
+		{StopID: "P1", ParentStation: "S"},
+		{StopID: "P2", ParentStation: "S", WheelchairBoarding: WheelchairNo},
+		{StopID: "BA", LocationType: LocationBoardingArea, ParentStation: "P1", WheelchairBoarding: WheelchairUnknown},
+		{StopID: "X"},
+	}
+	inheritWheelchairBoarding(stops)
+
+	expected := []string{WheelchairYes, WheelchairYes, WheelchairNo, WheelchairYes, ""}
+	for i, stop := range stops {
+		if stop.WheelchairBoarding != expected[i] {
+			t.Errorf("Expected stop %s wheelchair boarding %q, got %q", stop.StopID, expected[i], stop.WheelchairBoarding)
+		}
+	}
+
+	if len(accessibleStops(stops)) != 3 {
+		t.Errorf("Expected 3 accessible stops, got %d", len(accessibleStops(stops)))
+	}
+}
+
+func TestParseAccessibleFilter(t *testing.T) {
+	accessible, ok := parseAccessibleFilter(httptest.NewRequest("GET", "/bus-positions?accessible=true", nil))
+	if !accessible || !ok {
+		t.Errorf("Expected accessible=true to filter")
+	}
+	accessible, ok = parseAccessibleFilter(httptest.NewRequest("GET", "/bus-positions", nil))
+	if accessible || !ok {
+		t.Errorf("Expected no filter by default")
+	}
+	_, ok = parseAccessibleFilter(httptest.NewRequest("GET", "/bus-positions?accessible=maybe", nil))
+	if ok {
+		t.Errorf("Expected accessible=maybe to be rejected")
+	}
+
+	buses := []BusPosition{{ID: "1", WheelchairAccessible: WheelchairYes}, {ID: "2", WheelchairAccessible: WheelchairNo}, {ID: "3"}}
+	filtered := accessibleBuses(buses)
+	if len(filtered) != 1 || filtered[0].ID != "1" {
+		t.Errorf("Expected only bus 1, got %+v", filtered)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// getAlerts fetches service alerts from the MARTA API. Unlike positions and
+// trip updates, alerts are optional, so failures are returned to the caller
+// instead of stopping the service.
+func getAlerts(apiURL string) ([]Alert, error) {
+	response, err := http.Get(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch alerts: %w", err)
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch alerts: %s", response.Status)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alerts: %w", err)
+	}
+
+	feed := &pb.FeedMessage{}
+	err = proto.Unmarshal(data, feed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alerts: %w", err)
+	}
+
+	alerts := make([]Alert, 0)
+	for _, entity := range feed.Entity {
+		alert := entity.GetAlert()
+		if alert == nil || entity.GetIsDeleted() {
+			continue
+		}
+		alerts = append(alerts, Alert{
+			ID:              entity.GetId(),
+			ActivePeriod:    alert.GetActivePeriod(),
+			InformedEntity:  alert.GetInformedEntity(),
+			Cause:           alert.GetCause().String(),
+			Effect:          alert.GetEffect().String(),
+			URL:             translatedText(alert.GetUrl()),
+			HeaderText:      translatedText(alert.GetHeaderText()),
+			DescriptionText: translatedText(alert.GetDescriptionText()),
+		})
+	}
+
+	return alerts, nil
+}
+
+// translatedText picks the English translation of a string, or the first one.
+func translatedText(text *pb.TranslatedString) string {
+	translations := text.GetTranslation()
+	for _, translation := range translations {
+		if translation.GetLanguage() == "en" {
+			return translation.GetText()
+		}
+	}
+	if len(translations) > 0 {
+		return translations[0].GetText()
+	}
+	return ""
+}
+
+// ActiveAt reports whether the alert should be shown at t. An alert without
+// active periods is active for as long as it is in the feed.
+func (a Alert) ActiveAt(t time.Time) bool {
+	if len(a.ActivePeriod) == 0 {
+		return true
+	}
+	now := uint64(t.Unix())
+	for _, period := range a.ActivePeriod {
+		if period.Start != nil && now < period.GetStart() {
+			continue
+		}
+		if period.End != nil && now > period.GetEnd() {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Affects reports whether any informed entity of the alert selects the given
+// route, trip or stop. Empty arguments never match.
+func (a Alert) Affects(routeID, tripID, stopID string) bool {
+	for _, entity := range a.InformedEntity {
+		if routeID != "" && entity.GetRouteId() == routeID && entity.GetTrip() == nil && entity.GetStopId() == "" {
+			return true
+		}
+		if tripID != "" && entity.GetTrip().GetTripId() == tripID {
+			return true
+		}
+		if stopID != "" && entity.GetStopId() == stopID {
+			if entity.GetRouteId() == "" || entity.GetRouteId() == routeID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// activeAlerts returns the alerts active at now that affect the route, trip
+// or stop.
+func activeAlerts(alerts []Alert, routeID, tripID, stopID string, now time.Time) []Alert {
+	matched := make([]Alert, 0)
+	for _, alert := range alerts {
+		if alert.ActiveAt(now) && alert.Affects(routeID, tripID, stopID) {
+			matched = append(matched, alert)
+		}
+	}
+	return matched
+}
+
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	alerts := currentFeed().Alerts
+	if query.Get("route_id") != "" || query.Get("trip_id") != "" || query.Get("stop_id") != "" {
+		alerts = activeAlerts(alerts, query.Get("route_id"), query.Get("trip_id"), query.Get("stop_id"), time.Now())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(alerts)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxAnomalyHistory = 1000
+
+	AnomalyStuck              = "stuck"
+	AnomalyTripWithoutVehicle = "trip_without_vehicle"
+	AnomalyVehicleWithoutTrip = "vehicle_without_trip"
+)
+
+var (
+	anomaliesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anomalies_total",
+		Help: "Total number of stuck vehicle, trip without vehicle and vehicle without trip anomalies detected, by type.",
+	}, []string{"type"})
+
+	activeAnomalies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "active_anomalies",
+		Help: "Number of anomalies in progress, by type.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(anomaliesTotal)
+	prometheus.MustRegister(activeAnomalies)
+}
+
+var anomalyDetector *AnomalyDetector
+
+// Anomaly is a period during which a vehicle or trip looked wrong in the
+// feeds. Vehicle anomalies carry the last reported position.
+type Anomaly struct {
+	Type      string
+	VehicleID string
+	TripID    string
+	RouteID   string
+	Latitude  float64
+	Longitude float64
+	Detail    string
+	Start     time.Time
+	LastSeen  time.Time
+	End       *time.Time
+}
+
+type stuckAnchor struct {
+	TripID    string
+	Latitude  float64
+	Longitude float64
+	Since     time.Time
+}
+
+// AnomalyDetector flags vehicles that stay within StuckRadius meters for
+// StuckAfter anywhere but a layover point, trips in the trip updates that
+// should be running but have no vehicle, and vehicles without a trip. The
+// last two must persist for Grace, since the two feeds are polled apart.
+//
+// Layover points are the stations and the terminals of every trip, within
+// LayoverRadius meters.
+type AnomalyDetector struct {
+	StuckAfter    time.Duration
+	StuckRadius   float64
+	LayoverRadius float64
+	Grace         time.Duration
+
+	index    *GTFSIndex
+	layovers []Stop
+	mu       sync.RWMutex
+	anchors  map[string]stuckAnchor
+	pending  map[string]time.Time
+	active   map[string]*Anomaly
+	history  []Anomaly
+}
+
+func NewAnomalyDetector(index *GTFSIndex, stuckAfter time.Duration, stuckRadius, layoverRadius float64, grace time.Duration) *AnomalyDetector {
+	return &AnomalyDetector{
+		StuckAfter:    stuckAfter,
+		StuckRadius:   stuckRadius,
+		LayoverRadius: layoverRadius,
+		Grace:         grace,
+		index:         index,
+		layovers:      layoverPoints(index),
+		anchors:       make(map[string]stuckAnchor),
+		pending:       make(map[string]time.Time),
+		active:        make(map[string]*Anomaly),
+	}
+}
+
+func anomalyKey(anomalyType, id string) string {
+	return anomalyType + ":" + id
+}
+
+// Observe evaluates the vehicle positions and trip updates current at now.
+func (d *AnomalyDetector) Observe(buses []BusPosition, tripUpdates []TripUpdate, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	found := make(map[string]Anomaly)
+	vehicles := make(map[string]bool, len(buses))
+	trips := make(map[string]bool, len(buses))
+
+	for _, bus := range buses {
+		vehicles[bus.ID] = true
+		if bus.TripID != "" {
+			trips[bus.TripID] = true
+		}
+
+		// A new trip assignment restarts the clock, like moving does.
+		anchor, ok := d.anchors[bus.ID]
+		if !ok || anchor.TripID != bus.TripID || haversineMeters(anchor.Latitude, anchor.Longitude, bus.Latitude, bus.Longitude) > d.StuckRadius {
+			anchor = stuckAnchor{TripID: bus.TripID, Latitude: bus.Latitude, Longitude: bus.Longitude, Since: now}
+			d.anchors[bus.ID] = anchor
+		}
+		if now.Sub(anchor.Since) >= d.StuckAfter && !d.atLayover(bus) {
+			found[anomalyKey(AnomalyStuck, bus.ID)] = Anomaly{
+				Type:      AnomalyStuck,
+				VehicleID: bus.ID,
+				TripID:    bus.TripID,
+				RouteID:   bus.RouteID,
+				Latitude:  bus.Latitude,
+				Longitude: bus.Longitude,
+				Detail:    fmt.Sprintf("within %.0fm for %.0f minutes", d.StuckRadius, now.Sub(anchor.Since).Minutes()),
+				Start:     anchor.Since,
+			}
+		}
+
+		detail := ""
+		if bus.TripID == "" {
+			detail = "no trip assigned"
+		} else if _, ok := d.index.Trips[bus.TripID]; !ok && len(d.index.Trips) > 0 {
+			detail = fmt.Sprintf("trip %s is not in the static schedule", bus.TripID)
+		}
+		if detail != "" {
+			key := anomalyKey(AnomalyVehicleWithoutTrip, bus.ID)
+			found[key] = Anomaly{
+				Type:      AnomalyVehicleWithoutTrip,
+				VehicleID: bus.ID,
+				TripID:    bus.TripID,
+				RouteID:   bus.RouteID,
+				Latitude:  bus.Latitude,
+				Longitude: bus.Longitude,
+				Detail:    detail,
+				Start:     d.firstSeen(key, now),
+			}
+		}
+	}
+
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		vehicleID := tripUpdate.Vehicle.GetId()
+		if tripID == "" || trips[tripID] || (vehicleID != "" && vehicles[vehicleID]) {
+			continue
+		}
+		if !d.tripStarted(tripUpdate, now) {
+			continue
+		}
+		routeID := tripUpdate.Trip.GetRouteId()
+		if routeID == "" {
+			routeID = d.index.Trips[tripID].RouteID
+		}
+		detail := "no vehicle reports this trip"
+		if vehicleID != "" {
+			detail = fmt.Sprintf("vehicle %s is not in the vehicle positions", vehicleID)
+		}
+		key := anomalyKey(AnomalyTripWithoutVehicle, tripID)
+		found[key] = Anomaly{
+			Type:      AnomalyTripWithoutVehicle,
+			VehicleID: vehicleID,
+			TripID:    tripID,
+			RouteID:   routeID,
+			Detail:    detail,
+			Start:     d.firstSeen(key, now),
+		}
+	}
+
+	for key, anomaly := range found {
+		if anomaly.Type != AnomalyStuck && now.Sub(anomaly.Start) < d.Grace {
+			continue
+		}
+		if active, ok := d.active[key]; ok {
+			active.Latitude, active.Longitude = anomaly.Latitude, anomaly.Longitude
+			active.Detail = anomaly.Detail
+			active.LastSeen = now
+			continue
+		}
+		started := anomaly
+		started.LastSeen = now
+		d.active[key] = &started
+		anomaliesTotal.WithLabelValues(anomaly.Type).Inc()
+	}
+
+	for key := range d.active {
+		if _, ok := found[key]; !ok {
+			d.closeAnomaly(key, now)
+		}
+	}
+	for key := range d.pending {
+		if _, ok := found[key]; !ok {
+			delete(d.pending, key)
+		}
+	}
+	for id := range d.anchors {
+		if !vehicles[id] {
+			delete(d.anchors, id)
+		}
+	}
+
+	d.updateMetrics()
+}
+
+// firstSeen returns when a condition was first seen in its current streak.
+// The caller must hold d.mu.
+func (d *AnomalyDetector) firstSeen(key string, now time.Time) time.Time {
+	if since, ok := d.pending[key]; ok {
+		return since
+	}
+	d.pending[key] = now
+	return now
+}
+
+// atLayover reports whether a bus is at a station or a trip terminal.
+func (d *AnomalyDetector) atLayover(bus BusPosition) bool {
+	for _, point := range d.layovers {
+		if haversineMeters(point.Latitude, point.Longitude, bus.Latitude, bus.Longitude) <= d.LayoverRadius {
+			return true
+		}
+	}
+	return false
+}
+
+// layoverPoints returns the stations and the first and last stops of every
+// trip, once each.
+func layoverPoints(index *GTFSIndex) []Stop {
+	points := make([]Stop, 0)
+	for _, station := range index.Stations() {
+		points = append(points, Stop{Latitude: station.Latitude, Longitude: station.Longitude})
+	}
+	seen := make(map[string]bool)
+	for _, stopTimes := range index.StopTimes {
+		if len(stopTimes) == 0 {
+			continue
+		}
+		for _, stopID := range []string{stopTimes[0].StopID, stopTimes[len(stopTimes)-1].StopID} {
+			stop, ok := index.Stops[stopID]
+			if ok && !seen[stopID] {
+				seen[stopID] = true
+				points = append(points, stop)
+			}
+		}
+	}
+	return points
+}
+
+// tripStarted reports whether a trip should be running at now, going by the
+// earliest predicted time in its trip update or else its first scheduled
+// departure. Trips with no times at all are assumed to be running.
+func (d *AnomalyDetector) tripStarted(tripUpdate TripUpdate, now time.Time) bool {
+	for _, update := range tripUpdate.StopTimeUpdate {
+		event := update.GetDeparture()
+		if event.GetTime() == 0 {
+			event = update.GetArrival()
+		}
+		if event.GetTime() != 0 {
+			return !time.Unix(event.GetTime(), 0).After(now)
+		}
+	}
+
+	stopTimes := d.index.StopTimes[tripUpdate.Trip.GetTripId()]
+	if len(stopTimes) == 0 {
+		return true
+	}
+	serviceDate := d.index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+	return !d.index.ScheduledTime(serviceDate, stopTimes[0].DepartureTime).After(now)
+}
+
+// closeAnomaly ends an active anomaly, if any. The caller must hold d.mu.
+func (d *AnomalyDetector) closeAnomaly(key string, now time.Time) {
+	anomaly, ok := d.active[key]
+	if !ok {
+		return
+	}
+	end := now
+	anomaly.End = &end
+	delete(d.active, key)
+
+	d.history = append(d.history, *anomaly)
+	if len(d.history) > maxAnomalyHistory {
+		d.history = d.history[len(d.history)-maxAnomalyHistory:]
+	}
+}
+
+// updateMetrics publishes the number of active anomalies by type. The caller
+// must hold d.mu.
+func (d *AnomalyDetector) updateMetrics() {
+	counts := map[string]int{AnomalyStuck: 0, AnomalyTripWithoutVehicle: 0, AnomalyVehicleWithoutTrip: 0}
+	for _, anomaly := range d.active {
+		counts[anomaly.Type]++
+	}
+	for anomalyType, count := range counts {
+		activeAnomalies.WithLabelValues(anomalyType).Set(float64(count))
+	}
+}
+
+// Active returns the anomalies still in progress, oldest first.
+func (d *AnomalyDetector) Active() []Anomaly {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	anomalies := make([]Anomaly, 0, len(d.active))
+	for _, anomaly := range d.active {
+		anomalies = append(anomalies, *anomaly)
+	}
+	sort.Slice(anomalies, func(i, j int) bool {
+		if !anomalies[i].Start.Equal(anomalies[j].Start) {
+			return anomalies[i].Start.Before(anomalies[j].Start)
+		}
+		return anomalies[i].Type+anomalies[i].VehicleID+anomalies[i].TripID < anomalies[j].Type+anomalies[j].VehicleID+anomalies[j].TripID
+	})
+	return anomalies
+}
+
+// History returns the most recent finished anomalies, oldest first.
+func (d *AnomalyDetector) History() []Anomaly {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return append([]Anomaly(nil), d.history...)
+}
+
+type AnomalyReport struct {
+	StuckMinutes float64
+	GraceSeconds float64
+	Active       []Anomaly
+	Recent       []Anomaly
+}
+
+// anomaliesHandler serves the stuck vehicle, trip without vehicle and vehicle
+// without trip anomalies, filtered by type and route_id.
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	anomalyType := r.URL.Query().Get("type")
+	routeID := r.URL.Query().Get("route_id")
+
+	report := AnomalyReport{
+		StuckMinutes: anomalyDetector.StuckAfter.Minutes(),
+		GraceSeconds: anomalyDetector.Grace.Seconds(),
+		Active:       filterAnomalies(anomalyDetector.Active(), anomalyType, routeID),
+		Recent:       filterAnomalies(anomalyDetector.History(), anomalyType, routeID),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+func filterAnomalies(anomalies []Anomaly, anomalyType, routeID string) []Anomaly {
+	filtered := make([]Anomaly, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		if anomalyType != "" && anomaly.Type != anomalyType {
+			continue
+		}
+		if routeID != "" && anomaly.RouteID != routeID {
+			continue
+		}
+		filtered = append(filtered, anomaly)
+	}
+	return filtered
+}
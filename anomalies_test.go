@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	detector := NewAnomalyDetector(newTestIndex(), 20*time.Minute, 50, 150, 2*time.Minute)
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	buses := []BusPosition{
+		// Between A and B, far from both terminals.
+		{ID: "2301", TripID: "t1", RouteID: "r1", Latitude: 33.75, Longitude: -84.395},
+		// Laying over at terminal A.
+		{ID: "2302", TripID: "t2", RouteID: "r1", Latitude: 33.75, Longitude: -84.40},
+		{ID: "2303", RouteID: "r1", Latitude: 33.76, Longitude: -84.40},
+	}
+	tripUpdates := []TripUpdate{
+		{
+			Trip:           &pb.TripDescriptor{TripId: proto.String("t1")},
+			Vehicle:        &pb.VehicleDescriptor{Id: proto.String("2301")},
+			StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{newTestStopTimeUpdate(2, "B", start)},
+		},
+		{
+			Trip:           &pb.TripDescriptor{TripId: proto.String("t3"), RouteId: proto.String("r1")},
+			Vehicle:        &pb.VehicleDescriptor{Id: proto.String("9999")},
+			StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{newTestStopTimeUpdate(1, "A", start.Add(-time.Minute))},
+		},
+		{
+			// Not started yet.
+			Trip:           &pb.TripDescriptor{TripId: proto.String("t9")},
+			StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{newTestStopTimeUpdate(1, "A", start.Add(time.Hour))},
+		},
+	}
+
+	detector.Observe(buses, tripUpdates, start)
+	if active := detector.Active(); len(active) != 0 {
+		t.Errorf("Expected nothing active within the grace period, got %+v", active)
+	}
+
+	detector.Observe(buses, tripUpdates, start.Add(3*time.Minute))
+	active := detector.Active()
+	if len(active) != 2 {
+		t.Fatalf("Expected 2 anomalies after the grace period, got %+v", active)
+	}
+	types := map[string]Anomaly{}
+	for _, anomaly := range active {
+		types[anomaly.Type] = anomaly
+	}
+	if anomaly := types[AnomalyVehicleWithoutTrip]; anomaly.VehicleID != "2303" || !anomaly.Start.Equal(start) {
+		t.Errorf("Expected vehicle 2303 without trip since the first poll, got %+v", anomaly)
+	}
+	if anomaly := types[AnomalyTripWithoutVehicle]; anomaly.TripID != "t3" || anomaly.VehicleID != "9999" || anomaly.RouteID != "r1" {
+		t.Errorf("Expected trip t3 without vehicle, got %+v", anomaly)
+	}
+
+	detector.Observe(buses, tripUpdates, start.Add(21*time.Minute))
+	// A vehicle without a trip is stuck too; the one at terminal A isn't.
+	stuck := filterAnomalies(detector.Active(), AnomalyStuck, "")
+	if len(stuck) != 2 || stuck[0].VehicleID != "2301" || stuck[1].VehicleID != "2303" || !stuck[0].Start.Equal(start) {
+		t.Fatalf("Expected 2301 and 2303 stuck since the first poll, got %+v", stuck)
+	}
+
+	// 2301 drives off and 2303 picks up a trip.
+	buses[0].Longitude = -84.39
+	buses[2].TripID = "t3"
+	detector.Observe(buses, tripUpdates, start.Add(22*time.Minute))
+	if active := detector.Active(); len(active) != 0 {
+		t.Errorf("Expected every anomaly to end, got %+v", active)
+	}
+	history := detector.History()
+	if len(history) != 4 {
+		t.Fatalf("Expected 4 finished anomalies, got %d", len(history))
+	}
+	for _, anomaly := range history {
+		if anomaly.End == nil || !anomaly.End.Equal(start.Add(22*time.Minute)) {
+			t.Errorf("Expected %s to end at 08:22, got %v", anomaly.Type, anomaly.End)
+		}
+	}
+}
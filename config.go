@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// envFloat reads a float setting from the environment, falling back to def
+// when the variable is unset or malformed.
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %v", value, name, def)
+		return def
+	}
+	return parsed
+}
+
+// envInt reads an integer setting from the environment, falling back to def
+// when the variable is unset or malformed.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %v", value, name, def)
+		return def
+	}
+	return parsed
+}
+
+// envString reads a string setting from the environment, falling back to def
+// when the variable is unset.
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
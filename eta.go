@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How far back recent speed is measured over.
+	etaSpeedWindow = 2 * time.Minute
+	// Below this speed a vehicle is dwelling and its speed says nothing
+	// about how fast it will travel.
+	etaMinMovingSpeed = 1.0
+	// Weight of the newest sample in a segment's running travel time.
+	etaSegmentAlpha = 0.2
+)
+
+var etaPredictor *ETAPredictor
+
+// StopPrediction is the predicted arrival at one downstream stop, with the
+// agency's own TripUpdate prediction for comparison when there is one.
+type StopPrediction struct {
+	StopID             string
+	StopName           string
+	StopSequence       int
+	Scheduled          *time.Time
+	Predicted          time.Time
+	AgencyPredicted    *time.Time
+	DifferenceSeconds  *float64
+	FromHistory        bool
+	WheelchairBoarding string
+}
+
+// VehiclePrediction holds the predictions for the rest of a vehicle's trip.
+type VehiclePrediction struct {
+	VehicleID            string
+	TripID               string
+	RouteID              string
+	ObservedAt           time.Time
+	AlongTrackMeters     float64
+	SpeedMetersPerSecond float64
+	WheelchairAccessible string
+	Stops                []StopPrediction
+}
+
+type segmentStats struct {
+	Seconds float64
+	Samples int
+}
+
+type vehicleProgress struct {
+	TripID string
+	// Offsets holds the along-shape distance of every stop of the trip.
+	Offsets      []float64
+	Points       []trackPoint
+	LastStop     int
+	LastStopTime time.Time
+}
+
+// ETAPredictor predicts arrivals from the vehicle positions alone: progress
+// along the trip shape, recent speed and the travel times it has learned for
+// each stop-to-stop segment.
+type ETAPredictor struct {
+	DefaultSpeed float64
+
+	index    *GTFSIndex
+	mu       sync.RWMutex
+	segments map[string]*segmentStats
+	vehicles map[string]*vehicleProgress
+}
+
+// NewETAPredictor returns a predictor that falls back to defaultSpeed meters
+// per second when it knows neither the vehicle's speed nor the segment.
+func NewETAPredictor(index *GTFSIndex, defaultSpeed float64) *ETAPredictor {
+	return &ETAPredictor{
+		DefaultSpeed: defaultSpeed,
+		index:        index,
+		segments:     make(map[string]*segmentStats),
+		vehicles:     make(map[string]*vehicleProgress),
+	}
+}
+
+// Observe evaluates one poll of vehicle positions taken at now, learning
+// segment travel times from the stops vehicles passed since the last poll.
+func (p *ETAPredictor) Observe(buses []BusPosition, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seen := make(map[string]bool, len(buses))
+	for _, bus := range buses {
+		offsets := p.index.StopOffsets(bus.TripID)
+		if offsets == nil {
+			continue
+		}
+		shape := p.index.ShapeForTrip(bus.TripID)
+		stopTimes := p.index.StopTimes[bus.TripID]
+		seen[bus.ID] = true
+
+		observed := now
+		if bus.Timestamp > 0 {
+			observed = time.Unix(bus.Timestamp, 0)
+		}
+		_, alongTrack := shape.Project(bus.Latitude, bus.Longitude)
+		point := trackPoint{AlongTrack: alongTrack, Time: observed}
+
+		progress, ok := p.vehicles[bus.ID]
+		if !ok || progress.TripID != bus.TripID {
+			progress = &vehicleProgress{
+				TripID:   bus.TripID,
+				Offsets:  offsets,
+				LastStop: -1,
+			}
+			p.vehicles[bus.ID] = progress
+			// Stops already behind the vehicle were passed at unknown times.
+			for progress.LastStop+1 < len(progress.Offsets) && progress.Offsets[progress.LastStop+1] <= alongTrack {
+				progress.LastStop++
+			}
+			progress.Points = append(progress.Points, point)
+			continue
+		}
+
+		last := progress.Points[len(progress.Points)-1]
+		if !observed.After(last.Time) {
+			continue
+		}
+		p.passStops(progress, stopTimes, last, point)
+
+		progress.Points = append(progress.Points, point)
+		if len(progress.Points) > maxTrackPoints {
+			progress.Points = progress.Points[len(progress.Points)-maxTrackPoints:]
+		}
+	}
+
+	for id := range p.vehicles {
+		if !seen[id] {
+			delete(p.vehicles, id)
+		}
+	}
+}
+
+// passStops records the stops crossed between two consecutive positions,
+// interpolating when each was passed. A segment's travel time is only learned
+// when both of its stops were seen being passed. The caller must hold p.mu.
+func (p *ETAPredictor) passStops(progress *vehicleProgress, stopTimes []StopTime, from, to trackPoint) {
+	for progress.LastStop+1 < len(progress.Offsets) && progress.Offsets[progress.LastStop+1] <= to.AlongTrack {
+		next := progress.LastStop + 1
+		passed := to.Time
+		if to.AlongTrack > from.AlongTrack && progress.Offsets[next] > from.AlongTrack {
+			fraction := (progress.Offsets[next] - from.AlongTrack) / (to.AlongTrack - from.AlongTrack)
+			passed = from.Time.Add(time.Duration(fraction * float64(to.Time.Sub(from.Time))))
+		}
+
+		if progress.LastStop >= 0 && !progress.LastStopTime.IsZero() {
+			key := segmentKey(stopTimes[progress.LastStop].StopID, stopTimes[next].StopID)
+			p.learnSegment(key, passed.Sub(progress.LastStopTime).Seconds())
+		}
+		progress.LastStop = next
+		progress.LastStopTime = passed
+	}
+}
+
+// learnSegment folds one travel time into the running average of a segment.
+// The caller must hold p.mu.
+func (p *ETAPredictor) learnSegment(key string, seconds float64) {
+	if seconds <= 0 {
+		return
+	}
+	stats, ok := p.segments[key]
+	if !ok {
+		p.segments[key] = &segmentStats{Seconds: seconds, Samples: 1}
+		return
+	}
+	stats.Seconds = etaSegmentAlpha*seconds + (1-etaSegmentAlpha)*stats.Seconds
+	stats.Samples++
+}
+
+func segmentKey(fromStopID, toStopID string) string {
+	return fromStopID + ">" + toStopID
+}
+
+// recentSpeed returns the average speed over the last etaSpeedWindow.
+func recentSpeed(points []trackPoint) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+	last := points[len(points)-1]
+	first := points[0]
+	for _, point := range points {
+		if last.Time.Sub(point.Time) <= etaSpeedWindow {
+			first = point
+			break
+		}
+	}
+	elapsed := last.Time.Sub(first.Time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return (last.AlongTrack - first.AlongTrack) / elapsed
+}
+
+// Predict returns the predicted arrivals at the stops still ahead of a
+// vehicle, or false when the vehicle isn't being tracked.
+func (p *ETAPredictor) Predict(vehicleID string) (VehiclePrediction, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	progress, ok := p.vehicles[vehicleID]
+	if !ok {
+		return VehiclePrediction{}, false
+	}
+	stopTimes := p.index.StopTimes[progress.TripID]
+	last := progress.Points[len(progress.Points)-1]
+
+	speed := recentSpeed(progress.Points)
+	cruise := speed
+	if cruise < etaMinMovingSpeed {
+		cruise = p.DefaultSpeed
+	}
+
+	prediction := VehiclePrediction{
+		VehicleID:            vehicleID,
+		TripID:               progress.TripID,
+		RouteID:              p.index.Trips[progress.TripID].RouteID,
+		ObservedAt:           last.Time,
+		AlongTrackMeters:     last.AlongTrack,
+		SpeedMetersPerSecond: speed,
+		WheelchairAccessible: p.index.Trips[progress.TripID].WheelchairAccessible,
+		Stops:                make([]StopPrediction, 0),
+	}
+
+	elapsed := 0.0
+	position := last.AlongTrack
+	for i := progress.LastStop + 1; i < len(stopTimes); i++ {
+		remaining := progress.Offsets[i] - position
+		if remaining < 0 {
+			remaining = 0
+		}
+		segmentLength := progress.Offsets[i]
+		if i > 0 {
+			segmentLength -= progress.Offsets[i-1]
+		}
+
+		fromHistory := false
+		seconds := remaining / cruise
+		if i > 0 {
+			if stats, ok := p.segments[segmentKey(stopTimes[i-1].StopID, stopTimes[i].StopID)]; ok && segmentLength > 0 {
+				seconds = stats.Seconds * remaining / segmentLength
+				fromHistory = true
+			}
+		}
+		elapsed += seconds
+		position = progress.Offsets[i]
+
+		stop := p.index.Stops[stopTimes[i].StopID]
+		prediction.Stops = append(prediction.Stops, StopPrediction{
+			StopID:             stopTimes[i].StopID,
+			StopName:           stop.StopName,
+			StopSequence:       stopTimes[i].StopSequence,
+			Predicted:          last.Time.Add(time.Duration(elapsed * float64(time.Second))),
+			FromHistory:        fromHistory,
+			WheelchairBoarding: stop.WheelchairBoarding,
+		})
+	}
+
+	return prediction, true
+}
+
+// Compare fills in the scheduled times and the agency's predictions from the
+// trip update of the predicted trip.
+func (p *ETAPredictor) Compare(prediction *VehiclePrediction, tripUpdate *TripUpdate) {
+	serviceDate := p.index.ServiceDate(prediction.ObservedAt)
+	if tripUpdate != nil {
+		serviceDate = p.index.TripServiceDate(tripUpdate.Trip.GetStartDate(), prediction.ObservedAt)
+	}
+
+	for i := range prediction.Stops {
+		stop := &prediction.Stops[i]
+		if stopTime, ok := p.index.StopTimeFor(prediction.TripID, uint32(stop.StopSequence), stop.StopID); ok {
+			scheduled := p.index.ScheduledTime(serviceDate, stopTime.ArrivalTime)
+			stop.Scheduled = &scheduled
+		}
+		if tripUpdate == nil {
+			continue
+		}
+		for _, update := range tripUpdate.StopTimeUpdate {
+			if int(update.GetStopSequence()) != stop.StopSequence && update.GetStopId() != stop.StopID {
+				continue
+			}
+			event := update.GetArrival()
+			if event.GetTime() == 0 {
+				event = update.GetDeparture()
+			}
+			if event.GetTime() == 0 {
+				break
+			}
+			agency := time.Unix(event.GetTime(), 0)
+			difference := stop.Predicted.Sub(agency).Seconds()
+			stop.AgencyPredicted = &agency
+			stop.DifferenceSeconds = &difference
+			break
+		}
+	}
+}
+
+// Vehicles returns the IDs of the vehicles that can be predicted.
+func (p *ETAPredictor) Vehicles() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ids := make([]string, 0, len(p.vehicles))
+	for id := range p.vehicles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// predictionsHandler serves the internal predictions of one vehicle, or of
+// every vehicle heading to stop_id, next to the agency's predictions. A
+// vehicle asked for by ID is always returned, without stops when the filters
+// leave none.
+func predictionsHandler(w http.ResponseWriter, r *http.Request) {
+	vehicleID := r.URL.Query().Get("vehicle_id")
+	stopID := r.URL.Query().Get("stop_id")
+	if vehicleID == "" && stopID == "" {
+		http.Error(w, "Vehicle ID or stop ID not provided", http.StatusBadRequest)
+		return
+	}
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+
+	feed := currentFeed()
+	tripUpdates := make(map[string]*TripUpdate, len(feed.TripUpdates))
+	for i := range feed.TripUpdates {
+		tripUpdates[feed.TripUpdates[i].Trip.GetTripId()] = &feed.TripUpdates[i]
+	}
+
+	vehicleIDs := []string{vehicleID}
+	if vehicleID == "" {
+		vehicleIDs = etaPredictor.Vehicles()
+	}
+
+	predictions := make([]VehiclePrediction, 0)
+	for _, id := range vehicleIDs {
+		prediction, ok := etaPredictor.Predict(id)
+		if !ok {
+			continue
+		}
+		etaPredictor.Compare(&prediction, tripUpdates[prediction.TripID])
+
+		if stopID != "" || accessible {
+			stops := make([]StopPrediction, 0)
+			for _, stop := range prediction.Stops {
+				if stopID != "" && stop.StopID != stopID {
+					continue
+				}
+				if accessible && (prediction.WheelchairAccessible != WheelchairYes || stop.WheelchairBoarding != WheelchairYes) {
+					continue
+				}
+				stops = append(stops, stop)
+			}
+			if vehicleID == "" && len(stops) == 0 {
+				continue
+			}
+			prediction.Stops = stops
+		}
+		predictions = append(predictions, prediction)
+	}
+
+	if vehicleID != "" && len(predictions) == 0 {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(predictions)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
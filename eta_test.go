@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestETAPredictor(t *testing.T) {
+	index := newTestIndex()
+	predictor := NewETAPredictor(index, 5)
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	halfway := index.Shapes["s1"].Length() / 2
+
+	// The first bus runs from just before B to past C and teaches the
+	// predictor the B to C segment.
+	for elapsed := 0; elapsed <= 100; elapsed += 10 {
+		now := start.Add(time.Duration(elapsed) * time.Second)
+		meters := halfway - 100 + (halfway+150)*float64(elapsed)/100
+		predictor.Observe([]BusPosition{{ID: "first", Latitude: 33.75, Longitude: positionAlongTestShape(meters), TripID: "t1", Timestamp: now.Unix()}}, now)
+	}
+	learned, ok := predictor.segments[segmentKey("B", "C")]
+	if !ok || learned.Seconds < 80 || learned.Seconds > 95 {
+		t.Fatalf("Expected B to C to take about 86s, got %+v", learned)
+	}
+
+	// The second bus moves at 10m/s, a quarter of the way from A to B.
+	second := start.Add(10 * time.Minute)
+	for _, offset := range []float64{0, 10} {
+		now := second.Add(time.Duration(offset) * time.Second)
+		meters := halfway/2 - 100 + 10*offset
+		predictor.Observe([]BusPosition{{ID: "second", Latitude: 33.75, Longitude: positionAlongTestShape(meters), TripID: "t2", Timestamp: now.Unix()}}, now)
+	}
+
+	prediction, ok := predictor.Predict("second")
+	if !ok {
+		t.Fatalf("Expected a prediction for the second bus")
+	}
+	if len(prediction.Stops) != 2 {
+		t.Fatalf("Expected predictions for B and C, got %d", len(prediction.Stops))
+	}
+
+	// A to B has no history and runs at the bus's 10m/s.
+	toB := prediction.Stops[0].Predicted.Sub(prediction.ObservedAt).Seconds()
+	if prediction.Stops[0].FromHistory || math.Abs(toB-halfway/20) > 5 {
+		t.Errorf("Expected B in about %fs from speed, got %fs", halfway/20, toB)
+	}
+	// B to C uses the learned travel time.
+	toC := prediction.Stops[1].Predicted.Sub(prediction.Stops[0].Predicted).Seconds()
+	if !prediction.Stops[1].FromHistory || math.Abs(toC-learned.Seconds) > 1 {
+		t.Errorf("Expected C %fs after B from history, got %fs", learned.Seconds, toC)
+	}
+
+	agency := prediction.Stops[0].Predicted.Add(-30 * time.Second)
+	predictor.Compare(&prediction, &TripUpdate{
+		Trip: &pb.TripDescriptor{TripId: proto.String("t2"), StartDate: proto.String("20231016")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			newTestStopTimeUpdate(2, "B", agency),
+		},
+	})
+	if prediction.Stops[0].DifferenceSeconds == nil || math.Abs(*prediction.Stops[0].DifferenceSeconds-30) > 1 {
+		t.Errorf("Expected the prediction to be 30s after the agency's, got %v", prediction.Stops[0].DifferenceSeconds)
+	}
+	if prediction.Stops[1].Scheduled == nil || !prediction.Stops[1].Scheduled.Equal(time.Date(2023, 10, 16, 8, 16, 0, 0, time.UTC)) {
+		t.Errorf("Expected C to be scheduled at 08:16, got %v", prediction.Stops[1].Scheduled)
+	}
+}
+
+func TestPredictionsHandlerAccessible(t *testing.T) {
+	index := newTestIndex()
+	etaPredictor = NewETAPredictor(index, 5)
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	for _, offset := range []float64{0, 10} {
+		now := start.Add(time.Duration(offset) * time.Second)
+		etaPredictor.Observe([]BusPosition{{ID: "2301", Latitude: 33.75, Longitude: positionAlongTestShape(100 + 10*offset), TripID: "t1", Timestamp: now.Unix()}}, now)
+	}
+
+	// t1 isn't wheelchair accessible, but 2301 is still a known vehicle.
+	req := httptest.NewRequest(http.MethodGet, "/predictions?vehicle_id=2301&accessible=true", nil)
+	rr := httptest.NewRecorder()
+	predictionsHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	var predictions []VehiclePrediction
+	if err := json.NewDecoder(rr.Body).Decode(&predictions); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(predictions) != 1 || predictions[0].VehicleID != "2301" || len(predictions[0].Stops) != 0 {
+		t.Errorf("Expected 2301 without accessible stops, got %+v", predictions)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/predictions?vehicle_id=9999&accessible=true", nil)
+	rr = httptest.NewRecorder()
+	predictionsHandler(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown vehicle, got %d", rr.Code)
+	}
+}
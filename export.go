@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+
+	// exportFlushEvery is how many rows are written between flushes to the
+	// client.
+	exportFlushEvery = 500
+)
+
+var (
+	positionExportHeader  = []string{"timestamp", "vehicle_id", "route_id", "trip_id", "stop_id", "latitude", "longitude", "bearing", "speed", "current_status", "occupancy_status"}
+	stopDelayExportHeader = []string{"service_date", "route_id", "trip_id", "stop_id", "stop_sequence", "scheduled", "observed", "delay_seconds"}
+)
+
+// exportWriter streams rows as CSV or NDJSON, flushing every
+// exportFlushEvery rows so the client receives them as they are read.
+type exportWriter struct {
+	w       io.Writer
+	csv     *csv.Writer
+	json    *json.Encoder
+	flusher http.Flusher
+	rows    int
+}
+
+func newExportWriter(w io.Writer, format string, header []string) (*exportWriter, error) {
+	writer := &exportWriter{w: w}
+	writer.flusher, _ = w.(http.Flusher)
+	if format == ExportNDJSON {
+		writer.json = json.NewEncoder(w)
+		return writer, nil
+	}
+	writer.csv = csv.NewWriter(w)
+	return writer, writer.csv.Write(header)
+}
+
+// Write writes one row: record as CSV, or value as a JSON line.
+func (e *exportWriter) Write(record []string, value interface{}) error {
+	var err error
+	if e.json != nil {
+		err = e.json.Encode(value)
+	} else {
+		err = e.csv.Write(record)
+	}
+	if err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		return e.Flush()
+	}
+	return nil
+}
+
+func (e *exportWriter) Flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
+
+// writePositionsExport streams the stored positions between from and to,
+// optionally of one route, day by day and vehicle by vehicle.
+func writePositionsExport(w io.Writer, store *SegmentStore, from, to time.Time, routeID, format string) error {
+	writer, err := newExportWriter(w, format, positionExportHeader)
+	if err != nil {
+		return err
+	}
+	err = store.EachPosition(from, to, "", routeID, func(position StoredPosition) error {
+		return writer.Write([]string{
+			position.Timestamp.UTC().Format(time.RFC3339),
+			position.VehicleID,
+			position.RouteID,
+			position.TripID,
+			position.StopID,
+			strconv.FormatFloat(position.Latitude, 'f', 6, 64),
+			strconv.FormatFloat(position.Longitude, 'f', 6, 64),
+			strconv.FormatFloat(position.Bearing, 'f', 1, 64),
+			strconv.FormatFloat(position.Speed, 'f', 2, 64),
+			position.CurrentStatus,
+			position.OccupancyStatus,
+		}, position)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// writeStopDelaysExport streams the stop delays observed between from and
+// to, optionally of one route. Trips past midnight belong to the previous
+// service date, so its observations are read too.
+func writeStopDelaysExport(w io.Writer, store *SegmentStore, from, to time.Time, routeID, format string) error {
+	writer, err := newExportWriter(w, format, stopDelayExportHeader)
+	if err != nil {
+		return err
+	}
+	err = store.EachObservation(store.date(from.AddDate(0, 0, -1)), store.date(to), func(observation OTPObservation) error {
+		if observation.Observed.Before(from) || observation.Observed.After(to) {
+			return nil
+		}
+		if routeID != "" && observation.RouteID != routeID {
+			return nil
+		}
+		return writer.Write([]string{
+			observation.ServiceDate,
+			observation.RouteID,
+			observation.TripID,
+			observation.StopID,
+			strconv.Itoa(observation.StopSequence),
+			observation.Scheduled.UTC().Format(time.RFC3339),
+			observation.Observed.UTC().Format(time.RFC3339),
+			strconv.Itoa(observation.DelaySeconds),
+		}, observation)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// parseExportRequest reads the format, from, to and route_id parameters of
+// an export and writes the response headers.
+func parseExportRequest(w http.ResponseWriter, r *http.Request, name string) (string, time.Time, time.Time, string, bool) {
+	if segmentStore == nil {
+		http.Error(w, "History store not configured", http.StatusServiceUnavailable)
+		return "", time.Time{}, time.Time{}, "", false
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCSV
+	}
+	if format != ExportCSV && format != ExportNDJSON {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return "", time.Time{}, time.Time{}, "", false
+	}
+	from, to, ok := parseTimeRange(r, time.Now())
+	if !ok {
+		http.Error(w, "Invalid time range", http.StatusBadRequest)
+		return "", time.Time{}, time.Time{}, "", false
+	}
+
+	if format == ExportCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+format+`"`)
+	return format, from, to, r.URL.Query().Get("route_id"), true
+}
+
+// exportResponse notes whether any of the body was sent, after which an
+// error can no longer be answered with a status.
+type exportResponse struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *exportResponse) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *exportResponse) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finishExport handles the error of an export. Before any of the body was
+// sent it is a 500; after, the response is aborted so the client can't take
+// a truncated export for a complete one.
+func finishExport(w *exportResponse, name string, err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to export %s: %v", name, err)
+	if !w.started {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// exportPositionsHandler serves /export/positions.
+func exportPositionsHandler(w http.ResponseWriter, r *http.Request) {
+	response := &exportResponse{ResponseWriter: w}
+	format, from, to, routeID, ok := parseExportRequest(response, r, "positions")
+	if !ok {
+		return
+	}
+	err := writePositionsExport(response, segmentStore, from, to, routeID, format)
+	finishExport(response, "positions", err)
+}
+
+// exportStopDelaysHandler serves /export/stop-delays.
+func exportStopDelaysHandler(w http.ResponseWriter, r *http.Request) {
+	response := &exportResponse{ResponseWriter: w}
+	format, from, to, routeID, ok := parseExportRequest(response, r, "stop-delays")
+	if !ok {
+		return
+	}
+	err := writeStopDelaysExport(response, segmentStore, from, to, routeID, format)
+	finishExport(response, "stop delays", err)
+}
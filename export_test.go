@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExports(t *testing.T) {
+	store, err := OpenSegmentStore(t.TempDir(), time.UTC, 0)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore error: %v", err)
+	}
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		now := start.Add(time.Duration(i) * 30 * time.Second)
+		err := store.Observe([]BusPosition{
+			{ID: "2301", RouteID: "r1", TripID: "t1", Latitude: 33.75, Longitude: -84.40, Timestamp: now.Unix()},
+			{ID: "2302", RouteID: "r2", TripID: "t9", Latitude: 33.76, Longitude: -84.39, Timestamp: now.Unix()},
+		}, now)
+		if err != nil {
+			t.Fatalf("Observe error: %v", err)
+		}
+	}
+	err = store.AddObservations([]OTPObservation{
+		// Served after midnight on the previous service date.
+		{ServiceDate: "20231015", RouteID: "r1", TripID: "t0", StopID: "C", StopSequence: 3, Scheduled: start.Add(-7 * time.Hour), Observed: start.Add(-7 * time.Hour), DelaySeconds: 0},
+		{ServiceDate: "20231016", RouteID: "r1", TripID: "t1", StopID: "A", StopSequence: 1, Scheduled: start, Observed: start.Add(2 * time.Minute), DelaySeconds: 120},
+		{ServiceDate: "20231016", RouteID: "r2", TripID: "t9", StopID: "X", StopSequence: 1, Scheduled: start, Observed: start, DelaySeconds: 0},
+	})
+	if err != nil {
+		t.Fatalf("AddObservations error: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if err := writePositionsExport(&buffer, store, start, start.Add(time.Minute), "r1", ExportCSV); err != nil {
+		t.Fatalf("writePositionsExport error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 4 || lines[0] != strings.Join(positionExportHeader, ",") {
+		t.Fatalf("Expected a header and 3 rows, got %q", lines)
+	}
+	expected := "2023-10-16T08:00:00Z,2301,r1,t1,,33.750000,-84.400000,0.0,0.00,,"
+	if lines[1] != expected {
+		t.Errorf("Expected %s, got %s", expected, lines[1])
+	}
+
+	buffer.Reset()
+	if err := writeStopDelaysExport(&buffer, store, start.Add(-8*time.Hour), start.Add(time.Hour), "r1", ExportNDJSON); err != nil {
+		t.Fatalf("writeStopDelaysExport error: %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 stop delays on r1, got %q", lines)
+	}
+	var observation OTPObservation
+	if err := json.Unmarshal([]byte(lines[1]), &observation); err != nil {
+		t.Fatalf("Failed to decode line: %v", err)
+	}
+	if observation.TripID != "t1" || observation.DelaySeconds != 120 {
+		t.Errorf("Expected t1 two minutes late, got %+v", observation)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	store, err := OpenSegmentStore(t.TempDir(), time.UTC, 0)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore error: %v", err)
+	}
+	segmentStore = store
+	defer func() { segmentStore = nil }()
+
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	if err := store.Observe([]BusPosition{{ID: "2301", Latitude: 33.75, Longitude: -84.40, Timestamp: start.Unix()}}, start); err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+	// Tuesday's index is unreadable.
+	if err := os.WriteFile(store.indexPath(positionStream, "20231017"), []byte("{"), 0o644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	// Failing before any row is sent is an error response.
+	recorder := httptest.NewRecorder()
+	exportPositionsHandler(recorder, httptest.NewRequest("GET", "/export/positions?from=2023-10-17T08:00:00Z&to=2023-10-17T09:00:00Z", nil))
+	if recorder.Code != http.StatusInternalServerError || recorder.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Expected a 500 without an attachment, got %d %v", recorder.Code, recorder.Header())
+	}
+
+	// Failing after Monday's rows were sent aborts the response.
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Expected the response to be aborted, got %v", recovered)
+		}
+	}()
+	recorder = httptest.NewRecorder()
+	exportPositionsHandler(recorder, httptest.NewRequest("GET", "/export/positions?format=ndjson&from=2023-10-16T07:00:00Z&to=2023-10-17T09:00:00Z", nil))
+	t.Errorf("Expected the handler to abort, got %d", recorder.Code)
+}
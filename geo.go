@@ -0,0 +1,239 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	earthRadiusMeters = 6371000.0
+
+	// maxTrackPoints bounds how many recent positions are kept per vehicle.
+	maxTrackPoints = 40
+)
+
+// trackPoint is a vehicle's progress along its trip shape at a point in time.
+type trackPoint struct {
+	AlongTrack float64
+	Time       time.Time
+}
+
+// haversineMeters returns the great-circle distance between two points.
+func haversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusMeters * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// bearingDegrees returns the initial bearing from the first point to the
+// second, clockwise from north in [0, 360).
+func bearingDegrees(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// ShapeLine is a shape polyline with the cumulative distance of every point,
+// so positions can be projected onto it and measured along it.
+type ShapeLine struct {
+	ID         string
+	Points     []Shape
+	Cumulative []float64
+}
+
+// NewShapeLine builds a ShapeLine from points already ordered by sequence.
+func NewShapeLine(id string, points []Shape) *ShapeLine {
+	cumulative := make([]float64, len(points))
+	for i := 1; i < len(points); i++ {
+		cumulative[i] = cumulative[i-1] + haversineMeters(
+			points[i-1].Latitude, points[i-1].Longitude,
+			points[i].Latitude, points[i].Longitude)
+	}
+	return &ShapeLine{ID: id, Points: points, Cumulative: cumulative}
+}
+
+// Length returns the total length of the shape in meters.
+func (s *ShapeLine) Length() float64 {
+	if len(s.Cumulative) == 0 {
+		return 0
+	}
+	return s.Cumulative[len(s.Cumulative)-1]
+}
+
+// Project finds the closest point on the shape to the given position. It
+// returns the cross-track distance (how far the position is from the line)
+// and the along-track distance (how far along the line the closest point is),
+// both in meters.
+func (s *ShapeLine) Project(lat, lon float64) (crossTrack, alongTrack float64) {
+	if len(s.Points) == 0 {
+		return math.Inf(1), 0
+	}
+	if len(s.Points) == 1 {
+		return haversineMeters(lat, lon, s.Points[0].Latitude, s.Points[0].Longitude), 0
+	}
+
+	crossTrack = math.Inf(1)
+	for i := 1; i < len(s.Points); i++ {
+		a, b := s.Points[i-1], s.Points[i]
+
+		// Work in a local equirectangular plane around the segment start,
+		// which is accurate enough at bus-stop spacing.
+		cosLat := math.Cos(a.Latitude * math.Pi / 180)
+		bx := (b.Longitude - a.Longitude) * cosLat
+		by := b.Latitude - a.Latitude
+		px := (lon - a.Longitude) * cosLat
+		py := lat - a.Latitude
+
+		t := 0.0
+		if lengthSq := bx*bx + by*by; lengthSq > 0 {
+			t = (px*bx + py*by) / lengthSq
+		}
+		t = math.Max(0, math.Min(1, t))
+
+		closestLat := a.Latitude + t*(b.Latitude-a.Latitude)
+		closestLon := a.Longitude + t*(b.Longitude-a.Longitude)
+		distance := haversineMeters(lat, lon, closestLat, closestLon)
+		if distance < crossTrack {
+			crossTrack = distance
+			alongTrack = s.Cumulative[i-1] + t*(s.Cumulative[i]-s.Cumulative[i-1])
+		}
+	}
+
+	return crossTrack, alongTrack
+}
+
+// planarPoint is a point in a projected, planar coordinate system.
+type planarPoint struct {
+	X float64
+	Y float64
+}
+
+// simplifyPath drops the points of a path that deviate less than tolerance
+// from the line through their neighbours, using Douglas-Peucker. The first
+// and last points are always kept.
+func simplifyPath(points []planarPoint, tolerance float64) []planarPoint {
+	if len(points) < 3 || tolerance <= 0 {
+		return points
+	}
+	simplified := make([]planarPoint, 0)
+	for i, keep := range simplifyKeep(points, tolerance) {
+		if keep {
+			simplified = append(simplified, points[i])
+		}
+	}
+	return simplified
+}
+
+// simplifyKeep reports which points of a path simplifyPath keeps.
+func simplifyKeep(points []planarPoint, tolerance float64) []bool {
+	keep := make([]bool, len(points))
+	if len(points) == 0 {
+		return keep
+	}
+	keep[0], keep[len(points)-1] = true, true
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		span := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		farthest, distance := -1, tolerance
+		for i := span[0] + 1; i < span[1]; i++ {
+			if d := segmentDistance(points[i], points[span[0]], points[span[1]]); d > distance {
+				farthest, distance = i, d
+			}
+		}
+		if farthest < 0 {
+			continue
+		}
+		keep[farthest] = true
+		stack = append(stack, [2]int{span[0], farthest}, [2]int{farthest, span[1]})
+	}
+	return keep
+}
+
+// segmentDistance returns the distance from p to the segment from a to b.
+func segmentDistance(p, a, b planarPoint) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p.X-a.X, p.Y-a.Y)
+	}
+	t := ((p.X-a.X)*dx + (p.Y-a.Y)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p.X-(a.X+t*dx), p.Y-(a.Y+t*dy))
+}
+
+// BoundingBox is the extent of a set of points in degrees.
+type BoundingBox struct {
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+}
+
+// Intersects reports whether two boxes overlap or touch.
+func (b BoundingBox) Intersects(other BoundingBox) bool {
+	return b.MinLatitude <= other.MaxLatitude && other.MinLatitude <= b.MaxLatitude &&
+		b.MinLongitude <= other.MaxLongitude && other.MinLongitude <= b.MaxLongitude
+}
+
+// Contains reports whether a point lies within the box.
+func (b BoundingBox) Contains(lat, lon float64) bool {
+	return lat >= b.MinLatitude && lat <= b.MaxLatitude && lon >= b.MinLongitude && lon <= b.MaxLongitude
+}
+
+// Bounds returns the bounding box of the shape.
+func (s *ShapeLine) Bounds() BoundingBox {
+	if len(s.Points) == 0 {
+		return BoundingBox{}
+	}
+	bounds := BoundingBox{
+		MinLatitude:  s.Points[0].Latitude,
+		MinLongitude: s.Points[0].Longitude,
+		MaxLatitude:  s.Points[0].Latitude,
+		MaxLongitude: s.Points[0].Longitude,
+	}
+	for _, point := range s.Points[1:] {
+		bounds.MinLatitude = math.Min(bounds.MinLatitude, point.Latitude)
+		bounds.MinLongitude = math.Min(bounds.MinLongitude, point.Longitude)
+		bounds.MaxLatitude = math.Max(bounds.MaxLatitude, point.Latitude)
+		bounds.MaxLongitude = math.Max(bounds.MaxLongitude, point.Longitude)
+	}
+	return bounds
+}
+
+// Simplify returns the points of the shape with Douglas-Peucker applied at a
+// tolerance in meters. Points are projected to meters around the first
+// point, which is accurate enough at the scale of a city.
+func (s *ShapeLine) Simplify(toleranceMeters float64) []Shape {
+	if len(s.Points) < 3 || toleranceMeters <= 0 {
+		return s.Points
+	}
+
+	metersPerDegree := earthRadiusMeters * math.Pi / 180
+	origin := s.Points[0]
+	scale := math.Cos(origin.Latitude * math.Pi / 180)
+	points := make([]planarPoint, len(s.Points))
+	for i, point := range s.Points {
+		points[i] = planarPoint{
+			X: (point.Longitude - origin.Longitude) * scale * metersPerDegree,
+			Y: (point.Latitude - origin.Latitude) * metersPerDegree,
+		}
+	}
+
+	simplified := make([]Shape, 0)
+	for i, keep := range simplifyKeep(points, toleranceMeters) {
+		if keep {
+			simplified = append(simplified, s.Points[i])
+		}
+	}
+	return simplified
+}
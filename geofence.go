@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxGeofenceEvents = 1000
+
+	GeofenceEnter = "enter"
+	GeofenceExit  = "exit"
+	GeofenceDwell = "dwell"
+
+	GeofencePolygon = "polygon"
+	GeofenceCircle  = "circle"
+
+	// geofenceLostAfter is how long a vehicle that stopped reporting is kept
+	// as an occupant, e.g. while switched off in a garage.
+	geofenceLostAfter = 24 * time.Hour
+)
+
+var (
+	geofenceEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geofence_events_total",
+		Help: "Total number of geofence enter, exit and dwell events, by fence.",
+	}, []string{"fence_id", "type"})
+
+	geofenceOccupants = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "geofence_occupants",
+		Help: "Number of vehicles currently inside a geofence.",
+	}, []string{"fence_id"})
+)
+
+func init() {
+	prometheus.MustRegister(geofenceEventsTotal)
+	prometheus.MustRegister(geofenceOccupants)
+}
+
+var geofenceMonitor *GeofenceMonitor
+
+// geoPoint is a longitude, latitude pair in GeoJSON order.
+type geoPoint [2]float64
+
+// Geofence is an area vehicles are tracked in and out of: a polygon, made of
+// an outer ring and optional holes, or a circle of RadiusMeters around
+// Latitude and Longitude.
+type Geofence struct {
+	ID           string
+	Name         string
+	Type         string
+	Latitude     float64
+	Longitude    float64
+	RadiusMeters float64
+	// DwellMinutes overrides the monitor's dwell time for this fence.
+	DwellMinutes float64
+
+	polygons                       [][][]geoPoint
+	minLat, minLon, maxLat, maxLon float64
+}
+
+// Contains reports whether a position is inside the fence.
+func (f *Geofence) Contains(lat, lon float64) bool {
+	if f.Type == GeofenceCircle {
+		return haversineMeters(f.Latitude, f.Longitude, lat, lon) <= f.RadiusMeters
+	}
+	if lat < f.minLat || lat > f.maxLat || lon < f.minLon || lon > f.maxLon {
+		return false
+	}
+	for _, polygon := range f.polygons {
+		if !ringContains(polygon[0], lat, lon) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, lat, lon) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains casts a ray east from the position and counts the edges of
+// the ring it crosses.
+func ringContains(ring []geoPoint, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		lonI, latI := ring[i][0], ring[i][1]
+		lonJ, latJ := ring[j][0], ring[j][1]
+		if (latI > lat) != (latJ > lat) && lon < (lonJ-lonI)*(lat-latI)/(latJ-latI)+lonI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	ID         interface{}            `json:"id"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// LoadGeofences reads the geofences of a GeoJSON FeatureCollection. Polygon
+// and MultiPolygon features are fences as drawn; Point features are circles
+// and need a radius property in meters. The optional id, name and
+// dwell_minutes properties name a fence and override its dwell time.
+func LoadGeofences(filePath string) ([]*Geofence, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGeofences(data)
+}
+
+func ParseGeofences(data []byte) ([]*Geofence, error) {
+	var collection geoJSONFeatureCollection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a FeatureCollection, got %q", collection.Type)
+	}
+
+	fences := make([]*Geofence, 0, len(collection.Features))
+	seen := make(map[string]bool)
+	for i, feature := range collection.Features {
+		fence, err := parseGeofence(feature)
+		if err != nil {
+			return nil, fmt.Errorf("feature %d: %w", i, err)
+		}
+		if fence.ID == "" {
+			fence.ID = fmt.Sprintf("fence-%d", i+1)
+		}
+		if seen[fence.ID] {
+			return nil, fmt.Errorf("feature %d: duplicate id %q", i, fence.ID)
+		}
+		seen[fence.ID] = true
+		if fence.Name == "" {
+			fence.Name = fence.ID
+		}
+		fences = append(fences, fence)
+	}
+	return fences, nil
+}
+
+func parseGeofence(feature geoJSONFeature) (*Geofence, error) {
+	fence := &Geofence{}
+	if id, ok := feature.Properties["id"]; ok {
+		fence.ID = fmt.Sprint(id)
+	} else if feature.ID != nil {
+		fence.ID = fmt.Sprint(feature.ID)
+	}
+	if name, ok := feature.Properties["name"].(string); ok {
+		fence.Name = name
+	}
+	if minutes, ok := feature.Properties["dwell_minutes"].(float64); ok && minutes > 0 {
+		fence.DwellMinutes = minutes
+	}
+
+	switch feature.Geometry.Type {
+	case "Point":
+		var point geoPoint
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &point); err != nil {
+			return nil, fmt.Errorf("invalid Point: %w", err)
+		}
+		radius, ok := feature.Properties["radius"].(float64)
+		if !ok || radius <= 0 {
+			return nil, errors.New("a Point needs a positive radius property")
+		}
+		fence.Type = GeofenceCircle
+		fence.Longitude, fence.Latitude = point[0], point[1]
+		fence.RadiusMeters = radius
+		return fence, nil
+	case "Polygon":
+		var polygon [][]geoPoint
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("invalid Polygon: %w", err)
+		}
+		fence.polygons = [][][]geoPoint{polygon}
+	case "MultiPolygon":
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &fence.polygons); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported geometry %q", feature.Geometry.Type)
+	}
+
+	fence.Type = GeofencePolygon
+	fence.minLat, fence.minLon = math.Inf(1), math.Inf(1)
+	fence.maxLat, fence.maxLon = math.Inf(-1), math.Inf(-1)
+	for _, polygon := range fence.polygons {
+		if len(polygon) == 0 || len(polygon[0]) < 4 {
+			return nil, errors.New("a polygon needs an outer ring of at least 4 positions")
+		}
+		for _, point := range polygon[0] {
+			fence.minLon, fence.maxLon = math.Min(fence.minLon, point[0]), math.Max(fence.maxLon, point[0])
+			fence.minLat, fence.maxLat = math.Min(fence.minLat, point[1]), math.Max(fence.maxLat, point[1])
+		}
+	}
+	// Polygons are described by the center of their bounding box.
+	fence.Latitude = (fence.minLat + fence.maxLat) / 2
+	fence.Longitude = (fence.minLon + fence.maxLon) / 2
+	return fence, nil
+}
+
+// GeofenceEvent is a vehicle entering, leaving or dwelling in a fence.
+// DwellSeconds is how long the vehicle had been inside, for exit and dwell
+// events. Lost exits are vehicles that stopped reporting while inside.
+type GeofenceEvent struct {
+	Type         string
+	FenceID      string
+	FenceName    string
+	VehicleID    string
+	RouteID      string
+	TripID       string
+	Latitude     float64
+	Longitude    float64
+	Time         time.Time
+	DwellSeconds float64
+	Lost         bool
+}
+
+// GeofenceOccupant is a vehicle currently inside a fence.
+type GeofenceOccupant struct {
+	VehicleID string
+	RouteID   string
+	TripID    string
+	Latitude  float64
+	Longitude float64
+	EnteredAt time.Time
+	LastSeen  time.Time
+	Dwelling  bool
+}
+
+// GeofenceStatus is a fence with its current occupants.
+type GeofenceStatus struct {
+	Fence     *Geofence
+	Occupants []GeofenceOccupant
+}
+
+// GeofenceMonitor tracks which vehicles are inside each fence and logs when
+// they enter, leave, or have stayed for DwellAfter. A vehicle that stops
+// reporting while inside stays an occupant, as buses are often switched off
+// in a garage, until geofenceLostAfter.
+type GeofenceMonitor struct {
+	DwellAfter time.Duration
+
+	mu        sync.RWMutex
+	fences    []*Geofence
+	occupants map[string]map[string]*GeofenceOccupant
+	events    []GeofenceEvent
+}
+
+func NewGeofenceMonitor(fences []*Geofence, dwellAfter time.Duration) *GeofenceMonitor {
+	monitor := &GeofenceMonitor{
+		DwellAfter: dwellAfter,
+		fences:     fences,
+		occupants:  make(map[string]map[string]*GeofenceOccupant),
+	}
+	for _, fence := range fences {
+		monitor.occupants[fence.ID] = make(map[string]*GeofenceOccupant)
+	}
+	return monitor
+}
+
+// Observe evaluates one poll of vehicle positions taken at now and returns
+// the events it caused.
+func (m *GeofenceMonitor) Observe(buses []BusPosition, now time.Time) []GeofenceEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := make([]GeofenceEvent, 0)
+	for _, fence := range m.fences {
+		dwellAfter := m.DwellAfter
+		if fence.DwellMinutes > 0 {
+			dwellAfter = time.Duration(fence.DwellMinutes * float64(time.Minute))
+		}
+		occupants := m.occupants[fence.ID]
+
+		reporting := make(map[string]bool, len(buses))
+		for _, bus := range buses {
+			reporting[bus.ID] = true
+			occupant, wasInside := occupants[bus.ID]
+			inside := fence.Contains(bus.Latitude, bus.Longitude)
+
+			switch {
+			case inside && !wasInside:
+				occupant = &GeofenceOccupant{VehicleID: bus.ID, EnteredAt: now}
+				occupants[bus.ID] = occupant
+				events = append(events, newGeofenceEvent(GeofenceEnter, fence, bus, now, 0))
+			case !inside && wasInside:
+				delete(occupants, bus.ID)
+				events = append(events, newGeofenceEvent(GeofenceExit, fence, bus, now, now.Sub(occupant.EnteredAt)))
+				continue
+			case !inside:
+				continue
+			}
+
+			occupant.RouteID, occupant.TripID = bus.RouteID, bus.TripID
+			occupant.Latitude, occupant.Longitude = bus.Latitude, bus.Longitude
+			occupant.LastSeen = now
+			if !occupant.Dwelling && dwellAfter > 0 && now.Sub(occupant.EnteredAt) >= dwellAfter {
+				occupant.Dwelling = true
+				events = append(events, newGeofenceEvent(GeofenceDwell, fence, bus, now, now.Sub(occupant.EnteredAt)))
+			}
+		}
+
+		for id, occupant := range occupants {
+			if reporting[id] || now.Sub(occupant.LastSeen) < geofenceLostAfter {
+				continue
+			}
+			delete(occupants, id)
+			bus := BusPosition{ID: id, RouteID: occupant.RouteID, TripID: occupant.TripID, Latitude: occupant.Latitude, Longitude: occupant.Longitude}
+			event := newGeofenceEvent(GeofenceExit, fence, bus, now, now.Sub(occupant.EnteredAt))
+			event.Lost = true
+			events = append(events, event)
+		}
+
+		geofenceOccupants.WithLabelValues(fence.ID).Set(float64(len(occupants)))
+	}
+
+	for _, event := range events {
+		geofenceEventsTotal.WithLabelValues(event.FenceID, event.Type).Inc()
+	}
+	m.events = append(m.events, events...)
+	if len(m.events) > maxGeofenceEvents {
+		m.events = m.events[len(m.events)-maxGeofenceEvents:]
+	}
+	return events
+}
+
+func newGeofenceEvent(eventType string, fence *Geofence, bus BusPosition, now time.Time, dwell time.Duration) GeofenceEvent {
+	return GeofenceEvent{
+		Type:         eventType,
+		FenceID:      fence.ID,
+		FenceName:    fence.Name,
+		VehicleID:    bus.ID,
+		RouteID:      bus.RouteID,
+		TripID:       bus.TripID,
+		Latitude:     bus.Latitude,
+		Longitude:    bus.Longitude,
+		Time:         now,
+		DwellSeconds: dwell.Seconds(),
+	}
+}
+
+// Statuses returns every fence with its occupants, ordered by fence ID and
+// then by when they entered.
+func (m *GeofenceMonitor) Statuses() []GeofenceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	statuses := make([]GeofenceStatus, 0, len(m.fences))
+	for _, fence := range m.fences {
+		occupants := make([]GeofenceOccupant, 0, len(m.occupants[fence.ID]))
+		for _, occupant := range m.occupants[fence.ID] {
+			occupants = append(occupants, *occupant)
+		}
+		sort.Slice(occupants, func(i, j int) bool {
+			if !occupants[i].EnteredAt.Equal(occupants[j].EnteredAt) {
+				return occupants[i].EnteredAt.Before(occupants[j].EnteredAt)
+			}
+			return occupants[i].VehicleID < occupants[j].VehicleID
+		})
+		statuses = append(statuses, GeofenceStatus{Fence: fence, Occupants: occupants})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Fence.ID < statuses[j].Fence.ID
+	})
+	return statuses
+}
+
+// Events returns the most recent events, oldest first.
+func (m *GeofenceMonitor) Events() []GeofenceEvent {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]GeofenceEvent(nil), m.events...)
+}
+
+// geofencesHandler serves every fence with its occupants.
+func geofencesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(geofenceMonitor.Statuses())
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// geofenceOccupantsHandler serves /geofences/{id}, one fence with its
+// occupants.
+func geofenceOccupantsHandler(w http.ResponseWriter, r *http.Request) {
+	fenceID := strings.TrimPrefix(r.URL.Path, "/geofences/")
+	if fenceID == "" || strings.Contains(fenceID, "/") {
+		http.Error(w, "Geofence ID not provided", http.StatusBadRequest)
+		return
+	}
+
+	for _, status := range geofenceMonitor.Statuses() {
+		if status.Fence.ID != fenceID {
+			continue
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(status)
+		if err != nil {
+			http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Error(w, "Geofence not found", http.StatusNotFound)
+}
+
+// geofenceEventsHandler serves the event log, filtered by fence_id,
+// vehicle_id, type and since (RFC 3339).
+func geofenceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	events := make([]GeofenceEvent, 0)
+	for _, event := range geofenceMonitor.Events() {
+		if query.Get("fence_id") != "" && event.FenceID != query.Get("fence_id") {
+			continue
+		}
+		if query.Get("vehicle_id") != "" && event.VehicleID != query.Get("vehicle_id") {
+			continue
+		}
+		if query.Get("type") != "" && event.Type != query.Get("type") {
+			continue
+		}
+		if event.Time.Before(since) {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(events)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+const testGeofences = `{
+  "type": "FeatureCollection",
+  "features": [
+    {
+      "type": "Feature",
+      "id": "yard",
+      "properties": {"name": "Yard", "dwell_minutes": 5},
+      "geometry": {"type": "Polygon", "coordinates": [
+        [[-84.41, 33.74], [-84.39, 33.74], [-84.39, 33.76], [-84.41, 33.76], [-84.41, 33.74]],
+        [[-84.402, 33.748], [-84.398, 33.748], [-84.398, 33.752], [-84.402, 33.752], [-84.402, 33.748]]
+      ]}
+    },
+    {
+      "type": "Feature",
+      "properties": {"id": "stop-c", "radius": 100},
+      "geometry": {"type": "Point", "coordinates": [-84.38, 33.75]}
+    }
+  ]
+}`
+
+func TestParseGeofences(t *testing.T) {
+	fences, err := ParseGeofences([]byte(testGeofences))
+	if err != nil {
+		t.Fatalf("ParseGeofences error: %v", err)
+	}
+	if len(fences) != 2 {
+		t.Fatalf("Expected 2 fences, got %d", len(fences))
+	}
+
+	yard, circle := fences[0], fences[1]
+	if yard.ID != "yard" || yard.Name != "Yard" || yard.Type != GeofencePolygon || yard.DwellMinutes != 5 {
+		t.Errorf("Expected the yard polygon, got %+v", yard)
+	}
+	if !yard.Contains(33.745, -84.405) {
+		t.Errorf("Expected a point in the yard to be inside")
+	}
+	if yard.Contains(33.75, -84.40) {
+		t.Errorf("Expected a point in the hole to be outside")
+	}
+	if yard.Contains(33.77, -84.40) {
+		t.Errorf("Expected a point north of the yard to be outside")
+	}
+
+	if circle.ID != "stop-c" || circle.Name != "stop-c" || circle.Type != GeofenceCircle {
+		t.Errorf("Expected the stop-c circle, got %+v", circle)
+	}
+	if !circle.Contains(33.7505, -84.38) || circle.Contains(33.752, -84.38) {
+		t.Errorf("Expected the circle to cover 100m around C")
+	}
+
+	if _, err := ParseGeofences([]byte(`{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {}, "geometry": {"type": "Point", "coordinates": [-84.38, 33.75]}}]}`)); err == nil {
+		t.Errorf("Expected a circle without radius to be rejected")
+	}
+}
+
+func TestLoadShippedGeofences(t *testing.T) {
+	if _, err := os.Stat("./geofences.geojson"); err != nil {
+		t.Skip("no geofences.geojson")
+	}
+	fences, err := LoadGeofences("./geofences.geojson")
+	if err != nil {
+		t.Fatalf("LoadGeofences error: %v", err)
+	}
+	for _, fence := range fences {
+		if fence.Type == GeofencePolygon && !fence.Contains(fence.Latitude, fence.Longitude) {
+			t.Errorf("Expected fence %s to contain its center", fence.ID)
+		}
+	}
+}
+
+func TestGeofenceMonitor(t *testing.T) {
+	fences, err := ParseGeofences([]byte(testGeofences))
+	if err != nil {
+		t.Fatalf("ParseGeofences error: %v", err)
+	}
+	monitor := NewGeofenceMonitor(fences, 10*time.Minute)
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	bus := BusPosition{ID: "2301", RouteID: "r1", Latitude: 33.745, Longitude: -84.405}
+	events := monitor.Observe([]BusPosition{bus}, start)
+	if len(events) != 1 || events[0].Type != GeofenceEnter || events[0].FenceID != "yard" {
+		t.Fatalf("Expected 2301 to enter the yard, got %+v", events)
+	}
+
+	// The yard's own dwell time of 5 minutes applies.
+	events = monitor.Observe([]BusPosition{bus}, start.Add(5*time.Minute))
+	if len(events) != 1 || events[0].Type != GeofenceDwell || events[0].DwellSeconds != 300 {
+		t.Errorf("Expected a dwell event after 5 minutes, got %+v", events)
+	}
+	events = monitor.Observe([]BusPosition{bus}, start.Add(6*time.Minute))
+	if len(events) != 0 {
+		t.Errorf("Expected a single dwell event, got %+v", events)
+	}
+
+	statuses := monitor.Statuses()
+	if len(statuses) != 2 || statuses[1].Fence.ID != "yard" || len(statuses[1].Occupants) != 1 || !statuses[1].Occupants[0].Dwelling {
+		t.Errorf("Expected 2301 dwelling in the yard, got %+v", statuses)
+	}
+
+	// Missing from the feed, the bus is still in the yard.
+	events = monitor.Observe(nil, start.Add(7*time.Minute))
+	if len(events) != 0 {
+		t.Errorf("Expected no event while the bus isn't reporting, got %+v", events)
+	}
+
+	bus.Latitude, bus.Longitude = 33.75, -84.38
+	events = monitor.Observe([]BusPosition{bus}, start.Add(8*time.Minute))
+	if len(events) != 2 {
+		t.Fatalf("Expected an exit and an enter, got %+v", events)
+	}
+	types := map[string]GeofenceEvent{}
+	for _, event := range events {
+		types[event.FenceID+":"+event.Type] = event
+	}
+	if exit, ok := types["yard:exit"]; !ok || exit.DwellSeconds != 480 {
+		t.Errorf("Expected to leave the yard after 8 minutes, got %+v", events)
+	}
+	if _, ok := types["stop-c:enter"]; !ok {
+		t.Errorf("Expected to enter stop-c, got %+v", events)
+	}
+
+	events = monitor.Observe(nil, start.Add(8*time.Minute+geofenceLostAfter))
+	if len(events) != 1 || events[0].Type != GeofenceExit || !events[0].Lost {
+		t.Errorf("Expected a lost exit from stop-c, got %+v", events)
+	}
+	if len(monitor.Events()) != 5 {
+		t.Errorf("Expected 5 logged events, got %d", len(monitor.Events()))
+	}
+}
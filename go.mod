@@ -3,6 +3,7 @@ module github.com/calvarado2004/vehicle-positions
 go 1.20
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/prometheus/client_golang v1.17.0
 	github.com/rs/cors v1.10.1
 	google.golang.org/protobuf v1.31.0
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	gpxNamespace   = "http://www.topografix.com/GPX/1/1"
+	gpxContentType = "application/gpx+xml"
+)
+
+type gpxRoot struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Namespace string     `xml:"xmlns,attr"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Latitude  float64 `xml:"lat,attr"`
+	Longitude float64 `xml:"lon,attr"`
+	Time      string  `xml:"time"`
+	Name      string  `xml:"name,omitempty"`
+}
+
+// buildTrailGPX returns a vehicle's trail as a GPX track, with a segment per
+// trip so a change of trip doesn't draw a line across the map.
+func buildTrailGPX(vehicleID string, trail []TrailPoint) gpxRoot {
+	track := gpxTrack{Name: "Vehicle " + vehicleID, Segments: make([]gpxSegment, 0)}
+	for i, point := range trail {
+		if i == 0 || point.TripID != trail[i-1].TripID {
+			track.Segments = append(track.Segments, gpxSegment{Points: make([]gpxPoint, 0)})
+		}
+		segment := &track.Segments[len(track.Segments)-1]
+		segment.Points = append(segment.Points, gpxPoint{
+			Latitude:  point.Latitude,
+			Longitude: point.Longitude,
+			Time:      point.Timestamp.UTC().Format(time.RFC3339),
+			Name:      point.TripID,
+		})
+	}
+	return gpxRoot{
+		Namespace: gpxNamespace,
+		Version:   "1.1",
+		Creator:   "vehicle-positions",
+		Tracks:    []gpxTrack{track},
+	}
+}
+
+// vehicleTrail returns the positions of a vehicle between from and to, from
+// the history store when configured, otherwise from the recent trails.
+func vehicleTrail(vehicleID string, from, to time.Time) ([]TrailPoint, error) {
+	trail := make([]TrailPoint, 0)
+	if segmentStore == nil {
+		for _, point := range trailStore.Trail(vehicleID) {
+			if !point.Timestamp.Before(from) && !point.Timestamp.After(to) {
+				trail = append(trail, point)
+			}
+		}
+		return trail, nil
+	}
+
+	positions, err := segmentStore.Positions(from, to, vehicleID, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, position := range positions {
+		trail = append(trail, TrailPoint{
+			Latitude:  position.Latitude,
+			Longitude: position.Longitude,
+			Bearing:   position.Bearing,
+			TripID:    position.TripID,
+			Timestamp: position.Timestamp,
+		})
+	}
+	return trail, nil
+}
+
+// gpxVehicleHandler serves /gpx/vehicles/{id}.gpx, the trail of a vehicle
+// between from and to.
+func gpxVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	vehicleID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/gpx/vehicles/"), ".gpx")
+	if vehicleID == "" || strings.Contains(vehicleID, "/") {
+		http.Error(w, "Vehicle ID not provided", http.StatusBadRequest)
+		return
+	}
+	from, to, ok := parseTimeRange(r, time.Now())
+	if !ok {
+		http.Error(w, "Invalid time range", http.StatusBadRequest)
+		return
+	}
+
+	trail, err := vehicleTrail(vehicleID, from, to)
+	if err != nil {
+		log.Printf("Failed to read trail of vehicle %s: %v", vehicleID, err)
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+	if len(trail) == 0 {
+		http.Error(w, "Vehicle trail not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", gpxContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": vehicleID + ".gpx"}))
+	err = writeXML(w, buildTrailGPX(vehicleID, trail))
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
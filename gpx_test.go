@@ -0,0 +1,43 @@
+package main
+
+import (
+	"mime"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBuildTrailGPX(t *testing.T) {
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	trail := []TrailPoint{
+		{Latitude: 33.75, Longitude: -84.40, TripID: "t1", Timestamp: start},
+		{Latitude: 33.75, Longitude: -84.39, TripID: "t1", Timestamp: start.Add(time.Minute)},
+		{Latitude: 33.75, Longitude: -84.38, TripID: "t2", Timestamp: start.Add(2 * time.Minute)},
+	}
+
+	document := buildTrailGPX("v1", trail)
+	segments := document.Tracks[0].Segments
+	if len(segments) != 2 {
+		t.Fatalf("Expected a segment per trip, got %d", len(segments))
+	}
+	if len(segments[0].Points) != 2 || len(segments[1].Points) != 1 {
+		t.Errorf("Expected 2 and 1 points, got %d and %d", len(segments[0].Points), len(segments[1].Points))
+	}
+	if segments[0].Points[1].Time != "2023-10-16T08:01:00Z" {
+		t.Errorf("Expected 2023-10-16T08:01:00Z, got %s", segments[0].Points[1].Time)
+	}
+}
+
+func TestGPXVehicleHandlerFilename(t *testing.T) {
+	trailStore = NewTrailStore(time.Hour)
+	defer func() { trailStore = nil }()
+	now := time.Now()
+	trailStore.Observe([]BusPosition{{ID: `2301"; x="y`, Latitude: 33.75, Longitude: -84.40, Timestamp: now.Unix()}}, now)
+
+	recorder := httptest.NewRecorder()
+	gpxVehicleHandler(recorder, httptest.NewRequest("GET", "/gpx/vehicles/2301%22;%20x=%22y.gpx", nil))
+	_, params, err := mime.ParseMediaType(recorder.Header().Get("Content-Disposition"))
+	if err != nil || params["filename"] != `2301"; x="y.gpx` || params["x"] != "" {
+		t.Errorf("Expected the quoted vehicle ID as the filename, got %q: %v", recorder.Header().Get("Content-Disposition"), err)
+	}
+}
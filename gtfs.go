@@ -0,0 +1,797 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var gtfsIndex *GTFSIndex
+
+// GTFSIndex keeps the static GTFS feed in memory, keyed for the lookups the
+// realtime features need on every poll.
+type GTFSIndex struct {
+	Routes map[string]Route
+	Trips  map[string]Trip
+	Stops  map[string]Stop
+	Shapes map[string]*ShapeLine
+
+	// StopTimes are keyed by trip_id and ordered by stop_sequence.
+	StopTimes   map[string][]StopTime
+	Frequencies map[string][]Frequency
+
+	Calendar map[string]CalendarService
+	// CalendarDates maps service_id to date (YYYYMMDD) to exception_type.
+	CalendarDates map[string]map[string]string
+
+	// Location is the agency timezone that service days are expressed in.
+	Location *time.Location
+
+	// mu guards the lookups below, which are built lazily.
+	mu              sync.Mutex
+	offsets         map[string][]float64
+	tripsByRoute    map[string][]string
+	stopTimesByStop map[string][]StopTime
+	stations        map[string]*Station
+	stationOf       map[string]string
+	shapeRoutes     map[string]string
+}
+
+// LoadGTFSIndex reads the static GTFS files from dir. Files that are missing
+// are logged and left empty so the service can still start with a partial feed.
+func LoadGTFSIndex(dir string) *GTFSIndex {
+	index := &GTFSIndex{
+		Routes: make(map[string]Route),
+		Trips:  make(map[string]Trip),
+		Stops:  make(map[string]Stop),
+		Shapes: make(map[string]*ShapeLine),
+
+		StopTimes:     make(map[string][]StopTime),
+		Frequencies:   make(map[string][]Frequency),
+		Calendar:      make(map[string]CalendarService),
+		CalendarDates: make(map[string]map[string]string),
+		Location:      time.Local,
+	}
+
+	timezone, err := ParseAgencyTimezone(filepath.Join(dir, "agency.txt"))
+	if err != nil {
+		log.Printf("Failed to parse agency: %v", err)
+	} else if location, err := time.LoadLocation(timezone); err != nil {
+		log.Printf("Failed to load agency timezone %q: %v", timezone, err)
+	} else {
+		index.Location = location
+	}
+
+	routes, err := ParseRoutes(filepath.Join(dir, "routes.txt"))
+	if err != nil {
+		log.Printf("Failed to parse routes: %v", err)
+	}
+	// ParseRoutes keeps the header row, skip it here.
+	for i, route := range routes {
+		if i == 0 {
+			continue
+		}
+		index.Routes[route.ID] = route
+	}
+
+	trips, err := ParseTrips(filepath.Join(dir, "trips.txt"))
+	if err != nil {
+		log.Printf("Failed to parse trips: %v", err)
+	}
+	for _, trip := range trips {
+		index.Trips[trip.TripID] = trip
+	}
+
+	stops, err := ParseStops(filepath.Join(dir, "stops.txt"))
+	if err != nil {
+		log.Printf("Failed to parse stops: %v", err)
+	}
+	inheritWheelchairBoarding(stops)
+	for _, stop := range stops {
+		index.Stops[stop.StopID] = stop
+	}
+
+	shapes, err := ParseShapes(filepath.Join(dir, "shapes.txt"))
+	if err != nil {
+		log.Printf("Failed to parse shapes: %v", err)
+	}
+	for id, points := range groupShapes(shapes) {
+		index.Shapes[id] = NewShapeLine(id, points)
+	}
+
+	stopTimes, err := ParseStopTimes(filepath.Join(dir, "stop_times.txt"))
+	if err != nil {
+		log.Printf("Failed to parse stop times: %v", err)
+	}
+	for _, stopTime := range stopTimes {
+		index.StopTimes[stopTime.TripID] = append(index.StopTimes[stopTime.TripID], stopTime)
+	}
+	for _, tripStopTimes := range index.StopTimes {
+		sort.Slice(tripStopTimes, func(i, j int) bool {
+			return tripStopTimes[i].StopSequence < tripStopTimes[j].StopSequence
+		})
+		interpolateStopTimes(tripStopTimes)
+	}
+
+	frequencies, err := ParseFrequencies(filepath.Join(dir, "frequencies.txt"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// frequencies.txt is optional in GTFS.
+		log.Printf("Failed to parse frequencies: %v", err)
+	}
+	for _, frequency := range frequencies {
+		index.Frequencies[frequency.TripID] = append(index.Frequencies[frequency.TripID], frequency)
+	}
+
+	services, err := ParseCalendar(filepath.Join(dir, "calendar.txt"))
+	if err != nil {
+		log.Printf("Failed to parse calendar: %v", err)
+	}
+	for _, service := range services {
+		index.Calendar[service.ServiceID] = service
+	}
+
+	calendarDates, err := ParseCalendarDates(filepath.Join(dir, "calendar_dates.txt"))
+	if err != nil {
+		log.Printf("Failed to parse calendar dates: %v", err)
+	}
+	for _, calendarDate := range calendarDates {
+		if index.CalendarDates[calendarDate.ServiceID] == nil {
+			index.CalendarDates[calendarDate.ServiceID] = make(map[string]string)
+		}
+		index.CalendarDates[calendarDate.ServiceID][calendarDate.Date] = calendarDate.ExceptionType
+	}
+
+	return index
+}
+
+// ServiceActive reports whether a service_id runs on the given service date,
+// applying calendar_dates.txt exceptions on top of calendar.txt.
+func (g *GTFSIndex) ServiceActive(serviceID string, date time.Time) bool {
+	day := date.Format("20060102")
+	switch g.CalendarDates[serviceID][day] {
+	case "1":
+		return true
+	case "2":
+		return false
+	}
+
+	service, ok := g.Calendar[serviceID]
+	if !ok {
+		return false
+	}
+	// Dates are fixed width, so string comparison orders them correctly.
+	if day < service.StartDate || day > service.EndDate {
+		return false
+	}
+	return service.Weekdays[date.Weekday()]
+}
+
+// ServiceDate returns midnight of the service day that contains t, in the
+// agency timezone.
+func (g *GTFSIndex) ServiceDate(t time.Time) time.Time {
+	local := t.In(g.Location)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, g.Location)
+}
+
+// ScheduledTime converts a GTFS time (seconds after midnight) on a service
+// date to an absolute time. Per the spec the service day is measured from
+// noon minus 12h, which keeps the result correct across DST changes.
+func (g *GTFSIndex) ScheduledTime(serviceDate time.Time, seconds int) time.Time {
+	noon := time.Date(serviceDate.Year(), serviceDate.Month(), serviceDate.Day(), 12, 0, 0, 0, g.Location)
+	return noon.Add(-12 * time.Hour).Add(time.Duration(seconds) * time.Second)
+}
+
+// parseGTFSTime parses an HH:MM:SS GTFS time into seconds after midnight.
+// Hours may be 24 or more for trips that run past midnight.
+func parseGTFSTime(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid GTFS time %q", value)
+	}
+	total := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid GTFS time %q: %w", value, err)
+		}
+		total = total*60 + n
+	}
+	return total, nil
+}
+
+// parseStopTimeValue parses an arrival or departure time, which stops that
+// aren't timepoints may leave blank, returning unknownGTFSTime then.
+func parseStopTimeValue(value string) (int, error) {
+	if strings.TrimSpace(value) == "" {
+		return unknownGTFSTime, nil
+	}
+	return parseGTFSTime(value)
+}
+
+// interpolateStopTimes fills in the times a trip, ordered by stop_sequence,
+// leaves blank. A stop with one of its times takes it for both; stops with
+// neither are spread between the nearest timed stops by shape_dist_traveled
+// when the feed gives it, otherwise by their place in the trip. Blanks before the first or after
+// the last timed stop, which the spec doesn't allow, take its time.
+func interpolateStopTimes(stopTimes []StopTime) {
+	for i := range stopTimes {
+		stopTime := &stopTimes[i]
+		if stopTime.ArrivalTime == unknownGTFSTime {
+			stopTime.ArrivalTime = stopTime.DepartureTime
+		}
+		if stopTime.DepartureTime == unknownGTFSTime {
+			stopTime.DepartureTime = stopTime.ArrivalTime
+		}
+	}
+
+	previous := -1
+	for i := range stopTimes {
+		if stopTimes[i].ArrivalTime == unknownGTFSTime {
+			continue
+		}
+		if previous < 0 {
+			for j := 0; j < i; j++ {
+				stopTimes[j].ArrivalTime, stopTimes[j].DepartureTime = stopTimes[i].ArrivalTime, stopTimes[i].ArrivalTime
+			}
+		} else if i-previous > 1 {
+			from, to := stopTimes[previous], stopTimes[i]
+			span := to.ShapeDistTraveled - from.ShapeDistTraveled
+			for j := previous + 1; j < i; j++ {
+				fraction := float64(j-previous) / float64(i-previous)
+				if distance := stopTimes[j].ShapeDistTraveled - from.ShapeDistTraveled; span > 0 && distance > 0 && distance < span {
+					fraction = distance / span
+				}
+				seconds := from.DepartureTime + int(math.Round(fraction*float64(to.ArrivalTime-from.DepartureTime)))
+				stopTimes[j].ArrivalTime, stopTimes[j].DepartureTime = seconds, seconds
+			}
+		}
+		previous = i
+	}
+	if previous >= 0 {
+		for j := previous + 1; j < len(stopTimes); j++ {
+			stopTimes[j].ArrivalTime, stopTimes[j].DepartureTime = stopTimes[previous].DepartureTime, stopTimes[previous].DepartureTime
+		}
+	}
+}
+
+// ShapeForTrip returns the shape geometry assigned to a trip, or nil when the
+// trip or its shape is unknown.
+func (g *GTFSIndex) ShapeForTrip(tripID string) *ShapeLine {
+	if g == nil {
+		return nil
+	}
+	trip, ok := g.Trips[tripID]
+	if !ok {
+		return nil
+	}
+	return g.Shapes[trip.ShapeID]
+}
+
+// EnrichBusPositions fills in the static trip and route details of every bus
+// from trips.txt and routes.txt. A bus whose trip is unknown keeps the route
+// it reported.
+func (g *GTFSIndex) EnrichBusPositions(buses []BusPosition) {
+	for i := range buses {
+		bus := &buses[i]
+		if trip, ok := g.Trips[bus.TripID]; ok {
+			if bus.RouteID == "" {
+				bus.RouteID = trip.RouteID
+			}
+			bus.Headsign = trip.Headsign
+			bus.DirectionID = trip.DirectionID
+			bus.BlockID = trip.BlockID
+			bus.ShapeID = trip.ShapeID
+			bus.WheelchairAccessible = trip.WheelchairAccessible
+			bus.BikesAllowed = trip.BikesAllowed
+		}
+		if route, ok := g.Routes[bus.RouteID]; ok {
+			bus.RouteShortName = route.ShortName
+			bus.RouteLongName = route.LongName
+			bus.RouteColor = route.Color
+			bus.RouteTextColor = route.TextColor
+		}
+
+		switch {
+		case bus.RouteShortName != "" && bus.Headsign != "":
+			bus.DisplayName = bus.RouteShortName + " to " + bus.Headsign
+		case bus.RouteShortName != "":
+			bus.DisplayName = bus.RouteShortName
+		default:
+			bus.DisplayName = bus.Label
+		}
+	}
+}
+
+// StopTimeFor finds the scheduled stop_time of a trip by stop_sequence, or by
+// stop_id when the sequence is unknown.
+func (g *GTFSIndex) StopTimeFor(tripID string, stopSequence uint32, stopID string) (StopTime, bool) {
+	for _, stopTime := range g.StopTimes[tripID] {
+		if stopSequence > 0 && stopTime.StopSequence == int(stopSequence) {
+			return stopTime, true
+		}
+		if stopSequence == 0 && stopID != "" && stopTime.StopID == stopID {
+			return stopTime, true
+		}
+	}
+	return StopTime{}, false
+}
+
+// StopOffsets returns the distance along the trip shape of every stop of a
+// trip, in stop_sequence order, or nil when the trip has no shape or stop
+// times. A stop never falls behind the one before it, so loops in the shape
+// don't reorder the trip. Results are cached per trip.
+func (g *GTFSIndex) StopOffsets(tripID string) []float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if offsets, ok := g.offsets[tripID]; ok {
+		return offsets
+	}
+
+	shape := g.ShapeForTrip(tripID)
+	stopTimes := g.StopTimes[tripID]
+	if shape == nil || len(stopTimes) == 0 {
+		return nil
+	}
+
+	offsets := make([]float64, len(stopTimes))
+	for i, stopTime := range stopTimes {
+		if stop, ok := g.Stops[stopTime.StopID]; ok {
+			_, offsets[i] = shape.Project(stop.Latitude, stop.Longitude)
+		}
+		if i > 0 && offsets[i] < offsets[i-1] {
+			offsets[i] = offsets[i-1]
+		}
+	}
+
+	if g.offsets == nil {
+		g.offsets = make(map[string][]float64)
+	}
+	g.offsets[tripID] = offsets
+	return offsets
+}
+
+// RouteTrips returns the IDs of the trips of a route, sorted.
+func (g *GTFSIndex) RouteTrips(routeID string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.tripsByRoute == nil {
+		g.tripsByRoute = make(map[string][]string)
+		for tripID, trip := range g.Trips {
+			g.tripsByRoute[trip.RouteID] = append(g.tripsByRoute[trip.RouteID], tripID)
+		}
+		for _, tripIDs := range g.tripsByRoute {
+			sort.Strings(tripIDs)
+		}
+	}
+	return g.tripsByRoute[routeID]
+}
+
+// ShapeRoute returns the route of the trips using a shape. A shape shared by
+// several routes is attributed to the route of its first trip by trip_id.
+func (g *GTFSIndex) ShapeRoute(shapeID string) (Route, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.shapeRoutes == nil {
+		g.shapeRoutes = make(map[string]string)
+		firstTrip := make(map[string]string)
+		for tripID, trip := range g.Trips {
+			if first, ok := firstTrip[trip.ShapeID]; ok && first < tripID {
+				continue
+			}
+			firstTrip[trip.ShapeID] = tripID
+			g.shapeRoutes[trip.ShapeID] = trip.RouteID
+		}
+	}
+	route, ok := g.Routes[g.shapeRoutes[shapeID]]
+	return route, ok
+}
+
+// StopTimesAt returns the scheduled stop_times at a stop, ordered by
+// departure time.
+func (g *GTFSIndex) StopTimesAt(stopID string) []StopTime {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopTimesByStop == nil {
+		g.stopTimesByStop = make(map[string][]StopTime)
+		for _, tripStopTimes := range g.StopTimes {
+			for _, stopTime := range tripStopTimes {
+				g.stopTimesByStop[stopTime.StopID] = append(g.stopTimesByStop[stopTime.StopID], stopTime)
+			}
+		}
+		for _, stopTimes := range g.stopTimesByStop {
+			sort.Slice(stopTimes, func(i, j int) bool {
+				return stopTimes[i].DepartureTime < stopTimes[j].DepartureTime
+			})
+		}
+	}
+	return g.stopTimesByStop[stopID]
+}
+
+// TripServiceDate returns the service date of a realtime trip: its start_date
+// when given, otherwise the service day containing now.
+func (g *GTFSIndex) TripServiceDate(startDate string, now time.Time) time.Time {
+	if date, err := time.ParseInLocation("20060102", startDate, g.Location); err == nil {
+		return date
+	}
+	return g.ServiceDate(now)
+}
+
+// groupShapes splits the flat shapes.txt rows by shape_id, ordered by sequence.
+func groupShapes(shapes []Shape) map[string][]Shape {
+	grouped := make(map[string][]Shape)
+	for _, shape := range shapes {
+		grouped[shape.ShapeId] = append(grouped[shape.ShapeId], shape)
+	}
+	for _, points := range grouped {
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Sequence < points[j].Sequence
+		})
+	}
+	return grouped
+}
+
+// ParseTrips parses a trips.txt file and returns a slice of Trip structs.
+func ParseTrips(filePath string) ([]Trip, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Failed to close file: %v", err)
+		}
+	}(file)
+
+	trips, err := ParseTripsFromReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return trips, nil
+}
+
+// ParseTripsFromReader parses a trips.txt file and returns a slice of Trip structs.
+func ParseTripsFromReader(file *os.File) ([]Trip, error) {
+	newReader := csv.NewReader(file)
+	newReader.FieldsPerRecord = -1
+
+	records, err := newReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []Trip{}, nil
+	}
+
+	trips := make([]Trip, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		if len(record) < 10 {
+			continue
+		}
+
+		trip := Trip{
+			RouteID:              record[0],
+			ServiceID:            record[1],
+			TripID:               record[2],
+			Headsign:             record[3],
+			ShortName:            record[4],
+			DirectionID:          record[5],
+			BlockID:              record[6],
+			ShapeID:              record[7],
+			WheelchairAccessible: record[8],
+			BikesAllowed:         record[9],
+		}
+		trips = append(trips, trip)
+	}
+
+	return trips, nil
+}
+
+// formatGTFSTime formats seconds after midnight as an HH:MM:SS GTFS time.
+func formatGTFSTime(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// ParseStopTimes parses a stop_times.txt file and returns a slice of StopTime structs.
+func ParseStopTimes(filePath string) ([]StopTime, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Failed to close file: %v", err)
+		}
+	}(file)
+
+	stopTimes, err := ParseStopTimesFromReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return stopTimes, nil
+}
+
+// ParseStopTimesFromReader parses a stop_times.txt file laid out as
+// trip_id,arrival_time,departure_time,stop_id,stop_sequence,stop_headsign,
+// pickup_type,drop_off_type,shape_dist_traveled,timepoint. The file is large,
+// so it is streamed instead of read at once.
+func ParseStopTimesFromReader(file *os.File) ([]StopTime, error) {
+	newReader := csv.NewReader(file)
+	newReader.FieldsPerRecord = -1
+	newReader.ReuseRecord = true
+
+	// Skip the header row.
+	if _, err := newReader.Read(); err != nil {
+		if err == io.EOF {
+			return []StopTime{}, nil
+		}
+		return nil, err
+	}
+
+	stopTimes := make([]StopTime, 0)
+
+	for {
+		record, err := newReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 5 {
+			continue
+		}
+
+		arrival, err := parseStopTimeValue(record[1])
+		if err != nil {
+			return nil, err
+		}
+		departure, err := parseStopTimeValue(record[2])
+		if err != nil {
+			return nil, err
+		}
+		sequence, err := strconv.Atoi(record[4])
+		if err != nil {
+			return nil, err
+		}
+
+		stopTime := StopTime{
+			TripID:        record[0],
+			ArrivalTime:   arrival,
+			DepartureTime: departure,
+			StopID:        record[3],
+			StopSequence:  sequence,
+		}
+		if len(record) > 8 && record[8] != "" {
+			stopTime.ShapeDistTraveled, _ = strconv.ParseFloat(record[8], 64)
+		}
+		if len(record) > 9 {
+			stopTime.Timepoint = record[9]
+		}
+		stopTimes = append(stopTimes, stopTime)
+	}
+
+	return stopTimes, nil
+}
+
+// ParseFrequencies parses a frequencies.txt file and returns a slice of Frequency structs.
+func ParseFrequencies(filePath string) ([]Frequency, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Failed to close file: %v", err)
+		}
+	}(file)
+
+	frequencies, err := ParseFrequenciesFromReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return frequencies, nil
+}
+
+// ParseFrequenciesFromReader parses a frequencies.txt file laid out as
+// trip_id,start_time,end_time,headway_secs.
+func ParseFrequenciesFromReader(file *os.File) ([]Frequency, error) {
+	newReader := csv.NewReader(file)
+	newReader.FieldsPerRecord = -1
+
+	records, err := newReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []Frequency{}, nil
+	}
+
+	frequencies := make([]Frequency, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		if len(record) < 4 {
+			continue
+		}
+
+		start, err := parseGTFSTime(record[1])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseGTFSTime(record[2])
+		if err != nil {
+			return nil, err
+		}
+		headway, err := strconv.Atoi(record[3])
+		if err != nil {
+			return nil, err
+		}
+
+		frequency := Frequency{
+			TripID:      record[0],
+			StartTime:   start,
+			EndTime:     end,
+			HeadwaySecs: headway,
+		}
+		frequencies = append(frequencies, frequency)
+	}
+
+	return frequencies, nil
+}
+
+// ParseCalendar parses a calendar.txt file and returns a slice of CalendarService structs.
+func ParseCalendar(filePath string) ([]CalendarService, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Failed to close file: %v", err)
+		}
+	}(file)
+
+	services, err := ParseCalendarFromReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// ParseCalendarFromReader parses a calendar.txt file laid out as
+// service_id,monday,...,sunday,start_date,end_date.
+func ParseCalendarFromReader(file *os.File) ([]CalendarService, error) {
+	newReader := csv.NewReader(file)
+	newReader.FieldsPerRecord = -1
+
+	records, err := newReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []CalendarService{}, nil
+	}
+
+	services := make([]CalendarService, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		if len(record) < 10 {
+			continue
+		}
+
+		service := CalendarService{
+			ServiceID: record[0],
+			StartDate: record[8],
+			EndDate:   record[9],
+		}
+		// calendar.txt lists Monday first, time.Weekday starts on Sunday.
+		for i := 0; i < 7; i++ {
+			service.Weekdays[(i+1)%7] = record[1+i] == "1"
+		}
+		services = append(services, service)
+	}
+
+	return services, nil
+}
+
+// ParseCalendarDates parses a calendar_dates.txt file and returns a slice of CalendarDate structs.
+func ParseCalendarDates(filePath string) ([]CalendarDate, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Failed to close file: %v", err)
+		}
+	}(file)
+
+	calendarDates, err := ParseCalendarDatesFromReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return calendarDates, nil
+}
+
+// ParseCalendarDatesFromReader parses a calendar_dates.txt file and returns a slice of CalendarDate structs.
+func ParseCalendarDatesFromReader(file *os.File) ([]CalendarDate, error) {
+	newReader := csv.NewReader(file)
+	newReader.FieldsPerRecord = -1
+
+	records, err := newReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []CalendarDate{}, nil
+	}
+
+	calendarDates := make([]CalendarDate, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		if len(record) < 3 {
+			continue
+		}
+
+		calendarDate := CalendarDate{
+			ServiceID:     record[0],
+			Date:          record[1],
+			ExceptionType: record[2],
+		}
+		calendarDates = append(calendarDates, calendarDate)
+	}
+
+	return calendarDates, nil
+}
+
+// ParseAgencyTimezone returns the agency_timezone of the first agency in an
+// agency.txt file.
+func ParseAgencyTimezone(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Failed to close file: %v", err)
+		}
+	}(file)
+
+	newReader := csv.NewReader(file)
+	newReader.FieldsPerRecord = -1
+
+	records, err := newReader.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	if len(records) < 2 || len(records[1]) < 4 {
+		return "", errors.New("agency.txt has no agency_timezone")
+	}
+
+	return records[1][3], nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestIndex returns a small feed: route r1 runs trips t1, t2 and t3 on
+// weekdays along a straight east-west shape of roughly 1.8km, departing
+// 08:00, 08:10 and 08:20. Stops A, B and C sit at the start, middle and end
+// of the shape, three minutes apart.
+func newTestIndex() *GTFSIndex {
+	points := []Shape{
+		{ShapeId: "s1", Latitude: 33.75, Longitude: -84.40, Sequence: 1},
+		{ShapeId: "s1", Latitude: 33.75, Longitude: -84.39, Sequence: 2},
+		{ShapeId: "s1", Latitude: 33.75, Longitude: -84.38, Sequence: 3},
+	}
+	index := &GTFSIndex{
+		Routes: map[string]Route{"r1": {ID: "r1", ShortName: "1", LongName: "Test Route"}},
+		Trips:  map[string]Trip{},
+		Stops: map[string]Stop{
+			"A": {StopID: "A", StopCode: "100", StopName: "FIRST ST", Latitude: 33.75, Longitude: -84.40},
+			"B": {StopID: "B", StopCode: "200", StopName: "SECOND ST", Latitude: 33.75, Longitude: -84.39},
+			"C": {StopID: "C", StopCode: "300", StopName: "THIRD ST", Latitude: 33.75, Longitude: -84.38},
+		},
+		Shapes:        map[string]*ShapeLine{"s1": NewShapeLine("s1", points)},
+		StopTimes:     map[string][]StopTime{},
+		Frequencies:   map[string][]Frequency{},
+		Calendar:      map[string]CalendarService{},
+		CalendarDates: map[string]map[string]string{},
+		Location:      time.UTC,
+	}
+
+	service := CalendarService{ServiceID: "5", StartDate: "20231001", EndDate: "20231231"}
+	for day := time.Monday; day <= time.Friday; day++ {
+		service.Weekdays[day] = true
+	}
+	index.Calendar["5"] = service
+
+	for i, tripID := range []string{"t1", "t2", "t3"} {
+		index.Trips[tripID] = Trip{RouteID: "r1", ServiceID: "5", TripID: tripID, Headsign: "EAST", DirectionID: "0", ShapeID: "s1"}
+		departure := 8*3600 + i*600
+		index.StopTimes[tripID] = []StopTime{
+			{TripID: tripID, ArrivalTime: departure, DepartureTime: departure, StopID: "A", StopSequence: 1},
+			{TripID: tripID, ArrivalTime: departure + 180, DepartureTime: departure + 180, StopID: "B", StopSequence: 2},
+			{TripID: tripID, ArrivalTime: departure + 360, DepartureTime: departure + 360, StopID: "C", StopSequence: 3},
+		}
+	}
+
+	return index
+}
+
+func TestServiceActive(t *testing.T) {
+	index := newTestIndex()
+	index.CalendarDates["5"] = map[string]string{"20231016": "2"}
+
+	if index.ServiceActive("5", time.Date(2023, 10, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected service 5 to be removed on 20231016")
+	}
+	if !index.ServiceActive("5", time.Date(2023, 10, 17, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected service 5 to run on Tuesday 20231017")
+	}
+	if index.ServiceActive("5", time.Date(2023, 10, 21, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected service 5 not to run on Saturday 20231021")
+	}
+}
+
+func TestParseGTFSTime(t *testing.T) {
+	seconds, err := parseGTFSTime("25:10:05")
+	if err != nil {
+		t.Fatalf("parseGTFSTime error: %v", err)
+	}
+	if seconds != 25*3600+10*60+5 {
+		t.Errorf("Expected %d seconds, got %d", 25*3600+10*60+5, seconds)
+	}
+}
+
+func TestParseStopTimesBlankTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stop_times.txt")
+	data := "trip_id,arrival_time,departure_time,stop_id,stop_sequence,stop_headsign,pickup_type,drop_off_type,shape_dist_traveled,timepoint\n" +
+		"t1,08:00:00,08:00:00,A,1,,0,0,0,1\n" +
+		"t1,,,B,2,,0,0,300,0\n" +
+		"t1,,,C,3,,0,0,,0\n" +
+		"t1,08:10:00,08:10:00,D,4,,0,0,1000,1\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("Failed to write stop times: %v", err)
+	}
+
+	stopTimes, err := ParseStopTimes(path)
+	if err != nil {
+		t.Fatalf("ParseStopTimes error: %v", err)
+	}
+	if len(stopTimes) != 4 || stopTimes[1].ArrivalTime != unknownGTFSTime {
+		t.Fatalf("Expected 4 stop times with B blank, got %+v", stopTimes)
+	}
+
+	// B goes by distance, C without one by its place in the trip.
+	interpolateStopTimes(stopTimes)
+	expected := []int{8 * 3600, 8*3600 + 180, 8*3600 + 400, 8*3600 + 600}
+	for i, stopTime := range stopTimes {
+		if stopTime.ArrivalTime != expected[i] || stopTime.DepartureTime != expected[i] {
+			t.Errorf("Expected %s at %d, got %d and %d", stopTime.StopID, expected[i], stopTime.ArrivalTime, stopTime.DepartureTime)
+		}
+	}
+}
+
+func TestParseTrips(t *testing.T) {
+	trips, err := ParseTrips("./google_transit/trips.txt")
+	if err != nil {
+		t.Fatalf("ParseTrips error: %v", err)
+	}
+
+	if len(trips) != 47005 {
+		t.Errorf("Expected 47005 trips, got %d", len(trips))
+	}
+
+	expectedHeadsign := "BLUE EASTBOUND TO INDIAN CREEK STATION"
+	if trips[0].Headsign != expectedHeadsign {
+		t.Errorf("Expected headsign %s, got %s", expectedHeadsign, trips[0].Headsign)
+	}
+
+	expectedShapeID := "113787"
+	if trips[0].ShapeID != expectedShapeID {
+		t.Errorf("Expected shape ID %s, got %s", expectedShapeID, trips[0].ShapeID)
+	}
+}
+
+func TestEnrichBusPositions(t *testing.T) {
+	index := newTestIndex()
+	index.Trips["t1"] = Trip{RouteID: "r1", TripID: "t1", Headsign: "Five Points Station", DirectionID: "1", BlockID: "b7", ShapeID: "s1", WheelchairAccessible: "1", BikesAllowed: "2"}
+	index.Routes["r1"] = Route{ID: "r1", ShortName: "110", LongName: "Peachtree St", Color: "FF00FF", TextColor: "000000"}
+
+	buses := []BusPosition{
+		{ID: "2301", Label: "1601", TripID: "t1"},
+		{ID: "2302", Label: "1602", TripID: "unknown"},
+	}
+	index.EnrichBusPositions(buses)
+
+	expectedDisplayName := "110 to Five Points Station"
+	if buses[0].DisplayName != expectedDisplayName {
+		t.Errorf("Expected display name %s, got %s", expectedDisplayName, buses[0].DisplayName)
+	}
+	if buses[0].RouteID != "r1" || buses[0].BlockID != "b7" || buses[0].RouteColor != "FF00FF" || buses[0].WheelchairAccessible != "1" {
+		t.Errorf("Expected trip and route details to be filled in, got %+v", buses[0])
+	}
+	if buses[1].DisplayName != "1602" {
+		t.Errorf("Expected an unknown trip to fall back to the label, got %s", buses[1].DisplayName)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxHeadwayHistory = 1000
+
+	HeadwayNormal  = "normal"
+	HeadwayBunched = "bunched"
+	HeadwayGapped  = "gapped"
+	HeadwayUnknown = "unknown"
+)
+
+var (
+	routeHeadwaySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_headway_seconds",
+		Help: "Mean observed headway between consecutive vehicles, by route and direction.",
+	}, []string{"route_id", "direction_id"})
+
+	routeBunchedPairs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_bunched_pairs",
+		Help: "Number of consecutive vehicle pairs currently bunched, by route.",
+	}, []string{"route_id"})
+
+	routeGappedPairs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_gapped_pairs",
+		Help: "Number of consecutive vehicle pairs currently gapped, by route.",
+	}, []string{"route_id"})
+)
+
+func init() {
+	prometheus.MustRegister(routeHeadwaySeconds)
+	prometheus.MustRegister(routeBunchedPairs)
+	prometheus.MustRegister(routeGappedPairs)
+}
+
+var headwayMonitor *HeadwayMonitor
+
+// Headway is the spacing between a vehicle and the one ahead of it on the
+// same route, direction and shape. TimeSeconds is how long ago the leader was
+// where the follower is now.
+type Headway struct {
+	RouteID          string
+	DirectionID      string
+	ShapeID          string
+	LeaderID         string
+	FollowerID       string
+	DistanceMeters   float64
+	TimeSeconds      float64
+	ScheduledSeconds float64
+	Status           string
+}
+
+// HeadwayEvent is a period during which a pair of vehicles stayed bunched or
+// gapped.
+type HeadwayEvent struct {
+	Status           string
+	RouteID          string
+	DirectionID      string
+	LeaderID         string
+	FollowerID       string
+	Start            time.Time
+	End              *time.Time
+	TimeSeconds      float64
+	ScheduledSeconds float64
+}
+
+type vehicleTrack struct {
+	TripID string
+	Points []trackPoint
+}
+
+// HeadwayMonitor computes real-time headways on every poll and compares them
+// with the scheduled headways from stop_times.txt and frequencies.txt. A pair
+// is bunched below BunchingRatio of the scheduled headway and gapped above
+// GappingRatio. Without a schedule, pairs closer than BunchingDistance meters
+// are still reported as bunched.
+type HeadwayMonitor struct {
+	BunchingRatio    float64
+	GappingRatio     float64
+	BunchingDistance float64
+
+	index     *GTFSIndex
+	mu        sync.RWMutex
+	tracks    map[string]*vehicleTrack
+	headways  []Headway
+	active    map[string]*HeadwayEvent
+	history   []HeadwayEvent
+	schedules map[string]map[string]float64
+}
+
+// NewHeadwayMonitor returns a monitor that reads shapes and schedules from index.
+func NewHeadwayMonitor(index *GTFSIndex, bunchingRatio, gappingRatio, bunchingDistance float64) *HeadwayMonitor {
+	return &HeadwayMonitor{
+		BunchingRatio:    bunchingRatio,
+		GappingRatio:     gappingRatio,
+		BunchingDistance: bunchingDistance,
+		index:            index,
+		tracks:           make(map[string]*vehicleTrack),
+		active:           make(map[string]*HeadwayEvent),
+		schedules:        make(map[string]map[string]float64),
+	}
+}
+
+type trackedVehicle struct {
+	bus        BusPosition
+	trip       Trip
+	alongTrack float64
+	observed   time.Time
+}
+
+// Observe evaluates one poll of vehicle positions taken at now.
+func (m *HeadwayMonitor) Observe(buses []BusPosition, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := make(map[string][]trackedVehicle)
+	seen := make(map[string]bool, len(buses))
+	for _, bus := range buses {
+		trip, ok := m.index.Trips[bus.TripID]
+		if !ok {
+			continue
+		}
+		shape := m.index.Shapes[trip.ShapeID]
+		if shape == nil {
+			continue
+		}
+		seen[bus.ID] = true
+
+		observed := now
+		if bus.Timestamp > 0 {
+			observed = time.Unix(bus.Timestamp, 0)
+		}
+		_, alongTrack := shape.Project(bus.Latitude, bus.Longitude)
+		m.track(bus.ID, bus.TripID, trackPoint{AlongTrack: alongTrack, Time: observed})
+
+		key := trip.RouteID + "|" + trip.DirectionID + "|" + trip.ShapeID
+		groups[key] = append(groups[key], trackedVehicle{bus: bus, trip: trip, alongTrack: alongTrack, observed: observed})
+	}
+	for id := range m.tracks {
+		if !seen[id] {
+			delete(m.tracks, id)
+		}
+	}
+
+	headways := make([]Headway, 0)
+	for _, vehicles := range groups {
+		// Leaders first: the furthest along the shape.
+		sort.Slice(vehicles, func(i, j int) bool {
+			return vehicles[i].alongTrack > vehicles[j].alongTrack
+		})
+		for i := 1; i < len(vehicles); i++ {
+			leader, follower := vehicles[i-1], vehicles[i]
+			headway := Headway{
+				RouteID:        follower.trip.RouteID,
+				DirectionID:    follower.trip.DirectionID,
+				ShapeID:        follower.trip.ShapeID,
+				LeaderID:       leader.bus.ID,
+				FollowerID:     follower.bus.ID,
+				DistanceMeters: leader.alongTrack - follower.alongTrack,
+				TimeSeconds:    m.timeHeadway(leader.bus.ID, follower.alongTrack, follower.observed),
+			}
+			headway.ScheduledSeconds = m.scheduledHeadway(headway.RouteID, headway.DirectionID, now)
+			headway.Status = m.classify(headway)
+			headways = append(headways, headway)
+		}
+	}
+	m.headways = headways
+
+	m.updateEvents(headways, now)
+	m.updateMetrics(headways)
+}
+
+// track appends a position to a vehicle's recent progress along its trip.
+// The caller must hold m.mu.
+func (m *HeadwayMonitor) track(vehicleID, tripID string, point trackPoint) {
+	track, ok := m.tracks[vehicleID]
+	if !ok || track.TripID != tripID {
+		track = &vehicleTrack{TripID: tripID}
+		m.tracks[vehicleID] = track
+	}
+	if n := len(track.Points); n > 0 && !point.Time.After(track.Points[n-1].Time) {
+		return
+	}
+	track.Points = append(track.Points, point)
+	if len(track.Points) > maxTrackPoints {
+		track.Points = track.Points[len(track.Points)-maxTrackPoints:]
+	}
+}
+
+// timeHeadway returns the seconds between the leader passing alongTrack and
+// the follower reaching it at observed, or 0 when it can't be estimated.
+// The caller must hold m.mu.
+func (m *HeadwayMonitor) timeHeadway(leaderID string, alongTrack float64, observed time.Time) float64 {
+	track, ok := m.tracks[leaderID]
+	if !ok || len(track.Points) == 0 {
+		return 0
+	}
+	points := track.Points
+
+	for i := 1; i < len(points); i++ {
+		a, b := points[i-1], points[i]
+		if a.AlongTrack <= alongTrack && b.AlongTrack >= alongTrack && b.AlongTrack > a.AlongTrack {
+			fraction := (alongTrack - a.AlongTrack) / (b.AlongTrack - a.AlongTrack)
+			passed := a.Time.Add(time.Duration(fraction * float64(b.Time.Sub(a.Time))))
+			return observed.Sub(passed).Seconds()
+		}
+	}
+
+	// The leader passed before we started tracking it: extrapolate back at
+	// its average speed.
+	first, last := points[0], points[len(points)-1]
+	elapsed := last.Time.Sub(first.Time).Seconds()
+	if first.AlongTrack < alongTrack || elapsed <= 0 {
+		return 0
+	}
+	speed := (last.AlongTrack - first.AlongTrack) / elapsed
+	if speed < 0.5 {
+		return 0
+	}
+	passed := first.Time.Add(-time.Duration((first.AlongTrack - alongTrack) / speed * float64(time.Second)))
+	return observed.Sub(passed).Seconds()
+}
+
+func (m *HeadwayMonitor) classify(headway Headway) string {
+	if headway.ScheduledSeconds > 0 && headway.TimeSeconds > 0 {
+		ratio := headway.TimeSeconds / headway.ScheduledSeconds
+		switch {
+		case ratio < m.BunchingRatio:
+			return HeadwayBunched
+		case ratio > m.GappingRatio:
+			return HeadwayGapped
+		default:
+			return HeadwayNormal
+		}
+	}
+	if headway.DistanceMeters < m.BunchingDistance {
+		return HeadwayBunched
+	}
+	return HeadwayUnknown
+}
+
+// updateEvents opens and closes bunching and gapping events for the pairs in
+// the latest headways. The caller must hold m.mu.
+func (m *HeadwayMonitor) updateEvents(headways []Headway, now time.Time) {
+	current := make(map[string]bool)
+	for _, headway := range headways {
+		if headway.Status != HeadwayBunched && headway.Status != HeadwayGapped {
+			continue
+		}
+		key := headway.Status + "|" + headway.LeaderID + "|" + headway.FollowerID
+		current[key] = true
+		if event, ok := m.active[key]; ok {
+			event.TimeSeconds = headway.TimeSeconds
+			continue
+		}
+		m.active[key] = &HeadwayEvent{
+			Status:           headway.Status,
+			RouteID:          headway.RouteID,
+			DirectionID:      headway.DirectionID,
+			LeaderID:         headway.LeaderID,
+			FollowerID:       headway.FollowerID,
+			Start:            now,
+			TimeSeconds:      headway.TimeSeconds,
+			ScheduledSeconds: headway.ScheduledSeconds,
+		}
+	}
+
+	for key, event := range m.active {
+		if current[key] {
+			continue
+		}
+		end := now
+		event.End = &end
+		delete(m.active, key)
+		m.history = append(m.history, *event)
+	}
+	if len(m.history) > maxHeadwayHistory {
+		m.history = m.history[len(m.history)-maxHeadwayHistory:]
+	}
+}
+
+func (m *HeadwayMonitor) updateMetrics(headways []Headway) {
+	type sum struct {
+		total float64
+		count int
+	}
+	sums := make(map[[2]string]*sum)
+	routes := make(map[string]bool)
+	bunched := make(map[string]int)
+	gapped := make(map[string]int)
+	for _, headway := range headways {
+		routes[headway.RouteID] = true
+		switch headway.Status {
+		case HeadwayBunched:
+			bunched[headway.RouteID]++
+		case HeadwayGapped:
+			gapped[headway.RouteID]++
+		}
+		if headway.TimeSeconds <= 0 {
+			continue
+		}
+		key := [2]string{headway.RouteID, headway.DirectionID}
+		if sums[key] == nil {
+			sums[key] = &sum{}
+		}
+		sums[key].total += headway.TimeSeconds
+		sums[key].count++
+	}
+
+	routeHeadwaySeconds.Reset()
+	routeBunchedPairs.Reset()
+	routeGappedPairs.Reset()
+	for key, s := range sums {
+		routeHeadwaySeconds.WithLabelValues(key[0], key[1]).Set(s.total / float64(s.count))
+	}
+	for routeID := range routes {
+		routeBunchedPairs.WithLabelValues(routeID).Set(float64(bunched[routeID]))
+		routeGappedPairs.WithLabelValues(routeID).Set(float64(gapped[routeID]))
+	}
+}
+
+// scheduledHeadway returns the scheduled headway in seconds for a route and
+// direction at now, or 0 when the schedule has no service then. Trips after
+// midnight belong to the previous service day, so that day is checked too.
+// The caller must hold m.mu.
+func (m *HeadwayMonitor) scheduledHeadway(routeID, directionID string, now time.Time) float64 {
+	today := m.index.ServiceDate(now)
+	yesterday := m.index.ServiceDate(today.Add(-12 * time.Hour))
+
+	for _, serviceDate := range []time.Time{today, yesterday} {
+		hour := int(now.Sub(m.index.ScheduledTime(serviceDate, 0)).Hours())
+		schedule := m.scheduleFor(serviceDate)
+		if headway, ok := schedule[scheduleKey(routeID, directionID, hour)]; ok {
+			return headway
+		}
+	}
+	return 0
+}
+
+// scheduleFor returns the scheduled headways of a service date, building and
+// caching them on first use. The caller must hold m.mu.
+func (m *HeadwayMonitor) scheduleFor(serviceDate time.Time) map[string]float64 {
+	day := serviceDate.Format("20060102")
+	if schedule, ok := m.schedules[day]; ok {
+		return schedule
+	}
+	schedule := buildScheduledHeadways(m.index, serviceDate)
+
+	// Only today and yesterday are ever needed.
+	if len(m.schedules) >= 2 {
+		m.schedules = make(map[string]map[string]float64)
+	}
+	m.schedules[day] = schedule
+	return schedule
+}
+
+func scheduleKey(routeID, directionID string, hour int) string {
+	return routeID + "|" + directionID + "|" + strconv.Itoa(hour)
+}
+
+// buildScheduledHeadways averages the gaps between first departures of the
+// trips running on a service date, per route, direction and hour.
+// Frequency-based trips use their headway_secs instead.
+func buildScheduledHeadways(index *GTFSIndex, serviceDate time.Time) map[string]float64 {
+	schedule := make(map[string]float64)
+	departures := make(map[string][]int)
+
+	for tripID, trip := range index.Trips {
+		if !index.ServiceActive(trip.ServiceID, serviceDate) {
+			continue
+		}
+		if frequencies := index.Frequencies[tripID]; len(frequencies) > 0 {
+			for _, frequency := range frequencies {
+				for hour := frequency.StartTime / 3600; hour*3600 < frequency.EndTime; hour++ {
+					schedule[scheduleKey(trip.RouteID, trip.DirectionID, hour)] = float64(frequency.HeadwaySecs)
+				}
+			}
+			continue
+		}
+		stopTimes := index.StopTimes[tripID]
+		if len(stopTimes) == 0 {
+			continue
+		}
+		key := trip.RouteID + "|" + trip.DirectionID
+		departures[key] = append(departures[key], stopTimes[0].DepartureTime)
+	}
+
+	type sum struct {
+		total float64
+		count int
+	}
+	sums := make(map[string]*sum)
+	for key, times := range departures {
+		sort.Ints(times)
+		for i := 1; i < len(times); i++ {
+			hourKey := key + "|" + strconv.Itoa(times[i-1]/3600)
+			if sums[hourKey] == nil {
+				sums[hourKey] = &sum{}
+			}
+			sums[hourKey].total += float64(times[i] - times[i-1])
+			sums[hourKey].count++
+		}
+	}
+	for key, s := range sums {
+		if _, ok := schedule[key]; !ok {
+			schedule[key] = s.total / float64(s.count)
+		}
+	}
+
+	return schedule
+}
+
+// Headways returns the headways computed on the last poll.
+func (m *HeadwayMonitor) Headways() []Headway {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Headway(nil), m.headways...)
+}
+
+// Events returns the bunching and gapping events in progress and the most
+// recent finished ones, oldest first.
+func (m *HeadwayMonitor) Events() (active, history []HeadwayEvent) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	active = make([]HeadwayEvent, 0, len(m.active))
+	for _, event := range m.active {
+		active = append(active, *event)
+	}
+	return active, append([]HeadwayEvent(nil), m.history...)
+}
+
+func headwaysHandler(w http.ResponseWriter, r *http.Request) {
+	routeID := r.URL.Query().Get("route_id")
+
+	headways := make([]Headway, 0)
+	for _, headway := range headwayMonitor.Headways() {
+		if routeID == "" || headway.RouteID == routeID {
+			headways = append(headways, headway)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(headways)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+type HeadwayEventReport struct {
+	BunchingRatio float64
+	GappingRatio  float64
+	Active        []HeadwayEvent
+	Recent        []HeadwayEvent
+}
+
+func bunchingHandler(w http.ResponseWriter, r *http.Request) {
+	routeID := r.URL.Query().Get("route_id")
+	active, history := headwayMonitor.Events()
+
+	report := HeadwayEventReport{
+		BunchingRatio: headwayMonitor.BunchingRatio,
+		GappingRatio:  headwayMonitor.GappingRatio,
+		Active:        filterHeadwayEventsByRoute(active, routeID),
+		Recent:        filterHeadwayEventsByRoute(history, routeID),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+func filterHeadwayEventsByRoute(events []HeadwayEvent, routeID string) []HeadwayEvent {
+	if routeID == "" {
+		return events
+	}
+	filtered := make([]HeadwayEvent, 0)
+	for _, event := range events {
+		if event.RouteID == routeID {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
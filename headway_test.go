@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// positionAlongTestShape returns the longitude that is meters east of the
+// start of the test shape.
+func positionAlongTestShape(meters float64) float64 {
+	return -84.40 + meters/(111195*math.Cos(33.75*math.Pi/180))
+}
+
+func TestHeadwayMonitorBunching(t *testing.T) {
+	monitor := NewHeadwayMonitor(newTestIndex(), 0.5, 1.5, 0)
+	start := time.Date(2023, 10, 16, 8, 28, 0, 0, time.UTC)
+
+	// The leader runs at 10m/s, the follower sets off a minute behind it.
+	for elapsed := 0; elapsed <= 120; elapsed += 15 {
+		now := start.Add(time.Duration(elapsed) * time.Second)
+		buses := []BusPosition{
+			{ID: "leader", Latitude: 33.75, Longitude: positionAlongTestShape(float64(10 * elapsed)), TripID: "t1", RouteID: "r1", Timestamp: now.Unix()},
+		}
+		if elapsed >= 60 {
+			buses = append(buses, BusPosition{ID: "follower", Latitude: 33.75, Longitude: positionAlongTestShape(float64(10 * (elapsed - 60))), TripID: "t2", RouteID: "r1", Timestamp: now.Unix()})
+		}
+		monitor.Observe(buses, now)
+	}
+
+	headways := monitor.Headways()
+	if len(headways) != 1 {
+		t.Fatalf("Expected 1 headway, got %d", len(headways))
+	}
+	if headways[0].LeaderID != "leader" || headways[0].FollowerID != "follower" {
+		t.Errorf("Expected leader ahead of follower, got %s ahead of %s", headways[0].LeaderID, headways[0].FollowerID)
+	}
+	if math.Abs(headways[0].TimeSeconds-60) > 2 {
+		t.Errorf("Expected a headway of about 60s, got %f", headways[0].TimeSeconds)
+	}
+	if headways[0].ScheduledSeconds != 600 {
+		t.Errorf("Expected a scheduled headway of 600s, got %f", headways[0].ScheduledSeconds)
+	}
+	if headways[0].Status != HeadwayBunched {
+		t.Errorf("Expected status %s, got %s", HeadwayBunched, headways[0].Status)
+	}
+
+	active, _ := monitor.Events()
+	if len(active) != 1 {
+		t.Fatalf("Expected 1 active bunching event, got %d", len(active))
+	}
+
+	monitor.Observe([]BusPosition{{ID: "leader", Latitude: 33.75, Longitude: positionAlongTestShape(1300), TripID: "t1", RouteID: "r1"}}, start.Add(135*time.Second))
+	active, history := monitor.Events()
+	if len(active) != 0 || len(history) != 1 {
+		t.Errorf("Expected the bunching event to close, got %d active and %d finished", len(active), len(history))
+	}
+}
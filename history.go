@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHistoryRange bounds the time range of one history request.
+	maxHistoryRange = 7 * 24 * time.Hour
+	// replayLookback is how long before the replayed time a vehicle must have
+	// reported to be shown.
+	replayLookback = 2 * time.Minute
+)
+
+// parseTimeRange reads the RFC 3339 from and to parameters, defaulting to the
+// last hour.
+func parseTimeRange(r *http.Request, now time.Time) (time.Time, time.Time, bool) {
+	from, to := now.Add(-time.Hour), now
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			return from, to, false
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			return from, to, false
+		}
+	}
+	if to.Before(from) || to.Sub(from) > maxHistoryRange {
+		return from, to, false
+	}
+	return from, to, true
+}
+
+// historyVehicleHandler serves /history/vehicles/{id}, the stored positions
+// of a vehicle between from and to.
+func historyVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	servePositionHistory(w, r, strings.TrimPrefix(r.URL.Path, "/history/vehicles/"), "")
+}
+
+// historyRouteHandler serves /history/routes/{id}, the stored positions of
+// the vehicles on a route between from and to.
+func historyRouteHandler(w http.ResponseWriter, r *http.Request) {
+	servePositionHistory(w, r, "", strings.TrimPrefix(r.URL.Path, "/history/routes/"))
+}
+
+func servePositionHistory(w http.ResponseWriter, r *http.Request, vehicleID, routeID string) {
+	if segmentStore == nil {
+		http.Error(w, "History store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if vehicleID == "" && routeID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	from, to, ok := parseTimeRange(r, time.Now())
+	if !ok {
+		http.Error(w, "Invalid time range", http.StatusBadRequest)
+		return
+	}
+
+	positions, err := segmentStore.Positions(from, to, vehicleID, routeID)
+	if err != nil {
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(positions)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// replayHandler serves the positions of every vehicle, optionally of one
+// route_id, as they were at the RFC 3339 time at.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	if segmentStore == nil {
+		http.Error(w, "History store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		http.Error(w, "Invalid at", http.StatusBadRequest)
+		return
+	}
+
+	positions, err := segmentStore.Snapshot(at, replayLookback, r.URL.Query().Get("route_id"))
+	if err != nil {
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(positions)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
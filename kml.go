@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kmlNamespace   = "http://www.opengis.net/kml/2.2"
+	kmlContentType = "application/vnd.google-earth.kml+xml"
+
+	// defaultKMLRefreshSeconds matches how often the feed is polled.
+	defaultKMLRefreshSeconds = 15
+	minKMLRefreshSeconds     = 5
+)
+
+// kmlBaseURL is the public URL the service is reached at, for the network
+// link to point back to. Without it the link is relative to the document.
+var kmlBaseURL *url.URL
+
+// parseBaseURL checks that a base URL is an absolute http or https URL.
+func parseBaseURL(value string) (*url.URL, error) {
+	base, err := url.Parse(strings.TrimSuffix(value, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http or https URL", value)
+	}
+	base.RawQuery, base.Fragment = "", ""
+	return base, nil
+}
+
+type kmlRoot struct {
+	XMLName     xml.Name        `xml:"kml"`
+	Namespace   string          `xml:"xmlns,attr"`
+	Document    *kmlDocument    `xml:"Document,omitempty"`
+	NetworkLink *kmlNetworkLink `xml:"NetworkLink,omitempty"`
+}
+
+type kmlDocument struct {
+	Name       string         `xml:"name"`
+	Styles     []kmlStyle     `xml:"Style"`
+	Folders    []kmlFolder    `xml:"Folder"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr,omitempty"`
+	IconStyle *kmlIconStyle `xml:"IconStyle,omitempty"`
+	LineStyle *kmlLineStyle `xml:"LineStyle,omitempty"`
+}
+
+type kmlIconStyle struct {
+	Color   string  `xml:"color,omitempty"`
+	Heading float64 `xml:"heading,omitempty"`
+}
+
+type kmlLineStyle struct {
+	Color string  `xml:"color"`
+	Width float64 `xml:"width"`
+}
+
+type kmlPlacemark struct {
+	ID          string           `xml:"id,attr,omitempty"`
+	Name        string           `xml:"name"`
+	Description string           `xml:"description,omitempty"`
+	TimeStamp   *kmlTimeStamp    `xml:"TimeStamp,omitempty"`
+	StyleURL    string           `xml:"styleUrl,omitempty"`
+	Style       *kmlStyle        `xml:"Style,omitempty"`
+	Point       *kmlGeometry     `xml:"Point,omitempty"`
+	LineString  *kmlLineGeometry `xml:"LineString,omitempty"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlGeometry struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlLineGeometry struct {
+	Tessellate  int    `xml:"tessellate"`
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlNetworkLink struct {
+	Name string  `xml:"name"`
+	Link kmlLink `xml:"Link"`
+}
+
+type kmlLink struct {
+	Href            string `xml:"href"`
+	RefreshMode     string `xml:"refreshMode"`
+	RefreshInterval int    `xml:"refreshInterval"`
+}
+
+// buildRoutesKML returns a folder per route, optionally only routeID, with a
+// line per shape styled in the route colour.
+func buildRoutesKML(index *GTFSIndex, routeID string) kmlRoot {
+	routeIDs := make([]string, 0)
+	for id := range index.Routes {
+		if routeID == "" || id == routeID {
+			routeIDs = append(routeIDs, id)
+		}
+	}
+	sort.Strings(routeIDs)
+
+	document := &kmlDocument{Name: "Routes", Styles: make([]kmlStyle, 0), Folders: make([]kmlFolder, 0)}
+	for _, id := range routeIDs {
+		route := index.Routes[id]
+		styleID := "route-" + id
+		document.Styles = append(document.Styles, kmlStyle{
+			ID:        styleID,
+			LineStyle: &kmlLineStyle{Color: kmlColor(route.Color, "FFFFFF"), Width: 4},
+		})
+
+		shapeIDs := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, tripID := range index.RouteTrips(id) {
+			shapeID := index.Trips[tripID].ShapeID
+			if _, ok := index.Shapes[shapeID]; ok && !seen[shapeID] {
+				seen[shapeID] = true
+				shapeIDs = append(shapeIDs, shapeID)
+			}
+		}
+		sort.Strings(shapeIDs)
+
+		folder := kmlFolder{Name: routeName(route), Placemarks: make([]kmlPlacemark, 0, len(shapeIDs))}
+		for _, shapeID := range shapeIDs {
+			shape := index.Shapes[shapeID]
+			coordinates := make([]string, len(shape.Points))
+			for i, point := range shape.Points {
+				coordinates[i] = kmlCoordinate(point.Latitude, point.Longitude)
+			}
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				ID:          "shape-" + shapeID,
+				Name:        routeName(route),
+				Description: route.LongName,
+				StyleURL:    "#" + styleID,
+				LineString:  &kmlLineGeometry{Tessellate: 1, Coordinates: strings.Join(coordinates, " ")},
+			})
+		}
+		document.Folders = append(document.Folders, folder)
+	}
+	return kmlRoot{Namespace: kmlNamespace, Document: document}
+}
+
+// buildStopsKML returns a point per stop and station.
+func buildStopsKML(index *GTFSIndex) kmlRoot {
+	stopIDs := make([]string, 0, len(index.Stops))
+	for id, stop := range index.Stops {
+		if stop.LocationType == "" || stop.LocationType == LocationStop || stop.LocationType == LocationStation {
+			stopIDs = append(stopIDs, id)
+		}
+	}
+	sort.Strings(stopIDs)
+
+	document := &kmlDocument{Name: "Stops", Placemarks: make([]kmlPlacemark, 0, len(stopIDs))}
+	for _, id := range stopIDs {
+		stop := index.Stops[id]
+		description := "Stop " + stop.StopID
+		if stop.StopCode != "" {
+			description += ", code " + stop.StopCode
+		}
+		document.Placemarks = append(document.Placemarks, kmlPlacemark{
+			ID:          "stop-" + stop.StopID,
+			Name:        stop.StopName,
+			Description: description,
+			Point:       &kmlGeometry{Coordinates: kmlCoordinate(stop.Latitude, stop.Longitude)},
+		})
+	}
+	return kmlRoot{Namespace: kmlNamespace, Document: document}
+}
+
+// buildVehiclesKML returns a point per bus, optionally only of routeID,
+// coloured by route and turned to its bearing.
+func buildVehiclesKML(buses []BusPosition, routeID string) kmlRoot {
+	document := &kmlDocument{Name: "Vehicles", Placemarks: make([]kmlPlacemark, 0)}
+	for _, bus := range buses {
+		if routeID != "" && bus.RouteID != routeID {
+			continue
+		}
+		name := bus.DisplayName
+		if name == "" {
+			name = bus.ID
+		}
+		placemark := kmlPlacemark{
+			ID:          "vehicle-" + bus.ID,
+			Name:        name,
+			Description: fmt.Sprintf("Vehicle %s, route %s, trip %s", bus.ID, bus.RouteID, bus.TripID),
+			Style: &kmlStyle{IconStyle: &kmlIconStyle{
+				Color:   kmlColor(bus.RouteColor, "FFFFFF"),
+				Heading: bus.Bearing,
+			}},
+			Point: &kmlGeometry{Coordinates: kmlCoordinate(bus.Latitude, bus.Longitude)},
+		}
+		if bus.Timestamp > 0 {
+			placemark.TimeStamp = &kmlTimeStamp{When: time.Unix(bus.Timestamp, 0).UTC().Format(time.RFC3339)}
+		}
+		document.Placemarks = append(document.Placemarks, placemark)
+	}
+	return kmlRoot{Namespace: kmlNamespace, Document: document}
+}
+
+// buildVehiclesNetworkLink returns a network link reloading href every
+// refreshSeconds.
+func buildVehiclesNetworkLink(href string, refreshSeconds int) kmlRoot {
+	return kmlRoot{Namespace: kmlNamespace, NetworkLink: &kmlNetworkLink{
+		Name: "Live vehicles",
+		Link: kmlLink{Href: href, RefreshMode: "onInterval", RefreshInterval: refreshSeconds},
+	}}
+}
+
+// kmlColor converts a GTFS RRGGBB colour to KML's opaque AABBGGRR, using
+// fallback when color is unset or invalid.
+func kmlColor(color, fallback string) string {
+	if len(color) != 6 {
+		color = fallback
+	}
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil {
+		color = fallback
+	}
+	color = strings.ToLower(color)
+	return "ff" + color[4:6] + color[2:4] + color[0:2]
+}
+
+func kmlCoordinate(lat, lon float64) string {
+	return strconv.FormatFloat(lon, 'f', 6, 64) + "," + strconv.FormatFloat(lat, 'f', 6, 64)
+}
+
+func routeName(route Route) string {
+	if route.ShortName != "" {
+		return route.ShortName
+	}
+	if route.LongName != "" {
+		return route.LongName
+	}
+	return route.ID
+}
+
+// writeXML writes an XML document with its declaration.
+func writeXML(w io.Writer, document interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(document)
+}
+
+func serveKML(w http.ResponseWriter, name string, document kmlRoot) {
+	w.Header().Set("Content-Type", kmlContentType)
+	w.Header().Set("Content-Disposition", `inline; filename="`+name+`.kml"`)
+	err := writeXML(w, document)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// kmlRoutesHandler serves /kml/routes.kml, optionally of one route_id.
+func kmlRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	routeID := r.URL.Query().Get("route_id")
+	if _, ok := gtfsIndex.Routes[routeID]; routeID != "" && !ok {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	serveKML(w, "routes", buildRoutesKML(gtfsIndex, routeID))
+}
+
+// kmlStopsHandler serves /kml/stops.kml.
+func kmlStopsHandler(w http.ResponseWriter, r *http.Request) {
+	serveKML(w, "stops", buildStopsKML(gtfsIndex))
+}
+
+// kmlVehiclesHandler serves /kml/vehicles.kml, the current vehicles,
+// optionally of one route_id.
+func kmlVehiclesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	serveKML(w, "vehicles", buildVehiclesKML(currentFeed().Buses, r.URL.Query().Get("route_id")))
+}
+
+// kmlVehiclesLinkHandler serves /kml/vehicles-link.kml, a network link that
+// has Google Earth reload /kml/vehicles.kml every refresh seconds. The link
+// never comes from the request's Host or forwarding headers, which a client
+// controls.
+func kmlVehiclesLinkHandler(w http.ResponseWriter, r *http.Request) {
+	refresh := defaultKMLRefreshSeconds
+	if value := r.URL.Query().Get("refresh"); value != "" {
+		var err error
+		refresh, err = strconv.Atoi(value)
+		if err != nil || refresh < minKMLRefreshSeconds {
+			http.Error(w, "Invalid refresh", http.StatusBadRequest)
+			return
+		}
+	}
+
+	href := url.URL{Path: "vehicles.kml"}
+	if kmlBaseURL != nil {
+		href = *kmlBaseURL
+		href.Path += "/kml/vehicles.kml"
+	}
+	if routeID := r.URL.Query().Get("route_id"); routeID != "" {
+		href.RawQuery = url.Values{"route_id": {routeID}}.Encode()
+	}
+	serveKML(w, "vehicles-link", buildVehiclesNetworkLink(href.String(), refresh))
+}
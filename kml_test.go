@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKMLColor(t *testing.T) {
+	if color := kmlColor("FF8000", "FFFFFF"); color != "ff0080ff" {
+		t.Errorf("Expected ff0080ff, got %s", color)
+	}
+	if color := kmlColor("", "FFFFFF"); color != "ffffffff" {
+		t.Errorf("Expected ffffffff, got %s", color)
+	}
+	if color := kmlColor("GGGGGG", "000000"); color != "ff000000" {
+		t.Errorf("Expected ff000000, got %s", color)
+	}
+}
+
+func TestBuildRoutesKML(t *testing.T) {
+	index := newTestIndex()
+	index.Routes["r1"] = Route{ID: "r1", ShortName: "1", LongName: "Test Route", Color: "FF0000"}
+
+	document := buildRoutesKML(index, "r1")
+	if len(document.Document.Folders) != 1 || len(document.Document.Folders[0].Placemarks) != 1 {
+		t.Fatalf("Expected 1 route with 1 shape, got %v", document.Document.Folders)
+	}
+	placemark := document.Document.Folders[0].Placemarks[0]
+	if placemark.StyleURL != "#route-r1" || document.Document.Styles[0].LineStyle.Color != "ff0000ff" {
+		t.Errorf("Expected the shape styled red, got %s %v", placemark.StyleURL, document.Document.Styles[0].LineStyle)
+	}
+	if placemark.LineString.Coordinates != "-84.400000,33.750000 -84.390000,33.750000 -84.380000,33.750000" {
+		t.Errorf("Unexpected coordinates %s", placemark.LineString.Coordinates)
+	}
+
+	var buf bytes.Buffer
+	if err := writeXML(&buf, document); err != nil {
+		t.Fatalf("writeXML error: %v", err)
+	}
+	if !strings.Contains(buf.String(), `<kml xmlns="http://www.opengis.net/kml/2.2">`) {
+		t.Errorf("Expected a KML root, got %s", buf.String())
+	}
+}
+
+func TestBuildVehiclesKML(t *testing.T) {
+	buses := []BusPosition{
+		{ID: "v1", Latitude: 33.75, Longitude: -84.39, RouteID: "r1", Bearing: 90, Timestamp: 1697443200},
+		{ID: "v2", Latitude: 33.76, Longitude: -84.39, RouteID: "r2"},
+	}
+	document := buildVehiclesKML(buses, "r1")
+	if len(document.Document.Placemarks) != 1 {
+		t.Fatalf("Expected 1 vehicle, got %d", len(document.Document.Placemarks))
+	}
+	placemark := document.Document.Placemarks[0]
+	if placemark.Style.IconStyle.Heading != 90 || placemark.TimeStamp.When != "2023-10-16T08:00:00Z" {
+		t.Errorf("Expected heading 90 at 2023-10-16T08:00:00Z, got %v %v", placemark.Style.IconStyle.Heading, placemark.TimeStamp.When)
+	}
+
+	link := buildVehiclesNetworkLink("http://example.com/kml/vehicles.kml", 15)
+	var buf bytes.Buffer
+	if err := writeXML(&buf, link); err != nil {
+		t.Fatalf("writeXML error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "<refreshInterval>15</refreshInterval>") || strings.Contains(buf.String(), "<Document>") {
+		t.Errorf("Expected a bare network link refreshing every 15 seconds, got %s", buf.String())
+	}
+}
+
+func TestKMLVehiclesLinkHandler(t *testing.T) {
+	request := func() string {
+		r := httptest.NewRequest("GET", "/kml/vehicles-link.kml?route_id=r1", nil)
+		r.Host = "attacker.example"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		recorder := httptest.NewRecorder()
+		kmlVehiclesLinkHandler(recorder, r)
+		return recorder.Body.String()
+	}
+
+	// Without a base URL the link is relative to the document.
+	if body := request(); !strings.Contains(body, "<href>vehicles.kml?route_id=r1</href>") {
+		t.Errorf("Expected a relative link, got %s", body)
+	}
+
+	base, err := parseBaseURL("https://transit.example/live/")
+	if err != nil {
+		t.Fatalf("parseBaseURL error: %v", err)
+	}
+	kmlBaseURL = base
+	defer func() { kmlBaseURL = nil }()
+	if body := request(); !strings.Contains(body, "<href>https://transit.example/live/kml/vehicles.kml?route_id=r1</href>") {
+		t.Errorf("Expected a link under the base URL, got %s", body)
+	}
+
+	for _, value := range []string{"transit.example", "ftp://transit.example", "https://"} {
+		if _, err := parseBaseURL(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
+	_ "time/tzdata"
 )
 
 var (
@@ -51,66 +53,121 @@ func routeVisualizationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch all the necessary data
-	routes, _ := ParseRoutes("./google_transit/routes.txt")
-	var selectedRoute Route
-	for _, route := range routes {
-		if route.ID == routeID {
-			selectedRoute = route
-			break
-		}
+	feed := currentFeed()
+	routeVis, ok := buildRouteVisualization(gtfsIndex, routeID, feed.Buses, feed.TripUpdates)
+	if !ok {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
 	}
 
-	shapes, _ := ParseShapes("./google_transit/shapes.txt")
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(routeVis)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+	duration := time.Since(start).Seconds()
+	httpRequestDuration.WithLabelValues("/route-visualization").Observe(duration)
+	httpRequestsTotal.WithLabelValues("/route-visualization", strconv.Itoa(http.StatusOK)).Inc()
+}
 
-	stops, _ := ParseStops("./google_transit/stops.txt")
+// buildRouteVisualization gathers the shapes, stops, buses and trip updates of
+// one route. Everything is joined through maps, so the cost grows with the
+// size of the route rather than the size of the feed.
+func buildRouteVisualization(index *GTFSIndex, routeID string, buses []BusPosition, tripUpdates []TripUpdate) (RouteVisualization, bool) {
+	route, ok := index.Routes[routeID]
+	if !ok {
+		return RouteVisualization{}, false
+	}
+
+	tripIDs := index.RouteTrips(routeID)
+	shapeIDs := make(map[string]bool)
+	stopIDs := make(map[string]bool)
+	for _, tripID := range tripIDs {
+		shapeIDs[index.Trips[tripID].ShapeID] = true
+		for _, stopTime := range index.StopTimes[tripID] {
+			stopIDs[stopTime.StopID] = true
+		}
+	}
 
-	martaBusPositionsURL := "https://gtfs-rt.itsmarta.com/TMGTFSRealTimeWebService/vehicle/vehiclepositions.pb"
+	shapes := make([]Shape, 0)
+	for shapeID := range shapeIDs {
+		if shape, ok := index.Shapes[shapeID]; ok {
+			shapes = append(shapes, shape.Points...)
+		}
+	}
+	sort.SliceStable(shapes, func(i, j int) bool {
+		return shapes[i].ShapeId < shapes[j].ShapeId
+	})
 
-	buses := getBusPositions(martaBusPositionsURL)
-	busCount.Set(float64(len(buses)))
+	stops := make([]Stop, 0, len(stopIDs))
+	for stopID := range stopIDs {
+		if stop, ok := index.Stops[stopID]; ok {
+			stops = append(stops, stop)
+		}
+	}
+	sort.Slice(stops, func(i, j int) bool {
+		return stops[i].StopID < stops[j].StopID
+	})
 
-	martaTripUpdatesURL := "https://gtfs-rt.itsmarta.com/TMGTFSRealTimeWebService/tripupdate/tripupdates.pb"
-	tripUpdates := getTripUpdates(martaTripUpdatesURL)
+	routeTripUpdates := make([]TripUpdate, 0)
+	byTrip := make(map[string]TripUpdate)
+	byVehicle := make(map[string]TripUpdate)
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		updateRouteID := tripUpdate.Trip.GetRouteId()
+		if updateRouteID == "" {
+			updateRouteID = index.Trips[tripID].RouteID
+		}
+		if updateRouteID != routeID {
+			continue
+		}
+		routeTripUpdates = append(routeTripUpdates, tripUpdate)
+		byTrip[tripID] = tripUpdate
+		// A vehicle may have updates for its next trip too, keep the first.
+		if _, ok := byVehicle[tripUpdate.Vehicle.GetId()]; !ok {
+			byVehicle[tripUpdate.Vehicle.GetId()] = tripUpdate
+		}
+	}
 
-	var busVisualizations []BusVisualization
+	busVisualizations := make([]BusVisualization, 0)
 	for _, bus := range buses {
-		for _, tripUpdate := range tripUpdates {
-			if bus.ID == tripUpdate.Vehicle.GetId() {
-				busVis := BusVisualization{
-					BusPosition:   bus,
-					TripInfo:      tripUpdate.Trip,
-					StopSequences: tripUpdate.StopTimeUpdate,
-				}
-				busVisualizations = append(busVisualizations, busVis)
-				break
-			}
+		if bus.RouteID != routeID {
+			continue
+		}
+		tripUpdate, ok := byTrip[bus.TripID]
+		if !ok {
+			tripUpdate = byVehicle[bus.ID]
 		}
+		busVisualizations = append(busVisualizations, BusVisualization{
+			BusPosition:   bus,
+			TripInfo:      tripUpdate.Trip,
+			StopSequences: tripUpdate.StopTimeUpdate,
+		})
 	}
 
-	routeVis := RouteVisualization{
-		RouteInfo:   selectedRoute,
+	return RouteVisualization{
+		RouteInfo:   route,
 		Shapes:      shapes,
 		Stops:       stops,
 		Buses:       busVisualizations,
-		TripUpdates: tripUpdates,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(routeVis)
-	if err != nil {
-		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
-		return
-	}
-	duration := time.Since(start).Seconds()
-	httpRequestDuration.WithLabelValues("/route-visualization").Observe(duration)
-	httpRequestsTotal.WithLabelValues("/route-visualization", strconv.Itoa(http.StatusOK)).Inc()
+		TripUpdates: routeTripUpdates,
+	}, true
 }
 
 func busPositionsHandler(w http.ResponseWriter, r *http.Request) {
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+	buses := currentFeed().Buses
+	if accessible {
+		buses = accessibleBuses(buses)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(currentBusPositions)
+	err := json.NewEncoder(w).Encode(buses)
 	if err != nil {
 		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
 		return
@@ -162,11 +219,21 @@ func routesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func stopsHandler(w http.ResponseWriter, r *http.Request) {
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+
 	stops, err := ParseStops("./google_transit/stops.txt")
 	if err != nil {
 		log.Fatalf("Failed to parse stops: %v", err)
 		return
 	}
+	inheritWheelchairBoarding(stops)
+	if accessible {
+		stops = accessibleStops(stops)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(stops)
@@ -179,26 +246,155 @@ func stopsHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 
 	martaBusPositionsURL := "https://gtfs-rt.itsmarta.com/TMGTFSRealTimeWebService/vehicle/vehiclepositions.pb"
+	martaTripUpdatesURL := "https://gtfs-rt.itsmarta.com/TMGTFSRealTimeWebService/tripupdate/tripupdates.pb"
+	martaAlertsURL := "https://gtfs-rt.itsmarta.com/TMGTFSRealTimeWebService/alert/alerts.pb"
+
+	gtfsIndex = LoadGTFSIndex("./google_transit")
+	stopIndex = NewStopIndex(gtfsIndex.Stops)
+	trailStore = NewTrailStore(time.Duration(envInt("TRAIL_MINUTES", 60)) * time.Minute)
+	offRouteDetector = NewOffRouteDetector(gtfsIndex,
+		envFloat("OFF_ROUTE_THRESHOLD_METERS", 150),
+		envInt("OFF_ROUTE_CONSECUTIVE_REPORTS", 3))
+	anomalyDetector = NewAnomalyDetector(gtfsIndex,
+		time.Duration(envInt("STUCK_MINUTES", 20))*time.Minute,
+		envFloat("STUCK_RADIUS_METERS", 50),
+		envFloat("LAYOVER_RADIUS_METERS", 150),
+		time.Duration(envInt("ANOMALY_GRACE_SECONDS", 120))*time.Second)
+	fences, err := LoadGeofences(envString("GEOFENCES_FILE", "./geofences.geojson"))
+	if err != nil {
+		log.Printf("Failed to load geofences: %v", err)
+	}
+	geofenceMonitor = NewGeofenceMonitor(fences,
+		time.Duration(envInt("GEOFENCE_DWELL_MINUTES", 10))*time.Minute)
+	headwayMonitor = NewHeadwayMonitor(gtfsIndex,
+		envFloat("HEADWAY_BUNCHING_RATIO", 0.5),
+		envFloat("HEADWAY_GAPPING_RATIO", 1.5),
+		envFloat("HEADWAY_BUNCHING_METERS", 300))
+	etaPredictor = NewETAPredictor(gtfsIndex, envFloat("ETA_DEFAULT_SPEED", 5))
+	tripUpdateProducer = NewTripUpdateProducer(gtfsIndex, etaPredictor,
+		envFloat("TRIP_MATCH_DISTANCE_METERS", 200))
+	occupancyTracker = NewOccupancyTracker(gtfsIndex, envInt("OCCUPANCY_HISTORY_DAYS", 28))
+	motionEstimator = NewMotionEstimator(gtfsIndex,
+		envFloat("MOTION_MAX_SPEED", 35),
+		envFloat("MOTION_STOPPED_SPEED", 0.5))
+	webhookDispatcher = NewWebhookDispatcher(gtfsIndex,
+		time.Duration(envInt("WEBHOOK_APPROACH_SECONDS", 120))*time.Second,
+		time.Duration(envInt("WEBHOOK_STALE_SECONDS", 300))*time.Second,
+		envInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		time.Duration(envInt("WEBHOOK_RETRY_SECONDS", 30))*time.Second)
+	webhookDispatcher.AdminToken = envString("WEBHOOK_ADMIN_TOKEN", "")
+	webhookDispatcher.AllowPrivateTargets = envString("WEBHOOK_ALLOW_PRIVATE_TARGETS", "") == "true"
+	if value := envString("PUBLIC_BASE_URL", ""); value != "" {
+		kmlBaseURL, err = parseBaseURL(value)
+		if err != nil {
+			log.Fatalf("Invalid PUBLIC_BASE_URL: %v", err)
+		}
+	}
+	tileServer = NewTileServer(gtfsIndex,
+		envInt("TILE_STOPS_MIN_ZOOM", 13),
+		envInt("TILE_CACHE_SIZE", 4096))
+	snapshotDiffer = NewSnapshotDiffer(gtfsIndex)
+	publishers = configuredPublishers()
+	if dsn := envString("POSTGRES_DSN", ""); dsn != "" {
+		postgresSink, err = OpenPostgresSink(dsn, gtfsIndex, envInt("POSTGRES_BATCH_SIZE", 500))
+		if err != nil {
+			log.Fatalf("Failed to open Postgres sink: %v", err)
+		}
+	}
+	var otpStore OTPStore = newMemoryOTPStore()
+	if dir := envString("STORE_DIR", ""); dir != "" {
+		segmentStore, err = OpenSegmentStore(dir, gtfsIndex.Location, envInt("STORE_RETENTION_DAYS", 30))
+		if err != nil {
+			log.Fatalf("Failed to open segment store: %v", err)
+		}
+		maintainSegmentStore()
+		now := time.Now()
+		positions, err := segmentStore.Positions(now.Add(-trailStore.Window), now, "", "")
+		if err != nil {
+			log.Printf("Failed to load trails: %v", err)
+		}
+		trailStore.Load(positions, now)
+		otpStore = segmentStore
+	}
+	otpEngine = NewOTPEngine(gtfsIndex, otpStore,
+		envInt("OTP_EARLY_SECONDS", 60),
+		envInt("OTP_LATE_SECONDS", 300))
+
+	refreshBusPositions(martaBusPositionsURL)
+	refreshTripUpdates(martaTripUpdatesURL)
+	refreshAlerts(martaAlertsURL)
+	refreshWebhooks()
+	refreshPublishers()
+	refreshStorage()
+
+	if segmentStore != nil {
+		go func() {
+			for range time.Tick(time.Hour) {
+				maintainSegmentStore()
+			}
+		}()
+	}
 
-	currentBusPositions = getBusPositions(martaBusPositionsURL)
-	busCount.Set(float64(len(currentBusPositions)))
-
-	// Start fetching bus positions every 15 seconds
+	// Start fetching bus positions, trip updates and alerts every 15 seconds
 	go func() {
 		for range time.Tick(1 * time.Second * 15) {
-			currentBusPositions = getBusPositions(martaBusPositionsURL)
-			busCount.Set(float64(len(currentBusPositions)))
+			refreshBusPositions(martaBusPositionsURL)
+			refreshTripUpdates(martaTripUpdatesURL)
+			refreshAlerts(martaAlertsURL)
+			refreshWebhooks()
+			refreshPublishers()
+			refreshStorage()
 			log.Println("Updated bus positions!")
 		}
 	}()
 
 	handler := http.NewServeMux()
 	handler.HandleFunc("/shapes", shapesHandler)
+	handler.HandleFunc("/shapes/", shapeDetailHandler)
 	handler.HandleFunc("/routes", routesHandler)
 	handler.HandleFunc("/trip-updates", tripUpdatesHandler)
 	handler.HandleFunc("/bus-positions", busPositionsHandler)
 	handler.HandleFunc("/stops", stopsHandler)
+	handler.HandleFunc("/stops/search", stopSearchHandler)
+	handler.HandleFunc("/stops/nearby", stopsNearbyHandler)
+	handler.HandleFunc("/stations", stationsHandler)
+	handler.HandleFunc("/stations/", stationDetailHandler)
 	handler.HandleFunc("/route-visualization", routeVisualizationHandler)
+	handler.HandleFunc("/tiles/", tilesHandler)
+	handler.HandleFunc("/kml/routes.kml", kmlRoutesHandler)
+	handler.HandleFunc("/kml/stops.kml", kmlStopsHandler)
+	handler.HandleFunc("/kml/vehicles.kml", kmlVehiclesHandler)
+	handler.HandleFunc("/kml/vehicles-link.kml", kmlVehiclesLinkHandler)
+	handler.HandleFunc("/gpx/vehicles/", gpxVehicleHandler)
+	handler.HandleFunc("/siri/vehicle-monitoring.xml", siriVehicleMonitoringHandler)
+	handler.HandleFunc("/siri/vehicle-monitoring.json", siriVehicleMonitoringHandler)
+	handler.HandleFunc("/siri/stop-monitoring.xml", siriStopMonitoringHandler)
+	handler.HandleFunc("/siri/stop-monitoring.json", siriStopMonitoringHandler)
+	handler.HandleFunc("/anomalies", anomaliesHandler)
+	handler.HandleFunc("/anomalies/off-route", offRouteHandler)
+	handler.HandleFunc("/anomalies/bunching", bunchingHandler)
+	handler.HandleFunc("/headways", headwaysHandler)
+	handler.HandleFunc("/otp", otpHandler)
+	handler.HandleFunc("/predictions", predictionsHandler)
+	handler.HandleFunc("/movement", movementHandler)
+	handler.HandleFunc("/geofences", geofencesHandler)
+	handler.HandleFunc("/geofences/", geofenceOccupantsHandler)
+	handler.HandleFunc("/geofences/events", geofenceEventsHandler)
+	handler.HandleFunc("/webhooks", webhooksHandler)
+	handler.HandleFunc("/webhooks/", webhookHandler)
+	handler.HandleFunc("/webhooks/dead-letters", webhookDeadLettersHandler)
+	handler.HandleFunc("/history/vehicles/", historyVehicleHandler)
+	handler.HandleFunc("/history/routes/", historyRouteHandler)
+	handler.HandleFunc("/replay", replayHandler)
+	handler.HandleFunc("/export/positions", exportPositionsHandler)
+	handler.HandleFunc("/export/stop-delays", exportStopDelaysHandler)
+	handler.HandleFunc("/occupancy", occupancyHandler)
+	handler.HandleFunc("/occupancy/profiles", occupancyProfilesHandler)
+	handler.HandleFunc("/occupancy/trips", occupancyTripsHandler)
+	handler.HandleFunc("/gtfs-rt/tripupdates.pb", synthesizedTripUpdatesHandler)
+	handler.HandleFunc("/alerts", alertsHandler)
+	handler.HandleFunc("/vehicles/", vehicleDetailHandler)
+	handler.HandleFunc("/trips/", tripDetailHandler)
 	handler.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
 
 	handler.HandleFunc("/assets/", func(w http.ResponseWriter, r *http.Request) {
@@ -207,17 +403,119 @@ func main() {
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "DELETE", "HEAD", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE", "HEAD", "OPTIONS"},
+		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization"},
 		AllowCredentials: true,
 	})
 
 	log.Println("Starting server on :8080")
-	err := http.ListenAndServe(":8080", c.Handler(handler))
+	err = http.ListenAndServe(":8080", c.Handler(handler))
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
+// refreshBusPositions fetches the latest bus positions and runs them through
+// the detectors that watch every poll.
+func refreshBusPositions(apiURL string) {
+	now := time.Now()
+	buses := getBusPositions(apiURL)
+	gtfsIndex.EnrichBusPositions(buses)
+	motionEstimator.Estimate(buses, now)
+	feed := publishFeed(func(feed *FeedSnapshot) {
+		feed.Buses = buses
+	})
+	busCount.Set(float64(len(buses)))
+
+	offRouteDetector.Observe(buses, now)
+	headwayMonitor.Observe(buses, now)
+	etaPredictor.Observe(buses, now)
+	trailStore.Observe(buses, now)
+	occupancyTracker.Observe(buses, now)
+	anomalyDetector.Observe(buses, feed.TripUpdates, now)
+	geofenceMonitor.Observe(buses, now)
+
+	// Built after the ETA predictor has seen the poll, whose predictions it
+	// uses.
+	synthesized := tripUpdateProducer.Feed(buses, now)
+	publishFeed(func(feed *FeedSnapshot) {
+		feed.SynthesizedTripUpdates = synthesized
+	})
+}
+
+// refreshTripUpdates fetches the latest trip updates and records the delays
+// of the stops they served.
+func refreshTripUpdates(apiURL string) {
+	now := time.Now()
+	tripUpdates := getTripUpdates(apiURL)
+	publishFeed(func(feed *FeedSnapshot) {
+		feed.TripUpdates = tripUpdates
+	})
+
+	err := otpEngine.Observe(tripUpdates, now)
+	if err != nil {
+		log.Printf("Failed to record OTP observations: %v", err)
+	}
+}
+
+// refreshAlerts fetches the latest service alerts, keeping the previous ones
+// when the feed is unavailable.
+func refreshAlerts(apiURL string) {
+	alerts, err := getAlerts(apiURL)
+	if err != nil {
+		log.Printf("Failed to update alerts: %v", err)
+		return
+	}
+	publishFeed(func(feed *FeedSnapshot) {
+		feed.Alerts = alerts
+	})
+}
+
+// refreshWebhooks detects the events of the latest poll and delivers them
+// and the retries due to the registered webhooks.
+func refreshWebhooks() {
+	feed := currentFeed()
+	webhookDispatcher.Observe(feed.Buses, feed.TripUpdates, feed.Alerts, time.Now())
+	webhookDispatcher.Deliver(time.Now())
+}
+
+// refreshPublishers publishes what changed since the previous poll to the
+// configured sinks.
+func refreshPublishers() {
+	if len(publishers) == 0 {
+		return
+	}
+	feed := currentFeed()
+	events := snapshotDiffer.Diff(feed.Buses, feed.TripUpdates, time.Now())
+	publishEvents(publishers, events)
+}
+
+// refreshStorage writes the latest poll to the configured storage backends.
+func refreshStorage() {
+	now := time.Now()
+	feed := currentFeed()
+	if segmentStore != nil {
+		err := segmentStore.Observe(feed.Buses, now)
+		if err != nil {
+			log.Printf("Failed to write to segment store: %v", err)
+		}
+	}
+	if postgresSink != nil {
+		err := postgresSink.Enqueue(feed.Buses, feed.TripUpdates, now)
+		if err != nil {
+			log.Printf("Failed to write to Postgres: %v", err)
+		}
+	}
+}
+
+// maintainSegmentStore compacts finished days and applies retention.
+func maintainSegmentStore() {
+	err := segmentStore.Maintain(time.Now())
+	if err != nil {
+		log.Printf("Failed to maintain segment store: %v", err)
+	}
+}
+
 // getBusPositions fetches bus positions from the MARTA API
 func getBusPositions(apiURL string) []BusPosition {
 	response, err := http.Get(apiURL)
@@ -271,6 +569,26 @@ func getBusPositions(apiURL string) []BusPosition {
 			Longitude: float64(vehiclePosition.Position.GetLongitude()),
 			Label:     vehiclePosition.Vehicle.GetLabel(),
 			Bearing:   float64(vehiclePosition.Position.GetBearing()),
+			TripID:    vehiclePosition.Trip.GetTripId(),
+			RouteID:   vehiclePosition.Trip.GetRouteId(),
+			Timestamp: int64(timeStamp),
+
+			CurrentStopSequence: currentStopSequence,
+			StopID:              stopId,
+		}
+		// Enums default to their first value when absent, leave those empty.
+		if entity.GetVehicle().CurrentStatus != nil {
+			bus.CurrentStatus = currentStatus.String()
+		}
+		if entity.GetVehicle().OccupancyStatus != nil {
+			bus.OccupancyStatus = occupancyStatus.String()
+		}
+		if entity.GetVehicle().CongestionLevel != nil {
+			bus.CongestionLevel = congestionLevel.String()
+		}
+		if position.Speed != nil {
+			bus.SpeedMetersPerSecond = float64(position.GetSpeed())
+			bus.SpeedSource = SpeedFromFeed
 		}
 		busPositions = append(busPositions, bus)
 	}
@@ -309,14 +627,19 @@ func getTripUpdates(apiURL string) []TripUpdate {
 		tripUpdate := entity.GetTripUpdate()
 		stopTimeUpdate := tripUpdate.GetStopTimeUpdate()
 		timestamp := tripUpdate.GetTimestamp()
-		delay := tripUpdate.GetDelay()
+		// A trip delay the feed leaves out stays nil rather than reading
+		// as on time.
+		var delay *int32
+		if tripUpdate != nil && tripUpdate.Delay != nil {
+			delay = proto.Int32(tripUpdate.GetDelay())
+		}
 
 		trip := TripUpdate{
 			Trip:           tripUpdate.GetTrip(),
 			Vehicle:        tripUpdate.GetVehicle(),
 			StopTimeUpdate: stopTimeUpdate,
 			Timestamp:      &timestamp,
-			Delay:          &delay,
+			Delay:          delay,
 		}
 		tripUpdates = append(tripUpdates, trip)
 	}
@@ -489,6 +812,16 @@ func ParseStopsFromReader(file *os.File) ([]Stop, error) {
 			Latitude:  latitude,
 			Longitude: longitude,
 		}
+		// The hierarchy and accessibility columns are optional.
+		if len(record) > 8 {
+			stop.LocationType = record[8]
+		}
+		if len(record) > 9 {
+			stop.ParentStation = record[9]
+		}
+		if len(record) > 11 {
+			stop.WheelchairBoarding = record[11]
+		}
 		stops = append(stops, stop)
 	}
 
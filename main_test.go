@@ -7,6 +7,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestParseShapes(t *testing.T) {
@@ -220,6 +223,14 @@ func TestParseStops(t *testing.T) {
 		t.Errorf("Expected stop description %s, got %s", expectedStopDesc, stops[0].StopDesc)
 	}
 
+	if stops[0].WheelchairBoarding != "1" {
+		t.Errorf("Expected wheelchair boarding 1, got %s", stops[0].WheelchairBoarding)
+	}
+
+	if stops[0].LocationType != "" || stops[0].ParentStation != "" {
+		t.Errorf("Expected no hierarchy, got location type %q and parent %q", stops[0].LocationType, stops[0].ParentStation)
+	}
+
 }
 
 func createTempCSVFileForStopsTesting(filename string) *os.File {
@@ -282,9 +293,52 @@ func TestGetTripUpdates(t *testing.T) {
 		t.Errorf("Expected stop ID %s, got %s", expectedStopID, tripUpdates[0].StopTimeUpdate[0])
 	}
 
+	if tripUpdates[0].Delay != nil {
+		t.Errorf("Expected no trip delay, got %d", *tripUpdates[0].Delay)
+	}
+
 	expectedArrivalDelay := int32(0)
 	if tripUpdates[0].StopTimeUpdate[0].GetArrival().GetDelay() != expectedArrivalDelay {
 		t.Errorf("Expected arrival delay %d, got %d", expectedArrivalDelay, tripUpdates[0].StopTimeUpdate[0].GetArrival().GetDelay())
 	}
 
 }
+
+func TestBuildRouteVisualization(t *testing.T) {
+	index := newTestIndex()
+	index.Routes["r2"] = Route{ID: "r2", ShortName: "2"}
+	index.Trips["t9"] = Trip{RouteID: "r2", ServiceID: "5", TripID: "t9", ShapeID: "s9"}
+	index.Shapes["s9"] = NewShapeLine("s9", []Shape{{ShapeId: "s9", Latitude: 33.8, Longitude: -84.3, Sequence: 1}})
+	index.Stops["Z"] = Stop{StopID: "Z", StopName: "OTHER ROUTE"}
+	index.StopTimes["t9"] = []StopTime{{TripID: "t9", StopID: "Z", StopSequence: 1}}
+
+	buses := []BusPosition{
+		{ID: "2301", TripID: "t1", RouteID: "r1"},
+		{ID: "2302", TripID: "t9", RouteID: "r2"},
+	}
+	tripUpdates := []TripUpdate{
+		{Trip: &pb.TripDescriptor{TripId: proto.String("t1"), RouteId: proto.String("r1")}, Vehicle: &pb.VehicleDescriptor{Id: proto.String("2301")}},
+		{Trip: &pb.TripDescriptor{TripId: proto.String("t9"), RouteId: proto.String("r2")}, Vehicle: &pb.VehicleDescriptor{Id: proto.String("2302")}},
+	}
+
+	routeVis, ok := buildRouteVisualization(index, "r1", buses, tripUpdates)
+	if !ok {
+		t.Fatalf("Expected route r1 to be found")
+	}
+	if len(routeVis.Shapes) != 3 {
+		t.Errorf("Expected the 3 points of shape s1, got %d", len(routeVis.Shapes))
+	}
+	if len(routeVis.Stops) != 3 {
+		t.Errorf("Expected stops A, B and C, got %d", len(routeVis.Stops))
+	}
+	if len(routeVis.Buses) != 1 || routeVis.Buses[0].BusPosition.ID != "2301" || routeVis.Buses[0].TripInfo.GetTripId() != "t1" {
+		t.Errorf("Expected bus 2301 on trip t1, got %+v", routeVis.Buses)
+	}
+	if len(routeVis.TripUpdates) != 1 {
+		t.Errorf("Expected 1 trip update, got %d", len(routeVis.TripUpdates))
+	}
+
+	if _, ok := buildRouteVisualization(index, "missing", buses, tripUpdates); ok {
+		t.Errorf("Expected an unknown route not to be found")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SpeedFromFeed = "feed"
+	SpeedDerived  = "derived"
+
+	MovementMoving   = "moving"
+	MovementStopped  = "stopped"
+	MovementDwelling = "dwelling"
+	MovementUnknown  = "unknown"
+
+	// maxMotionFixes bounds how many recent fixes are kept per vehicle.
+	maxMotionFixes = 10
+	// motionWindow is how far back fixes are averaged into the speed.
+	motionWindow = time.Minute
+	// minHeadingMeters is how far a vehicle must move for its heading to be
+	// updated, so GPS jitter while stopped doesn't spin it around.
+	minHeadingMeters = 15.0
+	// dwellStopMeters is how close to its stop a stopped vehicle must be to
+	// count as dwelling.
+	dwellStopMeters = 50.0
+)
+
+var vehiclesByMovement = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "vehicles_by_movement_state",
+	Help: "Number of vehicles currently moving, stopped, dwelling at a stop or of unknown movement.",
+}, []string{"state"})
+
+func init() {
+	prometheus.MustRegister(vehiclesByMovement)
+}
+
+var motionEstimator *MotionEstimator
+
+// VehicleMotion is the estimated movement of a vehicle. StoppedSince is set
+// while it is stopped or dwelling.
+type VehicleMotion struct {
+	VehicleID            string
+	RouteID              string
+	SpeedMetersPerSecond float64
+	HeadingDegrees       float64
+	Source               string
+	State                string
+	StoppedSince         *time.Time
+	RejectedFixes        int
+	UpdatedAt            time.Time
+}
+
+type motionFix struct {
+	Latitude  float64
+	Longitude float64
+	Time      time.Time
+}
+
+type vehicleMotion struct {
+	fixes        []motionFix
+	pending      *motionFix
+	heading      float64
+	hasHeading   bool
+	stoppedSince time.Time
+	lastSeen     time.Time
+	motion       VehicleMotion
+}
+
+// MotionEstimator derives speed and heading from consecutive positions for
+// feeds that don't report them. A fix implying more than MaxSpeed is treated
+// as a GPS jump and dropped, unless the next fix confirms it. Vehicles slower
+// than StoppedSpeed are stopped.
+type MotionEstimator struct {
+	MaxSpeed     float64
+	StoppedSpeed float64
+
+	index *GTFSIndex
+
+	mu       sync.RWMutex
+	vehicles map[string]*vehicleMotion
+	// polled is when the latest poll was taken. Vehicles not seen then keep
+	// their history for an hour, but aren't reported.
+	polled time.Time
+}
+
+func NewMotionEstimator(index *GTFSIndex, maxSpeed, stoppedSpeed float64) *MotionEstimator {
+	return &MotionEstimator{
+		MaxSpeed:     maxSpeed,
+		StoppedSpeed: stoppedSpeed,
+		index:        index,
+		vehicles:     make(map[string]*vehicleMotion),
+	}
+}
+
+// Estimate records one poll of vehicle positions taken at now and fills in
+// the motion fields of every bus. A speed reported by the feed is kept; the
+// derived heading is preferred over the feed's bearing, which MARTA leaves
+// at zero.
+func (m *MotionEstimator) Estimate(buses []BusPosition, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.polled = now
+	for i := range buses {
+		bus := &buses[i]
+		vehicle := m.vehicles[bus.ID]
+		if vehicle == nil {
+			vehicle = &vehicleMotion{}
+			m.vehicles[bus.ID] = vehicle
+		}
+		vehicle.lastSeen = now
+
+		timestamp := now
+		if bus.Timestamp > 0 {
+			timestamp = time.Unix(bus.Timestamp, 0)
+		}
+		if bus.Latitude != 0 || bus.Longitude != 0 {
+			m.accept(vehicle, motionFix{Latitude: bus.Latitude, Longitude: bus.Longitude, Time: timestamp})
+		}
+
+		motion := VehicleMotion{
+			VehicleID:     bus.ID,
+			RouteID:       bus.RouteID,
+			State:         MovementUnknown,
+			RejectedFixes: vehicle.motion.RejectedFixes,
+			UpdatedAt:     timestamp,
+		}
+		speed, known := derivedSpeed(vehicle.fixes)
+		switch {
+		case bus.SpeedSource == SpeedFromFeed:
+			motion.SpeedMetersPerSecond, motion.Source = bus.SpeedMetersPerSecond, SpeedFromFeed
+		case known:
+			motion.SpeedMetersPerSecond, motion.Source = speed, SpeedDerived
+		}
+		motion.HeadingDegrees = bus.Bearing
+		if vehicle.hasHeading {
+			motion.HeadingDegrees = vehicle.heading
+		}
+
+		if motion.Source != "" {
+			if motion.SpeedMetersPerSecond < m.StoppedSpeed {
+				if vehicle.stoppedSince.IsZero() {
+					vehicle.stoppedSince = arrivedAt(vehicle.fixes, timestamp)
+				}
+				stoppedSince := vehicle.stoppedSince
+				motion.StoppedSince = &stoppedSince
+				motion.State = MovementStopped
+				if m.atStop(*bus) {
+					motion.State = MovementDwelling
+				}
+			} else {
+				vehicle.stoppedSince = time.Time{}
+				motion.State = MovementMoving
+			}
+		}
+		vehicle.motion = motion
+
+		bus.SpeedMetersPerSecond = motion.SpeedMetersPerSecond
+		bus.SpeedSource = motion.Source
+		bus.HeadingDegrees = motion.HeadingDegrees
+		bus.MovementState = motion.State
+	}
+
+	// Forget vehicles that left the feed.
+	for id, vehicle := range m.vehicles {
+		if now.Sub(vehicle.lastSeen) > time.Hour {
+			delete(m.vehicles, id)
+		}
+	}
+
+	m.updateMetrics()
+}
+
+// accept adds a fix to a vehicle's history unless it is a GPS jump. Two
+// consecutive jumps that agree with each other mean the vehicle really is
+// somewhere else, e.g. after a gap in the feed, so the history restarts.
+func (m *MotionEstimator) accept(vehicle *vehicleMotion, fix motionFix) {
+	if n := len(vehicle.fixes); n > 0 {
+		last := vehicle.fixes[n-1]
+		if !fix.Time.After(last.Time) {
+			return
+		}
+		if impliedSpeed(last, fix) > m.MaxSpeed {
+			pending := vehicle.pending
+			if pending == nil || !fix.Time.After(pending.Time) || impliedSpeed(*pending, fix) > m.MaxSpeed {
+				vehicle.pending = &fix
+				vehicle.motion.RejectedFixes++
+				return
+			}
+			vehicle.fixes = []motionFix{*pending}
+			vehicle.hasHeading = false
+			vehicle.stoppedSince = time.Time{}
+		}
+	}
+	vehicle.pending = nil
+	vehicle.fixes = append(vehicle.fixes, fix)
+
+	// Keep the fixes within the window, but always the last two.
+	first := 0
+	cutoff := fix.Time.Add(-motionWindow)
+	for first < len(vehicle.fixes)-2 && (vehicle.fixes[first].Time.Before(cutoff) || len(vehicle.fixes)-first > maxMotionFixes) {
+		first++
+	}
+	vehicle.fixes = vehicle.fixes[first:]
+
+	// The heading comes from the latest fix far enough back to be reliable.
+	for i := len(vehicle.fixes) - 2; i >= 0; i-- {
+		from := vehicle.fixes[i]
+		if haversineMeters(from.Latitude, from.Longitude, fix.Latitude, fix.Longitude) >= minHeadingMeters {
+			vehicle.heading = bearingDegrees(from.Latitude, from.Longitude, fix.Latitude, fix.Longitude)
+			vehicle.hasHeading = true
+			break
+		}
+	}
+}
+
+// atStop reports whether a bus is at the stop it reports.
+func (m *MotionEstimator) atStop(bus BusPosition) bool {
+	if bus.CurrentStatus == pb.VehiclePosition_STOPPED_AT.String() {
+		return true
+	}
+	stop, ok := m.index.Stops[bus.StopID]
+	if !ok {
+		return false
+	}
+	return haversineMeters(stop.Latitude, stop.Longitude, bus.Latitude, bus.Longitude) <= dwellStopMeters
+}
+
+// updateMetrics publishes the number of vehicles of the latest poll in every
+// movement state. m.mu must be held.
+func (m *MotionEstimator) updateMetrics() {
+	counts := map[string]int{MovementMoving: 0, MovementStopped: 0, MovementDwelling: 0, MovementUnknown: 0}
+	for _, vehicle := range m.vehicles {
+		if vehicle.lastSeen.Equal(m.polled) {
+			counts[vehicle.motion.State]++
+		}
+	}
+	for state, count := range counts {
+		vehiclesByMovement.WithLabelValues(state).Set(float64(count))
+	}
+}
+
+// Motions returns the estimated movement of every vehicle in the latest poll,
+// ordered by ID.
+func (m *MotionEstimator) Motions() []VehicleMotion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	motions := make([]VehicleMotion, 0, len(m.vehicles))
+	for _, vehicle := range m.vehicles {
+		if vehicle.lastSeen.Equal(m.polled) {
+			motions = append(motions, vehicle.motion)
+		}
+	}
+	sort.Slice(motions, func(i, j int) bool {
+		return motions[i].VehicleID < motions[j].VehicleID
+	})
+	return motions
+}
+
+// arrivedAt returns the time of the earliest recent fix at the same place as
+// the latest one, which is when a vehicle that just stopped got there.
+func arrivedAt(fixes []motionFix, fallback time.Time) time.Time {
+	if len(fixes) == 0 {
+		return fallback
+	}
+	last := fixes[len(fixes)-1]
+	arrived := last.Time
+	for i := len(fixes) - 2; i >= 0; i-- {
+		if haversineMeters(fixes[i].Latitude, fixes[i].Longitude, last.Latitude, last.Longitude) >= minHeadingMeters {
+			break
+		}
+		arrived = fixes[i].Time
+	}
+	return arrived
+}
+
+// impliedSpeed is the speed needed to travel between two fixes.
+func impliedSpeed(from, to motionFix) float64 {
+	seconds := to.Time.Sub(from.Time).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return haversineMeters(from.Latitude, from.Longitude, to.Latitude, to.Longitude) / seconds
+}
+
+// derivedSpeed averages the speed over the path through the given fixes.
+func derivedSpeed(fixes []motionFix) (float64, bool) {
+	if len(fixes) < 2 {
+		return 0, false
+	}
+	distance := 0.0
+	for i := 1; i < len(fixes); i++ {
+		distance += haversineMeters(fixes[i-1].Latitude, fixes[i-1].Longitude, fixes[i].Latitude, fixes[i].Longitude)
+	}
+	seconds := fixes[len(fixes)-1].Time.Sub(fixes[0].Time).Seconds()
+	if seconds <= 0 {
+		return 0, false
+	}
+	return distance / seconds, true
+}
+
+// movementHandler serves the movement of every vehicle, filtered by state,
+// route_id and min_stopped_seconds.
+func movementHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	minStopped := 0.0
+	if value := query.Get("min_stopped_seconds"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid min_stopped_seconds", http.StatusBadRequest)
+			return
+		}
+		minStopped = parsed
+	}
+
+	now := time.Now()
+	motions := make([]VehicleMotion, 0)
+	for _, motion := range motionEstimator.Motions() {
+		if query.Get("state") != "" && motion.State != query.Get("state") {
+			continue
+		}
+		if query.Get("route_id") != "" && motion.RouteID != query.Get("route_id") {
+			continue
+		}
+		if minStopped > 0 && (motion.StoppedSince == nil || now.Sub(*motion.StoppedSince).Seconds() < minStopped) {
+			continue
+		}
+		motions = append(motions, motion)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(motions)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
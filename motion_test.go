@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMotionEstimator(t *testing.T) {
+	estimator := NewMotionEstimator(newTestIndex(), 35, 0.5)
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	// Meters east of stop A along latitude 33.75.
+	metersPerDegree := 111195 * math.Cos(33.75*math.Pi/180)
+
+	poll := func(seconds int, lat, eastMeters float64) BusPosition {
+		now := start.Add(time.Duration(seconds) * time.Second)
+		buses := []BusPosition{{ID: "2301", RouteID: "r1", StopID: "B", Latitude: lat, Longitude: -84.40 + eastMeters/metersPerDegree, Timestamp: now.Unix()}}
+		estimator.Estimate(buses, now)
+		return buses[0]
+	}
+
+	bus := poll(0, 33.75, 0)
+	if bus.MovementState != MovementUnknown || bus.SpeedSource != "" {
+		t.Errorf("Expected unknown movement from one fix, got %s", bus.MovementState)
+	}
+
+	bus = poll(30, 33.75, 300)
+	if bus.MovementState != MovementMoving || bus.SpeedSource != SpeedDerived {
+		t.Errorf("Expected derived moving, got %s from %s", bus.MovementState, bus.SpeedSource)
+	}
+	if math.Abs(bus.SpeedMetersPerSecond-10) > 0.1 {
+		t.Errorf("Expected 10 m/s, got %f", bus.SpeedMetersPerSecond)
+	}
+	if math.Abs(bus.HeadingDegrees-90) > 1 {
+		t.Errorf("Expected heading east, got %f", bus.HeadingDegrees)
+	}
+
+	// A 5km GPS jump is rejected.
+	bus = poll(60, 33.80, 600)
+	if math.Abs(bus.SpeedMetersPerSecond-10) > 0.1 || math.Abs(bus.HeadingDegrees-90) > 1 {
+		t.Errorf("Expected the jump to be ignored, got %f m/s heading %f", bus.SpeedMetersPerSecond, bus.HeadingDegrees)
+	}
+
+	// Back on track, then held 25m short of stop B.
+	poll(90, 33.75, 900)
+	poll(120, 33.75, 900)
+	bus = poll(150, 33.75, 900)
+	if bus.MovementState != MovementDwelling || bus.SpeedMetersPerSecond != 0 {
+		t.Errorf("Expected dwelling at B, got %s at %f m/s", bus.MovementState, bus.SpeedMetersPerSecond)
+	}
+	if math.Abs(bus.HeadingDegrees-90) > 1 {
+		t.Errorf("Expected the heading kept while stopped, got %f", bus.HeadingDegrees)
+	}
+
+	motions := estimator.Motions()
+	if len(motions) != 1 || motions[0].RejectedFixes != 1 {
+		t.Fatalf("Expected one vehicle with one rejected fix, got %+v", motions)
+	}
+	if motions[0].StoppedSince == nil || !motions[0].StoppedSince.Equal(start.Add(90*time.Second)) {
+		t.Errorf("Expected stopped since 08:01:30, got %v", motions[0].StoppedSince)
+	}
+
+	// Two agreeing fixes far away mean the vehicle really moved.
+	poll(180, 33.80, 900)
+	bus = poll(210, 33.80, 1200)
+	if bus.MovementState != MovementMoving || math.Abs(bus.SpeedMetersPerSecond-10) > 0.1 {
+		t.Errorf("Expected the history to restart at the new location, got %s at %f m/s", bus.MovementState, bus.SpeedMetersPerSecond)
+	}
+
+	// A vehicle that left the feed is no longer reported.
+	estimator.Estimate([]BusPosition{}, start.Add(240*time.Second))
+	if motions := estimator.Motions(); len(motions) != 0 {
+		t.Errorf("Expected no vehicles once 2301 left the feed, got %+v", motions)
+	}
+}
+
+func TestMotionEstimatorKeepsFeedSpeed(t *testing.T) {
+	estimator := NewMotionEstimator(newTestIndex(), 35, 0.5)
+	now := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	buses := []BusPosition{{ID: "2301", Latitude: 33.75, Longitude: -84.40, Bearing: 180, SpeedMetersPerSecond: 7, SpeedSource: SpeedFromFeed}}
+	estimator.Estimate(buses, now)
+	if buses[0].SpeedMetersPerSecond != 7 || buses[0].MovementState != MovementMoving || buses[0].HeadingDegrees != 180 {
+		t.Errorf("Expected the feed's speed and bearing, got %+v", buses[0])
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+
+	mqttDialTimeout  = 10 * time.Second
+	mqttWriteTimeout = 10 * time.Second
+	// mqttQueueSize bounds the polls' worth of events waiting for the
+	// broker.
+	mqttQueueSize = 16
+	// maxMQTTPacket bounds the packets read from the broker, which only
+	// sends small acknowledgements to a publisher.
+	maxMQTTPacket = 1 << 20
+)
+
+// MQTTPublisher publishes feed events at QoS 0 to topics named
+// {TopicPrefix}/{route}/{vehicle}, with "/trip_update" appended for trip
+// update events. Publish only queues the events: a goroutine connects
+// lazily, sends them and reconnects with the next events after losing the
+// broker, so a slow broker never holds up the poll.
+type MQTTPublisher struct {
+	Address     string
+	ClientID    string
+	Username    string
+	Password    string
+	TopicPrefix string
+	KeepAlive   time.Duration
+
+	queue     chan []FeedEvent
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	// Owned by the run goroutine.
+	conn      net.Conn
+	closed    chan struct{}
+	pongs     chan struct{}
+	lastWrite time.Time
+	pingSent  time.Time
+}
+
+func NewMQTTPublisher(address, clientID, username, password, topicPrefix string, keepAlive time.Duration) *MQTTPublisher {
+	p := &MQTTPublisher{
+		Address:     address,
+		ClientID:    clientID,
+		Username:    username,
+		Password:    password,
+		TopicPrefix: topicPrefix,
+		KeepAlive:   keepAlive,
+		queue:       make(chan []FeedEvent, mqttQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *MQTTPublisher) Name() string {
+	return "mqtt"
+}
+
+// Publish queues the events for sending, dropping them when the queue is
+// full because the broker can't keep up.
+func (p *MQTTPublisher) Publish(events []FeedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	select {
+	case p.queue <- events:
+		return nil
+	default:
+		return fmt.Errorf("MQTT queue is full, dropped %d events", len(events))
+	}
+}
+
+// Close sends what is still queued and disconnects from the broker.
+func (p *MQTTPublisher) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	<-p.stopped
+	return p.closeErr
+}
+
+// run sends the queued events and keeps the connection alive until the
+// publisher is closed.
+func (p *MQTTPublisher) run() {
+	defer close(p.stopped)
+
+	var tick <-chan time.Time
+	if p.KeepAlive > 0 {
+		ticker := time.NewTicker(p.KeepAlive / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case events := <-p.queue:
+			p.send(events)
+		case <-tick:
+			p.keepAlive()
+		case <-p.closed:
+			p.disconnect()
+		case <-p.pongs:
+			p.pingSent = time.Time{}
+		case <-p.done:
+			p.drain()
+			if p.conn != nil {
+				p.closeErr = p.write([]byte{mqttDisconnect << 4, 0})
+				p.disconnect()
+			}
+			return
+		}
+	}
+}
+
+// drain sends what is left in the queue.
+func (p *MQTTPublisher) drain() {
+	for {
+		select {
+		case events := <-p.queue:
+			p.send(events)
+		default:
+			return
+		}
+	}
+}
+
+// send publishes events, connecting first when needed.
+func (p *MQTTPublisher) send(events []FeedEvent) {
+	err := p.publish(events)
+	if err != nil {
+		publishErrorsTotal.WithLabelValues(p.Name()).Inc()
+		log.Printf("Failed to publish to %s: %v", p.Name(), err)
+	}
+}
+
+func (p *MQTTPublisher) publish(events []FeedEvent) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		if err := p.write(encodeMQTTPublish(p.topic(event), payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepAlive pings the broker when the connection has been idle for half the
+// keep alive, and drops the connection when the broker didn't answer the
+// previous ping within the keep alive.
+func (p *MQTTPublisher) keepAlive() {
+	if p.conn == nil {
+		return
+	}
+	if !p.pingSent.IsZero() {
+		if time.Since(p.pingSent) >= p.KeepAlive {
+			log.Printf("MQTT broker didn't answer a ping within %s, disconnecting", p.KeepAlive)
+			p.disconnect()
+		}
+		return
+	}
+	if time.Since(p.lastWrite) >= p.KeepAlive/2 {
+		if err := p.write([]byte{mqttPingreq << 4, 0}); err != nil {
+			log.Printf("Failed to ping MQTT broker: %v", err)
+			return
+		}
+		p.pingSent = time.Now()
+	}
+}
+
+// topic returns the topic of an event. Characters MQTT reserves in topic
+// levels are replaced.
+func (p *MQTTPublisher) topic(event FeedEvent) string {
+	route, vehicle := event.RouteID, event.VehicleID
+	if route == "" {
+		route = "unassigned"
+	}
+	if vehicle == "" {
+		vehicle = "unassigned"
+	}
+	topic := p.TopicPrefix + "/" + mqttTopicLevel(route) + "/" + mqttTopicLevel(vehicle)
+	if event.TripUpdate != nil {
+		topic += "/trip_update"
+	}
+	return topic
+}
+
+func mqttTopicLevel(level string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(level)
+}
+
+// connect opens the connection and waits for the broker to accept it.
+func (p *MQTTPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.Address, mqttDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	keepAlive := uint16(p.KeepAlive / time.Second)
+	_ = conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err := conn.Write(encodeMQTTConnect(p.ClientID, p.Username, p.Password, keepAlive)); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to send MQTT connect: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	packetType, body, err := readMQTTPacket(reader)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to read MQTT connack: %w", err)
+	}
+	if packetType != mqttConnack || len(body) != 2 {
+		_ = conn.Close()
+		return fmt.Errorf("unexpected MQTT packet type %d", packetType)
+	}
+	if body[1] != 0 {
+		_ = conn.Close()
+		return fmt.Errorf("MQTT broker refused connection with code %d", body[1])
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	p.conn = conn
+	p.closed = make(chan struct{})
+	p.pongs = make(chan struct{}, 1)
+	p.lastWrite = time.Now()
+	p.pingSent = time.Time{}
+
+	// Read what the broker sends, i.e. ping responses, until it hangs up.
+	go func(closed, pongs chan struct{}) {
+		defer close(closed)
+		for {
+			packetType, _, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			if packetType == mqttPingresp {
+				select {
+				case pongs <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}(p.closed, p.pongs)
+	return nil
+}
+
+// write sends a packet, dropping the connection when it fails.
+func (p *MQTTPublisher) write(packet []byte) error {
+	_ = p.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	if _, err := p.conn.Write(packet); err != nil {
+		p.disconnect()
+		return fmt.Errorf("failed to write to MQTT broker: %w", err)
+	}
+	p.lastWrite = time.Now()
+	return nil
+}
+
+// disconnect closes the connection. The reader goroutine's channels are
+// dropped with it so a late hang up isn't taken for the next connection's.
+func (p *MQTTPublisher) disconnect() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+	p.closed = nil
+	p.pongs = nil
+	p.pingSent = time.Time{}
+}
+
+// encodeMQTTConnect builds a CONNECT packet for a clean session.
+func encodeMQTTConnect(clientID, username, password string, keepAlive uint16) []byte {
+	var flags byte = 0x02
+	payload := appendMQTTString(nil, clientID)
+	if username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, username)
+		if password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, password)
+		}
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+	body = append(body, payload...)
+	return encodeMQTTPacket(mqttConnect<<4, body)
+}
+
+// encodeMQTTPublish builds a QoS 0 PUBLISH packet.
+func encodeMQTTPublish(topic string, payload []byte) []byte {
+	body := appendMQTTString(nil, topic)
+	body = append(body, payload...)
+	return encodeMQTTPacket(mqttPublish<<4, body)
+}
+
+// encodeMQTTPacket prefixes a packet body with its fixed header.
+func encodeMQTTPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads one control packet, returning its type and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxMQTTPacket {
+		return 0, nil, fmt.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+type mqttMessage struct {
+	Type    byte
+	Topic   string
+	Payload []byte
+}
+
+// startTestBroker accepts one MQTT client, acknowledges its connection and,
+// when answerPings is set, its pings, and reports the client ID and every
+// packet it sends. messages is closed when the client hangs up.
+func startTestBroker(t *testing.T, answerPings bool) (string, chan string, chan mqttMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	clientIDs := make(chan string, 1)
+	messages := make(chan mqttMessage, 10)
+	go func() {
+		defer close(messages)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		packetType, body, err := readMQTTPacket(reader)
+		if err != nil || packetType != mqttConnect {
+			t.Errorf("Expected a connect packet, got %d: %v", packetType, err)
+			return
+		}
+		// Protocol name, level, flags and keep alive come before the client ID.
+		idLength := int(binary.BigEndian.Uint16(body[10:12]))
+		clientIDs <- string(body[12 : 12+idLength])
+		_, _ = conn.Write([]byte{mqttConnack << 4, 2, 0, 0})
+
+		for {
+			packetType, body, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			message := mqttMessage{Type: packetType}
+			switch packetType {
+			case mqttPublish:
+				topicLength := int(binary.BigEndian.Uint16(body[:2]))
+				message.Topic = string(body[2 : 2+topicLength])
+				message.Payload = body[2+topicLength:]
+			case mqttPingreq:
+				if !answerPings {
+					break
+				}
+				_, _ = conn.Write([]byte{mqttPingresp << 4, 0})
+			}
+			messages <- message
+		}
+	}()
+	return listener.Addr().String(), clientIDs, messages
+}
+
+func receiveMQTT(t *testing.T, messages chan mqttMessage) mqttMessage {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an MQTT packet")
+		return mqttMessage{}
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	address, clientIDs, messages := startTestBroker(t, true)
+	publisher := NewMQTTPublisher(address, "signage-test", "", "", "marta", 0)
+
+	bus := BusPosition{ID: "2301", RouteID: "r1", Latitude: 33.75, Longitude: -84.40}
+	err := publisher.Publish([]FeedEvent{
+		{Type: FeedVehicleMoved, VehicleID: "2301", RouteID: "r1", Vehicle: &bus},
+		{Type: FeedTripUpdateChanged, VehicleID: "2301", RouteID: "r1", TripID: "t1", TripUpdate: &TripUpdate{}},
+		{Type: FeedVehicleAdded, VehicleID: "2399"},
+	})
+	if err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+	if clientID := <-clientIDs; clientID != "signage-test" {
+		t.Errorf("Expected client ID signage-test, got %s", clientID)
+	}
+
+	message := receiveMQTT(t, messages)
+	if message.Type != mqttPublish || message.Topic != "marta/r1/2301" {
+		t.Fatalf("Expected a publish to marta/r1/2301, got %d to %s", message.Type, message.Topic)
+	}
+	var event FeedEvent
+	if err := json.Unmarshal(message.Payload, &event); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if event.Type != FeedVehicleMoved || event.Vehicle == nil || event.Vehicle.Latitude != 33.75 {
+		t.Errorf("Expected 2301 moved, got %+v", event)
+	}
+	if message := receiveMQTT(t, messages); message.Topic != "marta/r1/2301/trip_update" {
+		t.Errorf("Expected the trip update topic, got %s", message.Topic)
+	}
+	if message := receiveMQTT(t, messages); message.Topic != "marta/unassigned/2399" {
+		t.Errorf("Expected the unassigned topic, got %s", message.Topic)
+	}
+
+	if err := publisher.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if message := receiveMQTT(t, messages); message.Type != mqttDisconnect {
+		t.Errorf("Expected a disconnect, got packet type %d", message.Type)
+	}
+}
+
+func TestMQTTKeepAlive(t *testing.T) {
+	address, _, messages := startTestBroker(t, true)
+	publisher := NewMQTTPublisher(address, "signage-test", "", "", "marta", 100*time.Millisecond)
+	defer publisher.Close()
+
+	if err := publisher.Publish([]FeedEvent{{Type: FeedVehicleAdded, VehicleID: "2301"}}); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+	if message := receiveMQTT(t, messages); message.Type != mqttPublish {
+		t.Fatalf("Expected a publish, got packet type %d", message.Type)
+	}
+
+	// An idle connection is kept alive with pings as long as they're
+	// answered.
+	for i := 0; i < 3; i++ {
+		if message := receiveMQTT(t, messages); message.Type != mqttPingreq {
+			t.Fatalf("Expected a ping, got packet type %d", message.Type)
+		}
+	}
+}
+
+func TestMQTTPingTimeout(t *testing.T) {
+	address, _, messages := startTestBroker(t, false)
+	publisher := NewMQTTPublisher(address, "signage-test", "", "", "marta", 100*time.Millisecond)
+	defer publisher.Close()
+
+	if err := publisher.Publish([]FeedEvent{{Type: FeedVehicleAdded, VehicleID: "2301"}}); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+	if message := receiveMQTT(t, messages); message.Type != mqttPublish {
+		t.Fatalf("Expected a publish, got packet type %d", message.Type)
+	}
+	if message := receiveMQTT(t, messages); message.Type != mqttPingreq {
+		t.Fatalf("Expected a ping, got packet type %d", message.Type)
+	}
+
+	// The unanswered ping drops the connection.
+	select {
+	case message, ok := <-messages:
+		if ok {
+			t.Errorf("Expected the connection to be closed, got packet type %d", message.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the connection to be closed after an unanswered ping")
+	}
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 300000} {
+		packet := encodeMQTTPacket(mqttPublish<<4, make([]byte, length))
+		packetType, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || packetType != mqttPublish || len(body) != length {
+			t.Errorf("Expected a %d byte body, got %d: %v", length, len(body), err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Mapbox Vector Tile 2.1 geometry types and commands.
+const (
+	mvtPoint      = 1
+	mvtLineString = 2
+
+	mvtMoveTo = 1
+	mvtLineTo = 2
+
+	// mvtExtent is the size of a tile in tile units.
+	mvtExtent = 4096
+)
+
+// mvtLayer collects the features of one tile layer, sharing property keys
+// and values between them as the format requires.
+type mvtLayer struct {
+	name       string
+	keys       []string
+	keyIndex   map[string]uint32
+	values     []interface{}
+	valueIndex map[interface{}]uint32
+	features   [][]byte
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{
+		name:       name,
+		keyIndex:   make(map[string]uint32),
+		valueIndex: make(map[interface{}]uint32),
+	}
+}
+
+// addPoint adds a point feature at tile coordinates.
+func (l *mvtLayer) addPoint(point planarPoint, properties map[string]interface{}) {
+	x, y := int64(math.Round(point.X)), int64(math.Round(point.Y))
+	geometry := []uint64{mvtCommand(mvtMoveTo, 1), protowire.EncodeZigZag(x), protowire.EncodeZigZag(y)}
+	l.addFeature(mvtPoint, geometry, properties)
+}
+
+// addLines adds a line feature of one or more parts at tile coordinates.
+// Points that round to the same tile unit are merged and parts left with a
+// single point are dropped.
+func (l *mvtLayer) addLines(parts [][]planarPoint, properties map[string]interface{}) {
+	geometry := make([]uint64, 0)
+	var cursorX, cursorY int64
+	for _, part := range parts {
+		rounded := make([][2]int64, 0, len(part))
+		for _, point := range part {
+			x, y := int64(math.Round(point.X)), int64(math.Round(point.Y))
+			if n := len(rounded); n > 0 && rounded[n-1] == [2]int64{x, y} {
+				continue
+			}
+			rounded = append(rounded, [2]int64{x, y})
+		}
+		if len(rounded) < 2 {
+			continue
+		}
+
+		for i, point := range rounded {
+			switch i {
+			case 0:
+				geometry = append(geometry, mvtCommand(mvtMoveTo, 1))
+			case 1:
+				geometry = append(geometry, mvtCommand(mvtLineTo, len(rounded)-1))
+			}
+			geometry = append(geometry, protowire.EncodeZigZag(point[0]-cursorX), protowire.EncodeZigZag(point[1]-cursorY))
+			cursorX, cursorY = point[0], point[1]
+		}
+	}
+	if len(geometry) > 0 {
+		l.addFeature(mvtLineString, geometry, properties)
+	}
+}
+
+// addFeature encodes a feature. Properties are tagged in key order, so equal
+// input gives equal tiles.
+func (l *mvtLayer) addFeature(geometryType uint64, geometry []uint64, properties map[string]interface{}) {
+	keys := make([]string, 0, len(properties))
+	for key, value := range properties {
+		if value != nil && value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	tags := make([]byte, 0)
+	for _, key := range keys {
+		keyID, ok := l.keyIndex[key]
+		if !ok {
+			keyID = uint32(len(l.keys))
+			l.keyIndex[key] = keyID
+			l.keys = append(l.keys, key)
+		}
+		value := properties[key]
+		valueID, ok := l.valueIndex[value]
+		if !ok {
+			valueID = uint32(len(l.values))
+			l.valueIndex[value] = valueID
+			l.values = append(l.values, value)
+		}
+		tags = protowire.AppendVarint(tags, uint64(keyID))
+		tags = protowire.AppendVarint(tags, uint64(valueID))
+	}
+
+	packed := make([]byte, 0, len(geometry))
+	for _, value := range geometry {
+		packed = protowire.AppendVarint(packed, value)
+	}
+
+	feature := make([]byte, 0)
+	feature = protowire.AppendTag(feature, 2, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, tags)
+	feature = protowire.AppendTag(feature, 3, protowire.VarintType)
+	feature = protowire.AppendVarint(feature, geometryType)
+	feature = protowire.AppendTag(feature, 4, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, packed)
+	l.features = append(l.features, feature)
+}
+
+// encode returns the layer as a Tile message holding only it. Tiles are
+// repeated layers, so encoded layers concatenate into a tile. A layer without
+// features encodes to nothing.
+func (l *mvtLayer) encode() []byte {
+	if len(l.features) == 0 {
+		return nil
+	}
+
+	layer := make([]byte, 0)
+	layer = protowire.AppendTag(layer, 15, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, 2)
+	layer = protowire.AppendTag(layer, 1, protowire.BytesType)
+	layer = protowire.AppendString(layer, l.name)
+	for _, feature := range l.features {
+		layer = protowire.AppendTag(layer, 2, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, feature)
+	}
+	for _, key := range l.keys {
+		layer = protowire.AppendTag(layer, 3, protowire.BytesType)
+		layer = protowire.AppendString(layer, key)
+	}
+	for _, value := range l.values {
+		layer = protowire.AppendTag(layer, 4, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, encodeMVTValue(value))
+	}
+	layer = protowire.AppendTag(layer, 5, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, mvtExtent)
+
+	tile := protowire.AppendTag(nil, 3, protowire.BytesType)
+	return protowire.AppendBytes(tile, layer)
+}
+
+// encodeMVTValue encodes a property value: strings, float64, int and bool
+// are supported; anything else is encoded as an empty string.
+func encodeMVTValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case float64:
+		b := protowire.AppendTag(nil, 3, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(v))
+	case int:
+		b := protowire.AppendTag(nil, 6, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeZigZag(int64(v)))
+	case bool:
+		b := protowire.AppendTag(nil, 7, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b := protowire.AppendTag(nil, 1, protowire.BytesType)
+		return protowire.AppendString(b, v)
+	default:
+		b := protowire.AppendTag(nil, 1, protowire.BytesType)
+		return protowire.AppendString(b, "")
+	}
+}
+
+func mvtCommand(id, count int) uint64 {
+	return uint64(id&0x7) | uint64(count)<<3
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// occupancyLevels is the number of OccupancyStatus values, from EMPTY (0) to
+// NOT_ACCEPTING_PASSENGERS (6).
+const occupancyLevels = 7
+
+// fullLevel is the lowest occupancy level counted as full.
+var fullLevel = int(pb.VehiclePosition_CRUSHED_STANDING_ROOM_ONLY)
+
+var (
+	routeOccupancyVehicles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_occupancy_vehicles",
+		Help: "Number of vehicles currently reporting each occupancy status, by route.",
+	}, []string{"route_id", "status"})
+
+	routeOccupancyLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_occupancy_level",
+		Help: "Mean current occupancy level of the vehicles of a route, from 0 (empty) to 6 (not accepting passengers).",
+	}, []string{"route_id"})
+)
+
+func init() {
+	prometheus.MustRegister(routeOccupancyVehicles)
+	prometheus.MustRegister(routeOccupancyLevel)
+}
+
+var occupancyTracker *OccupancyTracker
+
+// VehicleOccupancy is the latest occupancy a vehicle reported.
+type VehicleOccupancy struct {
+	VehicleID string
+	RouteID   string
+	TripID    string
+	Status    string
+	Level     int
+	Timestamp time.Time
+}
+
+// RouteOccupancy summarizes the current occupancy of a route's vehicles.
+type RouteOccupancy struct {
+	RouteID      string
+	Vehicles     int
+	AverageLevel float64
+	Counts       map[string]int
+}
+
+// OccupancyProfile is the historical crowding of a route in one hour of the
+// day, in the agency timezone.
+type OccupancyProfile struct {
+	RouteID      string
+	Hour         int
+	Observations int
+	AverageLevel float64
+	FullPercent  float64
+	Counts       map[string]int
+}
+
+// TripCrowding is the historical crowding of a scheduled trip. FullDays
+// counts the service days on which the trip was reported full at least once.
+type TripCrowding struct {
+	TripID       string
+	RouteID      string
+	Headsign     string
+	Observations int
+	AverageLevel float64
+	FullPercent  float64
+	MaxLevel     int
+	Days         int
+	FullDays     int
+}
+
+type occupancyStats struct {
+	Observations int
+	LevelSum     int
+	Full         int
+	MaxLevel     int
+	Counts       [occupancyLevels]int
+}
+
+func (s *occupancyStats) add(level int) {
+	s.Observations++
+	s.LevelSum += level
+	s.Counts[level]++
+	if level >= fullLevel {
+		s.Full++
+	}
+	if level > s.MaxLevel {
+		s.MaxLevel = level
+	}
+}
+
+func (s *occupancyStats) merge(other *occupancyStats) {
+	s.Observations += other.Observations
+	s.LevelSum += other.LevelSum
+	s.Full += other.Full
+	if other.MaxLevel > s.MaxLevel {
+		s.MaxLevel = other.MaxLevel
+	}
+	for level, count := range other.Counts {
+		s.Counts[level] += count
+	}
+}
+
+func (s *occupancyStats) averageLevel() float64 {
+	if s.Observations == 0 {
+		return 0
+	}
+	return float64(s.LevelSum) / float64(s.Observations)
+}
+
+func (s *occupancyStats) fullPercent() float64 {
+	if s.Observations == 0 {
+		return 0
+	}
+	return 100 * float64(s.Full) / float64(s.Observations)
+}
+
+func (s *occupancyStats) counts() map[string]int {
+	counts := make(map[string]int)
+	for level, count := range s.Counts {
+		if count > 0 {
+			counts[pb.VehiclePosition_OccupancyStatus(level).String()] = count
+		}
+	}
+	return counts
+}
+
+// tripOccupancy keeps the reports of a trip per service day, formatted as
+// YYYYMMDD.
+type tripOccupancy struct {
+	RouteID string
+	Days    map[string]*occupancyStats
+}
+
+type profileKey struct {
+	RouteID string
+	Hour    int
+}
+
+// OccupancyTracker keeps the current occupancy of every vehicle and rolls the
+// reports up into crowding profiles per route and hour and per trip. Trip
+// crowding covers the last HistoryDays service days.
+type OccupancyTracker struct {
+	index       *GTFSIndex
+	HistoryDays int
+
+	mu       sync.RWMutex
+	current  map[string]VehicleOccupancy
+	lastSeen map[string]time.Time
+	profiles map[profileKey]*occupancyStats
+	trips    map[string]*tripOccupancy
+	// prunedDay is the service day the trip history was last pruned on.
+	prunedDay string
+}
+
+func NewOccupancyTracker(index *GTFSIndex, historyDays int) *OccupancyTracker {
+	return &OccupancyTracker{
+		index:       index,
+		HistoryDays: historyDays,
+		current:     make(map[string]VehicleOccupancy),
+		lastSeen:    make(map[string]time.Time),
+		profiles:    make(map[profileKey]*occupancyStats),
+		trips:       make(map[string]*tripOccupancy),
+	}
+}
+
+// Observe records one poll of vehicle positions taken at now. Each report is
+// counted once, so a vehicle that hasn't sent a new position since the last
+// poll doesn't weigh more in the profiles.
+func (t *OccupancyTracker) Observe(buses []BusPosition, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current = make(map[string]VehicleOccupancy)
+	for _, bus := range buses {
+		level, ok := pb.VehiclePosition_OccupancyStatus_value[bus.OccupancyStatus]
+		if !ok {
+			continue
+		}
+		timestamp := now
+		if bus.Timestamp > 0 {
+			timestamp = time.Unix(bus.Timestamp, 0)
+		}
+		t.current[bus.ID] = VehicleOccupancy{
+			VehicleID: bus.ID,
+			RouteID:   bus.RouteID,
+			TripID:    bus.TripID,
+			Status:    bus.OccupancyStatus,
+			Level:     int(level),
+			Timestamp: timestamp,
+		}
+
+		if bus.Timestamp > 0 && !timestamp.After(t.lastSeen[bus.ID]) {
+			continue
+		}
+		t.lastSeen[bus.ID] = timestamp
+
+		if bus.RouteID != "" {
+			key := profileKey{RouteID: bus.RouteID, Hour: timestamp.In(t.index.Location).Hour()}
+			if t.profiles[key] == nil {
+				t.profiles[key] = &occupancyStats{}
+			}
+			t.profiles[key].add(int(level))
+		}
+
+		if bus.TripID != "" {
+			trip := t.trips[bus.TripID]
+			if trip == nil {
+				trip = &tripOccupancy{RouteID: bus.RouteID, Days: make(map[string]*occupancyStats)}
+				t.trips[bus.TripID] = trip
+			}
+			day := t.index.ServiceDate(timestamp).Format("20060102")
+			if trip.Days[day] == nil {
+				trip.Days[day] = &occupancyStats{}
+			}
+			trip.Days[day].add(int(level))
+		}
+	}
+	t.pruneTrips(now)
+
+	// Forget vehicles that left the feed.
+	for id := range t.lastSeen {
+		if _, ok := t.current[id]; !ok && now.Sub(t.lastSeen[id]) > time.Hour {
+			delete(t.lastSeen, id)
+		}
+	}
+
+	t.updateMetrics()
+}
+
+// pruneTrips drops the trip reports of service days that fell out of the
+// last HistoryDays, and the trips left without any, once per service day.
+// t.mu must be held.
+func (t *OccupancyTracker) pruneTrips(now time.Time) {
+	today := t.index.ServiceDate(now)
+	if today.Format("20060102") == t.prunedDay {
+		return
+	}
+	t.prunedDay = today.Format("20060102")
+
+	oldest := today.AddDate(0, 0, 1-t.HistoryDays).Format("20060102")
+	for tripID, trip := range t.trips {
+		for day := range trip.Days {
+			if day < oldest {
+				delete(trip.Days, day)
+			}
+		}
+		if len(trip.Days) == 0 {
+			delete(t.trips, tripID)
+		}
+	}
+}
+
+// updateMetrics publishes the current occupancy by route. t.mu must be held.
+func (t *OccupancyTracker) updateMetrics() {
+	routeOccupancyVehicles.Reset()
+	routeOccupancyLevel.Reset()
+	for _, route := range t.routes() {
+		for status, count := range route.Counts {
+			routeOccupancyVehicles.WithLabelValues(route.RouteID, status).Set(float64(count))
+		}
+		routeOccupancyLevel.WithLabelValues(route.RouteID).Set(route.AverageLevel)
+	}
+}
+
+// routes summarizes the current occupancy by route. t.mu must be held.
+func (t *OccupancyTracker) routes() []RouteOccupancy {
+	stats := make(map[string]*occupancyStats)
+	for _, vehicle := range t.current {
+		if stats[vehicle.RouteID] == nil {
+			stats[vehicle.RouteID] = &occupancyStats{}
+		}
+		stats[vehicle.RouteID].add(vehicle.Level)
+	}
+
+	routes := make([]RouteOccupancy, 0, len(stats))
+	for routeID, routeStats := range stats {
+		routes = append(routes, RouteOccupancy{
+			RouteID:      routeID,
+			Vehicles:     routeStats.Observations,
+			AverageLevel: routeStats.averageLevel(),
+			Counts:       routeStats.counts(),
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].RouteID < routes[j].RouteID
+	})
+	return routes
+}
+
+// Current returns the latest occupancy of every vehicle reporting one, and
+// the summary of every route, optionally for one route only.
+func (t *OccupancyTracker) Current(routeID string) ([]VehicleOccupancy, []RouteOccupancy) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	vehicles := make([]VehicleOccupancy, 0, len(t.current))
+	for _, vehicle := range t.current {
+		if routeID == "" || vehicle.RouteID == routeID {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	sort.Slice(vehicles, func(i, j int) bool {
+		return vehicles[i].VehicleID < vehicles[j].VehicleID
+	})
+
+	routes := make([]RouteOccupancy, 0)
+	for _, route := range t.routes() {
+		if routeID == "" || route.RouteID == routeID {
+			routes = append(routes, route)
+		}
+	}
+	return vehicles, routes
+}
+
+// Profiles returns the crowding profiles of a route, or of every route when
+// routeID is empty, ordered by route and hour.
+func (t *OccupancyTracker) Profiles(routeID string) []OccupancyProfile {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	profiles := make([]OccupancyProfile, 0)
+	for key, stats := range t.profiles {
+		if routeID != "" && key.RouteID != routeID {
+			continue
+		}
+		profiles = append(profiles, OccupancyProfile{
+			RouteID:      key.RouteID,
+			Hour:         key.Hour,
+			Observations: stats.Observations,
+			AverageLevel: stats.averageLevel(),
+			FullPercent:  stats.fullPercent(),
+			Counts:       stats.counts(),
+		})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].RouteID != profiles[j].RouteID {
+			return profiles[i].RouteID < profiles[j].RouteID
+		}
+		return profiles[i].Hour < profiles[j].Hour
+	})
+	return profiles
+}
+
+// Trips returns the trips with at least minObservations reports, the most
+// often full first.
+func (t *OccupancyTracker) Trips(routeID string, minObservations int) []TripCrowding {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	trips := make([]TripCrowding, 0)
+	for tripID, trip := range t.trips {
+		if routeID != "" && trip.RouteID != routeID {
+			continue
+		}
+		var stats occupancyStats
+		fullDays := 0
+		for _, day := range trip.Days {
+			stats.merge(day)
+			if day.Full > 0 {
+				fullDays++
+			}
+		}
+		if stats.Observations < minObservations {
+			continue
+		}
+		trips = append(trips, TripCrowding{
+			TripID:       tripID,
+			RouteID:      trip.RouteID,
+			Headsign:     t.index.Trips[tripID].Headsign,
+			Observations: stats.Observations,
+			AverageLevel: stats.averageLevel(),
+			FullPercent:  stats.fullPercent(),
+			MaxLevel:     stats.MaxLevel,
+			Days:         len(trip.Days),
+			FullDays:     fullDays,
+		})
+	}
+	sort.Slice(trips, func(i, j int) bool {
+		if trips[i].FullDays != trips[j].FullDays {
+			return trips[i].FullDays > trips[j].FullDays
+		}
+		if trips[i].FullPercent != trips[j].FullPercent {
+			return trips[i].FullPercent > trips[j].FullPercent
+		}
+		return trips[i].TripID < trips[j].TripID
+	})
+	return trips
+}
+
+type OccupancyReport struct {
+	Vehicles []VehicleOccupancy
+	Routes   []RouteOccupancy
+}
+
+func occupancyHandler(w http.ResponseWriter, r *http.Request) {
+	vehicles, routes := occupancyTracker.Current(r.URL.Query().Get("route_id"))
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(OccupancyReport{Vehicles: vehicles, Routes: routes})
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+func occupancyProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(occupancyTracker.Profiles(r.URL.Query().Get("route_id")))
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// occupancyTripsHandler serves the most crowded trips. min_observations
+// leaves out trips seen too rarely to judge, 10 by default.
+func occupancyTripsHandler(w http.ResponseWriter, r *http.Request) {
+	minObservations := 10
+	if value := r.URL.Query().Get("min_observations"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid min_observations", http.StatusBadRequest)
+			return
+		}
+		minObservations = parsed
+	}
+	limit, offset, ok := parsePagination(r)
+	if !ok {
+		http.Error(w, "Invalid pagination", http.StatusBadRequest)
+		return
+	}
+
+	trips := occupancyTracker.Trips(r.URL.Query().Get("route_id"), minObservations)
+	start, end := pageBounds(len(trips), limit, offset)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(Page{Total: len(trips), Limit: limit, Offset: offset, Results: trips[start:end]})
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
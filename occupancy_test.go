@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
+
+func TestOccupancyTracker(t *testing.T) {
+	tracker := NewOccupancyTracker(newTestIndex(), 28)
+	monday := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	poll := func(now time.Time, status1, status2 pb.VehiclePosition_OccupancyStatus) {
+		tracker.Observe([]BusPosition{
+			{ID: "2301", RouteID: "r1", TripID: "t1", Timestamp: now.Unix(), OccupancyStatus: status1.String()},
+			{ID: "2302", RouteID: "r1", TripID: "t2", Timestamp: now.Unix(), OccupancyStatus: status2.String()},
+			{ID: "2303", RouteID: "r1", TripID: "t3", Timestamp: now.Unix()},
+		}, now)
+	}
+
+	poll(monday, pb.VehiclePosition_FULL, pb.VehiclePosition_MANY_SEATS_AVAILABLE)
+	// The same reports polled again are not counted twice.
+	poll(monday, pb.VehiclePosition_FULL, pb.VehiclePosition_MANY_SEATS_AVAILABLE)
+	poll(monday.Add(30*time.Minute), pb.VehiclePosition_STANDING_ROOM_ONLY, pb.VehiclePosition_EMPTY)
+	poll(monday.AddDate(0, 0, 1), pb.VehiclePosition_CRUSHED_STANDING_ROOM_ONLY, pb.VehiclePosition_FEW_SEATS_AVAILABLE)
+
+	vehicles, routes := tracker.Current("r1")
+	if len(vehicles) != 2 {
+		t.Fatalf("Expected 2 vehicles reporting occupancy, got %d", len(vehicles))
+	}
+	if vehicles[0].VehicleID != "2301" || vehicles[0].Level != 4 {
+		t.Errorf("Expected 2301 at level 4, got %+v", vehicles[0])
+	}
+	if len(routes) != 1 || routes[0].AverageLevel != 3 || routes[0].Counts["FEW_SEATS_AVAILABLE"] != 1 {
+		t.Errorf("Expected r1 at average level 3, got %+v", routes)
+	}
+
+	profiles := tracker.Profiles("r1")
+	if len(profiles) != 1 || profiles[0].Hour != 8 || profiles[0].Observations != 6 {
+		t.Fatalf("Expected one 08:00 profile of 6 observations, got %+v", profiles)
+	}
+	// FULL and CRUSHED_STANDING_ROOM_ONLY of 6 observations.
+	if profiles[0].FullPercent < 33.3 || profiles[0].FullPercent > 33.4 {
+		t.Errorf("Expected 33.3%% full, got %f", profiles[0].FullPercent)
+	}
+
+	trips := tracker.Trips("", 3)
+	if len(trips) != 2 {
+		t.Fatalf("Expected 2 trips with 3 observations, got %d", len(trips))
+	}
+	if trips[0].TripID != "t1" || trips[0].Days != 2 || trips[0].FullDays != 2 || trips[0].MaxLevel != 5 {
+		t.Errorf("Expected t1 full on both days first, got %+v", trips[0])
+	}
+	if trips[1].TripID != "t2" || trips[1].FullDays != 0 || trips[1].Headsign != "EAST" {
+		t.Errorf("Expected t2 never full second, got %+v", trips[1])
+	}
+
+	// Four weeks later the first Monday falls out of the trip history.
+	poll(monday.AddDate(0, 0, 28), pb.VehiclePosition_EMPTY, pb.VehiclePosition_EMPTY)
+	trips = tracker.Trips("", 1)
+	if len(trips) != 2 {
+		t.Fatalf("Expected 2 trips, got %d", len(trips))
+	}
+	if trips[0].TripID != "t1" || trips[0].Observations != 2 || trips[0].Days != 2 || trips[0].FullDays != 1 {
+		t.Errorf("Expected t1 over the last 2 days only, got %+v", trips[0])
+	}
+}
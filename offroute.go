@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const maxOffRouteHistory = 1000
+
+var offRouteEpisodesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "off_route_episodes_total",
+	Help: "Total number of off-route episodes detected, by route.",
+}, []string{"route_id"})
+
+func init() {
+	prometheus.MustRegister(offRouteEpisodesTotal)
+}
+
+var offRouteDetector *OffRouteDetector
+
+// OffRouteEpisode is a period during which a vehicle stayed away from the
+// shape of the trip it was assigned to.
+type OffRouteEpisode struct {
+	VehicleID   string
+	TripID      string
+	RouteID     string
+	ShapeID     string
+	Start       time.Time
+	End         *time.Time
+	MaxDistance float64
+	Reports     int
+}
+
+// OffRouteDetector flags vehicles whose cross-track distance from their trip
+// shape exceeds Threshold meters for Consecutive reports in a row. A report
+// polled again is counted once.
+type OffRouteDetector struct {
+	Threshold   float64
+	Consecutive int
+
+	index      *GTFSIndex
+	mu         sync.RWMutex
+	streaks    map[string][]time.Time
+	lastReport map[string]time.Time
+	active     map[string]*OffRouteEpisode
+	history    []OffRouteEpisode
+}
+
+// NewOffRouteDetector returns a detector that reads trip shapes from index.
+func NewOffRouteDetector(index *GTFSIndex, threshold float64, consecutive int) *OffRouteDetector {
+	if consecutive < 1 {
+		consecutive = 1
+	}
+	return &OffRouteDetector{
+		Threshold:   threshold,
+		Consecutive: consecutive,
+		index:       index,
+		streaks:     make(map[string][]time.Time),
+		lastReport:  make(map[string]time.Time),
+		active:      make(map[string]*OffRouteEpisode),
+	}
+}
+
+// Observe evaluates one poll of vehicle positions taken at now.
+func (d *OffRouteDetector) Observe(buses []BusPosition, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := make(map[string]bool, len(buses))
+	for _, bus := range buses {
+		seen[bus.ID] = true
+
+		shape := d.index.ShapeForTrip(bus.TripID)
+		if shape == nil {
+			d.closeEpisode(bus.ID, now)
+			continue
+		}
+
+		// A new trip assignment starts a fresh evaluation.
+		if episode, ok := d.active[bus.ID]; ok && episode.TripID != bus.TripID {
+			d.closeEpisode(bus.ID, now)
+		}
+
+		distance, _ := shape.Project(bus.Latitude, bus.Longitude)
+		if distance <= d.Threshold {
+			d.closeEpisode(bus.ID, now)
+			continue
+		}
+
+		reported := now
+		if bus.Timestamp > 0 {
+			reported = time.Unix(bus.Timestamp, 0)
+			if !reported.After(d.lastReport[bus.ID]) {
+				continue
+			}
+			d.lastReport[bus.ID] = reported
+		}
+
+		if episode, ok := d.active[bus.ID]; ok {
+			episode.Reports++
+			if distance > episode.MaxDistance {
+				episode.MaxDistance = distance
+			}
+			continue
+		}
+
+		d.streaks[bus.ID] = append(d.streaks[bus.ID], reported)
+		streak := d.streaks[bus.ID]
+		if len(streak) < d.Consecutive {
+			continue
+		}
+
+		d.active[bus.ID] = &OffRouteEpisode{
+			VehicleID:   bus.ID,
+			TripID:      bus.TripID,
+			RouteID:     bus.RouteID,
+			ShapeID:     shape.ID,
+			Start:       streak[0],
+			MaxDistance: distance,
+			Reports:     len(streak),
+		}
+		delete(d.streaks, bus.ID)
+		offRouteEpisodesTotal.WithLabelValues(bus.RouteID).Inc()
+	}
+
+	// Vehicles that dropped out of the feed can no longer be tracked.
+	for id := range d.active {
+		if !seen[id] {
+			d.closeEpisode(id, now)
+		}
+	}
+	for id := range d.streaks {
+		if !seen[id] {
+			delete(d.streaks, id)
+		}
+	}
+	for id := range d.lastReport {
+		if !seen[id] {
+			delete(d.lastReport, id)
+		}
+	}
+}
+
+// closeEpisode ends the active episode for a vehicle, if any, and resets its
+// streak. The caller must hold d.mu.
+func (d *OffRouteDetector) closeEpisode(vehicleID string, now time.Time) {
+	delete(d.streaks, vehicleID)
+
+	episode, ok := d.active[vehicleID]
+	if !ok {
+		return
+	}
+	end := now
+	episode.End = &end
+	delete(d.active, vehicleID)
+
+	d.history = append(d.history, *episode)
+	if len(d.history) > maxOffRouteHistory {
+		d.history = d.history[len(d.history)-maxOffRouteHistory:]
+	}
+}
+
+// Active returns the episodes still in progress.
+func (d *OffRouteDetector) Active() []OffRouteEpisode {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	episodes := make([]OffRouteEpisode, 0, len(d.active))
+	for _, episode := range d.active {
+		episodes = append(episodes, *episode)
+	}
+	return episodes
+}
+
+// History returns the most recent finished episodes, oldest first.
+func (d *OffRouteDetector) History() []OffRouteEpisode {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return append([]OffRouteEpisode(nil), d.history...)
+}
+
+type OffRouteReport struct {
+	Threshold   float64
+	Consecutive int
+	Active      []OffRouteEpisode
+	Recent      []OffRouteEpisode
+}
+
+func offRouteHandler(w http.ResponseWriter, r *http.Request) {
+	routeID := r.URL.Query().Get("route_id")
+
+	report := OffRouteReport{
+		Threshold:   offRouteDetector.Threshold,
+		Consecutive: offRouteDetector.Consecutive,
+		Active:      filterEpisodesByRoute(offRouteDetector.Active(), routeID),
+		Recent:      filterEpisodesByRoute(offRouteDetector.History(), routeID),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+func filterEpisodesByRoute(episodes []OffRouteEpisode, routeID string) []OffRouteEpisode {
+	if routeID == "" {
+		return episodes
+	}
+	filtered := make([]OffRouteEpisode, 0)
+	for _, episode := range episodes {
+		if episode.RouteID == routeID {
+			filtered = append(filtered, episode)
+		}
+	}
+	return filtered
+}
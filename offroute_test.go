@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShapeLineProject(t *testing.T) {
+	shape := newTestIndex().Shapes["s1"]
+
+	crossTrack, alongTrack := shape.Project(33.751, -84.39)
+	if crossTrack < 100 || crossTrack > 120 {
+		t.Errorf("Expected cross-track distance around 111m, got %f", crossTrack)
+	}
+	if alongTrack < shape.Length()/2-5 || alongTrack > shape.Length()/2+5 {
+		t.Errorf("Expected along-track distance around %f, got %f", shape.Length()/2, alongTrack)
+	}
+}
+
+func TestOffRouteDetector(t *testing.T) {
+	detector := NewOffRouteDetector(newTestIndex(), 150, 3)
+	start := time.Unix(1697467600, 0)
+
+	onRoute := BusPosition{ID: "2301", Latitude: 33.7501, Longitude: -84.39, TripID: "t1", RouteID: "r1"}
+	offRoute := BusPosition{ID: "2301", Latitude: 33.76, Longitude: -84.39, TripID: "t1", RouteID: "r1"}
+
+	detector.Observe([]BusPosition{onRoute}, start)
+	for i := 1; i <= 2; i++ {
+		detector.Observe([]BusPosition{offRoute}, start.Add(time.Duration(i)*15*time.Second))
+	}
+	if len(detector.Active()) != 0 {
+		t.Errorf("Expected no active episode after 2 reports, got %d", len(detector.Active()))
+	}
+
+	detector.Observe([]BusPosition{offRoute}, start.Add(45*time.Second))
+	active := detector.Active()
+	if len(active) != 1 {
+		t.Fatalf("Expected 1 active episode, got %d", len(active))
+	}
+	if !active[0].Start.Equal(start.Add(15 * time.Second)) {
+		t.Errorf("Expected episode to start at the first off-route report, got %v", active[0].Start)
+	}
+
+	detector.Observe([]BusPosition{onRoute}, start.Add(60*time.Second))
+	if len(detector.Active()) != 0 {
+		t.Errorf("Expected episode to close once back on route")
+	}
+	history := detector.History()
+	if len(history) != 1 || history[0].End == nil {
+		t.Fatalf("Expected 1 finished episode, got %v", history)
+	}
+	if history[0].Reports != 3 {
+		t.Errorf("Expected 3 reports, got %d", history[0].Reports)
+	}
+}
+
+func TestOffRouteDetectorRepeatedReport(t *testing.T) {
+	detector := NewOffRouteDetector(newTestIndex(), 150, 3)
+	start := time.Unix(1697467600, 0)
+
+	offRoute := BusPosition{ID: "2301", Latitude: 33.76, Longitude: -84.39, TripID: "t1", RouteID: "r1", Timestamp: start.Unix()}
+
+	// A vehicle that stops reporting is polled with the same report.
+	for i := 0; i < 3; i++ {
+		detector.Observe([]BusPosition{offRoute}, start.Add(time.Duration(i)*15*time.Second))
+	}
+	if len(detector.Active()) != 0 {
+		t.Errorf("Expected no active episode after 1 report, got %d", len(detector.Active()))
+	}
+
+	for i := 1; i <= 2; i++ {
+		offRoute.Timestamp = start.Add(time.Duration(i) * 30 * time.Second).Unix()
+		detector.Observe([]BusPosition{offRoute}, start.Add(time.Duration(i)*45*time.Second))
+	}
+	active := detector.Active()
+	if len(active) != 1 {
+		t.Fatalf("Expected 1 active episode, got %d", len(active))
+	}
+	if !active[0].Start.Equal(start) || active[0].Reports != 3 {
+		t.Errorf("Expected an episode of 3 reports starting at the first, got %+v", active[0])
+	}
+
+	detector.Observe([]BusPosition{offRoute}, start.Add(2*time.Minute))
+	if active := detector.Active(); len(active) != 1 || active[0].Reports != 3 {
+		t.Errorf("Expected the repeated report not to be counted, got %+v", active)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
+
+const (
+	OTPEarly  = "early"
+	OTPOnTime = "on-time"
+	OTPLate   = "late"
+
+	// A stop that drops out of the trip updates counts as served only if it
+	// was predicted within this window of now.
+	otpArrivalGrace = 2 * time.Minute
+
+	maxMemoryOTPObservations = 200000
+)
+
+var otpEngine *OTPEngine
+
+// OTPObservation is the delay observed when a trip served a timepoint.
+type OTPObservation struct {
+	ServiceDate  string
+	RouteID      string
+	TripID       string
+	StopID       string
+	StopSequence int
+	Hour         int
+	Scheduled    time.Time
+	Observed     time.Time
+	DelaySeconds int
+}
+
+// OTPStore keeps the history of observations OTP summaries are computed from.
+// Service dates are YYYYMMDD and ranges are inclusive.
+type OTPStore interface {
+	AddObservations(observations []OTPObservation) error
+	Observations(fromDate, toDate string) ([]OTPObservation, error)
+}
+
+// memoryOTPStore keeps the most recent observations in memory.
+type memoryOTPStore struct {
+	mu           sync.RWMutex
+	observations []OTPObservation
+}
+
+func newMemoryOTPStore() *memoryOTPStore {
+	return &memoryOTPStore{}
+}
+
+func (s *memoryOTPStore) AddObservations(observations []OTPObservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observations = append(s.observations, observations...)
+	if len(s.observations) > maxMemoryOTPObservations {
+		s.observations = s.observations[len(s.observations)-maxMemoryOTPObservations:]
+	}
+	return nil
+}
+
+func (s *memoryOTPStore) Observations(fromDate, toDate string) ([]OTPObservation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	observations := make([]OTPObservation, 0)
+	for _, observation := range s.observations {
+		if observation.ServiceDate >= fromDate && observation.ServiceDate <= toDate {
+			observations = append(observations, observation)
+		}
+	}
+	return observations, nil
+}
+
+// OTPEngine turns the stop time updates of every poll into on-time
+// performance observations. A timepoint is observed once it drops out of its
+// trip's updates, using the last prediction made for it.
+type OTPEngine struct {
+	EarlySeconds int
+	LateSeconds  int
+
+	index   *GTFSIndex
+	store   OTPStore
+	mu      sync.Mutex
+	pending map[string]OTPObservation
+}
+
+// NewOTPEngine returns an engine that records observations into store. A stop
+// served more than earlySeconds ahead of schedule is early, more than
+// lateSeconds behind is late.
+func NewOTPEngine(index *GTFSIndex, store OTPStore, earlySeconds, lateSeconds int) *OTPEngine {
+	return &OTPEngine{
+		EarlySeconds: earlySeconds,
+		LateSeconds:  lateSeconds,
+		index:        index,
+		store:        store,
+		pending:      make(map[string]OTPObservation),
+	}
+}
+
+// Observe processes one poll of trip updates taken at now.
+func (e *OTPEngine) Observe(tripUpdates []TripUpdate, now time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		if tripID == "" {
+			continue
+		}
+		routeID := tripUpdate.Trip.GetRouteId()
+		if routeID == "" {
+			routeID = e.index.Trips[tripID].RouteID
+		}
+		serviceDate := e.index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+
+		for _, stopTimeUpdate := range tripUpdate.StopTimeUpdate {
+			observation, ok := e.resolve(tripID, routeID, serviceDate, tripUpdate.Delay, stopTimeUpdate)
+			if !ok {
+				continue
+			}
+			key := observation.TripID + "|" + observation.ServiceDate + "|" + strconv.Itoa(observation.StopSequence) + "|" + observation.StopID
+			seen[key] = true
+			e.pending[key] = observation
+		}
+	}
+
+	finished := make([]OTPObservation, 0)
+	for key, observation := range e.pending {
+		if seen[key] {
+			continue
+		}
+		delete(e.pending, key)
+		if observation.Observed.After(now.Add(otpArrivalGrace)) {
+			// Dropped long before it was due: cancelled or lost tracking.
+			continue
+		}
+		finished = append(finished, observation)
+	}
+	if len(finished) == 0 {
+		return nil
+	}
+
+	return e.store.AddObservations(finished)
+}
+
+// resolve works out the scheduled and predicted time of a stop time update.
+// A stop without a time or delay of its own is predicted by tripDelay, the
+// trip's delay, when the feed gives one. Stops that are not timepoints in
+// stop_times.txt are ignored.
+func (e *OTPEngine) resolve(tripID, routeID string, serviceDate time.Time, tripDelay *int32, update *pb.TripUpdate_StopTimeUpdate) (OTPObservation, bool) {
+	if update.GetScheduleRelationship() != pb.TripUpdate_StopTimeUpdate_SCHEDULED {
+		return OTPObservation{}, false
+	}
+
+	stopTime, scheduled := e.index.StopTimeFor(tripID, update.GetStopSequence(), update.GetStopId())
+	if scheduled && stopTime.Timepoint == "0" {
+		return OTPObservation{}, false
+	}
+
+	observation := OTPObservation{
+		ServiceDate:  serviceDate.Format("20060102"),
+		RouteID:      routeID,
+		TripID:       tripID,
+		StopID:       update.GetStopId(),
+		StopSequence: int(update.GetStopSequence()),
+	}
+	if observation.StopID == "" {
+		observation.StopID = stopTime.StopID
+	}
+
+	event, scheduledSeconds := update.GetArrival(), stopTime.ArrivalTime
+	if event == nil || (event.Time == nil && event.Delay == nil) {
+		event, scheduledSeconds = update.GetDeparture(), stopTime.DepartureTime
+	}
+	if (event == nil || (event.Time == nil && event.Delay == nil)) && tripDelay != nil {
+		event, scheduledSeconds = &pb.TripUpdate_StopTimeEvent{Delay: tripDelay}, stopTime.ArrivalTime
+	}
+	if event == nil {
+		return OTPObservation{}, false
+	}
+
+	switch {
+	case scheduled && event.Time != nil:
+		observation.Scheduled = e.index.ScheduledTime(serviceDate, scheduledSeconds)
+		observation.Observed = time.Unix(event.GetTime(), 0)
+		observation.DelaySeconds = int(observation.Observed.Sub(observation.Scheduled).Seconds())
+	case event.Time != nil && event.Delay != nil:
+		observation.Observed = time.Unix(event.GetTime(), 0)
+		observation.DelaySeconds = int(event.GetDelay())
+		observation.Scheduled = observation.Observed.Add(-time.Duration(observation.DelaySeconds) * time.Second)
+	case scheduled && event.Delay != nil:
+		observation.Scheduled = e.index.ScheduledTime(serviceDate, scheduledSeconds)
+		observation.DelaySeconds = int(event.GetDelay())
+		observation.Observed = observation.Scheduled.Add(time.Duration(observation.DelaySeconds) * time.Second)
+	default:
+		return OTPObservation{}, false
+	}
+	observation.Hour = observation.Scheduled.In(e.index.Location).Hour()
+
+	return observation, true
+}
+
+// Classify buckets a delay into early, on-time or late using the given windows.
+func Classify(delaySeconds, earlySeconds, lateSeconds int) string {
+	switch {
+	case delaySeconds < -earlySeconds:
+		return OTPEarly
+	case delaySeconds > lateSeconds:
+		return OTPLate
+	default:
+		return OTPOnTime
+	}
+}
+
+// OTPSummary aggregates observations for one route, stop or hour.
+type OTPSummary struct {
+	Key                 string
+	Observations        int
+	Early               int
+	OnTime              int
+	Late                int
+	OnTimePercent       float64
+	AverageDelaySeconds float64
+}
+
+// Summaries aggregates the observations between two service dates by "route",
+// "stop" or "hour", optionally restricted to one route and stop.
+func (e *OTPEngine) Summaries(fromDate, toDate, group, routeID, stopID string, earlySeconds, lateSeconds int) ([]OTPSummary, error) {
+	observations, err := e.store.Observations(fromDate, toDate)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[string]*OTPSummary)
+	totalDelay := make(map[string]int)
+	for _, observation := range observations {
+		if routeID != "" && observation.RouteID != routeID {
+			continue
+		}
+		if stopID != "" && observation.StopID != stopID {
+			continue
+		}
+
+		var key string
+		switch group {
+		case "route":
+			key = observation.RouteID
+		case "stop":
+			key = observation.StopID
+		case "hour":
+			key = fmt.Sprintf("%02d", observation.Hour)
+		default:
+			return nil, fmt.Errorf("unknown group %q", group)
+		}
+
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &OTPSummary{Key: key}
+			summaries[key] = summary
+		}
+		summary.Observations++
+		totalDelay[key] += observation.DelaySeconds
+		switch Classify(observation.DelaySeconds, earlySeconds, lateSeconds) {
+		case OTPEarly:
+			summary.Early++
+		case OTPLate:
+			summary.Late++
+		default:
+			summary.OnTime++
+		}
+	}
+
+	result := make([]OTPSummary, 0, len(summaries))
+	for key, summary := range summaries {
+		summary.OnTimePercent = 100 * float64(summary.OnTime) / float64(summary.Observations)
+		summary.AverageDelaySeconds = float64(totalDelay[key]) / float64(summary.Observations)
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+
+	return result, nil
+}
+
+type OTPReport struct {
+	From         string
+	To           string
+	Group        string
+	EarlySeconds int
+	LateSeconds  int
+	Summaries    []OTPSummary
+}
+
+// otpHandler serves OTP summaries. Dates are YYYY-MM-DD service dates and
+// default to today; early and late override the configured windows.
+func otpHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	today := otpEngine.index.ServiceDate(time.Now()).Format("2006-01-02")
+
+	report := OTPReport{
+		From:         query.Get("from"),
+		To:           query.Get("to"),
+		Group:        query.Get("group"),
+		EarlySeconds: otpEngine.EarlySeconds,
+		LateSeconds:  otpEngine.LateSeconds,
+	}
+	if report.From == "" {
+		report.From = today
+	}
+	if report.To == "" {
+		report.To = report.From
+	}
+	if report.Group == "" {
+		report.Group = "route"
+	}
+
+	fromDate, err := time.Parse("2006-01-02", report.From)
+	if err != nil {
+		http.Error(w, "Invalid from date", http.StatusBadRequest)
+		return
+	}
+	toDate, err := time.Parse("2006-01-02", report.To)
+	if err != nil {
+		http.Error(w, "Invalid to date", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("early"); value != "" {
+		if report.EarlySeconds, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid early window", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("late"); value != "" {
+		if report.LateSeconds, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid late window", http.StatusBadRequest)
+			return
+		}
+	}
+	if report.Group != "route" && report.Group != "stop" && report.Group != "hour" {
+		http.Error(w, "Group must be route, stop or hour", http.StatusBadRequest)
+		return
+	}
+
+	report.Summaries, err = otpEngine.Summaries(fromDate.Format("20060102"), toDate.Format("20060102"),
+		report.Group, query.Get("route_id"), query.Get("stop_id"), report.EarlySeconds, report.LateSeconds)
+	if err != nil {
+		http.Error(w, "Failed to read OTP history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
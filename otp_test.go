@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestStopTimeUpdate(sequence uint32, stopID string, arrival time.Time) *pb.TripUpdate_StopTimeUpdate {
+	return &pb.TripUpdate_StopTimeUpdate{
+		StopSequence: proto.Uint32(sequence),
+		StopId:       proto.String(stopID),
+		Arrival:      &pb.TripUpdate_StopTimeEvent{Time: proto.Int64(arrival.Unix())},
+	}
+}
+
+func TestOTPEngine(t *testing.T) {
+	engine := NewOTPEngine(newTestIndex(), newMemoryOTPStore(), 60, 300)
+	trip := &pb.TripDescriptor{TripId: proto.String("t1"), RouteId: proto.String("r1"), StartDate: proto.String("20231016")}
+
+	// Two minutes late at A, seven minutes late at B.
+	arrivalA := time.Date(2023, 10, 16, 8, 2, 0, 0, time.UTC)
+	arrivalB := time.Date(2023, 10, 16, 8, 10, 0, 0, time.UTC)
+
+	err := engine.Observe([]TripUpdate{{Trip: trip, StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+		newTestStopTimeUpdate(1, "A", arrivalA),
+		newTestStopTimeUpdate(2, "B", arrivalB),
+	}}}, arrivalA.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+	err = engine.Observe([]TripUpdate{{Trip: trip, StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+		newTestStopTimeUpdate(2, "B", arrivalB),
+	}}}, arrivalA.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+	// The trip finishes and drops out of the feed.
+	err = engine.Observe([]TripUpdate{}, arrivalB.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+
+	summaries, err := engine.Summaries("20231016", "20231016", "stop", "r1", "", 60, 300)
+	if err != nil {
+		t.Fatalf("Summaries error: %v", err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 stop summaries, got %d", len(summaries))
+	}
+	if summaries[0].Key != "A" || summaries[0].OnTime != 1 || summaries[0].AverageDelaySeconds != 120 {
+		t.Errorf("Expected stop A on time with a 120s delay, got %+v", summaries[0])
+	}
+	if summaries[1].Key != "B" || summaries[1].Late != 1 {
+		t.Errorf("Expected stop B late, got %+v", summaries[1])
+	}
+
+	summaries, err = engine.Summaries("20231016", "20231016", "hour", "", "", 60, 60)
+	if err != nil {
+		t.Fatalf("Summaries error: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].Key != "08" || summaries[0].Late != 2 {
+		t.Errorf("Expected 2 late observations at 08 with a 60s window, got %+v", summaries)
+	}
+}
+
+func TestOTPEngineTripDelay(t *testing.T) {
+	engine := NewOTPEngine(newTestIndex(), newMemoryOTPStore(), 60, 300)
+	trip := &pb.TripDescriptor{TripId: proto.String("t1"), RouteId: proto.String("r1"), StartDate: proto.String("20231016")}
+	now := time.Date(2023, 10, 16, 8, 5, 0, 0, time.UTC)
+
+	// C has no prediction of its own; the trip runs three minutes late.
+	// t2 gives neither a stop nor a trip delay, so B isn't observed.
+	err := engine.Observe([]TripUpdate{
+		{Trip: trip, Delay: proto.Int32(180), StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			{StopSequence: proto.Uint32(3), StopId: proto.String("C")},
+		}},
+		{Trip: &pb.TripDescriptor{TripId: proto.String("t2"), StartDate: proto.String("20231016")}, StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			{StopSequence: proto.Uint32(2), StopId: proto.String("B")},
+		}},
+	}, now)
+	if err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+	if err := engine.Observe([]TripUpdate{}, now.Add(5*time.Minute)); err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+
+	summaries, err := engine.Summaries("20231016", "20231016", "stop", "", "", 60, 300)
+	if err != nil {
+		t.Fatalf("Summaries error: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].Key != "C" || summaries[0].AverageDelaySeconds != 180 {
+		t.Errorf("Expected stop C three minutes late, got %+v", summaries)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxPostgresParameters is the most bind parameters Postgres accepts in
+	// one statement.
+	maxPostgresParameters = 65535
+
+	// postgresRecordTimeout bounds the transaction of a poll, well within
+	// the poll interval so a slow database can't pile up writes.
+	postgresRecordTimeout = 10 * time.Second
+	// postgresQueueSize bounds the polls waiting to be written.
+	postgresQueueSize = 4
+)
+
+var postgresRowsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "postgres_rows_written_total",
+	Help: "Total number of rows written to Postgres, by table.",
+}, []string{"table"})
+
+func init() {
+	prometheus.MustRegister(postgresRowsTotal)
+}
+
+var postgresSink *PostgresSink
+
+// postgresMigrations are applied in order, each once, and must never change
+// once released; add a new one instead.
+var postgresMigrations = []string{
+	`CREATE EXTENSION IF NOT EXISTS postgis`,
+	`CREATE TABLE vehicle_positions (
+		id               bigserial PRIMARY KEY,
+		polled_at        timestamptz NOT NULL,
+		reported_at      timestamptz NOT NULL,
+		vehicle_id       text NOT NULL,
+		trip_id          text NOT NULL,
+		route_id         text NOT NULL,
+		stop_id          text NOT NULL,
+		current_status   text NOT NULL,
+		occupancy_status text NOT NULL,
+		bearing          real NOT NULL,
+		speed            real NOT NULL,
+		geom             geometry(Point, 4326) NOT NULL
+	);
+	CREATE INDEX vehicle_positions_vehicle_idx ON vehicle_positions (vehicle_id, reported_at);
+	CREATE INDEX vehicle_positions_route_idx ON vehicle_positions (route_id, reported_at);
+	CREATE INDEX vehicle_positions_geom_idx ON vehicle_positions USING GIST (geom)`,
+	`CREATE TABLE stop_time_updates (
+		id                    bigserial PRIMARY KEY,
+		polled_at             timestamptz NOT NULL,
+		trip_id               text NOT NULL,
+		route_id              text NOT NULL,
+		vehicle_id            text NOT NULL,
+		start_date            text NOT NULL,
+		stop_sequence         integer,
+		stop_id               text NOT NULL,
+		arrival_time          timestamptz,
+		arrival_delay         integer,
+		departure_time        timestamptz,
+		departure_delay       integer,
+		schedule_relationship text NOT NULL
+	);
+	CREATE INDEX stop_time_updates_trip_idx ON stop_time_updates (trip_id, polled_at);
+	CREATE INDEX stop_time_updates_stop_idx ON stop_time_updates (stop_id, polled_at)`,
+}
+
+// PostgresSink writes vehicle positions and stop time updates into Postgres
+// with PostGIS. Each poll is one transaction of multi-row inserts of up to
+// BatchSize rows. Only new vehicle reports and changed trip updates are
+// written, so polling faster than the feed updates doesn't duplicate rows.
+// Polls queued with Enqueue are written by a goroutine of the sink's own.
+type PostgresSink struct {
+	BatchSize int
+
+	db      *sql.DB
+	index   *GTFSIndex
+	queue   chan postgresPoll
+	stopped chan struct{}
+
+	mu          sync.Mutex
+	reported    map[string]int64
+	tripUpdates map[string]TripUpdate
+}
+
+// OpenPostgresSink connects to the database at dsn and migrates its schema.
+func OpenPostgresSink(dsn string, index *GTFSIndex, batchSize int) (*PostgresSink, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := migratePostgres(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	s := &PostgresSink{
+		BatchSize:   batchSize,
+		db:          db,
+		index:       index,
+		queue:       make(chan postgresPoll, postgresQueueSize),
+		stopped:     make(chan struct{}),
+		reported:    make(map[string]int64),
+		tripUpdates: make(map[string]TripUpdate),
+	}
+	go s.run()
+	return s, nil
+}
+
+// migratePostgres applies the migrations the database hasn't seen yet. An
+// advisory lock keeps two instances starting together from racing.
+func migratePostgres(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	statements := []string{
+		`SELECT pg_advisory_xact_lock(7253410)`,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    integer PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to prepare migrations: %w", err)
+		}
+	}
+
+	var current int
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	for version := current + 1; version <= len(postgresMigrations); version++ {
+		if _, err := tx.ExecContext(ctx, postgresMigrations[version-1]); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migrations: %w", err)
+	}
+	return nil
+}
+
+type postgresPoll struct {
+	buses       []BusPosition
+	tripUpdates []TripUpdate
+	now         time.Time
+}
+
+// Enqueue queues a poll taken at now for writing, dropping it when the
+// database is too far behind. A dropped poll loses only the reports the
+// feed replaced before the next one.
+func (s *PostgresSink) Enqueue(buses []BusPosition, tripUpdates []TripUpdate, now time.Time) error {
+	select {
+	case s.queue <- postgresPoll{buses: buses, tripUpdates: tripUpdates, now: now}:
+		return nil
+	default:
+		return errors.New("Postgres queue is full, dropped poll")
+	}
+}
+
+// run writes the queued polls until the sink is closed.
+func (s *PostgresSink) run() {
+	defer close(s.stopped)
+	for poll := range s.queue {
+		if err := s.Record(poll.buses, poll.tripUpdates, poll.now); err != nil {
+			log.Printf("Failed to write to Postgres: %v", err)
+		}
+	}
+}
+
+// Record writes one poll taken at now. Nothing is remembered as written
+// unless the transaction commits, so a failed poll is retried by the next.
+func (s *PostgresSink) Record(buses []BusPosition, tripUpdates []TripUpdate, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	positionRows := make([][]interface{}, 0)
+	reported := make(map[string]int64)
+	for _, bus := range buses {
+		if bus.Latitude == 0 && bus.Longitude == 0 {
+			continue
+		}
+		timestamp := bus.Timestamp
+		if timestamp <= 0 {
+			timestamp = now.Unix()
+		}
+		if timestamp <= s.reported[bus.ID] {
+			continue
+		}
+		reported[bus.ID] = timestamp
+		positionRows = append(positionRows, []interface{}{
+			now, time.Unix(timestamp, 0), bus.ID, bus.TripID, bus.RouteID, bus.StopID,
+			bus.CurrentStatus, bus.OccupancyStatus, bus.HeadingDegrees, bus.SpeedMetersPerSecond,
+			bus.Longitude, bus.Latitude,
+		})
+	}
+
+	stopTimeRows := make([][]interface{}, 0)
+	changed := make(map[string]TripUpdate)
+	seen := make(map[string]bool, len(tripUpdates))
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		if tripID == "" {
+			continue
+		}
+		seen[tripID] = true
+		if previous, ok := s.tripUpdates[tripID]; ok && sameTripUpdate(previous, tripUpdate) {
+			continue
+		}
+		changed[tripID] = tripUpdate
+		stopTimeRows = append(stopTimeRows, s.stopTimeRows(tripUpdate, now)...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postgresRecordTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = s.insert(ctx, tx, `INSERT INTO vehicle_positions (polled_at, reported_at, vehicle_id, trip_id, route_id, stop_id, current_status, occupancy_status, bearing, speed, geom) VALUES `,
+		`(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ST_SetSRID(ST_MakePoint(?, ?), 4326))`, positionRows)
+	if err != nil {
+		return fmt.Errorf("failed to insert vehicle positions: %w", err)
+	}
+	err = s.insert(ctx, tx, `INSERT INTO stop_time_updates (polled_at, trip_id, route_id, vehicle_id, start_date, stop_sequence, stop_id, arrival_time, arrival_delay, departure_time, departure_delay, schedule_relationship) VALUES `,
+		`(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, stopTimeRows)
+	if err != nil {
+		return fmt.Errorf("failed to insert stop time updates: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit poll: %w", err)
+	}
+
+	postgresRowsTotal.WithLabelValues("vehicle_positions").Add(float64(len(positionRows)))
+	postgresRowsTotal.WithLabelValues("stop_time_updates").Add(float64(len(stopTimeRows)))
+	for id, timestamp := range reported {
+		s.reported[id] = timestamp
+	}
+	for tripID, tripUpdate := range changed {
+		s.tripUpdates[tripID] = tripUpdate
+	}
+	for tripID := range s.tripUpdates {
+		if !seen[tripID] {
+			delete(s.tripUpdates, tripID)
+		}
+	}
+	return nil
+}
+
+// stopTimeRows flattens a trip update into stop_time_updates rows. Times and
+// delays the feed leaves out are stored as NULL.
+func (s *PostgresSink) stopTimeRows(tripUpdate TripUpdate, now time.Time) [][]interface{} {
+	tripID := tripUpdate.Trip.GetTripId()
+	routeID := tripUpdate.Trip.GetRouteId()
+	if routeID == "" {
+		routeID = s.index.Trips[tripID].RouteID
+	}
+
+	rows := make([][]interface{}, 0, len(tripUpdate.StopTimeUpdate))
+	for _, update := range tripUpdate.StopTimeUpdate {
+		var sequence sql.NullInt64
+		if update.StopSequence != nil {
+			sequence = sql.NullInt64{Int64: int64(update.GetStopSequence()), Valid: true}
+		}
+		arrivalTime, arrivalDelay := stopTimeEventColumns(update.GetArrival())
+		departureTime, departureDelay := stopTimeEventColumns(update.GetDeparture())
+		rows = append(rows, []interface{}{
+			now, tripID, routeID, tripUpdate.Vehicle.GetId(), tripUpdate.Trip.GetStartDate(),
+			sequence, update.GetStopId(), arrivalTime, arrivalDelay, departureTime, departureDelay,
+			update.GetScheduleRelationship().String(),
+		})
+	}
+	return rows
+}
+
+func stopTimeEventColumns(event *pb.TripUpdate_StopTimeEvent) (sql.NullTime, sql.NullInt64) {
+	var predicted sql.NullTime
+	var delay sql.NullInt64
+	if event == nil {
+		return predicted, delay
+	}
+	if event.Time != nil {
+		predicted = sql.NullTime{Time: time.Unix(event.GetTime(), 0), Valid: true}
+	}
+	if event.Delay != nil {
+		delay = sql.NullInt64{Int64: int64(event.GetDelay()), Valid: true}
+	}
+	return predicted, delay
+}
+
+// insert writes rows in statements of up to BatchSize rows, fewer if the
+// rows would exceed the parameter limit.
+func (s *PostgresSink) insert(ctx context.Context, tx *sql.Tx, prefix, row string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	batchSize := s.BatchSize
+	if limit := maxPostgresParameters / len(rows[0]); batchSize > limit {
+		batchSize = limit
+	}
+
+	for start := 0; start < len(rows); start += batchSize {
+		end := minInt(start+batchSize, len(rows))
+		args := make([]interface{}, 0, (end-start)*len(rows[0]))
+		for _, values := range rows[start:end] {
+			args = append(args, values...)
+		}
+		if _, err := tx.ExecContext(ctx, prefix+insertValues(row, end-start), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertValues repeats a VALUES tuple for rows rows, numbering the ?
+// placeholders across them as $1, $2 and so on.
+func insertValues(row string, rows int) string {
+	var b strings.Builder
+	parameter := 1
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		for _, r := range row {
+			if r != '?' {
+				b.WriteRune(r)
+				continue
+			}
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(parameter))
+			parameter++
+		}
+	}
+	return b.String()
+}
+
+// Close writes the polls still queued and closes the database connection.
+// Enqueue must not be called after Close.
+func (s *PostgresSink) Close() error {
+	close(s.queue)
+	<-s.stopped
+	return s.db.Close()
+}
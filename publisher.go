@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	FeedVehicleAdded      = "vehicle_added"
+	FeedVehicleMoved      = "vehicle_moved"
+	FeedVehicleRemoved    = "vehicle_removed"
+	FeedTripUpdateChanged = "trip_update_changed"
+	FeedTripUpdateRemoved = "trip_update_removed"
+)
+
+var (
+	publishedEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "published_events_total",
+		Help: "Total number of feed events published, by sink.",
+	}, []string{"sink"})
+	publishErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "publish_errors_total",
+		Help: "Total number of failed publishes, by sink.",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(publishedEventsTotal, publishErrorsTotal)
+}
+
+var (
+	snapshotDiffer *SnapshotDiffer
+	publishers     []Publisher
+)
+
+// FeedEvent is a change between two consecutive snapshots of the realtime
+// feeds. Vehicle is set for vehicle events and TripUpdate for trip update
+// events; removals carry the last known state.
+type FeedEvent struct {
+	Type       string
+	Time       time.Time
+	VehicleID  string
+	RouteID    string
+	TripID     string
+	Vehicle    *BusPosition
+	TripUpdate *TripUpdate
+}
+
+// Publisher sends feed events to an external sink. Publish is called once per
+// poll, with no events when nothing changed, so sinks can keep their
+// connections alive.
+type Publisher interface {
+	Name() string
+	Publish(events []FeedEvent) error
+	Close() error
+}
+
+// SnapshotDiffer turns consecutive snapshots of vehicle positions and trip
+// updates into feed events.
+type SnapshotDiffer struct {
+	index *GTFSIndex
+
+	mu          sync.Mutex
+	vehicles    map[string]BusPosition
+	tripUpdates map[string]TripUpdate
+}
+
+func NewSnapshotDiffer(index *GTFSIndex) *SnapshotDiffer {
+	return &SnapshotDiffer{
+		index:       index,
+		vehicles:    make(map[string]BusPosition),
+		tripUpdates: make(map[string]TripUpdate),
+	}
+}
+
+// Diff compares a snapshot taken at now with the previous one. A vehicle
+// moved when its position changed; a trip update changed when its vehicle or
+// any stop time update did, ignoring the feed timestamp. Events are ordered
+// by type, then vehicle and trip ID.
+func (d *SnapshotDiffer) Diff(buses []BusPosition, tripUpdates []TripUpdate, now time.Time) []FeedEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	events := make([]FeedEvent, 0)
+	vehicles := make(map[string]BusPosition, len(buses))
+	for _, bus := range buses {
+		vehicles[bus.ID] = bus
+		previous, ok := d.vehicles[bus.ID]
+		switch {
+		case !ok:
+			events = append(events, newVehicleEvent(FeedVehicleAdded, bus, now))
+		case previous.Latitude != bus.Latitude || previous.Longitude != bus.Longitude:
+			events = append(events, newVehicleEvent(FeedVehicleMoved, bus, now))
+		}
+	}
+	for id, previous := range d.vehicles {
+		if _, ok := vehicles[id]; !ok {
+			events = append(events, newVehicleEvent(FeedVehicleRemoved, previous, now))
+		}
+	}
+	d.vehicles = vehicles
+
+	updates := make(map[string]TripUpdate, len(tripUpdates))
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		if tripID == "" {
+			continue
+		}
+		updates[tripID] = tripUpdate
+		previous, ok := d.tripUpdates[tripID]
+		if !ok || !sameTripUpdate(previous, tripUpdate) {
+			events = append(events, d.newTripUpdateEvent(FeedTripUpdateChanged, tripUpdate, now))
+		}
+	}
+	for tripID, previous := range d.tripUpdates {
+		if _, ok := updates[tripID]; !ok {
+			events = append(events, d.newTripUpdateEvent(FeedTripUpdateRemoved, previous, now))
+		}
+	}
+	d.tripUpdates = updates
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type < events[j].Type
+		}
+		if events[i].VehicleID != events[j].VehicleID {
+			return events[i].VehicleID < events[j].VehicleID
+		}
+		return events[i].TripID < events[j].TripID
+	})
+	return events
+}
+
+func newVehicleEvent(eventType string, bus BusPosition, now time.Time) FeedEvent {
+	return FeedEvent{
+		Type:      eventType,
+		Time:      now,
+		VehicleID: bus.ID,
+		RouteID:   bus.RouteID,
+		TripID:    bus.TripID,
+		Vehicle:   &bus,
+	}
+}
+
+// newTripUpdateEvent builds a trip update event, taking the route from the
+// schedule when the feed leaves it out.
+func (d *SnapshotDiffer) newTripUpdateEvent(eventType string, tripUpdate TripUpdate, now time.Time) FeedEvent {
+	event := FeedEvent{
+		Type:       eventType,
+		Time:       now,
+		VehicleID:  tripUpdate.Vehicle.GetId(),
+		RouteID:    tripUpdate.Trip.GetRouteId(),
+		TripID:     tripUpdate.Trip.GetTripId(),
+		TripUpdate: &tripUpdate,
+	}
+	if event.RouteID == "" {
+		event.RouteID = d.index.Trips[event.TripID].RouteID
+	}
+	return event
+}
+
+// sameTripUpdate reports whether two updates of a trip predict the same.
+func sameTripUpdate(a, b TripUpdate) bool {
+	if !proto.Equal(a.Trip, b.Trip) || !proto.Equal(a.Vehicle, b.Vehicle) || len(a.StopTimeUpdate) != len(b.StopTimeUpdate) {
+		return false
+	}
+	if (a.Delay == nil) != (b.Delay == nil) || (a.Delay != nil && *a.Delay != *b.Delay) {
+		return false
+	}
+	for i := range a.StopTimeUpdate {
+		if !proto.Equal(a.StopTimeUpdate[i], b.StopTimeUpdate[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// NDJSONPublisher writes every event as one JSON line.
+type NDJSONPublisher struct {
+	name   string
+	mu     sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+// NewNDJSONPublisher writes events to w. closer, which may be nil, is closed
+// with the publisher.
+func NewNDJSONPublisher(name string, w io.Writer, closer io.Closer) *NDJSONPublisher {
+	return &NDJSONPublisher{name: name, writer: bufio.NewWriter(w), closer: closer}
+}
+
+// OpenNDJSONPublisher appends events to the file at path, or writes them to
+// stdout when path is "-".
+func OpenNDJSONPublisher(path string) (*NDJSONPublisher, error) {
+	if path == "-" {
+		return NewNDJSONPublisher("stdout", os.Stdout, nil), nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return NewNDJSONPublisher("ndjson", file, file), nil
+}
+
+func (p *NDJSONPublisher) Name() string {
+	return p.name
+}
+
+func (p *NDJSONPublisher) Publish(events []FeedEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	encoder := json.NewEncoder(p.writer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+	}
+	return p.writer.Flush()
+}
+
+func (p *NDJSONPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.writer.Flush()
+	if p.closer != nil {
+		if closeErr := p.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// publishEvents hands the events of one poll to every publisher. A failing
+// sink is logged and doesn't hold back the others.
+func publishEvents(publishers []Publisher, events []FeedEvent) {
+	for _, publisher := range publishers {
+		if err := publisher.Publish(events); err != nil {
+			publishErrorsTotal.WithLabelValues(publisher.Name()).Inc()
+			log.Printf("Failed to publish to %s: %v", publisher.Name(), err)
+			continue
+		}
+		publishedEventsTotal.WithLabelValues(publisher.Name()).Add(float64(len(events)))
+	}
+}
+
+// configuredPublishers builds the sinks enabled in the environment:
+// PUBLISH_NDJSON names a file to append events to, or "-" for stdout, and
+// MQTT_BROKER the host:port of an MQTT broker.
+func configuredPublishers() []Publisher {
+	configured := make([]Publisher, 0)
+	if path := envString("PUBLISH_NDJSON", ""); path != "" {
+		publisher, err := OpenNDJSONPublisher(path)
+		if err != nil {
+			log.Printf("Failed to open NDJSON publisher: %v", err)
+		} else {
+			configured = append(configured, publisher)
+		}
+	}
+	if address := envString("MQTT_BROKER", ""); address != "" {
+		configured = append(configured, NewMQTTPublisher(address,
+			envString("MQTT_CLIENT_ID", "vehicle-positions"),
+			envString("MQTT_USERNAME", ""),
+			envString("MQTT_PASSWORD", ""),
+			envString("MQTT_TOPIC_PREFIX", "marta"),
+			time.Duration(envInt("MQTT_KEEPALIVE_SECONDS", 60))*time.Second))
+	}
+	return configured
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSnapshotDiffer(t *testing.T) {
+	differ := NewSnapshotDiffer(newTestIndex())
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	tripUpdate := func(arrival time.Time, timestamp uint64) TripUpdate {
+		return TripUpdate{
+			Trip:           &pb.TripDescriptor{TripId: proto.String("t1")},
+			Vehicle:        &pb.VehicleDescriptor{Id: proto.String("2301")},
+			StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{newTestStopTimeUpdate(2, "B", arrival)},
+			Timestamp:      proto.Uint64(timestamp),
+		}
+	}
+	buses := []BusPosition{
+		{ID: "2301", RouteID: "r1", TripID: "t1", Latitude: 33.75, Longitude: -84.40},
+		{ID: "2302", RouteID: "r1", TripID: "t2", Latitude: 33.75, Longitude: -84.39},
+	}
+
+	events := differ.Diff(buses, []TripUpdate{tripUpdate(start, 1)}, start)
+	if len(events) != 3 {
+		t.Fatalf("Expected 2 added vehicles and a changed trip update, got %+v", events)
+	}
+	if events[0].Type != FeedTripUpdateChanged || events[0].RouteID != "r1" || events[0].VehicleID != "2301" {
+		t.Errorf("Expected the t1 update with the scheduled route, got %+v", events[0])
+	}
+	if events[1].Type != FeedVehicleAdded || events[1].VehicleID != "2301" || events[2].VehicleID != "2302" {
+		t.Errorf("Expected 2301 and 2302 added, got %+v", events[1:])
+	}
+
+	// Only the timestamp of the trip update changed.
+	events = differ.Diff(buses, []TripUpdate{tripUpdate(start, 2)}, start.Add(15*time.Second))
+	if len(events) != 0 {
+		t.Errorf("Expected no events, got %+v", events)
+	}
+
+	buses = buses[:1]
+	buses[0].Longitude = -84.395
+	events = differ.Diff(buses, []TripUpdate{tripUpdate(start.Add(time.Minute), 3)}, start.Add(30*time.Second))
+	types := make([]string, 0)
+	for _, event := range events {
+		types = append(types, event.Type+":"+event.VehicleID)
+	}
+	expected := "trip_update_changed:2301 vehicle_moved:2301 vehicle_removed:2302"
+	if strings.Join(types, " ") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(types, " "))
+	}
+
+	events = differ.Diff(buses, nil, start.Add(45*time.Second))
+	if len(events) != 1 || events[0].Type != FeedTripUpdateRemoved || events[0].TripUpdate == nil {
+		t.Errorf("Expected the t1 update removed, got %+v", events)
+	}
+}
+
+func TestNDJSONPublisher(t *testing.T) {
+	var buffer bytes.Buffer
+	publisher := NewNDJSONPublisher("test", &buffer, nil)
+	bus := BusPosition{ID: "2301", RouteID: "r1"}
+	err := publisher.Publish([]FeedEvent{
+		{Type: FeedVehicleAdded, VehicleID: "2301", Vehicle: &bus},
+		{Type: FeedVehicleRemoved, VehicleID: "2302"},
+	})
+	if err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	var event FeedEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("Failed to decode line: %v", err)
+	}
+	if event.Type != FeedVehicleAdded || event.Vehicle == nil || event.Vehicle.RouteID != "r1" {
+		t.Errorf("Expected 2301 added on r1, got %+v", event)
+	}
+}
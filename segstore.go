@@ -0,0 +1,827 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	positionStream = "positions"
+	otpStream      = "otp"
+
+	// segmentMarkEvery is how many records of a vehicle in a compacted
+	// segment share one time mark.
+	segmentMarkEvery = 64
+	// maxSegmentRecord bounds a record, so a corrupt length can't make a
+	// reader allocate gigabytes.
+	maxSegmentRecord = 1 << 20
+)
+
+var errTornRecord = errors.New("torn or corrupt record")
+
+var segmentStore *SegmentStore
+
+// StoredPosition is one vehicle report kept in the segment store.
+type StoredPosition struct {
+	VehicleID       string
+	TripID          string
+	RouteID         string
+	StopID          string
+	CurrentStatus   string
+	OccupancyStatus string
+	Latitude        float64
+	Longitude       float64
+	Bearing         float64
+	Speed           float64
+	Timestamp       time.Time
+}
+
+// segmentIndex locates the records of every vehicle in a position segment.
+// Each vehicle's records are in time order, with a mark every
+// segmentMarkEvery records. An open segment interleaves the vehicles in
+// arrival order; a compacted one holds each vehicle's records contiguously.
+type segmentIndex struct {
+	Compacted bool
+	Vehicles  map[string]*vehicleIndex
+	Routes    map[string][]string
+}
+
+type vehicleIndex struct {
+	ID     string
+	Offset int64
+	End    int64
+	First  int64
+	Last   int64
+	Count  int
+	Marks  []segmentMark
+}
+
+type segmentMark struct {
+	Time   int64
+	Offset int64
+}
+
+func newSegmentIndex() *segmentIndex {
+	return &segmentIndex{
+		Vehicles: make(map[string]*vehicleIndex),
+		Routes:   make(map[string][]string),
+	}
+}
+
+// add indexes a record of an open segment between offset and end. The
+// store only appends a vehicle's reports newer than its last, so they arrive
+// in time order.
+func (idx *segmentIndex) add(position StoredPosition, offset, end int64) {
+	vehicle := idx.Vehicles[position.VehicleID]
+	timestamp := position.Timestamp.Unix()
+	if vehicle == nil {
+		vehicle = &vehicleIndex{ID: position.VehicleID, Offset: offset, First: timestamp}
+		idx.Vehicles[position.VehicleID] = vehicle
+	}
+	if vehicle.Count%segmentMarkEvery == 0 {
+		vehicle.Marks = append(vehicle.Marks, segmentMark{Time: timestamp, Offset: offset})
+	}
+	vehicle.Count++
+	vehicle.Last = timestamp
+	vehicle.End = end
+	if position.RouteID != "" && !containsString(idx.Routes[position.RouteID], position.VehicleID) {
+		idx.Routes[position.RouteID] = append(idx.Routes[position.RouteID], position.VehicleID)
+	}
+}
+
+// SegmentStore is an embedded time-series store of vehicle positions and OTP
+// observations. Each stream appends to one segment file per service-zone day
+// in Dir. Once a day is over, Maintain compacts its position segment and
+// deletes the segments older than RetentionDays, when set.
+type SegmentStore struct {
+	Dir           string
+	RetentionDays int
+
+	location *time.Location
+
+	maintainMu sync.Mutex
+
+	mu         sync.RWMutex
+	files      map[string]*os.File
+	indexes    map[string]*segmentIndex
+	compacting map[string]bool
+	reported   map[string]int64
+}
+
+// OpenSegmentStore opens the store in dir, creating it if needed. The open
+// position segments are scanned to rebuild their indexes, dropping any torn
+// record a crash left at their end.
+func OpenSegmentStore(dir string, location *time.Location, retentionDays int) (*SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	s := &SegmentStore{
+		Dir:           dir,
+		RetentionDays: retentionDays,
+		location:      location,
+		files:         make(map[string]*os.File),
+		indexes:       make(map[string]*segmentIndex),
+		compacting:    make(map[string]bool),
+		reported:      make(map[string]int64),
+	}
+
+	dates, err := s.dates(positionStream)
+	if err != nil {
+		return nil, err
+	}
+	for _, date := range dates {
+		if s.compacted(date) {
+			continue
+		}
+		idx := newSegmentIndex()
+		end, err := scanSegment(s.segmentPath(positionStream, date), 0, -1, func(offset int64, payload []byte) error {
+			position, err := decodePosition(payload)
+			if err != nil {
+				return err
+			}
+			idx.add(position, offset, offset+segmentRecordSize(payload))
+			if timestamp := position.Timestamp.Unix(); timestamp > s.reported[position.VehicleID] {
+				s.reported[position.VehicleID] = timestamp
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Truncate(s.segmentPath(positionStream, date), end); err != nil {
+			return nil, fmt.Errorf("failed to truncate segment %s: %w", date, err)
+		}
+		s.indexes[date] = idx
+	}
+	return s, nil
+}
+
+// Observe appends the positions of one poll that the store hasn't seen yet.
+// A report for a day that is being or was already compacted is dropped.
+func (s *SegmentStore) Observe(buses []BusPosition, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, bus := range buses {
+		if bus.Latitude == 0 && bus.Longitude == 0 {
+			continue
+		}
+		timestamp := bus.Timestamp
+		if timestamp <= 0 {
+			timestamp = now.Unix()
+		}
+		if timestamp <= s.reported[bus.ID] {
+			continue
+		}
+		s.reported[bus.ID] = timestamp
+
+		position := StoredPosition{
+			VehicleID:       bus.ID,
+			TripID:          bus.TripID,
+			RouteID:         bus.RouteID,
+			StopID:          bus.StopID,
+			CurrentStatus:   bus.CurrentStatus,
+			OccupancyStatus: bus.OccupancyStatus,
+			Latitude:        bus.Latitude,
+			Longitude:       bus.Longitude,
+			Bearing:         bus.HeadingDegrees,
+			Speed:           bus.SpeedMetersPerSecond,
+			Timestamp:       time.Unix(timestamp, 0),
+		}
+		date := s.date(position.Timestamp)
+		if s.compacting[date] {
+			continue
+		}
+		idx := s.indexes[date]
+		if idx == nil {
+			if s.compacted(date) {
+				continue
+			}
+			idx = newSegmentIndex()
+			s.indexes[date] = idx
+		}
+		payload := encodePosition(position)
+		offset, err := s.append(positionStream, date, payload)
+		if err != nil {
+			return err
+		}
+		idx.add(position, offset, offset+segmentRecordSize(payload))
+	}
+	return nil
+}
+
+// Positions returns the positions reported between from and to, inclusive,
+// optionally of one vehicle or route, ordered by time.
+func (s *SegmentStore) Positions(from, to time.Time, vehicleID, routeID string) ([]StoredPosition, error) {
+	positions := make([]StoredPosition, 0)
+	err := s.EachPosition(from, to, vehicleID, routeID, func(position StoredPosition) error {
+		positions = append(positions, position)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(positions, func(i, j int) bool {
+		if !positions[i].Timestamp.Equal(positions[j].Timestamp) {
+			return positions[i].Timestamp.Before(positions[j].Timestamp)
+		}
+		return positions[i].VehicleID < positions[j].VehicleID
+	})
+	return positions, nil
+}
+
+// EachPosition calls fn with the positions reported between from and to,
+// inclusive, optionally of one vehicle or route, day by day and within a day
+// vehicle by vehicle in time order. The store is only locked to look up each
+// day, so a slow fn doesn't hold back polling; segments are append-only and
+// compaction replaces them whole, so the open file stays consistent with the
+// index read with it.
+func (s *SegmentStore) EachPosition(from, to time.Time, vehicleID, routeID string, fn func(StoredPosition) error) error {
+	for date := s.date(from); date <= s.date(to); date = nextSegmentDate(date) {
+		compacted, vehicles, file, err := s.openDay(date, vehicleID, routeID)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			continue
+		}
+
+		for _, vehicle := range vehicles {
+			if vehicle.Last < from.Unix() || vehicle.First > to.Unix() {
+				continue
+			}
+			err = readVehicle(file, compacted, vehicle, from.Unix(), to.Unix(), func(position StoredPosition) error {
+				if routeID != "" && position.RouteID != routeID {
+					return nil
+				}
+				return fn(position)
+			})
+			if err != nil {
+				break
+			}
+		}
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openDay opens the position segment of a date and returns copies of the
+// indexes of the requested vehicles, ordered by vehicle ID. The file is nil
+// when there is no segment.
+func (s *SegmentStore) openDay(date, vehicleID, routeID string) (bool, []vehicleIndex, *os.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, err := s.index(date)
+	if err != nil || idx == nil {
+		return false, nil, nil, err
+	}
+
+	ids := make([]string, 0)
+	switch {
+	case vehicleID != "":
+		ids = append(ids, vehicleID)
+	case routeID != "":
+		ids = append(ids, idx.Routes[routeID]...)
+	default:
+		for id := range idx.Vehicles {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	vehicles := make([]vehicleIndex, 0, len(ids))
+	for _, id := range ids {
+		if vehicle := idx.Vehicles[id]; vehicle != nil {
+			vehicles = append(vehicles, *vehicle)
+		}
+	}
+
+	file, err := os.Open(s.segmentPath(positionStream, date))
+	if os.IsNotExist(err) {
+		return false, nil, nil, nil
+	}
+	if err != nil {
+		return false, nil, nil, fmt.Errorf("failed to open segment %s: %w", date, err)
+	}
+	return idx.Compacted, vehicles, file, nil
+}
+
+// Snapshot returns the latest position of every vehicle that reported within
+// lookback before at, ordered by vehicle ID.
+func (s *SegmentStore) Snapshot(at time.Time, lookback time.Duration, routeID string) ([]StoredPosition, error) {
+	positions, err := s.Positions(at.Add(-lookback), at, "", routeID)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]StoredPosition)
+	for _, position := range positions {
+		latest[position.VehicleID] = position
+	}
+	snapshot := make([]StoredPosition, 0, len(latest))
+	for _, position := range latest {
+		snapshot = append(snapshot, position)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].VehicleID < snapshot[j].VehicleID
+	})
+	return snapshot, nil
+}
+
+// readVehicle calls fn with the positions of a vehicle between from and to.
+// It reads from the last mark before from up to the first mark past to,
+// skipping the records of other vehicles an open segment interleaves.
+func readVehicle(file *os.File, compacted bool, vehicle vehicleIndex, from, to int64, fn func(StoredPosition) error) error {
+	start, end := vehicle.Offset, vehicle.End
+	for _, mark := range vehicle.Marks {
+		if mark.Time <= from {
+			start = mark.Offset
+		} else if mark.Time > to {
+			end = mark.Offset
+			break
+		}
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, end-start))
+	for {
+		payload, _, err := readSegmentRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		position, err := decodePosition(payload)
+		if err != nil {
+			return err
+		}
+		if !compacted && position.VehicleID != vehicle.ID {
+			continue
+		}
+		if position.Timestamp.Unix() > to {
+			return nil
+		}
+		if position.Timestamp.Unix() >= from {
+			if err := fn(position); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// AddObservations appends OTP observations to the segments of their service
+// dates.
+func (s *SegmentStore) AddObservations(observations []OTPObservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, observation := range observations {
+		payload, err := json.Marshal(observation)
+		if err != nil {
+			return fmt.Errorf("failed to encode observation: %w", err)
+		}
+		if _, err := s.append(otpStream, observation.ServiceDate, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Observations returns the OTP observations of the service dates between
+// fromDate and toDate, inclusive.
+func (s *SegmentStore) Observations(fromDate, toDate string) ([]OTPObservation, error) {
+	observations := make([]OTPObservation, 0)
+	err := s.EachObservation(fromDate, toDate, func(observation OTPObservation) error {
+		observations = append(observations, observation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return observations, nil
+}
+
+// EachObservation calls fn with the OTP observations of the service dates
+// between fromDate and toDate, inclusive, in the order they were recorded.
+// A record still being appended reads as a torn one and ends the day.
+func (s *SegmentStore) EachObservation(fromDate, toDate string, fn func(OTPObservation) error) error {
+	s.mu.RLock()
+	dates, err := s.dates(otpStream)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, date := range dates {
+		if date < fromDate || date > toDate {
+			continue
+		}
+		_, err := scanSegment(s.segmentPath(otpStream, date), 0, -1, func(_ int64, payload []byte) error {
+			var observation OTPObservation
+			if err := json.Unmarshal(payload, &observation); err != nil {
+				return err
+			}
+			return fn(observation)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Maintain compacts the position segments of the days before yesterday,
+// which no longer receive reports, and deletes expired segments.
+func (s *SegmentStore) Maintain(now time.Time) error {
+	s.maintainMu.Lock()
+	defer s.maintainMu.Unlock()
+
+	today := s.date(now)
+	yesterday := s.date(now.AddDate(0, 0, -1))
+	dates, err := s.dates(positionStream)
+	if err != nil {
+		return err
+	}
+	for _, date := range dates {
+		if date >= yesterday || s.compacted(date) {
+			continue
+		}
+		if err := s.compact(date); err != nil {
+			return err
+		}
+	}
+
+	if s.RetentionDays <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := s.date(now.AddDate(0, 0, -s.RetentionDays))
+	for _, stream := range []string{positionStream, otpStream} {
+		dates, err := s.dates(stream)
+		if err != nil {
+			return err
+		}
+		for _, date := range dates {
+			if date >= cutoff || date == today {
+				continue
+			}
+			s.closeFile(stream, date)
+			delete(s.indexes, date)
+			for _, path := range []string{s.segmentPath(stream, date), s.indexPath(stream, date)} {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to delete expired segment: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// compact rewrites a position segment with the records of every vehicle
+// together and in time order, without duplicates, and writes its index. Both
+// are written to temporary files without holding s.mu, which is only taken
+// to rename them over the open segment; readers holding the old segment keep
+// reading it. The index is renamed last, so a crash in between only repeats
+// the compaction.
+func (s *SegmentStore) compact(date string) error {
+	s.mu.Lock()
+	s.closeFile(positionStream, date)
+	s.compacting[date] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.compacting, date)
+		s.mu.Unlock()
+	}()
+	path := s.segmentPath(positionStream, date)
+	indexPath := s.indexPath(positionStream, date)
+
+	positions := make([]StoredPosition, 0)
+	_, err := scanSegment(path, 0, -1, func(_ int64, payload []byte) error {
+		position, err := decodePosition(payload)
+		if err == nil {
+			positions = append(positions, position)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		if positions[i].VehicleID != positions[j].VehicleID {
+			return positions[i].VehicleID < positions[j].VehicleID
+		}
+		return positions[i].Timestamp.Before(positions[j].Timestamp)
+	})
+
+	idx := newSegmentIndex()
+	idx.Compacted = true
+	data := make([]byte, 0)
+	var previous *StoredPosition
+	for i := range positions {
+		position := positions[i]
+		timestamp := position.Timestamp.Unix()
+		if previous != nil && previous.VehicleID == position.VehicleID && previous.Timestamp.Equal(position.Timestamp) {
+			continue
+		}
+		previous = &positions[i]
+
+		offset := int64(len(data))
+		vehicle := idx.Vehicles[position.VehicleID]
+		if vehicle == nil {
+			vehicle = &vehicleIndex{ID: position.VehicleID, Offset: offset, First: timestamp}
+			idx.Vehicles[position.VehicleID] = vehicle
+		}
+		if vehicle.Count%segmentMarkEvery == 0 {
+			vehicle.Marks = append(vehicle.Marks, segmentMark{Time: timestamp, Offset: offset})
+		}
+		vehicle.Count++
+		vehicle.Last = timestamp
+		data = appendSegmentRecord(data, encodePosition(position))
+		vehicle.End = int64(len(data))
+		if position.RouteID != "" && !containsString(idx.Routes[position.RouteID], position.VehicleID) {
+			idx.Routes[position.RouteID] = append(idx.Routes[position.RouteID], position.VehicleID)
+		}
+	}
+
+	if err := writeFileSynced(path+".tmp", data); err != nil {
+		return fmt.Errorf("failed to compact segment %s: %w", date, err)
+	}
+	encoded, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to encode index %s: %w", date, err)
+	}
+	if err := writeFileSynced(indexPath+".tmp", encoded); err != nil {
+		return fmt.Errorf("failed to write index %s: %w", date, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to compact segment %s: %w", date, err)
+	}
+	if err := os.Rename(indexPath+".tmp", indexPath); err != nil {
+		return fmt.Errorf("failed to write index %s: %w", date, err)
+	}
+	delete(s.indexes, date)
+	return nil
+}
+
+// Close closes the open segments.
+func (s *SegmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for key, file := range s.files {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.files, key)
+	}
+	return err
+}
+
+// append writes a record to a segment and returns its offset. s.mu must be
+// held.
+func (s *SegmentStore) append(stream, date string, payload []byte) (int64, error) {
+	key := stream + "-" + date
+	file := s.files[key]
+	if file == nil {
+		opened, err := os.OpenFile(s.segmentPath(stream, date), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open segment %s: %w", key, err)
+		}
+		file = opened
+		s.files[key] = file
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek segment %s: %w", key, err)
+	}
+	if _, err := file.Write(appendSegmentRecord(nil, payload)); err != nil {
+		return 0, fmt.Errorf("failed to append to segment %s: %w", key, err)
+	}
+	return offset, nil
+}
+
+// closeFile closes the append handle of a segment. s.mu must be held.
+func (s *SegmentStore) closeFile(stream, date string) {
+	key := stream + "-" + date
+	if file := s.files[key]; file != nil {
+		_ = file.Close()
+		delete(s.files, key)
+	}
+}
+
+// index returns the index of a position segment, or nil when there is no
+// segment for the date. s.mu must be held.
+func (s *SegmentStore) index(date string) (*segmentIndex, error) {
+	if idx := s.indexes[date]; idx != nil {
+		return idx, nil
+	}
+	data, err := os.ReadFile(s.indexPath(positionStream, date))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index %s: %w", date, err)
+	}
+	idx := newSegmentIndex()
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("failed to decode index %s: %w", date, err)
+	}
+	return idx, nil
+}
+
+func (s *SegmentStore) compacted(date string) bool {
+	_, err := os.Stat(s.indexPath(positionStream, date))
+	return err == nil
+}
+
+// dates lists the dates a stream has segments for, oldest first.
+func (s *SegmentStore) dates(stream string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, stream+"-*.seg"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %w", err)
+	}
+	dates := make([]string, 0, len(paths))
+	for _, path := range paths {
+		date := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), stream+"-"), ".seg")
+		if _, err := time.Parse("20060102", date); err == nil {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	return dates, nil
+}
+
+// date returns the day of a time in the store's zone, as YYYYMMDD.
+func (s *SegmentStore) date(t time.Time) string {
+	return t.In(s.location).Format("20060102")
+}
+
+func (s *SegmentStore) segmentPath(stream, date string) string {
+	return filepath.Join(s.Dir, stream+"-"+date+".seg")
+}
+
+func (s *SegmentStore) indexPath(stream, date string) string {
+	return filepath.Join(s.Dir, stream+"-"+date+".idx")
+}
+
+func nextSegmentDate(date string) string {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return "99999999"
+	}
+	return day.AddDate(0, 0, 1).Format("20060102")
+}
+
+// writeFileSynced writes a file and syncs it to disk.
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// appendSegmentRecord frames a payload as its uvarint length, its CRC-32 and
+// the payload itself.
+func appendSegmentRecord(b []byte, payload []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(payload))
+	return append(b, payload...)
+}
+
+// readSegmentRecord reads one framed record and returns its payload and
+// size. It returns io.EOF at a clean end and errTornRecord for a partial or
+// corrupt record.
+func readSegmentRecord(r *bufio.Reader) ([]byte, int, error) {
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > maxSegmentRecord {
+		return nil, 0, errTornRecord
+	}
+	framed := make([]byte, 4+length)
+	if _, err := io.ReadFull(r, framed); err != nil {
+		return nil, 0, errTornRecord
+	}
+	payload := framed[4:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(framed[:4]) {
+		return nil, 0, errTornRecord
+	}
+	return payload, int(segmentRecordSize(payload)), nil
+}
+
+// segmentRecordSize returns the size of a payload once framed.
+func segmentRecordSize(payload []byte) int64 {
+	return int64(len(binary.AppendUvarint(nil, uint64(len(payload))))) + 4 + int64(len(payload))
+}
+
+// scanSegment calls fn with up to limit records of a segment starting at
+// offset, all of them when limit is negative, and returns the offset after
+// the last valid record. Reading stops quietly at a torn record.
+func scanSegment(path string, offset int64, limit int, fn func(offset int64, payload []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek segment: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	for read := 0; limit < 0 || read < limit; read++ {
+		payload, size, err := readSegmentRecord(reader)
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err := fn(offset, payload); err != nil {
+			return offset, fmt.Errorf("failed to process record at %d: %w", offset, err)
+		}
+		offset += int64(size)
+	}
+	return offset, nil
+}
+
+// encodePosition packs a position as its strings, each prefixed with its
+// uvarint length, the timestamp as a varint, the coordinates as varint
+// microdegrees, and the bearing and speed as float32.
+func encodePosition(position StoredPosition) []byte {
+	b := make([]byte, 0, 64)
+	for _, value := range []string{position.VehicleID, position.TripID, position.RouteID, position.StopID, position.CurrentStatus, position.OccupancyStatus} {
+		b = binary.AppendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+	b = binary.AppendVarint(b, position.Timestamp.Unix())
+	b = binary.AppendVarint(b, int64(math.Round(position.Latitude*1e6)))
+	b = binary.AppendVarint(b, int64(math.Round(position.Longitude*1e6)))
+	b = binary.BigEndian.AppendUint32(b, math.Float32bits(float32(position.Bearing)))
+	b = binary.BigEndian.AppendUint32(b, math.Float32bits(float32(position.Speed)))
+	return b
+}
+
+func decodePosition(b []byte) (StoredPosition, error) {
+	var position StoredPosition
+	fields := []*string{&position.VehicleID, &position.TripID, &position.RouteID, &position.StopID, &position.CurrentStatus, &position.OccupancyStatus}
+	for _, field := range fields {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < length {
+			return position, errTornRecord
+		}
+		*field = string(b[n : n+int(length)])
+		b = b[n+int(length):]
+	}
+
+	values := make([]int64, 3)
+	for i := range values {
+		value, n := binary.Varint(b)
+		if n <= 0 {
+			return position, errTornRecord
+		}
+		values[i] = value
+		b = b[n:]
+	}
+	if len(b) != 8 {
+		return position, errTornRecord
+	}
+	position.Timestamp = time.Unix(values[0], 0)
+	position.Latitude = float64(values[1]) / 1e6
+	position.Longitude = float64(values[2]) / 1e6
+	position.Bearing = float64(math.Float32frombits(binary.BigEndian.Uint32(b[:4])))
+	position.Speed = float64(math.Float32frombits(binary.BigEndian.Uint32(b[4:])))
+	return position, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSegmentStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenSegmentStore(dir, time.UTC, 3)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore error: %v", err)
+	}
+	monday := time.Date(2023, 10, 16, 23, 58, 0, 0, time.UTC)
+
+	// Polls every 30 seconds across midnight; 2302 switches to route r2.
+	for i := 0; i < 8; i++ {
+		now := monday.Add(time.Duration(i) * 30 * time.Second)
+		route := "r1"
+		if i >= 6 {
+			route = "r2"
+		}
+		buses := []BusPosition{
+			{ID: "2301", RouteID: "r1", TripID: "t1", Latitude: 33.75, Longitude: -84.40 + float64(i)*0.001, HeadingDegrees: 90, Timestamp: now.Unix()},
+			{ID: "2302", RouteID: route, TripID: "t2", Latitude: 33.76, Longitude: -84.39, Timestamp: now.Unix()},
+		}
+		// The same reports polled twice are stored once.
+		for j := 0; j < 2; j++ {
+			if err := store.Observe(buses, now); err != nil {
+				t.Fatalf("Observe error: %v", err)
+			}
+		}
+	}
+
+	check := func(label string, store *SegmentStore) {
+		positions, err := store.Positions(monday, monday.Add(4*time.Minute), "2301", "")
+		if err != nil {
+			t.Fatalf("%s: Positions error: %v", label, err)
+		}
+		if len(positions) != 8 {
+			t.Fatalf("%s: Expected 8 positions of 2301, got %d", label, len(positions))
+		}
+		last := positions[7]
+		if last.Longitude != -84.393 || last.Bearing != 90 || last.TripID != "t1" || !last.Timestamp.Equal(monday.Add(210*time.Second)) {
+			t.Errorf("%s: Expected the last position of 2301 at 00:01:30, got %+v", label, last)
+		}
+
+		positions, err = store.Positions(monday.Add(time.Minute), monday.Add(4*time.Minute), "", "r2")
+		if err != nil {
+			t.Fatalf("%s: Positions error: %v", label, err)
+		}
+		if len(positions) != 2 || positions[0].VehicleID != "2302" {
+			t.Errorf("%s: Expected 2 positions of 2302 on r2, got %+v", label, positions)
+		}
+
+		snapshot, err := store.Snapshot(monday.Add(100*time.Second), time.Minute, "")
+		if err != nil {
+			t.Fatalf("%s: Snapshot error: %v", label, err)
+		}
+		if len(snapshot) != 2 || snapshot[0].VehicleID != "2301" || !snapshot[0].Timestamp.Equal(monday.Add(90*time.Second)) {
+			t.Errorf("%s: Expected both vehicles at 00:01:30, got %+v", label, snapshot)
+		}
+	}
+	check("open", store)
+
+	// A crash leaves half a record behind.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	file, err := os.OpenFile(store.segmentPath(positionStream, "20231017"), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	_, _ = file.Write([]byte{40, 1, 2, 3})
+	_ = file.Close()
+
+	store, err = OpenSegmentStore(dir, time.UTC, 3)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore error: %v", err)
+	}
+	check("reopened", store)
+	if err := store.Observe([]BusPosition{{ID: "2301", Latitude: 33.75, Longitude: -84.40, Timestamp: monday.Add(time.Minute).Unix()}}, monday); err != nil {
+		t.Fatalf("Observe error: %v", err)
+	}
+	check("reopened and polled again", store)
+
+	// Two days later Monday is compacted; three days later it expires.
+	if err := store.Maintain(monday.AddDate(0, 0, 2)); err != nil {
+		t.Fatalf("Maintain error: %v", err)
+	}
+	if !store.compacted("20231016") || store.compacted("20231017") {
+		t.Errorf("Expected only Monday to be compacted")
+	}
+	check("compacted", store)
+
+	if err := store.Maintain(monday.AddDate(0, 0, 4)); err != nil {
+		t.Fatalf("Maintain error: %v", err)
+	}
+	if dates, _ := store.dates(positionStream); !reflect.DeepEqual(dates, []string{"20231017"}) {
+		t.Errorf("Expected only Tuesday to be kept, got %v", dates)
+	}
+}
+
+func TestSegmentStoreMarks(t *testing.T) {
+	store, err := OpenSegmentStore(t.TempDir(), time.UTC, 0)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore error: %v", err)
+	}
+	start := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 3*segmentMarkEvery; i++ {
+		now := start.Add(time.Duration(i) * 10 * time.Second)
+		buses := []BusPosition{
+			{ID: "2301", Latitude: 33.75, Longitude: -84.40, Timestamp: now.Unix()},
+			{ID: "2302", Latitude: 33.76, Longitude: -84.39, Timestamp: now.Unix()},
+		}
+		if err := store.Observe(buses, now); err != nil {
+			t.Fatalf("Observe error: %v", err)
+		}
+	}
+
+	check := func(label string, compacted bool) {
+		idx, err := store.index("20231016")
+		if err != nil || idx == nil || idx.Compacted != compacted {
+			t.Fatalf("%s: Expected a compacted index %v, got %+v: %v", label, compacted, idx, err)
+		}
+		if marks := len(idx.Vehicles["2301"].Marks); marks != 3 {
+			t.Errorf("%s: Expected 3 marks, got %d", label, marks)
+		}
+		// A range starting between two marks.
+		from := start.Add(time.Duration(segmentMarkEvery+10) * 10 * time.Second)
+		positions, err := store.Positions(from, from.Add(time.Minute), "2301", "")
+		if err != nil {
+			t.Fatalf("%s: Positions error: %v", label, err)
+		}
+		if len(positions) != 7 || !positions[0].Timestamp.Equal(from) || positions[6].VehicleID != "2301" {
+			t.Errorf("%s: Expected 7 positions of 2301 from %v, got %+v", label, from, positions)
+		}
+	}
+	check("open", false)
+
+	if err := store.Maintain(start.AddDate(0, 0, 2)); err != nil {
+		t.Fatalf("Maintain error: %v", err)
+	}
+	check("compacted", true)
+}
+
+func TestSegmentStoreOTP(t *testing.T) {
+	store, err := OpenSegmentStore(t.TempDir(), time.UTC, 0)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore error: %v", err)
+	}
+	err = store.AddObservations([]OTPObservation{
+		{ServiceDate: "20231016", TripID: "t1", StopID: "A", DelaySeconds: 30},
+		{ServiceDate: "20231017", TripID: "t1", StopID: "A", DelaySeconds: 400},
+		{ServiceDate: "20231018", TripID: "t1", StopID: "A", DelaySeconds: -90},
+	})
+	if err != nil {
+		t.Fatalf("AddObservations error: %v", err)
+	}
+
+	observations, err := store.Observations("20231017", "20231018")
+	if err != nil {
+		t.Fatalf("Observations error: %v", err)
+	}
+	if len(observations) != 2 || observations[0].DelaySeconds != 400 || observations[1].DelaySeconds != -90 {
+		t.Errorf("Expected the Tuesday and Wednesday observations, got %+v", observations)
+	}
+}
+
+func TestTrailStoreLoad(t *testing.T) {
+	store := NewTrailStore(10 * time.Minute)
+	now := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	store.Load([]StoredPosition{
+		{VehicleID: "2301", Latitude: 33.75, Timestamp: now.Add(-20 * time.Minute)},
+		{VehicleID: "2301", Latitude: 33.76, TripID: "t1", Timestamp: now.Add(-5 * time.Minute)},
+	}, now)
+
+	trail := store.Trail("2301")
+	if len(trail) != 1 || trail[0].Latitude != 33.76 || trail[0].TripID != "t1" {
+		t.Errorf("Expected the position within the window, got %+v", trail)
+	}
+}
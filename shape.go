@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ShapeFormatPoints   = "points"
+	ShapeFormatPolyline = "polyline"
+
+	// maxShapeToleranceMeters bounds the simplification tolerance, past
+	// which a shape is little more than its end points.
+	maxShapeToleranceMeters = 1000
+)
+
+// ShapePoint is a point of a shape.
+type ShapePoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// ShapeDetail is one shape, its extent and its length, with its points
+// either listed or as a Google encoded polyline.
+type ShapeDetail struct {
+	ShapeID            string
+	RouteID            string
+	RouteShortName     string
+	RouteColor         string
+	LengthMeters       float64
+	Bounds             BoundingBox
+	OriginalPointCount int
+	PointCount         int
+	ToleranceMeters    float64
+	Points             []ShapePoint
+	EncodedPolyline    string
+}
+
+// shapeDetailHandler serves /shapes/{shape_id}. tolerance simplifies the
+// shape to within that many meters, and format=polyline returns it as an
+// encoded polyline instead of a list of points.
+func shapeDetailHandler(w http.ResponseWriter, r *http.Request) {
+	shapeID := strings.TrimPrefix(r.URL.Path, "/shapes/")
+	if shapeID == "" || strings.Contains(shapeID, "/") {
+		http.Error(w, "Shape ID not provided", http.StatusBadRequest)
+		return
+	}
+	shape, ok := gtfsIndex.Shapes[shapeID]
+	if !ok {
+		http.Error(w, "Shape not found", http.StatusNotFound)
+		return
+	}
+
+	tolerance := 0.0
+	if value := r.URL.Query().Get("tolerance"); value != "" {
+		var err error
+		tolerance, err = strconv.ParseFloat(value, 64)
+		if err != nil || tolerance < 0 || tolerance > maxShapeToleranceMeters {
+			http.Error(w, "Invalid tolerance", http.StatusBadRequest)
+			return
+		}
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ShapeFormatPoints
+	}
+	if format != ShapeFormatPoints && format != ShapeFormatPolyline {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	detail := buildShapeDetail(gtfsIndex, shape, tolerance, format)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(detail)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// buildShapeDetail describes a shape simplified at tolerance meters. The
+// length and bounds are those of the full shape.
+func buildShapeDetail(index *GTFSIndex, shape *ShapeLine, tolerance float64, format string) ShapeDetail {
+	points := shape.Simplify(tolerance)
+	detail := ShapeDetail{
+		ShapeID:            shape.ID,
+		LengthMeters:       shape.Length(),
+		Bounds:             shape.Bounds(),
+		OriginalPointCount: len(shape.Points),
+		PointCount:         len(points),
+		ToleranceMeters:    tolerance,
+	}
+	if route, ok := index.ShapeRoute(shape.ID); ok {
+		detail.RouteID = route.ID
+		detail.RouteShortName = route.ShortName
+		detail.RouteColor = route.Color
+	}
+
+	if format == ShapeFormatPolyline {
+		detail.EncodedPolyline = encodePolyline(points)
+		return detail
+	}
+	detail.Points = make([]ShapePoint, len(points))
+	for i, point := range points {
+		detail.Points[i] = ShapePoint{Latitude: point.Latitude, Longitude: point.Longitude}
+	}
+	return detail
+}
+
+// encodePolyline encodes points with Google's encoded polyline algorithm at
+// five decimal places.
+func encodePolyline(points []Shape) string {
+	var encoded strings.Builder
+	var lastLat, lastLon int64
+	for _, point := range points {
+		lat := int64(math.Round(point.Latitude * 1e5))
+		lon := int64(math.Round(point.Longitude * 1e5))
+		appendPolylineValue(&encoded, lat-lastLat)
+		appendPolylineValue(&encoded, lon-lastLon)
+		lastLat, lastLon = lat, lon
+	}
+	return encoded.String()
+}
+
+func appendPolylineValue(encoded *strings.Builder, value int64) {
+	shifted := value << 1
+	if value < 0 {
+		shifted = ^shifted
+	}
+	for shifted >= 0x20 {
+		encoded.WriteByte(byte((0x20 | (shifted & 0x1f)) + 63))
+		shifted >>= 5
+	}
+	encoded.WriteByte(byte(shifted + 63))
+}
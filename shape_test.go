@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncodePolyline(t *testing.T) {
+	points := []Shape{
+		{Latitude: 38.5, Longitude: -120.2},
+		{Latitude: 40.7, Longitude: -120.95},
+		{Latitude: 43.252, Longitude: -126.453},
+	}
+	encoded := encodePolyline(points)
+	if encoded != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" {
+		t.Errorf("Expected _p~iF~ps|U_ulLnnqC_mqNvxq`@, got %s", encoded)
+	}
+}
+
+func TestBuildShapeDetail(t *testing.T) {
+	index := newTestIndex()
+	shape := index.Shapes["s1"]
+
+	detail := buildShapeDetail(index, shape, 0, ShapeFormatPoints)
+	if detail.PointCount != 3 || len(detail.Points) != 3 {
+		t.Errorf("Expected 3 points without a tolerance, got %d", detail.PointCount)
+	}
+	if detail.RouteID != "r1" {
+		t.Errorf("Expected route r1, got %s", detail.RouteID)
+	}
+	expected := BoundingBox{MinLatitude: 33.75, MinLongitude: -84.40, MaxLatitude: 33.75, MaxLongitude: -84.38}
+	if detail.Bounds != expected {
+		t.Errorf("Expected bounds %v, got %v", expected, detail.Bounds)
+	}
+	if math.Abs(detail.LengthMeters-1849) > 5 {
+		t.Errorf("Expected a length of about 1849 m, got %.0f", detail.LengthMeters)
+	}
+
+	detail = buildShapeDetail(index, shape, 10, ShapeFormatPolyline)
+	if detail.PointCount != 2 || detail.OriginalPointCount != 3 {
+		t.Errorf("Expected the straight shape to simplify to 2 of 3 points, got %d of %d", detail.PointCount, detail.OriginalPointCount)
+	}
+	if detail.Points != nil || detail.EncodedPolyline != encodePolyline([]Shape{shape.Points[0], shape.Points[2]}) {
+		t.Errorf("Expected only an encoded polyline of the end points, got %v %q", detail.Points, detail.EncodedPolyline)
+	}
+}
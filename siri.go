@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
+
+const (
+	siriNamespace   = "http://www.siri.org.uk/siri"
+	siriVersion     = "2.0"
+	siriProducerRef = "MARTA"
+
+	// siriValidFor is how long a delivery stays current, one poll of the
+	// feed.
+	siriValidFor = 15 * time.Second
+
+	defaultSiriStopVisits = 20
+	maxSiriStopVisits     = 100
+)
+
+// SIRI deliveries. Fields are named after the SIRI elements, so the same
+// types encode SIRI XML and SIRI Lite JSON.
+type SiriResponse struct {
+	XMLName         xml.Name `xml:"Siri" json:"-"`
+	Namespace       string   `xml:"xmlns,attr" json:"-"`
+	Version         string   `xml:"version,attr" json:"-"`
+	ServiceDelivery SiriServiceDelivery
+}
+
+type SiriServiceDelivery struct {
+	ResponseTimestamp         string
+	ProducerRef               string
+	VehicleMonitoringDelivery []SiriVehicleMonitoringDelivery `xml:",omitempty" json:",omitempty"`
+	StopMonitoringDelivery    []SiriStopMonitoringDelivery    `xml:",omitempty" json:",omitempty"`
+}
+
+type SiriVehicleMonitoringDelivery struct {
+	Version           string `xml:"version,attr" json:"-"`
+	ResponseTimestamp string
+	ValidUntil        string
+	VehicleActivity   []SiriVehicleActivity
+}
+
+type SiriVehicleActivity struct {
+	RecordedAtTime          string
+	ValidUntilTime          string
+	MonitoredVehicleJourney SiriMonitoredVehicleJourney
+}
+
+type SiriStopMonitoringDelivery struct {
+	Version            string `xml:"version,attr" json:"-"`
+	ResponseTimestamp  string
+	ValidUntil         string
+	MonitoredStopVisit []SiriMonitoredStopVisit
+}
+
+type SiriMonitoredStopVisit struct {
+	RecordedAtTime          string
+	MonitoringRef           string
+	MonitoredVehicleJourney SiriMonitoredVehicleJourney
+}
+
+// SiriMonitoredVehicleJourney is a trip as SIRI describes it. Fields are in
+// schema order.
+type SiriMonitoredVehicleJourney struct {
+	LineRef                 string
+	DirectionRef            string `xml:",omitempty" json:",omitempty"`
+	FramedVehicleJourneyRef SiriFramedVehicleJourneyRef
+	JourneyPatternRef       string `xml:",omitempty" json:",omitempty"`
+	PublishedLineName       string `xml:",omitempty" json:",omitempty"`
+	OriginRef               string `xml:",omitempty" json:",omitempty"`
+	OriginName              string `xml:",omitempty" json:",omitempty"`
+	DestinationRef          string `xml:",omitempty" json:",omitempty"`
+	DestinationName         string `xml:",omitempty" json:",omitempty"`
+	Monitored               bool
+	VehicleLocation         *SiriLocation      `xml:",omitempty" json:",omitempty"`
+	Bearing                 *float64           `xml:",omitempty" json:",omitempty"`
+	Occupancy               string             `xml:",omitempty" json:",omitempty"`
+	Delay                   string             `xml:",omitempty" json:",omitempty"`
+	BlockRef                string             `xml:",omitempty" json:",omitempty"`
+	VehicleRef              string             `xml:",omitempty" json:",omitempty"`
+	MonitoredCall           *SiriMonitoredCall `xml:",omitempty" json:",omitempty"`
+}
+
+type SiriFramedVehicleJourneyRef struct {
+	DataFrameRef           string
+	DatedVehicleJourneyRef string
+}
+
+type SiriLocation struct {
+	Longitude float64
+	Latitude  float64
+}
+
+type SiriMonitoredCall struct {
+	StopPointRef          string
+	Order                 uint32 `xml:",omitempty" json:",omitempty"`
+	StopPointName         string `xml:",omitempty" json:",omitempty"`
+	AimedArrivalTime      string `xml:",omitempty" json:",omitempty"`
+	ExpectedArrivalTime   string `xml:",omitempty" json:",omitempty"`
+	AimedDepartureTime    string `xml:",omitempty" json:",omitempty"`
+	ExpectedDepartureTime string `xml:",omitempty" json:",omitempty"`
+}
+
+func newSiriResponse(index *GTFSIndex, now time.Time) SiriResponse {
+	return SiriResponse{
+		Namespace: siriNamespace,
+		Version:   siriVersion,
+		ServiceDelivery: SiriServiceDelivery{
+			ResponseTimestamp: siriTime(index, now),
+			ProducerRef:       siriProducerRef,
+		},
+	}
+}
+
+// buildVehicleMonitoring returns a SIRI-VM delivery of the buses, optionally
+// only of lineRef or vehicleRef, with the delay and next stop from their
+// trip updates.
+func buildVehicleMonitoring(index *GTFSIndex, buses []BusPosition, tripUpdates []TripUpdate, lineRef, vehicleRef string, now time.Time) SiriResponse {
+	delivery := SiriVehicleMonitoringDelivery{
+		Version:           siriVersion,
+		ResponseTimestamp: siriTime(index, now),
+		ValidUntil:        siriTime(index, now.Add(siriValidFor)),
+		VehicleActivity:   make([]SiriVehicleActivity, 0),
+	}
+	for i := range buses {
+		bus := &buses[i]
+		if (lineRef != "" && bus.RouteID != lineRef) || (vehicleRef != "" && bus.ID != vehicleRef) {
+			continue
+		}
+
+		serviceDate := index.ServiceDate(now)
+		if tripUpdate := findTripUpdate(tripUpdates, bus.TripID, bus.ID); tripUpdate != nil {
+			serviceDate = index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+		}
+		journey := buildSiriJourney(index, bus.TripID, bus.RouteID, bus.ID, serviceDate, bus)
+
+		detail := buildVehicleDetail(index, *bus, tripUpdates, nil, nil, now)
+		if len(detail.NextStops) > 0 {
+			next := detail.NextStops[0]
+			journey.MonitoredCall = &SiriMonitoredCall{
+				StopPointRef:        next.StopID,
+				Order:               next.StopSequence,
+				StopPointName:       next.StopName,
+				AimedArrivalTime:    siriTimePointer(index, next.ScheduledArrival),
+				ExpectedArrivalTime: siriTimePointer(index, next.PredictedArrival),
+			}
+			if next.DelaySeconds != nil {
+				journey.Delay = siriDuration(*next.DelaySeconds)
+			}
+		}
+
+		activity := SiriVehicleActivity{
+			RecordedAtTime:          siriTime(index, now),
+			ValidUntilTime:          siriTime(index, now.Add(siriValidFor)),
+			MonitoredVehicleJourney: journey,
+		}
+		if bus.Timestamp > 0 {
+			activity.RecordedAtTime = siriTime(index, time.Unix(bus.Timestamp, 0))
+		}
+		delivery.VehicleActivity = append(delivery.VehicleActivity, activity)
+	}
+
+	response := newSiriResponse(index, now)
+	response.ServiceDelivery.VehicleMonitoringDelivery = []SiriVehicleMonitoringDelivery{delivery}
+	return response
+}
+
+// buildStopMonitoring returns a SIRI-SM delivery of the next visits to the
+// stops of station within window, optionally only of lineRef and at most
+// maxVisits of them.
+func buildStopMonitoring(index *GTFSIndex, station *Station, buses []BusPosition, tripUpdates []TripUpdate, lineRef string, maxVisits int, window time.Duration, now time.Time) SiriResponse {
+	delivery := SiriStopMonitoringDelivery{
+		Version:            siriVersion,
+		ResponseTimestamp:  siriTime(index, now),
+		ValidUntil:         siriTime(index, now.Add(siriValidFor)),
+		MonitoredStopVisit: make([]SiriMonitoredStopVisit, 0),
+	}
+	for _, departure := range stationDepartures(index, station, tripUpdates, window, now) {
+		if len(delivery.MonitoredStopVisit) >= maxVisits {
+			break
+		}
+		if lineRef != "" && departure.RouteID != lineRef {
+			continue
+		}
+
+		serviceDate := index.ServiceDate(now)
+		tripUpdate := findTripUpdate(tripUpdates, departure.TripID, "")
+		if tripUpdate != nil {
+			serviceDate = index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+		}
+		var bus *BusPosition
+		for i := range buses {
+			if (departure.VehicleID != "" && buses[i].ID == departure.VehicleID) || (departure.TripID != "" && buses[i].TripID == departure.TripID) {
+				bus = &buses[i]
+				break
+			}
+		}
+
+		journey := buildSiriJourney(index, departure.TripID, departure.RouteID, departure.VehicleID, serviceDate, bus)
+		stopTime, _ := index.StopTimeFor(departure.TripID, 0, departure.StopID)
+		journey.MonitoredCall = &SiriMonitoredCall{
+			StopPointRef:          departure.StopID,
+			Order:                 uint32(stopTime.StopSequence),
+			StopPointName:         departure.StopName,
+			AimedDepartureTime:    siriTimePointer(index, departure.ScheduledDeparture),
+			ExpectedDepartureTime: siriTimePointer(index, departure.PredictedDeparture),
+		}
+		if departure.DelaySeconds != nil {
+			journey.Delay = siriDuration(*departure.DelaySeconds)
+		}
+
+		delivery.MonitoredStopVisit = append(delivery.MonitoredStopVisit, SiriMonitoredStopVisit{
+			RecordedAtTime:          siriTime(index, now),
+			MonitoringRef:           station.ID,
+			MonitoredVehicleJourney: journey,
+		})
+	}
+
+	response := newSiriResponse(index, now)
+	response.ServiceDelivery.StopMonitoringDelivery = []SiriStopMonitoringDelivery{delivery}
+	return response
+}
+
+// buildSiriJourney maps a trip to a MonitoredVehicleJourney: its route to the
+// line, direction_id to the direction, the shape to the journey pattern and
+// the headsign and last stop to the destination. bus, when known, adds where
+// the vehicle is.
+func buildSiriJourney(index *GTFSIndex, tripID, routeID, vehicleID string, serviceDate time.Time, bus *BusPosition) SiriMonitoredVehicleJourney {
+	trip := index.Trips[tripID]
+	if routeID == "" {
+		routeID = trip.RouteID
+	}
+	journey := SiriMonitoredVehicleJourney{
+		LineRef:      routeID,
+		DirectionRef: trip.DirectionID,
+		FramedVehicleJourneyRef: SiriFramedVehicleJourneyRef{
+			DataFrameRef:           serviceDate.Format("2006-01-02"),
+			DatedVehicleJourneyRef: tripID,
+		},
+		JourneyPatternRef: trip.ShapeID,
+		DestinationName:   trip.Headsign,
+		BlockRef:          trip.BlockID,
+		VehicleRef:        vehicleID,
+	}
+	if route, ok := index.Routes[routeID]; ok {
+		journey.PublishedLineName = routeName(route)
+	}
+	if stopTimes := index.StopTimes[tripID]; len(stopTimes) > 0 {
+		origin, destination := stopTimes[0].StopID, stopTimes[len(stopTimes)-1].StopID
+		journey.OriginRef = origin
+		journey.OriginName = index.Stops[origin].StopName
+		journey.DestinationRef = destination
+		if journey.DestinationName == "" {
+			journey.DestinationName = index.Stops[destination].StopName
+		}
+	}
+
+	if bus != nil {
+		bearing := bus.Bearing
+		journey.Monitored = true
+		journey.VehicleLocation = &SiriLocation{Longitude: bus.Longitude, Latitude: bus.Latitude}
+		journey.Bearing = &bearing
+		journey.Occupancy = siriOccupancy(bus.OccupancyStatus)
+		if journey.VehicleRef == "" {
+			journey.VehicleRef = bus.ID
+		}
+	}
+	return journey
+}
+
+// siriOccupancy maps a GTFS-realtime occupancy status to SIRI's coarser
+// occupancy, or "" when unknown.
+func siriOccupancy(status string) string {
+	switch status {
+	case pb.VehiclePosition_EMPTY.String(), pb.VehiclePosition_MANY_SEATS_AVAILABLE.String(), pb.VehiclePosition_FEW_SEATS_AVAILABLE.String():
+		return "seatsAvailable"
+	case pb.VehiclePosition_STANDING_ROOM_ONLY.String(), pb.VehiclePosition_CRUSHED_STANDING_ROOM_ONLY.String():
+		return "standingAvailable"
+	case pb.VehiclePosition_FULL.String(), pb.VehiclePosition_NOT_ACCEPTING_PASSENGERS.String():
+		return "full"
+	default:
+		return ""
+	}
+}
+
+// siriDuration formats a delay in seconds as an XML Schema duration, e.g.
+// PT2M30S or -PT45S.
+func siriDuration(seconds int) string {
+	sign := ""
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	if seconds == 0 {
+		return "PT0S"
+	}
+	duration := sign + "PT"
+	if hours := seconds / 3600; hours > 0 {
+		duration += strconv.Itoa(hours) + "H"
+	}
+	if minutes := seconds % 3600 / 60; minutes > 0 {
+		duration += strconv.Itoa(minutes) + "M"
+	}
+	if seconds%60 > 0 {
+		duration += strconv.Itoa(seconds%60) + "S"
+	}
+	return duration
+}
+
+func siriTime(index *GTFSIndex, t time.Time) string {
+	return t.In(index.Location).Format(time.RFC3339)
+}
+
+func siriTimePointer(index *GTFSIndex, t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return siriTime(index, *t)
+}
+
+// siriMonitoredStation returns the stops a MonitoringRef names: a single stop,
+// or every stop of a station.
+func siriMonitoredStation(index *GTFSIndex, ref string) *Station {
+	if stop, ok := index.Stops[ref]; ok && stop.LocationType != LocationStation {
+		return &Station{
+			ID:        stop.StopID,
+			Name:      stop.StopName,
+			Latitude:  stop.Latitude,
+			Longitude: stop.Longitude,
+			StopIDs:   []string{stop.StopID},
+		}
+	}
+	return index.Station(ref)
+}
+
+// siriFormat returns "xml" or "json" from the extension of a SIRI path.
+func siriFormat(path string) string {
+	if strings.HasSuffix(path, ".json") {
+		return "json"
+	}
+	return "xml"
+}
+
+// serveSiri writes a delivery as SIRI XML, or as SIRI Lite JSON.
+func serveSiri(w http.ResponseWriter, format string, response SiriResponse) {
+	var err error
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(struct{ Siri SiriResponse }{response})
+	} else {
+		w.Header().Set("Content-Type", "application/xml")
+		err = writeXML(w, response)
+	}
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// siriVehicleMonitoringHandler serves /siri/vehicle-monitoring.xml and .json,
+// optionally filtered by LineRef and VehicleRef.
+func siriVehicleMonitoringHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	feed := currentFeed()
+	response := buildVehicleMonitoring(gtfsIndex, feed.Buses, feed.TripUpdates,
+		query.Get("LineRef"), query.Get("VehicleRef"), time.Now())
+	serveSiri(w, siriFormat(r.URL.Path), response)
+}
+
+// siriStopMonitoringHandler serves /siri/stop-monitoring.xml and .json for
+// the stop or station in MonitoringRef, optionally filtered by LineRef, with
+// up to MaximumStopVisits visits in the next MinutesAhead minutes.
+func siriStopMonitoringHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ref := query.Get("MonitoringRef")
+	if ref == "" {
+		http.Error(w, "MonitoringRef not provided", http.StatusBadRequest)
+		return
+	}
+	station := siriMonitoredStation(gtfsIndex, ref)
+	if station == nil {
+		http.Error(w, "Stop not found", http.StatusNotFound)
+		return
+	}
+
+	maxVisits := defaultSiriStopVisits
+	if value := query.Get("MaximumStopVisits"); value != "" {
+		var err error
+		maxVisits, err = strconv.Atoi(value)
+		if err != nil || maxVisits < 1 || maxVisits > maxSiriStopVisits {
+			http.Error(w, "Invalid MaximumStopVisits", http.StatusBadRequest)
+			return
+		}
+	}
+	minutes := defaultDepartureMinutes
+	if value := query.Get("MinutesAhead"); value != "" {
+		var err error
+		minutes, err = strconv.Atoi(value)
+		if err != nil || minutes < 1 || minutes > maxDepartureMinutes {
+			http.Error(w, "Invalid MinutesAhead", http.StatusBadRequest)
+			return
+		}
+	}
+
+	feed := currentFeed()
+	response := buildStopMonitoring(gtfsIndex, station, feed.Buses, feed.TripUpdates,
+		query.Get("LineRef"), maxVisits, time.Duration(minutes)*time.Minute, time.Now())
+	serveSiri(w, siriFormat(r.URL.Path), response)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestSiriFeed() ([]BusPosition, []TripUpdate) {
+	buses := []BusPosition{{
+		ID: "2301", TripID: "t1", RouteID: "r1", Latitude: 33.75, Longitude: -84.395, Bearing: 90,
+		OccupancyStatus: pb.VehiclePosition_STANDING_ROOM_ONLY.String(),
+		Timestamp:       time.Date(2023, 10, 16, 7, 59, 45, 0, time.UTC).Unix(),
+	}}
+	tripUpdates := []TripUpdate{{
+		Trip:    &pb.TripDescriptor{TripId: proto.String("t1"), StartDate: proto.String("20231016")},
+		Vehicle: &pb.VehicleDescriptor{Id: proto.String("2301")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			newTestStopTimeUpdate(2, "B", time.Date(2023, 10, 16, 8, 5, 0, 0, time.UTC)),
+		},
+	}}
+	return buses, tripUpdates
+}
+
+func TestBuildVehicleMonitoring(t *testing.T) {
+	index := newTestIndex()
+	buses, tripUpdates := newTestSiriFeed()
+	now := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	response := buildVehicleMonitoring(index, buses, tripUpdates, "r1", "", now)
+	activities := response.ServiceDelivery.VehicleMonitoringDelivery[0].VehicleActivity
+	if len(activities) != 1 {
+		t.Fatalf("Expected 1 vehicle activity, got %d", len(activities))
+	}
+	if activities[0].RecordedAtTime != "2023-10-16T07:59:45Z" {
+		t.Errorf("Expected the vehicle's report time, got %s", activities[0].RecordedAtTime)
+	}
+	journey := activities[0].MonitoredVehicleJourney
+	if journey.LineRef != "r1" || journey.DirectionRef != "0" || journey.PublishedLineName != "1" {
+		t.Errorf("Expected line r1 direction 0 named 1, got %s %s %s", journey.LineRef, journey.DirectionRef, journey.PublishedLineName)
+	}
+	if journey.FramedVehicleJourneyRef != (SiriFramedVehicleJourneyRef{DataFrameRef: "2023-10-16", DatedVehicleJourneyRef: "t1"}) {
+		t.Errorf("Unexpected journey ref %v", journey.FramedVehicleJourneyRef)
+	}
+	if journey.OriginRef != "A" || journey.DestinationRef != "C" || journey.DestinationName != "EAST" {
+		t.Errorf("Expected A to C, EAST, got %s to %s, %s", journey.OriginRef, journey.DestinationRef, journey.DestinationName)
+	}
+	if journey.Delay != "PT2M" || journey.Occupancy != "standingAvailable" || !journey.Monitored {
+		t.Errorf("Expected a monitored journey 2 minutes late with standing room, got %s %s %v", journey.Delay, journey.Occupancy, journey.Monitored)
+	}
+	if journey.MonitoredCall == nil || journey.MonitoredCall.StopPointRef != "B" || journey.MonitoredCall.ExpectedArrivalTime != "2023-10-16T08:05:00Z" {
+		t.Errorf("Expected the next call at B at 08:05, got %+v", journey.MonitoredCall)
+	}
+
+	response = buildVehicleMonitoring(index, buses, tripUpdates, "r2", "", now)
+	if len(response.ServiceDelivery.VehicleMonitoringDelivery[0].VehicleActivity) != 0 {
+		t.Errorf("Expected no vehicles on line r2")
+	}
+}
+
+func TestBuildStopMonitoring(t *testing.T) {
+	index := newTestIndex()
+	buses, tripUpdates := newTestSiriFeed()
+	now := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	response := buildStopMonitoring(index, siriMonitoredStation(index, "B"), buses, tripUpdates, "", 2, time.Hour, now)
+	visits := response.ServiceDelivery.StopMonitoringDelivery[0].MonitoredStopVisit
+	if len(visits) != 2 {
+		t.Fatalf("Expected 2 visits, got %d", len(visits))
+	}
+	first, second := visits[0].MonitoredVehicleJourney, visits[1].MonitoredVehicleJourney
+	if first.VehicleRef != "2301" || first.Delay != "PT2M" || first.MonitoredCall.ExpectedDepartureTime != "2023-10-16T08:05:00Z" {
+		t.Errorf("Expected vehicle 2301 at 08:05, 2 minutes late, got %s %s %+v", first.VehicleRef, first.Delay, first.MonitoredCall)
+	}
+	if first.MonitoredCall.Order != 2 || visits[0].MonitoringRef != "B" {
+		t.Errorf("Expected the call at B, order 2, got %s %d", visits[0].MonitoringRef, first.MonitoredCall.Order)
+	}
+	if second.Monitored || second.FramedVehicleJourneyRef.DatedVehicleJourneyRef != "t2" || second.MonitoredCall.AimedDepartureTime != "2023-10-16T08:13:00Z" {
+		t.Errorf("Expected the scheduled t2 at 08:13, got %+v", second)
+	}
+}
+
+func TestServeSiri(t *testing.T) {
+	index := newTestIndex()
+	buses, tripUpdates := newTestSiriFeed()
+	response := buildVehicleMonitoring(index, buses, tripUpdates, "", "", time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC))
+
+	var xmlBuf bytes.Buffer
+	if err := writeXML(&xmlBuf, response); err != nil {
+		t.Fatalf("writeXML error: %v", err)
+	}
+	for _, expected := range []string{`<Siri xmlns="http://www.siri.org.uk/siri" version="2.0">`, `<VehicleMonitoringDelivery version="2.0">`, "<Delay>PT2M</Delay>"} {
+		if !strings.Contains(xmlBuf.String(), expected) {
+			t.Errorf("Expected %s in %s", expected, xmlBuf.String())
+		}
+	}
+	if strings.Contains(xmlBuf.String(), "StopMonitoringDelivery") {
+		t.Errorf("Expected no stop monitoring delivery")
+	}
+
+	var lite map[string]map[string]map[string]interface{}
+	data, err := json.Marshal(struct{ Siri SiriResponse }{response})
+	if err != nil {
+		t.Fatalf("json error: %v", err)
+	}
+	if err := json.Unmarshal(data, &lite); err != nil {
+		t.Fatalf("json error: %v", err)
+	}
+	if _, ok := lite["Siri"]["ServiceDelivery"]["VehicleMonitoringDelivery"]; !ok {
+		t.Errorf("Expected a SIRI Lite vehicle monitoring delivery, got %s", data)
+	}
+}
+
+func TestSiriDuration(t *testing.T) {
+	cases := map[int]string{0: "PT0S", 120: "PT2M", 3725: "PT1H2M5S", -45: "-PT45S"}
+	for seconds, expected := range cases {
+		if duration := siriDuration(seconds); duration != expected {
+			t.Errorf("Expected %s for %d seconds, got %s", expected, seconds, duration)
+		}
+	}
+}
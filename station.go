@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
+
+// location_type values of stops.txt. An empty value is a stop or platform.
+const (
+	LocationStop         = "0"
+	LocationStation      = "1"
+	LocationEntrance     = "2"
+	LocationGenericNode  = "3"
+	LocationBoardingArea = "4"
+)
+
+const (
+	// stationGroupMeters bounds how far apart same-named stops may be to be
+	// grouped into one derived station.
+	stationGroupMeters = 300.0
+	// stationVehicleMeters is how close a vehicle must be to count as at a
+	// station when it doesn't report one of its stops.
+	stationVehicleMeters = 200.0
+
+	defaultDepartureMinutes = 60
+	maxDepartureMinutes     = 360
+)
+
+// Station is a place made of one or more stops. Feeds that model stations
+// set location_type and parent_station; for those that don't, stops sharing
+// a station name within stationGroupMeters are grouped and Derived is set.
+type Station struct {
+	ID                 string
+	Name               string
+	Latitude           float64
+	Longitude          float64
+	WheelchairBoarding string
+	Derived            bool
+	StopIDs            []string
+}
+
+// Stations returns every station, ordered by name.
+func (g *GTFSIndex) Stations() []*Station {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.buildStations()
+	stations := make([]*Station, 0, len(g.stations))
+	for _, station := range g.stations {
+		stations = append(stations, station)
+	}
+	sort.Slice(stations, func(i, j int) bool {
+		if stations[i].Name != stations[j].Name {
+			return stations[i].Name < stations[j].Name
+		}
+		return stations[i].ID < stations[j].ID
+	})
+	return stations
+}
+
+// Station returns a station by its ID or by the ID of one of its stops.
+func (g *GTFSIndex) Station(id string) *Station {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.buildStations()
+	if station, ok := g.stations[id]; ok {
+		return station
+	}
+	return g.stations[g.stationOf[id]]
+}
+
+// buildStations fills the station lookups on first use. g.mu must be held.
+func (g *GTFSIndex) buildStations() {
+	if g.stations != nil {
+		return
+	}
+	g.stations = make(map[string]*Station)
+	g.stationOf = make(map[string]string)
+
+	stopIDs := make([]string, 0, len(g.Stops))
+	explicit := false
+	for id, stop := range g.Stops {
+		stopIDs = append(stopIDs, id)
+		if stop.LocationType == LocationStation {
+			explicit = true
+		}
+	}
+	sort.Strings(stopIDs)
+
+	if explicit {
+		g.buildExplicitStations(stopIDs)
+	} else {
+		g.buildDerivedStations(stopIDs)
+	}
+}
+
+// buildExplicitStations follows parent_station, which may take two steps
+// from a boarding area through its platform.
+func (g *GTFSIndex) buildExplicitStations(stopIDs []string) {
+	for _, id := range stopIDs {
+		stop := g.Stops[id]
+		if stop.LocationType != LocationStation {
+			continue
+		}
+		g.stations[id] = &Station{
+			ID:                 id,
+			Name:               stop.StopName,
+			Latitude:           stop.Latitude,
+			Longitude:          stop.Longitude,
+			WheelchairBoarding: stop.WheelchairBoarding,
+			StopIDs:            make([]string, 0),
+		}
+	}
+
+	for _, id := range stopIDs {
+		parent := g.Stops[id].ParentStation
+		for depth := 0; depth < 2 && parent != ""; depth++ {
+			if station, ok := g.stations[parent]; ok {
+				station.StopIDs = append(station.StopIDs, id)
+				g.stationOf[id] = parent
+				break
+			}
+			parent = g.Stops[parent].ParentStation
+		}
+	}
+}
+
+// buildDerivedStations groups stops whose names share a station name, such
+// as "WEST LAKE STATION" and "WEST LAKE STATION - WEST LOOP".
+func (g *GTFSIndex) buildDerivedStations(stopIDs []string) {
+	byName := make(map[string][]*Station)
+	for _, id := range stopIDs {
+		stop := g.Stops[id]
+		if stop.LocationType != "" && stop.LocationType != LocationStop {
+			continue
+		}
+		name := stationName(stop.StopName)
+		if name == "" {
+			continue
+		}
+
+		var station *Station
+		for _, candidate := range byName[name] {
+			if haversineMeters(candidate.Latitude, candidate.Longitude, stop.Latitude, stop.Longitude) <= stationGroupMeters {
+				station = candidate
+				break
+			}
+		}
+		if station == nil {
+			station = &Station{ID: stationSlug(name), Name: name, Derived: true, StopIDs: make([]string, 0)}
+			if n := len(byName[name]); n > 0 {
+				station.ID += "-" + strconv.Itoa(n+1)
+			}
+			byName[name] = append(byName[name], station)
+			g.stations[station.ID] = station
+		}
+
+		// Keep the station at the centroid of its stops.
+		n := float64(len(station.StopIDs))
+		station.Latitude = (station.Latitude*n + stop.Latitude) / (n + 1)
+		station.Longitude = (station.Longitude*n + stop.Longitude) / (n + 1)
+		station.StopIDs = append(station.StopIDs, id)
+		g.stationOf[id] = station.ID
+	}
+
+	// A station is accessible when any of its stops is, and inaccessible
+	// only when all of them are.
+	for _, station := range g.stations {
+		inaccessible := 0
+		for _, id := range station.StopIDs {
+			switch g.Stops[id].WheelchairBoarding {
+			case WheelchairYes:
+				station.WheelchairBoarding = WheelchairYes
+			case WheelchairNo:
+				inaccessible++
+			}
+		}
+		if station.WheelchairBoarding == "" && inaccessible == len(station.StopIDs) {
+			station.WheelchairBoarding = WheelchairNo
+		}
+	}
+}
+
+// stationName returns the station a stop name refers to, dropping any bay or
+// loop suffix, or "" when the stop isn't at a station.
+func stationName(stopName string) string {
+	name := strings.TrimSpace(stopName)
+	if i := strings.Index(name, " - "); i >= 0 {
+		name = strings.TrimSpace(name[:i])
+	}
+	if !strings.HasSuffix(strings.ToUpper(name), "STATION") {
+		return ""
+	}
+	return name
+}
+
+// stationSlug turns a station name into an ID, e.g. "west-lake-station".
+func stationSlug(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// StationDeparture is a departure from one of the stops of a station, with
+// its prediction when the trip is in the trip updates feed. Accessible is set
+// when both the trip and the stop are wheelchair accessible.
+type StationDeparture struct {
+	StopID               string
+	StopName             string
+	TripID               string
+	RouteID              string
+	RouteShortName       string
+	Headsign             string
+	VehicleID            string
+	ScheduledDeparture   *time.Time
+	PredictedDeparture   *time.Time
+	DelaySeconds         *int
+	Realtime             bool
+	WheelchairAccessible string
+	WheelchairBoarding   string
+	Accessible           bool
+}
+
+// StationDetail is a station with its stops, departures and vehicles.
+type StationDetail struct {
+	Station    Station
+	Stops      []Stop
+	Departures []StationDeparture
+	Vehicles   []BusPosition
+	Alerts     []Alert
+}
+
+// stationDetailHandler serves /stations/{id}, where id may also be the ID of
+// one of the station's stops.
+func stationDetailHandler(w http.ResponseWriter, r *http.Request) {
+	stationID := strings.TrimPrefix(r.URL.Path, "/stations/")
+	if stationID == "" || strings.Contains(stationID, "/") {
+		http.Error(w, "Station ID not provided", http.StatusBadRequest)
+		return
+	}
+
+	minutes := defaultDepartureMinutes
+	if value := r.URL.Query().Get("minutes"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid minutes", http.StatusBadRequest)
+			return
+		}
+		minutes = parsed
+		if minutes > maxDepartureMinutes {
+			minutes = maxDepartureMinutes
+		}
+	}
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+
+	station := gtfsIndex.Station(stationID)
+	if station == nil {
+		http.Error(w, "Station not found", http.StatusNotFound)
+		return
+	}
+
+	feed := currentFeed()
+	detail := buildStationDetail(gtfsIndex, station, feed.Buses, feed.TripUpdates, feed.Alerts, time.Duration(minutes)*time.Minute, time.Now())
+	if accessible {
+		detail.Stops = accessibleStops(detail.Stops)
+		detail.Vehicles = accessibleBuses(detail.Vehicles)
+		detail.Departures = accessibleDepartures(detail.Departures)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(detail)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+func stationsHandler(w http.ResponseWriter, r *http.Request) {
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+
+	stations := gtfsIndex.Stations()
+	if accessible {
+		filtered := make([]*Station, 0, len(stations))
+		for _, station := range stations {
+			if station.WheelchairBoarding == WheelchairYes {
+				filtered = append(filtered, station)
+			}
+		}
+		stations = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(stations)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// buildStationDetail aggregates the departures within window of now and the
+// vehicles at every stop of a station.
+func buildStationDetail(index *GTFSIndex, station *Station, buses []BusPosition, tripUpdates []TripUpdate, alerts []Alert, window time.Duration, now time.Time) StationDetail {
+	detail := StationDetail{
+		Station:    *station,
+		Stops:      make([]Stop, 0, len(station.StopIDs)),
+		Departures: stationDepartures(index, station, tripUpdates, window, now),
+		Vehicles:   make([]BusPosition, 0),
+		Alerts:     make([]Alert, 0),
+	}
+
+	members := make(map[string]bool, len(station.StopIDs))
+	for _, id := range station.StopIDs {
+		members[id] = true
+		detail.Stops = append(detail.Stops, index.Stops[id])
+	}
+
+	for _, bus := range buses {
+		if members[bus.StopID] || haversineMeters(station.Latitude, station.Longitude, bus.Latitude, bus.Longitude) <= stationVehicleMeters {
+			detail.Vehicles = append(detail.Vehicles, bus)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, id := range station.StopIDs {
+		for _, alert := range activeAlerts(alerts, "", "", id, now) {
+			if !seen[alert.ID] {
+				seen[alert.ID] = true
+				detail.Alerts = append(detail.Alerts, alert)
+			}
+		}
+	}
+
+	return detail
+}
+
+// stationDepartures merges the predicted departures from the trip updates
+// with the scheduled ones of trips that have no prediction, ordered by the
+// best known departure time.
+func stationDepartures(index *GTFSIndex, station *Station, tripUpdates []TripUpdate, window time.Duration, now time.Time) []StationDeparture {
+	members := make(map[string]bool, len(station.StopIDs))
+	for _, id := range station.StopIDs {
+		members[id] = true
+	}
+	departures := make([]StationDeparture, 0)
+	predicted := make(map[string]bool)
+	from, to := now.Add(-time.Minute), now.Add(window)
+
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		serviceDate := index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+		for _, update := range tripUpdate.StopTimeUpdate {
+			stopTime, scheduled := index.StopTimeFor(tripID, update.GetStopSequence(), update.GetStopId())
+			stopID := update.GetStopId()
+			if stopID == "" {
+				stopID = stopTime.StopID
+			}
+			if !members[stopID] || update.GetScheduleRelationship() == pb.TripUpdate_StopTimeUpdate_SKIPPED {
+				continue
+			}
+
+			departure := newStationDeparture(index, stopID, tripID, tripUpdate.Trip.GetRouteId())
+			departure.VehicleID = tripUpdate.Vehicle.GetId()
+			departure.Realtime = true
+			if scheduled {
+				scheduledDeparture := index.ScheduledTime(serviceDate, stopTime.DepartureTime)
+				departure.ScheduledDeparture = &scheduledDeparture
+			}
+			departure.PredictedDeparture, departure.DelaySeconds = resolveStopTimeEvent(index, serviceDate, stopTime.DepartureTime, scheduled, update.GetDeparture())
+			if departure.PredictedDeparture == nil && departure.DelaySeconds == nil {
+				departure.PredictedDeparture, departure.DelaySeconds = resolveStopTimeEvent(index, serviceDate, stopTime.ArrivalTime, scheduled, update.GetArrival())
+			}
+
+			when := departureTime(departure)
+			if when != nil && (when.Before(from) || when.After(to)) {
+				continue
+			}
+			predicted[tripID] = true
+			departures = append(departures, departure)
+		}
+	}
+
+	// Trips running past midnight belong to the previous service day.
+	today := index.ServiceDate(now)
+	for _, serviceDate := range []time.Time{today.AddDate(0, 0, -1), today} {
+		for _, id := range station.StopIDs {
+			for _, stopTime := range index.StopTimesAt(id) {
+				trip := index.Trips[stopTime.TripID]
+				if predicted[stopTime.TripID] || !index.ServiceActive(trip.ServiceID, serviceDate) {
+					continue
+				}
+				scheduledDeparture := index.ScheduledTime(serviceDate, stopTime.DepartureTime)
+				if scheduledDeparture.Before(from) || scheduledDeparture.After(to) {
+					continue
+				}
+				departure := newStationDeparture(index, id, stopTime.TripID, trip.RouteID)
+				departure.ScheduledDeparture = &scheduledDeparture
+				departures = append(departures, departure)
+			}
+		}
+	}
+
+	sort.SliceStable(departures, func(i, j int) bool {
+		a, b := departureTime(departures[i]), departureTime(departures[j])
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.Before(*b)
+	})
+	return departures
+}
+
+func newStationDeparture(index *GTFSIndex, stopID, tripID, routeID string) StationDeparture {
+	trip := index.Trips[tripID]
+	if routeID == "" {
+		routeID = trip.RouteID
+	}
+	stop := index.Stops[stopID]
+	return StationDeparture{
+		StopID:               stopID,
+		StopName:             stop.StopName,
+		TripID:               tripID,
+		RouteID:              routeID,
+		RouteShortName:       index.Routes[routeID].ShortName,
+		Headsign:             trip.Headsign,
+		WheelchairAccessible: trip.WheelchairAccessible,
+		WheelchairBoarding:   stop.WheelchairBoarding,
+		Accessible:           trip.WheelchairAccessible == WheelchairYes && stepFreeBoarding(stop),
+	}
+}
+
+// departureTime is the predicted departure when there is one, otherwise the
+// scheduled one.
+func departureTime(departure StationDeparture) *time.Time {
+	if departure.PredictedDeparture != nil {
+		return departure.PredictedDeparture
+	}
+	return departure.ScheduledDeparture
+}
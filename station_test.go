@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDerivedStations(t *testing.T) {
+	index := newTestIndex()
+	index.Stops["28"] = Stop{StopID: "28", StopName: "WEST LAKE STATION", Latitude: 33.753328, Longitude: -84.445329, WheelchairBoarding: "1"}
+	index.Stops["39"] = Stop{StopID: "39", StopName: "WEST LAKE STATION", Latitude: 33.753247, Longitude: -84.445568, WheelchairBoarding: "2"}
+	index.Stops["99900"] = Stop{StopID: "99900", StopName: "WEST LAKE STATION - WEST LOOP", Latitude: 33.752833, Longitude: -84.445389}
+	index.Stops["far"] = Stop{StopID: "far", StopName: "WEST LAKE STATION", Latitude: 33.80, Longitude: -84.445329}
+
+	station := index.Station("west-lake-station")
+	if station == nil {
+		t.Fatalf("Expected station west-lake-station")
+	}
+	if len(station.StopIDs) != 3 || !station.Derived {
+		t.Errorf("Expected 3 derived stops, got %v", station.StopIDs)
+	}
+	if station.WheelchairBoarding != "1" {
+		t.Errorf("Expected the station to be accessible, got %q", station.WheelchairBoarding)
+	}
+	if index.Station("39") != station {
+		t.Errorf("Expected stop 39 to resolve to its station")
+	}
+	if other := index.Station("far"); other == nil || other.ID != "west-lake-station-2" {
+		t.Errorf("Expected the distant stop in its own station, got %+v", other)
+	}
+	if index.Station("A") != nil {
+		t.Errorf("Expected stop A not to be in a station")
+	}
+	if len(index.Stations()) != 2 {
+		t.Errorf("Expected 2 stations, got %d", len(index.Stations()))
+	}
+}
+
+func TestExplicitStations(t *testing.T) {
+	index := newTestIndex()
+	index.Stops["S"] = Stop{StopID: "S", StopName: "CENTRAL", LocationType: LocationStation}
+	index.Stops["P1"] = Stop{StopID: "P1", StopName: "CENTRAL STATION PLATFORM 1", ParentStation: "S"}
+	index.Stops["E1"] = Stop{StopID: "E1", StopName: "CENTRAL STATION ENTRANCE", LocationType: LocationEntrance, ParentStation: "S"}
+	index.Stops["BA"] = Stop{StopID: "BA", StopName: "CENTRAL STATION BAY A", LocationType: LocationBoardingArea, ParentStation: "P1"}
+
+	station := index.Station("BA")
+	if station == nil || station.ID != "S" || station.Derived {
+		t.Fatalf("Expected boarding area BA to resolve to station S, got %+v", station)
+	}
+	if len(station.StopIDs) != 3 {
+		t.Errorf("Expected 3 children, got %v", station.StopIDs)
+	}
+	if len(index.Stations()) != 1 {
+		t.Errorf("Expected only the explicit station, got %d", len(index.Stations()))
+	}
+}
+
+func TestBuildStationDetail(t *testing.T) {
+	index := newTestIndex()
+	index.Stops["B"] = Stop{StopID: "B", StopName: "SECOND STATION", Latitude: 33.75, Longitude: -84.39, WheelchairBoarding: WheelchairYes}
+	index.Stops["B2"] = Stop{StopID: "B2", StopName: "SECOND STATION - BAY 2", Latitude: 33.7501, Longitude: -84.39}
+	trip := index.Trips["t2"]
+	trip.WheelchairAccessible = WheelchairYes
+	index.Trips["t2"] = trip
+	station := index.Station("B")
+	if station == nil {
+		t.Fatalf("Expected stop B to be in a station")
+	}
+
+	now := time.Date(2023, 10, 16, 8, 0, 0, 0, time.UTC)
+	buses := []BusPosition{
+		{ID: "2301", TripID: "t1", StopID: "B", Latitude: 33.75, Longitude: -84.395},
+		{ID: "2302", Latitude: 33.7502, Longitude: -84.3901},
+		{ID: "2303", Latitude: 33.75, Longitude: -84.40},
+	}
+	tripUpdates := []TripUpdate{{
+		Trip:    &pb.TripDescriptor{TripId: proto.String("t1"), StartDate: proto.String("20231016")},
+		Vehicle: &pb.VehicleDescriptor{Id: proto.String("2301")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			newTestStopTimeUpdate(2, "B", time.Date(2023, 10, 16, 8, 5, 0, 0, time.UTC)),
+		},
+	}}
+
+	detail := buildStationDetail(index, station, buses, tripUpdates, nil, 20*time.Minute, now)
+
+	if len(detail.Departures) != 2 {
+		t.Fatalf("Expected 2 departures, got %d", len(detail.Departures))
+	}
+	first, second := detail.Departures[0], detail.Departures[1]
+	if first.TripID != "t1" || !first.Realtime || first.DelaySeconds == nil || *first.DelaySeconds != 120 {
+		t.Errorf("Expected t1 predicted 120s late first, got %+v", first)
+	}
+	if first.VehicleID != "2301" || first.RouteShortName != "1" || first.Headsign != "EAST" {
+		t.Errorf("Expected t1 to carry its vehicle, route and headsign, got %+v", first)
+	}
+	if second.TripID != "t2" || second.Realtime || !second.ScheduledDeparture.Equal(time.Date(2023, 10, 16, 8, 13, 0, 0, time.UTC)) {
+		t.Errorf("Expected t2 scheduled at 08:13 second, got %+v", second)
+	}
+
+	if first.Accessible || !second.Accessible {
+		t.Errorf("Expected only the accessible trip t2 to be accessible")
+	}
+	if accessible := accessibleDepartures(detail.Departures); len(accessible) != 1 || accessible[0].TripID != "t2" {
+		t.Errorf("Expected only t2 to remain accessible, got %+v", accessible)
+	}
+
+	if len(detail.Vehicles) != 2 || detail.Vehicles[0].ID != "2301" || detail.Vehicles[1].ID != "2302" {
+		t.Errorf("Expected vehicles 2301 and 2302 at the station, got %+v", detail.Vehicles)
+	}
+	if len(detail.Stops) != 2 {
+		t.Errorf("Expected 2 stops, got %d", len(detail.Stops))
+	}
+}
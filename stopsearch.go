@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// stopGridDegrees is the cell size of the spatial index, about 1.1km of
+	// latitude.
+	stopGridDegrees = 0.01
+
+	defaultStopPageSize = 20
+	maxStopPageSize     = 100
+	defaultNearbyRadius = 500.0
+	maxNearbyRadius     = 5000.0
+)
+
+var stopIndex *StopIndex
+
+type gridCell struct {
+	Lat int
+	Lon int
+}
+
+// StopIndex answers stop searches by name, code and location.
+type StopIndex struct {
+	stops  []Stop
+	names  []string
+	byCode map[string][]int
+	grid   map[gridCell][]int
+}
+
+// NewStopIndex indexes the given stops, ordered by name.
+func NewStopIndex(stops map[string]Stop) *StopIndex {
+	index := &StopIndex{
+		stops:  make([]Stop, 0, len(stops)),
+		byCode: make(map[string][]int),
+		grid:   make(map[gridCell][]int),
+	}
+	for _, stop := range stops {
+		index.stops = append(index.stops, stop)
+	}
+	sort.Slice(index.stops, func(i, j int) bool {
+		if index.stops[i].StopName != index.stops[j].StopName {
+			return index.stops[i].StopName < index.stops[j].StopName
+		}
+		return index.stops[i].StopID < index.stops[j].StopID
+	})
+
+	index.names = make([]string, len(index.stops))
+	for i, stop := range index.stops {
+		index.names[i] = strings.ToLower(stop.StopName)
+		if stop.StopCode != "" {
+			index.byCode[stop.StopCode] = append(index.byCode[stop.StopCode], i)
+		}
+		cell := cellFor(stop.Latitude, stop.Longitude)
+		index.grid[cell] = append(index.grid[cell], i)
+	}
+
+	return index
+}
+
+func cellFor(lat, lon float64) gridCell {
+	return gridCell{Lat: int(math.Floor(lat / stopGridDegrees)), Lon: int(math.Floor(lon / stopGridDegrees))}
+}
+
+// StopMatch is a stop found by a search. Lower scores are better matches.
+type StopMatch struct {
+	Stop  Stop
+	Score int
+}
+
+// Search matches a query against stop codes exactly and stop names case
+// insensitively: whole-name prefixes first, then word prefixes, substrings
+// and finally words within a small edit distance. With accessible, only
+// stops with step-free boarding match.
+func (s *StopIndex) Search(query string, accessible bool) []StopMatch {
+	query = strings.TrimSpace(query)
+	matches := make([]StopMatch, 0)
+	if query == "" {
+		return matches
+	}
+
+	seen := make(map[int]bool)
+	for _, i := range s.byCode[query] {
+		seen[i] = true
+		if accessible && !stepFreeBoarding(s.stops[i]) {
+			continue
+		}
+		matches = append(matches, StopMatch{Stop: s.stops[i], Score: 0})
+	}
+
+	lowered := strings.ToLower(query)
+	queryWords := strings.Fields(lowered)
+	for i, name := range s.names {
+		if seen[i] || (accessible && !stepFreeBoarding(s.stops[i])) {
+			continue
+		}
+		if score, ok := nameScore(name, lowered, queryWords); ok {
+			matches = append(matches, StopMatch{Stop: s.stops[i], Score: score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score < matches[j].Score
+	})
+	return matches
+}
+
+// nameScore rates how well a lowercased stop name matches a lowercased query.
+func nameScore(name, query string, queryWords []string) (int, bool) {
+	if strings.HasPrefix(name, query) {
+		return 1, true
+	}
+	nameWords := strings.Fields(name)
+	if hasWordPrefix(nameWords, queryWords) {
+		return 2, true
+	}
+	if strings.Contains(name, query) {
+		return 3, true
+	}
+
+	// Every query word must be close to some word of the name.
+	total := 0
+	for _, queryWord := range queryWords {
+		allowed := 1
+		if len(queryWord) < 4 {
+			allowed = 0
+		} else if len(queryWord) >= 8 {
+			allowed = 2
+		}
+		best := allowed + 1
+		for _, nameWord := range nameWords {
+			candidate := nameWord
+			// Compare against the prefix so partially typed words still match.
+			if len(candidate) > len(queryWord) {
+				candidate = candidate[:len(queryWord)]
+			}
+			if distance := levenshtein(queryWord, candidate); distance < best {
+				best = distance
+			}
+		}
+		if best > allowed {
+			return 0, false
+		}
+		total += best
+	}
+	return 4 + total, true
+}
+
+// hasWordPrefix reports whether the query words prefix consecutive words of
+// the name, e.g. "five poi" in "peachtree st & five points".
+func hasWordPrefix(nameWords, queryWords []string) bool {
+	if len(queryWords) == 0 {
+		return false
+	}
+	for start := 0; start+len(queryWords) <= len(nameWords); start++ {
+		matched := true
+		for i, queryWord := range queryWords {
+			nameWord := nameWords[start+i]
+			last := i == len(queryWords)-1
+			if (last && !strings.HasPrefix(nameWord, queryWord)) || (!last && nameWord != queryWord) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// StopDistance is a stop found near a location.
+type StopDistance struct {
+	Stop           Stop
+	DistanceMeters float64
+}
+
+// Nearby returns the stops within radius meters of a location, closest first,
+// only those with step-free boarding when accessible is set. Only the grid
+// cells overlapping the radius are scanned.
+func (s *StopIndex) Nearby(lat, lon, radius float64, accessible bool) []StopDistance {
+	latSpan := radius / 111195
+	lonSpan := latSpan / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	minCell := cellFor(lat-latSpan, lon-lonSpan)
+	maxCell := cellFor(lat+latSpan, lon+lonSpan)
+
+	results := make([]StopDistance, 0)
+	for cellLat := minCell.Lat; cellLat <= maxCell.Lat; cellLat++ {
+		for cellLon := minCell.Lon; cellLon <= maxCell.Lon; cellLon++ {
+			for _, i := range s.grid[gridCell{Lat: cellLat, Lon: cellLon}] {
+				stop := s.stops[i]
+				if accessible && !stepFreeBoarding(stop) {
+					continue
+				}
+				distance := haversineMeters(lat, lon, stop.Latitude, stop.Longitude)
+				if distance <= radius {
+					results = append(results, StopDistance{Stop: stop, DistanceMeters: distance})
+				}
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DistanceMeters < results[j].DistanceMeters
+	})
+	return results
+}
+
+// Page is one page of a paginated result.
+type Page struct {
+	Total   int
+	Limit   int
+	Offset  int
+	Results interface{}
+}
+
+// parsePagination reads limit and offset, clamping them to sane values.
+func parsePagination(r *http.Request) (limit, offset int, ok bool) {
+	limit, offset = defaultStopPageSize, 0
+	var err error
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return 0, 0, false
+		}
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, false
+		}
+	}
+	if limit > maxStopPageSize {
+		limit = maxStopPageSize
+	}
+	return limit, offset, true
+}
+
+// pageBounds returns the slice bounds of a page over total results.
+func pageBounds(total, limit, offset int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func stopSearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if strings.TrimSpace(query) == "" {
+		http.Error(w, "Query not provided", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := parsePagination(r)
+	if !ok {
+		http.Error(w, "Invalid pagination", http.StatusBadRequest)
+		return
+	}
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+
+	matches := stopIndex.Search(query, accessible)
+	start, end := pageBounds(len(matches), limit, offset)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(Page{Total: len(matches), Limit: limit, Offset: offset, Results: matches[start:end]})
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+func stopsNearbyHandler(w http.ResponseWriter, r *http.Request) {
+	lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		http.Error(w, "Invalid latitude", http.StatusBadRequest)
+		return
+	}
+	lon, err := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		http.Error(w, "Invalid longitude", http.StatusBadRequest)
+		return
+	}
+	radius := defaultNearbyRadius
+	if value := r.URL.Query().Get("radius"); value != "" {
+		if radius, err = strconv.ParseFloat(value, 64); err != nil || radius <= 0 {
+			http.Error(w, "Invalid radius", http.StatusBadRequest)
+			return
+		}
+	}
+	if radius > maxNearbyRadius {
+		radius = maxNearbyRadius
+	}
+	limit, offset, ok := parsePagination(r)
+	if !ok {
+		http.Error(w, "Invalid pagination", http.StatusBadRequest)
+		return
+	}
+	accessible, ok := parseAccessibleFilter(r)
+	if !ok {
+		http.Error(w, "Invalid accessible filter", http.StatusBadRequest)
+		return
+	}
+
+	results := stopIndex.Nearby(lat, lon, radius, accessible)
+	start, end := pageBounds(len(results), limit, offset)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(Page{Total: len(results), Limit: limit, Offset: offset, Results: results[start:end]})
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStopIndexSearch(t *testing.T) {
+	index := NewStopIndex(newTestIndex().Stops)
+
+	matches := index.Search("200", false)
+	if len(matches) != 1 || matches[0].Stop.StopID != "B" || matches[0].Score != 0 {
+		t.Errorf("Expected stop code 200 to match B exactly, got %+v", matches)
+	}
+
+	matches = index.Search("sec", false)
+	if len(matches) != 1 || matches[0].Stop.StopID != "B" {
+		t.Errorf("Expected prefix sec to match B, got %+v", matches)
+	}
+
+	matches = index.Search("st", false)
+	if len(matches) != 3 {
+		t.Errorf("Expected word prefix st to match 3 stops, got %d", len(matches))
+	}
+
+	matches = index.Search("thirf", false)
+	if len(matches) != 1 || matches[0].Stop.StopID != "C" {
+		t.Errorf("Expected misspelled thirf to match C, got %+v", matches)
+	}
+
+	matches = index.Search("fifth", false)
+	if len(matches) != 0 {
+		t.Errorf("Expected no match for fifth, got %+v", matches)
+	}
+}
+
+func TestStopIndexNearby(t *testing.T) {
+	index := NewStopIndex(newTestIndex().Stops)
+
+	// B is about 280m away, C about 650m and A about 1200m.
+	results := index.Nearby(33.75, -84.387, 1000, false)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 stops within 1000m, got %d", len(results))
+	}
+	if results[0].Stop.StopID != "B" || results[1].Stop.StopID != "C" {
+		t.Errorf("Expected B then C, got %s then %s", results[0].Stop.StopID, results[1].Stop.StopID)
+	}
+	if results[0].DistanceMeters > results[1].DistanceMeters {
+		t.Errorf("Expected results sorted by distance")
+	}
+
+	results = index.Nearby(33.75, -84.40, 10, false)
+	if len(results) != 1 || results[0].Stop.StopID != "A" {
+		t.Errorf("Expected only A within 10m, got %+v", results)
+	}
+}
+
+func TestStopIndexAccessible(t *testing.T) {
+	stops := newTestIndex().Stops
+	b := stops["B"]
+	b.WheelchairBoarding = WheelchairYes
+	stops["B"] = b
+	index := NewStopIndex(stops)
+
+	matches := index.Search("st", true)
+	if len(matches) != 1 || matches[0].Stop.StopID != "B" {
+		t.Errorf("Expected only B to match accessibly, got %+v", matches)
+	}
+	results := index.Nearby(33.75, -84.387, 1000, true)
+	if len(results) != 1 || results[0].Stop.StopID != "B" {
+		t.Errorf("Expected only B nearby accessibly, got %+v", results)
+	}
+}
+
+func TestStopSearchHandlerPagination(t *testing.T) {
+	stopIndex = NewStopIndex(newTestIndex().Stops)
+
+	req := httptest.NewRequest(http.MethodGet, "/stops/search?q=st&limit=2&offset=2", nil)
+	rr := httptest.NewRecorder()
+	stopSearchHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	var page struct {
+		Total   int
+		Limit   int
+		Offset  int
+		Results []StopMatch
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if page.Total != 3 || page.Limit != 2 || page.Offset != 2 || len(page.Results) != 1 {
+		t.Errorf("Expected the last of 3 results, got %+v", page)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/stops/nearby?lat=33.75", nil)
+	rr = httptest.NewRecorder()
+	stopsNearbyHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without lon, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxTileZoom = 22
+	// tileBuffer is how far, in tile units, geometry extends past the tile
+	// edge so lines and symbols don't end abruptly at the seams.
+	tileBuffer = 64
+	// tileSimplifyTolerance is the Douglas-Peucker tolerance in tile units.
+	// Tile units are coarser in meters at lower zooms, so shapes are
+	// simplified more the further out the map is.
+	tileSimplifyTolerance = 4
+)
+
+var tileServer *TileServer
+
+// TileServer renders Mapbox vector tiles of the static GTFS: a "shapes"
+// layer of route shapes and, from StopsMinZoom, a "stops" layer. Rendered
+// tiles are cached, least recently used first out. Live vehicles are never
+// cached and are added per request as a "vehicles" layer.
+type TileServer struct {
+	StopsMinZoom int
+	CacheSize    int
+
+	index *GTFSIndex
+
+	mu     sync.Mutex
+	shapes []tileShape
+	cache  map[string]*list.Element
+	order  *list.List
+}
+
+type tileShape struct {
+	shape      *ShapeLine
+	bounds     BoundingBox
+	properties map[string]interface{}
+}
+
+type cachedTile struct {
+	key  string
+	tile []byte
+}
+
+func NewTileServer(index *GTFSIndex, stopsMinZoom, cacheSize int) *TileServer {
+	return &TileServer{
+		StopsMinZoom: stopsMinZoom,
+		CacheSize:    cacheSize,
+		index:        index,
+		cache:        make(map[string]*list.Element),
+		order:        list.New(),
+	}
+}
+
+// Tile returns the static layers of a tile.
+func (t *TileServer) Tile(z, x, y int) []byte {
+	key := fmt.Sprintf("%d/%d/%d", z, x, y)
+
+	t.mu.Lock()
+	if element, ok := t.cache[key]; ok {
+		t.order.MoveToFront(element)
+		t.mu.Unlock()
+		return element.Value.(*cachedTile).tile
+	}
+	shapes := t.tileShapes()
+	t.mu.Unlock()
+
+	tile := t.render(shapes, z, x, y)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.cache[key]; !ok && t.CacheSize > 0 {
+		t.cache[key] = t.order.PushFront(&cachedTile{key: key, tile: tile})
+		for t.order.Len() > t.CacheSize {
+			oldest := t.order.Back()
+			t.order.Remove(oldest)
+			delete(t.cache, oldest.Value.(*cachedTile).key)
+		}
+	}
+	return tile
+}
+
+// tileShapes returns the shapes with their bounds and properties, built on
+// first use. t.mu must be held.
+func (t *TileServer) tileShapes() []tileShape {
+	if t.shapes != nil {
+		return t.shapes
+	}
+
+	ids := make([]string, 0, len(t.index.Shapes))
+	for id := range t.index.Shapes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t.shapes = make([]tileShape, 0, len(ids))
+	for _, id := range ids {
+		shape := t.index.Shapes[id]
+		properties := map[string]interface{}{"shape_id": id}
+		if route, ok := t.index.ShapeRoute(id); ok {
+			properties["route_id"] = route.ID
+			properties["route_short_name"] = route.ShortName
+			properties["route_long_name"] = route.LongName
+			properties["route_color"] = hexColor(route.Color)
+			properties["route_text_color"] = hexColor(route.TextColor)
+		}
+		t.shapes = append(t.shapes, tileShape{shape: shape, bounds: shape.Bounds(), properties: properties})
+	}
+	return t.shapes
+}
+
+func (t *TileServer) render(shapes []tileShape, z, x, y int) []byte {
+	bounds := tileBounds(z, x, y)
+
+	shapeLayer := newMVTLayer("shapes")
+	for _, shape := range shapes {
+		if !shape.bounds.Intersects(bounds) {
+			continue
+		}
+		points := make([]planarPoint, len(shape.shape.Points))
+		for i, point := range shape.shape.Points {
+			points[i] = tilePoint(point.Latitude, point.Longitude, z, x, y)
+		}
+		parts := clipPath(points, -tileBuffer, mvtExtent+tileBuffer)
+		for i, part := range parts {
+			parts[i] = simplifyPath(part, tileSimplifyTolerance)
+		}
+		shapeLayer.addLines(parts, shape.properties)
+	}
+	tile := shapeLayer.encode()
+
+	if z >= t.StopsMinZoom {
+		stopIDs := make([]string, 0)
+		for id, stop := range t.index.Stops {
+			if stop.LocationType != "" && stop.LocationType != LocationStop && stop.LocationType != LocationStation {
+				continue
+			}
+			if bounds.Contains(stop.Latitude, stop.Longitude) {
+				stopIDs = append(stopIDs, id)
+			}
+		}
+		sort.Strings(stopIDs)
+
+		stopLayer := newMVTLayer("stops")
+		for _, id := range stopIDs {
+			stop := t.index.Stops[id]
+			stopLayer.addPoint(tilePoint(stop.Latitude, stop.Longitude, z, x, y), map[string]interface{}{
+				"stop_id":             stop.StopID,
+				"name":                stop.StopName,
+				"code":                stop.StopCode,
+				"location_type":       stop.LocationType,
+				"wheelchair_boarding": stop.WheelchairBoarding,
+			})
+		}
+		tile = append(tile, stopLayer.encode()...)
+	}
+	return tile
+}
+
+// VehicleLayer returns a "vehicles" layer of the buses within a tile.
+func (t *TileServer) VehicleLayer(buses []BusPosition, z, x, y int) []byte {
+	bounds := tileBounds(z, x, y)
+	layer := newMVTLayer("vehicles")
+	for _, bus := range buses {
+		if !bounds.Contains(bus.Latitude, bus.Longitude) {
+			continue
+		}
+		layer.addPoint(tilePoint(bus.Latitude, bus.Longitude, z, x, y), map[string]interface{}{
+			"vehicle_id":       bus.ID,
+			"label":            bus.Label,
+			"display_name":     bus.DisplayName,
+			"route_id":         bus.RouteID,
+			"route_short_name": bus.RouteShortName,
+			"route_color":      hexColor(bus.RouteColor),
+			"trip_id":          bus.TripID,
+			"bearing":          bus.Bearing,
+			"current_status":   bus.CurrentStatus,
+			"occupancy_status": bus.OccupancyStatus,
+		})
+	}
+	return layer.encode()
+}
+
+// tilePoint projects a point to Web Mercator in the units of tile z/x/y.
+// Points outside the tile fall outside 0..mvtExtent.
+func tilePoint(lat, lon float64, z, x, y int) planarPoint {
+	n := math.Exp2(float64(z))
+	lat = math.Max(-85.0511, math.Min(85.0511, lat))
+	latRad := lat * math.Pi / 180
+	worldX := (lon + 180) / 360 * n
+	worldY := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	return planarPoint{
+		X: (worldX - float64(x)) * mvtExtent,
+		Y: (worldY - float64(y)) * mvtExtent,
+	}
+}
+
+// tileBounds returns the area of tile z/x/y including its buffer.
+func tileBounds(z, x, y int) BoundingBox {
+	n := math.Exp2(float64(z))
+	buffer := float64(tileBuffer) / mvtExtent
+	longitude := func(tileX float64) float64 {
+		return tileX/n*360 - 180
+	}
+	latitude := func(tileY float64) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*tileY/n))) * 180 / math.Pi
+	}
+	return BoundingBox{
+		MinLatitude:  latitude(float64(y+1) + buffer),
+		MinLongitude: longitude(float64(x) - buffer),
+		MaxLatitude:  latitude(float64(y) - buffer),
+		MaxLongitude: longitude(float64(x+1) + buffer),
+	}
+}
+
+// clipPath clips a path to the square min..max, returning the parts of it
+// within the square.
+func clipPath(points []planarPoint, min, max float64) [][]planarPoint {
+	parts := make([][]planarPoint, 0)
+	var part []planarPoint
+	for i := 1; i < len(points); i++ {
+		start, end, ok := clipSegment(points[i-1], points[i], min, max)
+		if !ok {
+			continue
+		}
+		if len(part) == 0 || start != points[i-1] {
+			if len(part) > 1 {
+				parts = append(parts, part)
+			}
+			part = []planarPoint{start}
+		}
+		part = append(part, end)
+		if end != points[i] {
+			parts = append(parts, part)
+			part = nil
+		}
+	}
+	if len(part) > 1 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// clipSegment clips the segment from a to b to the square min..max using
+// Liang-Barsky, reporting false when it lies entirely outside.
+func clipSegment(a, b planarPoint, min, max float64) (planarPoint, planarPoint, bool) {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	t0, t1 := 0.0, 1.0
+	edges := [4][2]float64{{-dx, a.X - min}, {dx, max - a.X}, {-dy, a.Y - min}, {dy, max - a.Y}}
+	for _, edge := range edges {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return a, b, false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return a, b, false
+			}
+			t0 = math.Max(t0, r)
+		} else {
+			if r < t0 {
+				return a, b, false
+			}
+			t1 = math.Min(t1, r)
+		}
+	}
+
+	start, end := a, b
+	if t0 > 0 {
+		start = planarPoint{X: a.X + t0*dx, Y: a.Y + t0*dy}
+	}
+	if t1 < 1 {
+		end = planarPoint{X: a.X + t1*dx, Y: a.Y + t1*dy}
+	}
+	return start, end, true
+}
+
+// hexColor returns a GTFS colour as a CSS colour, or "" when unset.
+func hexColor(color string) string {
+	if color == "" {
+		return ""
+	}
+	return "#" + color
+}
+
+// parseTilePath parses "{z}/{x}/{y}.mvt".
+func parseTilePath(path string) (int, int, int, bool) {
+	parts := strings.Split(strings.TrimSuffix(path, ".mvt"), "/")
+	if len(parts) != 3 || !strings.HasSuffix(path, ".mvt") {
+		return 0, 0, 0, false
+	}
+	z, errZ := strconv.Atoi(parts[0])
+	x, errX := strconv.Atoi(parts[1])
+	y, errY := strconv.Atoi(parts[2])
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > maxTileZoom {
+		return 0, 0, 0, false
+	}
+	if x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// tilesHandler serves /tiles/{z}/{x}/{y}.mvt, adding live vehicles when
+// vehicles=true.
+func tilesHandler(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := parseTilePath(strings.TrimPrefix(r.URL.Path, "/tiles/"))
+	if !ok {
+		http.Error(w, "Invalid tile", http.StatusBadRequest)
+		return
+	}
+	vehicles := false
+	if value := r.URL.Query().Get("vehicles"); value != "" {
+		var err error
+		vehicles, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid vehicles", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tile := tileServer.Tile(z, x, y)
+	if vehicles {
+		tile = append(append([]byte(nil), tile...), tileServer.VehicleLayer(currentFeed().Buses, z, x, y)...)
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	_, _ = w.Write(tile)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeTileLayers returns the number of features of every layer of a tile.
+func decodeTileLayers(t *testing.T, tile []byte) map[string]int {
+	layers := make(map[string]int)
+	for len(tile) > 0 {
+		number, typ, n := protowire.ConsumeTag(tile)
+		if n < 0 || number != 3 || typ != protowire.BytesType {
+			t.Fatalf("Expected a layer, got field %d", number)
+		}
+		tile = tile[n:]
+		layer, n := protowire.ConsumeBytes(tile)
+		if n < 0 {
+			t.Fatalf("Malformed layer")
+		}
+		tile = tile[n:]
+
+		name, features := "", 0
+		for len(layer) > 0 {
+			number, typ, n := protowire.ConsumeTag(layer)
+			layer = layer[n:]
+			n = protowire.ConsumeFieldValue(number, typ, layer)
+			if n < 0 {
+				t.Fatalf("Malformed layer field %d", number)
+			}
+			switch number {
+			case 1:
+				value, _ := protowire.ConsumeString(layer)
+				name = value
+			case 2:
+				features++
+			}
+			layer = layer[n:]
+		}
+		layers[name] = features
+	}
+	return layers
+}
+
+func testTileFor(lat, lon float64, z int) (int, int) {
+	point := tilePoint(lat, lon, z, 0, 0)
+	return int(math.Floor(point.X / mvtExtent)), int(math.Floor(point.Y / mvtExtent))
+}
+
+func TestTileServer(t *testing.T) {
+	index := newTestIndex()
+	index.Routes["r1"] = Route{ID: "r1", ShortName: "1", Color: "FF0000"}
+	server := NewTileServer(index, 13, 2)
+
+	x, y := testTileFor(33.75, -84.39, 13)
+	layers := decodeTileLayers(t, server.Tile(13, x, y))
+	if layers["shapes"] != 1 {
+		t.Errorf("Expected 1 shape, got %d", layers["shapes"])
+	}
+	if layers["stops"] != 3 {
+		t.Errorf("Expected 3 stops, got %d", layers["stops"])
+	}
+
+	x, y = testTileFor(33.75, -84.39, 10)
+	layers = decodeTileLayers(t, server.Tile(10, x, y))
+	if _, ok := layers["stops"]; ok {
+		t.Errorf("Expected no stops below zoom 13")
+	}
+
+	layers = decodeTileLayers(t, server.Tile(14, 0, 0))
+	if len(layers) != 0 {
+		t.Errorf("Expected an empty tile, got %v", layers)
+	}
+	if server.order.Len() != 2 {
+		t.Errorf("Expected 2 cached tiles, got %d", server.order.Len())
+	}
+
+	x, y = testTileFor(33.75, -84.39, 13)
+	buses := []BusPosition{
+		{ID: "v1", Latitude: 33.75, Longitude: -84.39, RouteID: "r1"},
+		{ID: "v2", Latitude: 34.5, Longitude: -84.39, RouteID: "r1"},
+	}
+	layers = decodeTileLayers(t, server.VehicleLayer(buses, 13, x, y))
+	if layers["vehicles"] != 1 {
+		t.Errorf("Expected 1 vehicle, got %d", layers["vehicles"])
+	}
+}
+
+func TestClipPath(t *testing.T) {
+	points := []planarPoint{{-100, 50}, {50, 50}, {50, 200}, {50, 50}, {150, 50}}
+	parts := clipPath(points, 0, 100)
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts, got %d", len(parts))
+	}
+	if parts[0][0] != (planarPoint{0, 50}) || parts[0][2] != (planarPoint{50, 100}) {
+		t.Errorf("Expected the first part to run from the left edge to the bottom edge, got %v", parts[0])
+	}
+	if parts[1][0] != (planarPoint{50, 100}) || parts[1][2] != (planarPoint{100, 50}) {
+		t.Errorf("Expected the second part to run from the bottom edge to the right edge, got %v", parts[1])
+	}
+}
+
+func TestSimplifyPath(t *testing.T) {
+	points := []planarPoint{{0, 0}, {1, 0.1}, {2, -0.1}, {3, 5}, {4, 6}, {5, 7}, {6, 8.05}, {7, 9}}
+	simplified := simplifyPath(points, 0.5)
+	expected := []planarPoint{{0, 0}, {2, -0.1}, {3, 5}, {7, 9}}
+	if len(simplified) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, simplified)
+	}
+	for i := range expected {
+		if simplified[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, simplified)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var trailStore *TrailStore
+
+// TrailPoint is one reported position of a vehicle.
+type TrailPoint struct {
+	Latitude  float64
+	Longitude float64
+	Bearing   float64
+	TripID    string
+	Timestamp time.Time
+}
+
+// TrailStore keeps the recent positions of every vehicle, dropping those
+// older than Window.
+type TrailStore struct {
+	Window time.Duration
+
+	mu     sync.RWMutex
+	trails map[string][]TrailPoint
+}
+
+func NewTrailStore(window time.Duration) *TrailStore {
+	return &TrailStore{
+		Window: window,
+		trails: make(map[string][]TrailPoint),
+	}
+}
+
+// Observe appends one poll of vehicle positions taken at now. Positions with
+// a timestamp the vehicle already reported are skipped.
+func (s *TrailStore) Observe(buses []BusPosition, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, bus := range buses {
+		timestamp := now
+		if bus.Timestamp > 0 {
+			timestamp = time.Unix(bus.Timestamp, 0)
+		}
+		trail := s.trails[bus.ID]
+		if n := len(trail); n > 0 && !timestamp.After(trail[n-1].Timestamp) {
+			continue
+		}
+		s.trails[bus.ID] = append(trail, TrailPoint{
+			Latitude:  bus.Latitude,
+			Longitude: bus.Longitude,
+			Bearing:   bus.Bearing,
+			TripID:    bus.TripID,
+			Timestamp: timestamp,
+		})
+	}
+
+	cutoff := now.Add(-s.Window)
+	for id, trail := range s.trails {
+		first := 0
+		for first < len(trail) && trail[first].Timestamp.Before(cutoff) {
+			first++
+		}
+		if first == len(trail) {
+			delete(s.trails, id)
+			continue
+		}
+		s.trails[id] = trail[first:]
+	}
+}
+
+// Trail returns the recent positions of a vehicle, oldest first.
+func (s *TrailStore) Trail(vehicleID string) []TrailPoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]TrailPoint{}, s.trails[vehicleID]...)
+}
+
+// Load seeds the trails with stored positions, ordered by time, e.g. to keep
+// them across a restart. Positions outside the window are left out.
+func (s *TrailStore) Load(positions []StoredPosition, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-s.Window)
+	for _, position := range positions {
+		if position.Timestamp.Before(cutoff) {
+			continue
+		}
+		trail := s.trails[position.VehicleID]
+		if n := len(trail); n > 0 && !position.Timestamp.After(trail[n-1].Timestamp) {
+			continue
+		}
+		s.trails[position.VehicleID] = append(trail, TrailPoint{
+			Latitude:  position.Latitude,
+			Longitude: position.Longitude,
+			Bearing:   position.Bearing,
+			TripID:    position.TripID,
+			Timestamp: position.Timestamp,
+		})
+	}
+}
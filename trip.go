@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
+
+const (
+	StopPassed   = "passed"
+	StopCurrent  = "current"
+	StopUpcoming = "upcoming"
+	StopSkipped  = "skipped"
+)
+
+// TripStop is one stop_time of a trip merged with its realtime prediction.
+// Propagated is set when the delay was carried over from an earlier stop.
+type TripStop struct {
+	StopID               string
+	StopName             string
+	StopSequence         int
+	ScheduledArrival     time.Time
+	ScheduledDeparture   time.Time
+	RealtimeArrival      *time.Time
+	RealtimeDeparture    *time.Time
+	DelaySeconds         *int
+	Propagated           bool
+	ScheduleRelationship string
+	Status               string
+	WheelchairBoarding   string
+}
+
+// TripDetail is the full stop sequence of a trip on a service date.
+type TripDetail struct {
+	Trip        Trip
+	Route       *Route
+	ServiceDate string
+	Vehicle     *BusPosition
+	Stops       []TripStop
+}
+
+// tripDetailHandler serves /trips/{trip_id}.
+func tripDetailHandler(w http.ResponseWriter, r *http.Request) {
+	tripID := strings.TrimPrefix(r.URL.Path, "/trips/")
+	if tripID == "" || strings.Contains(tripID, "/") {
+		http.Error(w, "Trip ID not provided", http.StatusBadRequest)
+		return
+	}
+
+	feed := currentFeed()
+	detail, ok := buildTripDetail(gtfsIndex, tripID, feed.Buses, feed.TripUpdates, time.Now())
+	if !ok {
+		http.Error(w, "Trip not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(detail)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// buildTripDetail merges the schedule of a trip with its trip update and the
+// vehicle assigned to it.
+func buildTripDetail(index *GTFSIndex, tripID string, buses []BusPosition, tripUpdates []TripUpdate, now time.Time) (TripDetail, bool) {
+	trip, ok := index.Trips[tripID]
+	if !ok {
+		return TripDetail{}, false
+	}
+
+	detail := TripDetail{
+		Trip:  trip,
+		Stops: make([]TripStop, 0),
+	}
+	if route, ok := index.Routes[trip.RouteID]; ok {
+		detail.Route = &route
+	}
+
+	tripUpdate := findTripUpdate(tripUpdates, tripID, "")
+	serviceDate := index.ServiceDate(now)
+	if tripUpdate != nil {
+		serviceDate = index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+	}
+	detail.ServiceDate = serviceDate.Format("20060102")
+
+	for i := range buses {
+		if buses[i].TripID == tripID {
+			vehicle := buses[i]
+			detail.Vehicle = &vehicle
+			break
+		}
+	}
+	if detail.Vehicle == nil && tripUpdate != nil {
+		for i := range buses {
+			if buses[i].ID == tripUpdate.Vehicle.GetId() {
+				vehicle := buses[i]
+				detail.Vehicle = &vehicle
+				break
+			}
+		}
+	}
+
+	updates := make(map[int]*pb.TripUpdate_StopTimeUpdate)
+	updatesByStop := make(map[string]*pb.TripUpdate_StopTimeUpdate)
+	if tripUpdate != nil {
+		for _, update := range tripUpdate.StopTimeUpdate {
+			if update.StopSequence != nil {
+				updates[int(update.GetStopSequence())] = update
+			} else if update.GetStopId() != "" {
+				updatesByStop[update.GetStopId()] = update
+			}
+		}
+	}
+
+	// Per the GTFS-Realtime spec a delay applies to every following stop
+	// until the next stop time update, and NO_DATA stops the propagation.
+	var propagated *int
+	for _, stopTime := range index.StopTimes[tripID] {
+		stop := TripStop{
+			StopID:             stopTime.StopID,
+			StopName:           index.Stops[stopTime.StopID].StopName,
+			StopSequence:       stopTime.StopSequence,
+			WheelchairBoarding: index.Stops[stopTime.StopID].WheelchairBoarding,
+			ScheduledArrival:   index.ScheduledTime(serviceDate, stopTime.ArrivalTime),
+			ScheduledDeparture: index.ScheduledTime(serviceDate, stopTime.DepartureTime),
+		}
+
+		update, ok := updates[stopTime.StopSequence]
+		if !ok {
+			update, ok = updatesByStop[stopTime.StopID]
+		}
+
+		switch {
+		case ok && update.GetScheduleRelationship() == pb.TripUpdate_StopTimeUpdate_SKIPPED:
+			stop.ScheduleRelationship = update.GetScheduleRelationship().String()
+		case ok && update.GetScheduleRelationship() == pb.TripUpdate_StopTimeUpdate_NO_DATA:
+			stop.ScheduleRelationship = update.GetScheduleRelationship().String()
+			propagated = nil
+		case ok:
+			stop.ScheduleRelationship = update.GetScheduleRelationship().String()
+			arrival, arrivalDelay := resolveStopTimeEvent(index, serviceDate, stopTime.ArrivalTime, true, update.GetArrival())
+			departure, departureDelay := resolveStopTimeEvent(index, serviceDate, stopTime.DepartureTime, true, update.GetDeparture())
+			if arrivalDelay == nil {
+				arrivalDelay = departureDelay
+			}
+			if departureDelay == nil {
+				departureDelay = arrivalDelay
+			}
+			if departureDelay == nil {
+				// Neither event carried anything usable.
+				propagated = nil
+				break
+			}
+			if arrival == nil {
+				realtime := stop.ScheduledArrival.Add(time.Duration(*arrivalDelay) * time.Second)
+				arrival = &realtime
+			}
+			if departure == nil {
+				realtime := stop.ScheduledDeparture.Add(time.Duration(*departureDelay) * time.Second)
+				departure = &realtime
+			}
+			stop.RealtimeArrival, stop.RealtimeDeparture = arrival, departure
+			stop.DelaySeconds = arrivalDelay
+			propagated = departureDelay
+		case propagated != nil:
+			arrival := stop.ScheduledArrival.Add(time.Duration(*propagated) * time.Second)
+			departure := stop.ScheduledDeparture.Add(time.Duration(*propagated) * time.Second)
+			delay := *propagated
+			stop.RealtimeArrival, stop.RealtimeDeparture = &arrival, &departure
+			stop.DelaySeconds = &delay
+			stop.Propagated = true
+		}
+
+		stop.Status = tripStopStatus(stop, detail.Vehicle, now)
+		detail.Stops = append(detail.Stops, stop)
+	}
+
+	return detail, true
+}
+
+// tripStopStatus places a stop relative to the vehicle's current stop, or
+// compares its departure with now when the trip has no vehicle.
+func tripStopStatus(stop TripStop, vehicle *BusPosition, now time.Time) string {
+	if stop.ScheduleRelationship == pb.TripUpdate_StopTimeUpdate_SKIPPED.String() {
+		return StopSkipped
+	}
+
+	if vehicle != nil && vehicle.CurrentStopSequence > 0 {
+		current := int(vehicle.CurrentStopSequence)
+		switch {
+		case stop.StopSequence < current:
+			return StopPassed
+		case stop.StopSequence == current:
+			return StopCurrent
+		default:
+			return StopUpcoming
+		}
+	}
+
+	departure := stop.ScheduledDeparture
+	if stop.RealtimeDeparture != nil {
+		departure = *stop.RealtimeDeparture
+	}
+	if departure.Before(now) {
+		return StopPassed
+	}
+	return StopUpcoming
+}
@@ -1,6 +1,10 @@
 package main
 
-import pb "github.com/calvarado2004/vehicle-positions/proto"
+import (
+	"sync/atomic"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
 
 type BusPosition struct {
 	ID        string
@@ -8,6 +12,35 @@ type BusPosition struct {
 	Longitude float64
 	Label     string
 	Bearing   float64
+	TripID    string
+	RouteID   string
+	Timestamp int64
+
+	CurrentStopSequence uint32
+	StopID              string
+	CurrentStatus       string
+	OccupancyStatus     string
+	CongestionLevel     string
+
+	// Motion, from the feed's speed when it has one, otherwise derived from
+	// consecutive positions.
+	SpeedMetersPerSecond float64
+	HeadingDegrees       float64
+	SpeedSource          string
+	MovementState        string
+
+	// Static trip and route details, filled in from trips.txt and routes.txt.
+	DisplayName          string
+	Headsign             string
+	DirectionID          string
+	BlockID              string
+	ShapeID              string
+	WheelchairAccessible string
+	BikesAllowed         string
+	RouteShortName       string
+	RouteLongName        string
+	RouteColor           string
+	RouteTextColor       string
 }
 
 type VehiclePosition struct {
@@ -30,6 +63,17 @@ type TripUpdate struct {
 	Delay          *int32
 }
 
+type Alert struct {
+	ID              string
+	ActivePeriod    []*pb.TimeRange
+	InformedEntity  []*pb.EntitySelector
+	Cause           string
+	Effect          string
+	URL             string
+	HeaderText      string
+	DescriptionText string
+}
+
 type Route struct {
 	ID        string `csv:"route_id"`
 	ShortName string `csv:"route_short_name"`
@@ -47,16 +91,97 @@ type Shape struct {
 	DistTraveled float64 `csv:"shape_dist_traveled"`
 }
 
+type Trip struct {
+	RouteID              string `csv:"route_id"`
+	ServiceID            string `csv:"service_id"`
+	TripID               string `csv:"trip_id"`
+	Headsign             string `csv:"trip_headsign"`
+	ShortName            string `csv:"trip_short_name"`
+	DirectionID          string `csv:"direction_id"`
+	BlockID              string `csv:"block_id"`
+	ShapeID              string `csv:"shape_id"`
+	WheelchairAccessible string `csv:"wheelchair_accessible"`
+	BikesAllowed         string `csv:"bikes_allowed"`
+}
+
+// unknownGTFSTime marks an arrival or departure time left blank in
+// stop_times.txt until it is interpolated.
+const unknownGTFSTime = -1
+
+// StopTime arrival and departure times are seconds after midnight of the
+// service day, so they may exceed 24 hours.
+type StopTime struct {
+	TripID            string  `csv:"trip_id"`
+	ArrivalTime       int     `csv:"arrival_time"`
+	DepartureTime     int     `csv:"departure_time"`
+	StopID            string  `csv:"stop_id"`
+	StopSequence      int     `csv:"stop_sequence"`
+	ShapeDistTraveled float64 `csv:"shape_dist_traveled"`
+	Timepoint         string  `csv:"timepoint"`
+}
+
+// Frequency start and end times are seconds after midnight of the service day.
+type Frequency struct {
+	TripID      string `csv:"trip_id"`
+	StartTime   int    `csv:"start_time"`
+	EndTime     int    `csv:"end_time"`
+	HeadwaySecs int    `csv:"headway_secs"`
+}
+
+type CalendarService struct {
+	ServiceID string  `csv:"service_id"`
+	Weekdays  [7]bool // indexed by time.Weekday, Sunday first
+	StartDate string  `csv:"start_date"`
+	EndDate   string  `csv:"end_date"`
+}
+
+type CalendarDate struct {
+	ServiceID     string `csv:"service_id"`
+	Date          string `csv:"date"`
+	ExceptionType string `csv:"exception_type"`
+}
+
 type Stop struct {
-	StopID    string  `csv:"stop_id"`
-	StopCode  string  `csv:"stop_code"`
-	StopName  string  `csv:"stop_name"`
-	StopDesc  string  `csv:"stop_desc"`
-	Latitude  float64 `csv:"stop_lat"`
-	Longitude float64 `csv:"stop_lon"`
+	StopID             string  `csv:"stop_id"`
+	StopCode           string  `csv:"stop_code"`
+	StopName           string  `csv:"stop_name"`
+	StopDesc           string  `csv:"stop_desc"`
+	Latitude           float64 `csv:"stop_lat"`
+	Longitude          float64 `csv:"stop_lon"`
+	LocationType       string  `csv:"location_type"`
+	ParentStation      string  `csv:"parent_station"`
+	WheelchairBoarding string  `csv:"wheelchair_boarding"`
+}
+
+// FeedSnapshot is the realtime state of the latest polls. A published
+// snapshot is never modified, so handlers read it without locking while the
+// poll goroutine publishes the next one.
+type FeedSnapshot struct {
+	Buses       []BusPosition
+	TripUpdates []TripUpdate
+	Alerts      []Alert
+	// SynthesizedTripUpdates is the feed built from Buses once per poll.
+	SynthesizedTripUpdates *pb.FeedMessage
+}
+
+var feedSnapshot atomic.Pointer[FeedSnapshot]
+
+// currentFeed returns the latest snapshot.
+func currentFeed() *FeedSnapshot {
+	if snapshot := feedSnapshot.Load(); snapshot != nil {
+		return snapshot
+	}
+	return &FeedSnapshot{}
 }
 
-var currentBusPositions []BusPosition
+// publishFeed publishes a copy of the latest snapshot with update applied.
+// Only the poll goroutine publishes, so no update is lost.
+func publishFeed(update func(*FeedSnapshot)) *FeedSnapshot {
+	snapshot := *currentFeed()
+	update(&snapshot)
+	feedSnapshot.Store(&snapshot)
+	return &snapshot
+}
 
 type RouteVisualization struct {
 	RouteInfo   Route
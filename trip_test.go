@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBuildTripDetailPropagatesDelay(t *testing.T) {
+	index := newTestIndex()
+	now := time.Date(2023, 10, 16, 8, 3, 0, 0, time.UTC)
+
+	buses := []BusPosition{{ID: "2301", TripID: "t1", CurrentStopSequence: 2, CurrentStatus: pb.VehiclePosition_IN_TRANSIT_TO.String()}}
+	tripUpdates := []TripUpdate{{
+		Trip: &pb.TripDescriptor{TripId: proto.String("t1"), StartDate: proto.String("20231016")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			newTestStopTimeUpdate(1, "A", time.Date(2023, 10, 16, 8, 2, 0, 0, time.UTC)),
+		},
+	}}
+
+	detail, ok := buildTripDetail(index, "t1", buses, tripUpdates, now)
+	if !ok {
+		t.Fatalf("Expected trip t1 to be found")
+	}
+	if detail.Vehicle == nil || detail.Vehicle.ID != "2301" {
+		t.Errorf("Expected vehicle 2301 on the trip, got %v", detail.Vehicle)
+	}
+	if len(detail.Stops) != 3 {
+		t.Fatalf("Expected 3 stops, got %d", len(detail.Stops))
+	}
+
+	expectedStatuses := []string{StopPassed, StopCurrent, StopUpcoming}
+	for i, stop := range detail.Stops {
+		if stop.DelaySeconds == nil || *stop.DelaySeconds != 120 {
+			t.Errorf("Expected stop %s to be 120s late, got %v", stop.StopID, stop.DelaySeconds)
+		}
+		if stop.Propagated != (i > 0) {
+			t.Errorf("Expected stop %s propagated to be %v", stop.StopID, i > 0)
+		}
+		if stop.Status != expectedStatuses[i] {
+			t.Errorf("Expected stop %s to be %s, got %s", stop.StopID, expectedStatuses[i], stop.Status)
+		}
+	}
+	expectedC := time.Date(2023, 10, 16, 8, 8, 0, 0, time.UTC)
+	if !detail.Stops[2].RealtimeArrival.Equal(expectedC) {
+		t.Errorf("Expected C at %v, got %v", expectedC, detail.Stops[2].RealtimeArrival)
+	}
+
+	// NO_DATA at B stops the propagation.
+	tripUpdates[0].StopTimeUpdate = append(tripUpdates[0].StopTimeUpdate, &pb.TripUpdate_StopTimeUpdate{
+		StopSequence:         proto.Uint32(2),
+		ScheduleRelationship: pb.TripUpdate_StopTimeUpdate_NO_DATA.Enum(),
+	})
+	detail, _ = buildTripDetail(index, "t1", nil, tripUpdates, now)
+	if detail.Stops[2].RealtimeArrival != nil {
+		t.Errorf("Expected no realtime arrival at C after NO_DATA, got %v", detail.Stops[2].RealtimeArrival)
+	}
+	if detail.Stops[0].Status != StopPassed || detail.Stops[2].Status != StopUpcoming {
+		t.Errorf("Expected statuses from times without a vehicle, got %s and %s", detail.Stops[0].Status, detail.Stops[2].Status)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// How far before its first departure and after its last arrival a trip
+	// can still be matched to a vehicle.
+	matchEarlyWindow = 10 * 60
+	matchLateWindow  = 30 * 60
+)
+
+var tripUpdateProducer *TripUpdateProducer
+
+// TripUpdateProducer synthesizes a GTFS-Realtime TripUpdates feed from the
+// vehicle positions, for agencies that don't publish trip updates. Vehicles
+// are matched to their scheduled trip and the delay at their current
+// position is carried to the stops ahead, unless the ETA predictor has
+// better predictions for them.
+type TripUpdateProducer struct {
+	// MatchDistance is how far in meters a vehicle without a known trip
+	// may be from a trip's shape to be matched to it.
+	MatchDistance float64
+
+	index     *GTFSIndex
+	predictor *ETAPredictor
+}
+
+// NewTripUpdateProducer returns a producer that reads schedules from index.
+// predictor may be nil.
+func NewTripUpdateProducer(index *GTFSIndex, predictor *ETAPredictor, matchDistance float64) *TripUpdateProducer {
+	return &TripUpdateProducer{
+		MatchDistance: matchDistance,
+		index:         index,
+		predictor:     predictor,
+	}
+}
+
+// tripMatch is a vehicle matched to a scheduled trip on a service date.
+type tripMatch struct {
+	TripID      string
+	ServiceDate time.Time
+	AlongTrack  float64
+	// DelaySeconds is how far behind the schedule the vehicle is at its
+	// current position.
+	DelaySeconds int
+	// Reported is set when the vehicle reported the trip itself rather than
+	// being matched to it by route.
+	Reported bool
+}
+
+// better reports whether m is a better claim on its trip than other: a
+// reported trip beats an inferred one, then the smaller delay wins.
+func (m tripMatch) better(other tripMatch) bool {
+	if m.Reported != other.Reported {
+		return m.Reported
+	}
+	return math.Abs(float64(m.DelaySeconds)) < math.Abs(float64(other.DelaySeconds))
+}
+
+// Feed builds a full-dataset TripUpdates feed for the given vehicles, keyed
+// by vehicle ID. When several vehicles match the same trip, only the best
+// match is kept, so every trip has at most one TripUpdate.
+func (p *TripUpdateProducer) Feed(buses []BusPosition, now time.Time) *pb.FeedMessage {
+	feed := &pb.FeedMessage{
+		Header: &pb.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      pb.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+	}
+
+	matches := make([]tripMatch, len(buses))
+	observedAt := make([]time.Time, len(buses))
+	best := make(map[string]int)
+	for i, bus := range buses {
+		observedAt[i] = now
+		if bus.Timestamp > 0 {
+			observedAt[i] = time.Unix(bus.Timestamp, 0)
+		}
+		match, ok := p.matchTrip(bus, observedAt[i])
+		if !ok {
+			continue
+		}
+		matches[i] = match
+		key := match.TripID + " " + match.ServiceDate.Format("20060102")
+		if j, ok := best[key]; !ok || match.better(matches[j]) {
+			best[key] = i
+		}
+	}
+
+	for i, bus := range buses {
+		match := matches[i]
+		if match.TripID == "" || best[match.TripID+" "+match.ServiceDate.Format("20060102")] != i {
+			continue
+		}
+		feed.Entity = append(feed.Entity, &pb.FeedEntity{
+			Id:         proto.String(bus.ID),
+			TripUpdate: p.tripUpdate(bus, match, observedAt[i]),
+		})
+	}
+
+	return feed
+}
+
+// matchTrip uses the vehicle's own trip when the static feed knows it, and
+// otherwise the trip of its route whose schedule best fits where the vehicle
+// is at this time.
+func (p *TripUpdateProducer) matchTrip(bus BusPosition, observed time.Time) (tripMatch, bool) {
+	today := p.index.ServiceDate(observed)
+	serviceDates := []time.Time{today, p.index.ServiceDate(today.Add(-12 * time.Hour))}
+
+	candidates := p.index.RouteTrips(bus.RouteID)
+	if _, ok := p.index.Trips[bus.TripID]; ok {
+		candidates = []string{bus.TripID}
+	}
+
+	// The trips of a route share a few shapes, so each is projected once.
+	type projection struct{ crossTrack, alongTrack float64 }
+	projections := make(map[string]projection)
+
+	best := tripMatch{}
+	bestScore := math.Inf(1)
+	for _, tripID := range candidates {
+		trip := p.index.Trips[tripID]
+		stopTimes := p.index.StopTimes[tripID]
+		offsets := p.index.StopOffsets(tripID)
+		if offsets == nil {
+			continue
+		}
+		projected, ok := projections[trip.ShapeID]
+		if !ok {
+			projected.crossTrack, projected.alongTrack = p.index.ShapeForTrip(tripID).Project(bus.Latitude, bus.Longitude)
+			projections[trip.ShapeID] = projected
+		}
+		crossTrack, alongTrack := projected.crossTrack, projected.alongTrack
+		if tripID != bus.TripID && crossTrack > p.MatchDistance {
+			continue
+		}
+
+		for _, serviceDate := range serviceDates {
+			if !p.index.ServiceActive(trip.ServiceID, serviceDate) {
+				continue
+			}
+			seconds := int(observed.Sub(p.index.ScheduledTime(serviceDate, 0)).Seconds())
+			if seconds < stopTimes[0].DepartureTime-matchEarlyWindow || seconds > stopTimes[len(stopTimes)-1].ArrivalTime+matchLateWindow {
+				continue
+			}
+			delay := seconds - scheduledSecondsAt(stopTimes, offsets, alongTrack)
+			score := math.Abs(float64(delay))
+			if score < bestScore {
+				bestScore = score
+				best = tripMatch{TripID: tripID, ServiceDate: serviceDate, AlongTrack: alongTrack, DelaySeconds: delay, Reported: tripID == bus.TripID}
+			}
+		}
+	}
+
+	return best, best.TripID != ""
+}
+
+// scheduledSecondsAt interpolates the scheduled time, in seconds after
+// midnight, at which a trip is at a distance along its shape.
+func scheduledSecondsAt(stopTimes []StopTime, offsets []float64, alongTrack float64) int {
+	if alongTrack <= offsets[0] {
+		return stopTimes[0].DepartureTime
+	}
+	for i := 1; i < len(stopTimes); i++ {
+		if alongTrack > offsets[i] {
+			continue
+		}
+		from, to := stopTimes[i-1].DepartureTime, stopTimes[i].ArrivalTime
+		if offsets[i] == offsets[i-1] {
+			return to
+		}
+		fraction := (alongTrack - offsets[i-1]) / (offsets[i] - offsets[i-1])
+		return from + int(fraction*float64(to-from))
+	}
+	return stopTimes[len(stopTimes)-1].ArrivalTime
+}
+
+// tripUpdate builds the TripUpdate of a matched vehicle with a stop time
+// update for every stop still ahead of it.
+func (p *TripUpdateProducer) tripUpdate(bus BusPosition, match tripMatch, observed time.Time) *pb.TripUpdate {
+	trip := p.index.Trips[match.TripID]
+	stopTimes := p.index.StopTimes[match.TripID]
+	offsets := p.index.StopOffsets(match.TripID)
+
+	descriptor := &pb.TripDescriptor{
+		TripId:               proto.String(match.TripID),
+		RouteId:              proto.String(trip.RouteID),
+		StartTime:            proto.String(formatGTFSTime(stopTimes[0].DepartureTime)),
+		StartDate:            proto.String(match.ServiceDate.Format("20060102")),
+		ScheduleRelationship: pb.TripDescriptor_SCHEDULED.Enum(),
+	}
+	if directionID, err := strconv.ParseUint(trip.DirectionID, 10, 32); err == nil {
+		descriptor.DirectionId = proto.Uint32(uint32(directionID))
+	}
+
+	update := &pb.TripUpdate{
+		Trip: descriptor,
+		Vehicle: &pb.VehicleDescriptor{
+			Id:    proto.String(bus.ID),
+			Label: proto.String(bus.Label),
+		},
+		Timestamp: proto.Uint64(uint64(observed.Unix())),
+		Delay:     proto.Int32(int32(match.DelaySeconds)),
+	}
+
+	predicted := make(map[int]time.Time)
+	if p.predictor != nil && bus.TripID == match.TripID {
+		if prediction, ok := p.predictor.Predict(bus.ID); ok {
+			for _, stop := range prediction.Stops {
+				predicted[stop.StopSequence] = stop.Predicted
+			}
+		}
+	}
+
+	for i, stopTime := range stopTimes {
+		if offsets[i] < match.AlongTrack {
+			continue
+		}
+		scheduledArrival := p.index.ScheduledTime(match.ServiceDate, stopTime.ArrivalTime)
+		scheduledDeparture := p.index.ScheduledTime(match.ServiceDate, stopTime.DepartureTime)
+
+		delay := match.DelaySeconds
+		if arrival, ok := predicted[stopTime.StopSequence]; ok {
+			delay = int(arrival.Sub(scheduledArrival).Seconds())
+		}
+		arrival := scheduledArrival.Add(time.Duration(delay) * time.Second)
+		departure := scheduledDeparture.Add(time.Duration(delay) * time.Second)
+		// Vehicles running early hold at timepoints until their scheduled departure.
+		if delay < 0 && stopTime.Timepoint != "0" {
+			departure = scheduledDeparture
+		}
+		if departure.Before(arrival) {
+			departure = arrival
+		}
+
+		update.StopTimeUpdate = append(update.StopTimeUpdate, &pb.TripUpdate_StopTimeUpdate{
+			StopSequence: proto.Uint32(uint32(stopTime.StopSequence)),
+			StopId:       proto.String(stopTime.StopID),
+			Arrival: &pb.TripUpdate_StopTimeEvent{
+				Delay: proto.Int32(int32(delay)),
+				Time:  proto.Int64(arrival.Unix()),
+			},
+			Departure: &pb.TripUpdate_StopTimeEvent{
+				Delay: proto.Int32(int32(departure.Sub(scheduledDeparture).Seconds())),
+				Time:  proto.Int64(departure.Unix()),
+			},
+			ScheduleRelationship: pb.TripUpdate_StopTimeUpdate_SCHEDULED.Enum(),
+		})
+	}
+
+	return update
+}
+
+// synthesizedTripUpdatesHandler serves the feed synthesized at the latest
+// poll as protobuf, or as JSON with format=json for debugging.
+func synthesizedTripUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	feed := currentFeed().SynthesizedTripUpdates
+	if feed == nil {
+		feed = tripUpdateProducer.Feed(nil, time.Now())
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		data, err := protojson.Marshal(feed)
+		if err != nil {
+			http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+		return
+	}
+
+	data, err := proto.Marshal(feed)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data)
+}
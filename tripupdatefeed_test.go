@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTripUpdateProducerMatchesSchedule(t *testing.T) {
+	producer := NewTripUpdateProducer(newTestIndex(), nil, 200)
+	halfway := producer.index.Shapes["s1"].Length() / 2
+
+	// A vehicle with no trip at stop B at 08:14 is t2, which is due there at 08:13.
+	now := time.Date(2023, 10, 16, 8, 14, 0, 0, time.UTC)
+	buses := []BusPosition{{ID: "2301", Label: "1601", Latitude: 33.75, Longitude: positionAlongTestShape(halfway - 1), RouteID: "r1"}}
+
+	data, err := proto.Marshal(producer.Feed(buses, now))
+	if err != nil {
+		t.Fatalf("Failed to marshal feed: %v", err)
+	}
+	feed := &pb.FeedMessage{}
+	if err := proto.Unmarshal(data, feed); err != nil {
+		t.Fatalf("Failed to unmarshal feed: %v", err)
+	}
+
+	if feed.GetHeader().GetGtfsRealtimeVersion() != "2.0" {
+		t.Errorf("Expected GTFS-RT version 2.0, got %s", feed.GetHeader().GetGtfsRealtimeVersion())
+	}
+	if len(feed.Entity) != 1 {
+		t.Fatalf("Expected 1 trip update, got %d", len(feed.Entity))
+	}
+
+	tripUpdate := feed.Entity[0].GetTripUpdate()
+	if tripUpdate.GetTrip().GetTripId() != "t2" {
+		t.Errorf("Expected trip t2, got %s", tripUpdate.GetTrip().GetTripId())
+	}
+	if tripUpdate.GetTrip().GetStartDate() != "20231016" || tripUpdate.GetTrip().GetStartTime() != "08:10:00" {
+		t.Errorf("Expected start 20231016 08:10:00, got %s %s", tripUpdate.GetTrip().GetStartDate(), tripUpdate.GetTrip().GetStartTime())
+	}
+	if tripUpdate.GetVehicle().GetId() != "2301" {
+		t.Errorf("Expected vehicle 2301, got %s", tripUpdate.GetVehicle().GetId())
+	}
+
+	// B and C are still ahead, both a minute late.
+	updates := tripUpdate.GetStopTimeUpdate()
+	if len(updates) != 2 {
+		t.Fatalf("Expected 2 stop time updates, got %d", len(updates))
+	}
+	if updates[1].GetStopId() != "C" || updates[1].GetArrival().GetDelay() < 55 || updates[1].GetArrival().GetDelay() > 65 {
+		t.Errorf("Expected C about 60s late, got %v", updates[1])
+	}
+	expectedArrival := time.Date(2023, 10, 16, 8, 17, 0, 0, time.UTC).Unix()
+	if diff := updates[1].GetArrival().GetTime() - expectedArrival; diff < -5 || diff > 5 {
+		t.Errorf("Expected C at 08:17, got %v", time.Unix(updates[1].GetArrival().GetTime(), 0).UTC())
+	}
+}
+
+func TestTripUpdateProducerDedupesTrips(t *testing.T) {
+	producer := NewTripUpdateProducer(newTestIndex(), nil, 200)
+	halfway := producer.index.Shapes["s1"].Length() / 2
+
+	// Two vehicles without a trip both best fit t2 at 08:14; the one closer
+	// to its schedule keeps it.
+	now := time.Date(2023, 10, 16, 8, 14, 0, 0, time.UTC)
+	buses := []BusPosition{
+		{ID: "2301", Latitude: 33.75, Longitude: positionAlongTestShape(halfway - 100), RouteID: "r1"},
+		{ID: "2302", Latitude: 33.75, Longitude: positionAlongTestShape(halfway - 1), RouteID: "r1"},
+	}
+
+	feed := producer.Feed(buses, now)
+	if len(feed.Entity) != 1 {
+		t.Fatalf("Expected 1 trip update, got %d", len(feed.Entity))
+	}
+	if feed.Entity[0].GetId() != "2302" || feed.Entity[0].GetTripUpdate().GetVehicle().GetId() != "2302" {
+		t.Errorf("Expected the entity of vehicle 2302, got %s", feed.Entity[0].GetId())
+	}
+	if feed.Entity[0].GetTripUpdate().GetTrip().GetTripId() != "t2" {
+		t.Errorf("Expected trip t2, got %s", feed.Entity[0].GetTripUpdate().GetTrip().GetTripId())
+	}
+}
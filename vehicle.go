@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+)
+
+// NextStop is an upcoming stop of a vehicle with the agency's prediction.
+type NextStop struct {
+	StopID               string
+	StopName             string
+	StopSequence         uint32
+	ScheduledArrival     *time.Time
+	PredictedArrival     *time.Time
+	PredictedDeparture   *time.Time
+	DelaySeconds         *int
+	ScheduleRelationship string
+	WheelchairBoarding   string
+}
+
+// VehicleDetail is everything known about one vehicle.
+type VehicleDetail struct {
+	Position        BusPosition
+	AgeSeconds      float64
+	Trip            *Trip
+	Route           *Route
+	CurrentStopName string
+	NextStops       []NextStop
+	Trail           []TrailPoint
+	Alerts          []Alert
+}
+
+// vehicleDetailHandler serves /vehicles/{id}.
+func vehicleDetailHandler(w http.ResponseWriter, r *http.Request) {
+	vehicleID := strings.TrimPrefix(r.URL.Path, "/vehicles/")
+	if vehicleID == "" || strings.Contains(vehicleID, "/") {
+		http.Error(w, "Vehicle ID not provided", http.StatusBadRequest)
+		return
+	}
+
+	var bus *BusPosition
+	feed := currentFeed()
+	buses := feed.Buses
+	for i := range buses {
+		if buses[i].ID == vehicleID {
+			bus = &buses[i]
+			break
+		}
+	}
+	if bus == nil {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+
+	detail := buildVehicleDetail(gtfsIndex, *bus, feed.TripUpdates, feed.Alerts, trailStore.Trail(vehicleID), time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(detail)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// buildVehicleDetail joins a vehicle with its static trip and route, its trip
+// update, its trail and the alerts affecting it.
+func buildVehicleDetail(index *GTFSIndex, bus BusPosition, tripUpdates []TripUpdate, alerts []Alert, trail []TrailPoint, now time.Time) VehicleDetail {
+	detail := VehicleDetail{
+		Position:        bus,
+		CurrentStopName: index.Stops[bus.StopID].StopName,
+		NextStops:       make([]NextStop, 0),
+		Trail:           trail,
+		Alerts:          activeAlerts(alerts, bus.RouteID, bus.TripID, "", now),
+	}
+	if bus.Timestamp > 0 {
+		detail.AgeSeconds = now.Sub(time.Unix(bus.Timestamp, 0)).Seconds()
+	}
+	if trip, ok := index.Trips[bus.TripID]; ok {
+		detail.Trip = &trip
+	}
+	if route, ok := index.Routes[bus.RouteID]; ok {
+		detail.Route = &route
+	}
+
+	tripUpdate := findTripUpdate(tripUpdates, bus.TripID, bus.ID)
+	if tripUpdate == nil {
+		return detail
+	}
+	tripID := tripUpdate.Trip.GetTripId()
+	serviceDate := index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+
+	for _, update := range tripUpdate.StopTimeUpdate {
+		sequence := update.GetStopSequence()
+		if bus.CurrentStopSequence > 0 && sequence > 0 {
+			if sequence < bus.CurrentStopSequence {
+				continue
+			}
+			if sequence == bus.CurrentStopSequence && bus.CurrentStatus == pb.VehiclePosition_STOPPED_AT.String() {
+				continue
+			}
+		}
+
+		next := NextStop{
+			StopID:               update.GetStopId(),
+			StopSequence:         sequence,
+			ScheduleRelationship: update.GetScheduleRelationship().String(),
+		}
+		stopTime, scheduled := index.StopTimeFor(tripID, sequence, update.GetStopId())
+		if next.StopID == "" {
+			next.StopID = stopTime.StopID
+		}
+		next.StopName = index.Stops[next.StopID].StopName
+		next.WheelchairBoarding = index.Stops[next.StopID].WheelchairBoarding
+
+		if scheduled {
+			arrival := index.ScheduledTime(serviceDate, stopTime.ArrivalTime)
+			next.ScheduledArrival = &arrival
+		}
+		var departureDelay *int
+		next.PredictedArrival, next.DelaySeconds = resolveStopTimeEvent(index, serviceDate, stopTime.ArrivalTime, scheduled, update.GetArrival())
+		next.PredictedDeparture, departureDelay = resolveStopTimeEvent(index, serviceDate, stopTime.DepartureTime, scheduled, update.GetDeparture())
+		// Some feeds only predict departures, e.g. at the first stop.
+		if next.PredictedArrival == nil && next.DelaySeconds == nil {
+			next.PredictedArrival, next.DelaySeconds = next.PredictedDeparture, departureDelay
+		}
+
+		detail.NextStops = append(detail.NextStops, next)
+	}
+
+	return detail
+}
+
+// findTripUpdate returns the trip update of a trip, or failing that the first
+// one of the vehicle.
+func findTripUpdate(tripUpdates []TripUpdate, tripID, vehicleID string) *TripUpdate {
+	var byVehicle *TripUpdate
+	for i := range tripUpdates {
+		if tripID != "" && tripUpdates[i].Trip.GetTripId() == tripID {
+			return &tripUpdates[i]
+		}
+		if byVehicle == nil && vehicleID != "" && tripUpdates[i].Vehicle.GetId() == vehicleID {
+			byVehicle = &tripUpdates[i]
+		}
+	}
+	return byVehicle
+}
+
+// resolveStopTimeEvent works out the predicted time and delay of a stop time
+// event. An event may carry an absolute time, a delay or both; whichever is
+// missing is derived from the scheduled time when there is one.
+func resolveStopTimeEvent(index *GTFSIndex, serviceDate time.Time, scheduledSeconds int, scheduled bool, event *pb.TripUpdate_StopTimeEvent) (*time.Time, *int) {
+	if event == nil || (event.Time == nil && event.Delay == nil) {
+		return nil, nil
+	}
+
+	var scheduledTime time.Time
+	if scheduled {
+		scheduledTime = index.ScheduledTime(serviceDate, scheduledSeconds)
+	}
+
+	switch {
+	case event.Time != nil:
+		predicted := time.Unix(event.GetTime(), 0)
+		if event.Delay != nil {
+			delay := int(event.GetDelay())
+			return &predicted, &delay
+		}
+		if scheduled {
+			delay := int(predicted.Sub(scheduledTime).Seconds())
+			return &predicted, &delay
+		}
+		return &predicted, nil
+	case scheduled:
+		delay := int(event.GetDelay())
+		predicted := scheduledTime.Add(time.Duration(delay) * time.Second)
+		return &predicted, &delay
+	default:
+		delay := int(event.GetDelay())
+		return nil, &delay
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBuildVehicleDetail(t *testing.T) {
+	index := newTestIndex()
+	now := time.Date(2023, 10, 16, 8, 2, 0, 0, time.UTC)
+
+	bus := BusPosition{ID: "2301", TripID: "t1", RouteID: "r1", Timestamp: now.Add(-20 * time.Second).Unix(),
+		CurrentStopSequence: 1, StopID: "A", CurrentStatus: pb.VehiclePosition_STOPPED_AT.String()}
+	tripUpdates := []TripUpdate{{
+		Trip:    &pb.TripDescriptor{TripId: proto.String("t1"), StartDate: proto.String("20231016")},
+		Vehicle: &pb.VehicleDescriptor{Id: proto.String("2301")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			newTestStopTimeUpdate(1, "A", now),
+			newTestStopTimeUpdate(2, "B", time.Date(2023, 10, 16, 8, 5, 0, 0, time.UTC)),
+			{StopSequence: proto.Uint32(3), StopId: proto.String("C"), Arrival: &pb.TripUpdate_StopTimeEvent{Delay: proto.Int32(90)}},
+		},
+	}}
+	alerts := []Alert{
+		{ID: "route", InformedEntity: []*pb.EntitySelector{{RouteId: proto.String("r1")}}},
+		{ID: "other", InformedEntity: []*pb.EntitySelector{{RouteId: proto.String("r2")}}},
+		{ID: "expired", InformedEntity: []*pb.EntitySelector{{Trip: &pb.TripDescriptor{TripId: proto.String("t1")}}},
+			ActivePeriod: []*pb.TimeRange{{End: proto.Uint64(uint64(now.Add(-time.Hour).Unix()))}}},
+	}
+
+	detail := buildVehicleDetail(index, bus, tripUpdates, alerts, nil, now)
+
+	if detail.AgeSeconds != 20 {
+		t.Errorf("Expected an age of 20s, got %f", detail.AgeSeconds)
+	}
+	if detail.CurrentStopName != "FIRST ST" {
+		t.Errorf("Expected current stop FIRST ST, got %s", detail.CurrentStopName)
+	}
+	if detail.Trip == nil || detail.Trip.Headsign != "EAST" || detail.Route == nil {
+		t.Errorf("Expected the static trip and route, got %v and %v", detail.Trip, detail.Route)
+	}
+
+	// The bus is stopped at A, so B and C are next.
+	if len(detail.NextStops) != 2 {
+		t.Fatalf("Expected 2 next stops, got %d", len(detail.NextStops))
+	}
+	if detail.NextStops[0].StopName != "SECOND ST" || detail.NextStops[0].DelaySeconds == nil || *detail.NextStops[0].DelaySeconds != 120 {
+		t.Errorf("Expected SECOND ST 120s late, got %+v", detail.NextStops[0])
+	}
+	expectedC := time.Date(2023, 10, 16, 8, 7, 30, 0, time.UTC)
+	if detail.NextStops[1].PredictedArrival == nil || !detail.NextStops[1].PredictedArrival.Equal(expectedC) {
+		t.Errorf("Expected C predicted at %v from its delay, got %v", expectedC, detail.NextStops[1].PredictedArrival)
+	}
+
+	if len(detail.Alerts) != 1 || detail.Alerts[0].ID != "route" {
+		t.Errorf("Expected only the active route alert, got %+v", detail.Alerts)
+	}
+}
+
+func TestTrailStore(t *testing.T) {
+	store := NewTrailStore(time.Minute)
+	start := time.Unix(1697467600, 0)
+
+	store.Observe([]BusPosition{{ID: "2301", Latitude: 33.75, Timestamp: start.Unix()}}, start)
+	store.Observe([]BusPosition{{ID: "2301", Latitude: 33.75, Timestamp: start.Unix()}}, start.Add(15*time.Second))
+	store.Observe([]BusPosition{{ID: "2301", Latitude: 33.76, Timestamp: start.Add(30 * time.Second).Unix()}}, start.Add(30*time.Second))
+	if trail := store.Trail("2301"); len(trail) != 2 {
+		t.Errorf("Expected 2 trail points, got %d", len(trail))
+	}
+
+	store.Observe(nil, start.Add(75*time.Second))
+	trail := store.Trail("2301")
+	if len(trail) != 1 || trail[0].Latitude != 33.76 {
+		t.Errorf("Expected only the newest point within the window, got %+v", trail)
+	}
+}
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	WebhookApproaching = "vehicle_approaching_stop"
+	WebhookDelay       = "delay_exceeded"
+	WebhookStale       = "vehicle_stale"
+	WebhookAlert       = "alert_published"
+
+	// defaultWebhookDelayMinutes is the delay threshold of webhooks that
+	// don't set one.
+	defaultWebhookDelayMinutes = 5
+	// maxWebhookBackoff caps the wait between two attempts of a delivery.
+	maxWebhookBackoff = time.Hour
+	// maxWebhookQueue bounds the pending deliveries; the oldest ones are
+	// dead-lettered when a slow endpoint lets the queue grow past it.
+	maxWebhookQueue      = 10000
+	maxWebhookDeadLetter = 1000
+	// maxWebhookConcurrency is how many deliveries are sent at once.
+	maxWebhookConcurrency = 8
+	webhookTimeout        = 10 * time.Second
+	// webhookDeliverBudget bounds how long a poll spends delivering, and
+	// maxWebhookDeliveriesPerPoll how many it sends; the rest wait for the
+	// next poll.
+	webhookDeliverBudget        = 5 * time.Second
+	maxWebhookDeliveriesPerPoll = 500
+)
+
+var webhookEventTypes = []string{WebhookApproaching, WebhookDelay, WebhookStale, WebhookAlert}
+
+// blockedWebhookNetworks are ranges not covered by the net.IP predicates that
+// webhooks must not reach either.
+var blockedWebhookNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+var (
+	webhookEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_events_total",
+		Help: "Total number of events detected for webhooks, by type.",
+	}, []string{"type"})
+	webhookDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Total number of webhook delivery attempts, by result: delivered, failed or dead_lettered.",
+	}, []string{"result"})
+	webhookPendingDeliveries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_pending_deliveries",
+		Help: "Number of webhook deliveries waiting to be sent or retried.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(webhookEventsTotal, webhookDeliveriesTotal, webhookPendingDeliveries)
+}
+
+var webhookDispatcher *WebhookDispatcher
+
+// WebhookRegistration is the request body to register a webhook. Empty
+// filters match everything; a webhook only receives the delay events of
+// trips crossing DelayMinutes.
+type WebhookRegistration struct {
+	URL          string
+	Secret       string
+	EventTypes   []string
+	RouteIDs     []string
+	StopIDs      []string
+	VehicleIDs   []string
+	DelayMinutes int
+}
+
+// Webhook is a registered endpoint. Its secret is never served back.
+type Webhook struct {
+	ID           string
+	URL          string
+	EventTypes   []string
+	RouteIDs     []string
+	StopIDs      []string
+	VehicleIDs   []string
+	DelayMinutes int
+	CreatedAt    time.Time
+
+	secret string
+}
+
+// WebhookEvent is the payload posted to webhooks. PredictedArrival is set
+// for approaching and delay events, LastReport for stale vehicles and Alert
+// for published alerts.
+type WebhookEvent struct {
+	ID                   string
+	Type                 string
+	Time                 time.Time
+	VehicleID            string
+	RouteID              string
+	TripID               string
+	StopID               string
+	StopName             string
+	PredictedArrival     *time.Time
+	DelaySeconds         int
+	PreviousDelaySeconds int
+	LastReport           *time.Time
+	Alert                *Alert
+}
+
+// WebhookDelivery is one event on its way to one webhook.
+type WebhookDelivery struct {
+	ID          string
+	WebhookID   string
+	URL         string
+	Event       WebhookEvent
+	Attempts    int
+	NextAttempt time.Time
+	LastAttempt *time.Time
+	LastError   string
+}
+
+type tripStopKey struct {
+	TripID string
+	StopID string
+}
+
+// WebhookDispatcher detects events from each poll and delivers them to the
+// webhooks whose filters match. Payloads are signed with the webhook secret;
+// failed deliveries are retried with exponential backoff starting at
+// RetryBackoff and dead-lettered after MaxAttempts.
+//
+// The webhook endpoints require AdminToken and are disabled without one.
+// Webhooks may only target public addresses, checked when registering and
+// again when connecting, unless AllowPrivateTargets is set.
+type WebhookDispatcher struct {
+	ApproachWindow      time.Duration
+	StaleAfter          time.Duration
+	MaxAttempts         int
+	RetryBackoff        time.Duration
+	AdminToken          string
+	AllowPrivateTargets bool
+
+	index  *GTFSIndex
+	client *http.Client
+
+	mu          sync.RWMutex
+	webhooks    map[string]*Webhook
+	queue       []WebhookDelivery
+	deadLetters []WebhookDelivery
+
+	primed     bool
+	approached map[tripStopKey]bool
+	delays     map[string]int
+	stale      map[string]bool
+	alerts     map[string]bool
+}
+
+func NewWebhookDispatcher(index *GTFSIndex, approachWindow, staleAfter time.Duration, maxAttempts int, retryBackoff time.Duration) *WebhookDispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	d := &WebhookDispatcher{
+		ApproachWindow: approachWindow,
+		StaleAfter:     staleAfter,
+		MaxAttempts:    maxAttempts,
+		RetryBackoff:   retryBackoff,
+		index:          index,
+		webhooks:       make(map[string]*Webhook),
+		approached:     make(map[tripStopKey]bool),
+		delays:         make(map[string]int),
+		stale:          make(map[string]bool),
+		alerts:         make(map[string]bool),
+	}
+
+	// The address is checked after name resolution, right before connecting,
+	// so a name can't be pointed at a private address after registering.
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip != nil && !d.AllowPrivateTargets && !publicIP(ip) {
+				return fmt.Errorf("webhook target %s is not a public address", host)
+			}
+			return nil
+		},
+	}
+	d.client = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConns:        maxWebhookConcurrency,
+		},
+		// Redirects could lead to a private address the registration check
+		// never saw; the dial check still applies, but don't follow them.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// Authorized reports whether a request carries the admin token as a bearer
+// token.
+func (d *WebhookDispatcher) Authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return d.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.AdminToken)) == 1
+}
+
+// checkTarget resolves the host of a webhook URL and rejects it when any of
+// its addresses is not public.
+func (d *WebhookDispatcher) checkTarget(host string) error {
+	if d.AllowPrivateTargets {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, address := range addresses {
+		if !publicIP(address.IP) {
+			return fmt.Errorf("%s resolves to %s, which is not a public address", host, address.IP)
+		}
+	}
+	return nil
+}
+
+// publicIP reports whether ip is a routable public address, i.e. not
+// loopback, private, link-local (which includes cloud metadata services),
+// multicast or otherwise reserved.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range blockedWebhookNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// Register validates a registration and adds the webhook.
+func (d *WebhookDispatcher) Register(registration WebhookRegistration, now time.Time) (Webhook, error) {
+	target, err := url.Parse(registration.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return Webhook{}, errors.New("URL must be an absolute http or https URL")
+	}
+	if err := d.checkTarget(target.Hostname()); err != nil {
+		return Webhook{}, err
+	}
+	if registration.Secret == "" {
+		return Webhook{}, errors.New("Secret is required")
+	}
+	for _, eventType := range registration.EventTypes {
+		if !containsString(webhookEventTypes, eventType) {
+			return Webhook{}, fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	if registration.DelayMinutes < 0 {
+		return Webhook{}, errors.New("DelayMinutes must not be negative")
+	}
+	if registration.DelayMinutes == 0 {
+		registration.DelayMinutes = defaultWebhookDelayMinutes
+	}
+
+	webhook := &Webhook{
+		ID:           newWebhookID(),
+		URL:          registration.URL,
+		EventTypes:   nonNilStrings(registration.EventTypes),
+		RouteIDs:     nonNilStrings(registration.RouteIDs),
+		StopIDs:      nonNilStrings(registration.StopIDs),
+		VehicleIDs:   nonNilStrings(registration.VehicleIDs),
+		DelayMinutes: registration.DelayMinutes,
+		CreatedAt:    now,
+		secret:       registration.Secret,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.webhooks[webhook.ID] = webhook
+	return *webhook, nil
+}
+
+// Remove deletes a webhook and drops its pending deliveries.
+func (d *WebhookDispatcher) Remove(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.webhooks[id]; !ok {
+		return false
+	}
+	delete(d.webhooks, id)
+	queue := d.queue[:0]
+	for _, delivery := range d.queue {
+		if delivery.WebhookID != id {
+			queue = append(queue, delivery)
+		}
+	}
+	d.queue = queue
+	webhookPendingDeliveries.Set(float64(len(d.queue)))
+	return true
+}
+
+// Webhook returns a registered webhook.
+func (d *WebhookDispatcher) Webhook(id string) (Webhook, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	webhook, ok := d.webhooks[id]
+	if !ok {
+		return Webhook{}, false
+	}
+	return *webhook, true
+}
+
+// Webhooks returns every registered webhook, oldest first.
+func (d *WebhookDispatcher) Webhooks() []Webhook {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	webhooks := make([]Webhook, 0, len(d.webhooks))
+	for _, webhook := range d.webhooks {
+		webhooks = append(webhooks, *webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		if !webhooks[i].CreatedAt.Equal(webhooks[j].CreatedAt) {
+			return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+		}
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks
+}
+
+// DeadLetters returns the deliveries that ran out of attempts, oldest first.
+func (d *WebhookDispatcher) DeadLetters() []WebhookDelivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]WebhookDelivery{}, d.deadLetters...)
+}
+
+// Observe detects the events of one poll taken at now and queues a delivery
+// for every webhook they match; Deliver sends them. Delays, alerts and stale
+// vehicles already in the feed on the first poll are taken as known, so a
+// restart doesn't repeat them.
+func (d *WebhookDispatcher) Observe(buses []BusPosition, tripUpdates []TripUpdate, alerts []Alert, now time.Time) []WebhookEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	events := d.tripEvents(tripUpdates, now)
+	staleEvents := d.staleEvents(buses, now)
+	alertEvents := d.alertEvents(alerts, now)
+	if d.primed {
+		events = append(events, staleEvents...)
+		events = append(events, alertEvents...)
+	}
+	d.primed = true
+
+	for i := range events {
+		events[i].ID = newWebhookID()
+		events[i].Time = now
+		webhookEventsTotal.WithLabelValues(events[i].Type).Inc()
+		for _, webhook := range d.webhooks {
+			if !webhook.Matches(events[i]) {
+				continue
+			}
+			d.enqueue(WebhookDelivery{
+				ID:          newWebhookID(),
+				WebhookID:   webhook.ID,
+				URL:         webhook.URL,
+				Event:       events[i],
+				NextAttempt: now,
+			})
+		}
+	}
+	webhookPendingDeliveries.Set(float64(len(d.queue)))
+	return events
+}
+
+// tripEvents reports trips approaching their next stop and trips whose delay
+// grew by a whole minute since the previous poll. Before d.primed it only
+// records the delays. d.mu must be held.
+func (d *WebhookDispatcher) tripEvents(tripUpdates []TripUpdate, now time.Time) []WebhookEvent {
+	events := make([]WebhookEvent, 0)
+	seen := make(map[string]bool, len(tripUpdates))
+	for _, tripUpdate := range tripUpdates {
+		tripID := tripUpdate.Trip.GetTripId()
+		if tripID == "" {
+			continue
+		}
+		seen[tripID] = true
+
+		next, ok := d.nextStop(tripUpdate, now)
+		if !ok {
+			continue
+		}
+
+		key := tripStopKey{TripID: tripID, StopID: next.StopID}
+		if !d.approached[key] && next.PredictedArrival.Sub(now) <= d.ApproachWindow {
+			d.approached[key] = true
+			events = append(events, next.withType(WebhookApproaching))
+		}
+
+		previous := d.delays[tripID]
+		d.delays[tripID] = next.DelaySeconds
+		if d.primed && next.DelaySeconds >= 60 && next.DelaySeconds/60 > previous/60 {
+			event := next.withType(WebhookDelay)
+			event.PreviousDelaySeconds = previous
+			events = append(events, event)
+		}
+	}
+
+	// Trips that left the feed are finished.
+	for key := range d.approached {
+		if !seen[key.TripID] {
+			delete(d.approached, key)
+		}
+	}
+	for tripID := range d.delays {
+		if !seen[tripID] {
+			delete(d.delays, tripID)
+		}
+	}
+	return events
+}
+
+// nextStop returns the first stop of a trip update predicted at or after now,
+// as an event without a type.
+func (d *WebhookDispatcher) nextStop(tripUpdate TripUpdate, now time.Time) (WebhookEvent, bool) {
+	tripID := tripUpdate.Trip.GetTripId()
+	serviceDate := d.index.TripServiceDate(tripUpdate.Trip.GetStartDate(), now)
+
+	for _, update := range tripUpdate.StopTimeUpdate {
+		stopTime, scheduled := d.index.StopTimeFor(tripID, update.GetStopSequence(), update.GetStopId())
+		predicted, delay := resolveStopTimeEvent(d.index, serviceDate, stopTime.ArrivalTime, scheduled, update.GetArrival())
+		if predicted == nil {
+			predicted, delay = resolveStopTimeEvent(d.index, serviceDate, stopTime.DepartureTime, scheduled, update.GetDeparture())
+		}
+		if predicted == nil || predicted.Before(now) {
+			continue
+		}
+
+		event := WebhookEvent{
+			VehicleID:        tripUpdate.Vehicle.GetId(),
+			RouteID:          tripUpdate.Trip.GetRouteId(),
+			TripID:           tripID,
+			StopID:           update.GetStopId(),
+			PredictedArrival: predicted,
+		}
+		if event.RouteID == "" {
+			event.RouteID = d.index.Trips[tripID].RouteID
+		}
+		if event.StopID == "" {
+			event.StopID = stopTime.StopID
+		}
+		event.StopName = d.index.Stops[event.StopID].StopName
+		if delay != nil {
+			event.DelaySeconds = *delay
+		}
+		return event, true
+	}
+	return WebhookEvent{}, false
+}
+
+func (e WebhookEvent) withType(eventType string) WebhookEvent {
+	e.Type = eventType
+	return e
+}
+
+// staleEvents reports vehicles whose last report became older than
+// StaleAfter. A vehicle is reported again only after a fresh report. d.mu
+// must be held.
+func (d *WebhookDispatcher) staleEvents(buses []BusPosition, now time.Time) []WebhookEvent {
+	events := make([]WebhookEvent, 0)
+	seen := make(map[string]bool, len(buses))
+	for _, bus := range buses {
+		seen[bus.ID] = true
+		if bus.Timestamp <= 0 {
+			continue
+		}
+		lastReport := time.Unix(bus.Timestamp, 0)
+		if now.Sub(lastReport) <= d.StaleAfter {
+			delete(d.stale, bus.ID)
+			continue
+		}
+		if d.stale[bus.ID] {
+			continue
+		}
+		d.stale[bus.ID] = true
+		events = append(events, WebhookEvent{
+			Type:       WebhookStale,
+			VehicleID:  bus.ID,
+			RouteID:    bus.RouteID,
+			TripID:     bus.TripID,
+			StopID:     bus.StopID,
+			StopName:   d.index.Stops[bus.StopID].StopName,
+			LastReport: &lastReport,
+		})
+	}
+	for id := range d.stale {
+		if !seen[id] {
+			delete(d.stale, id)
+		}
+	}
+	return events
+}
+
+// alertEvents reports alerts that appeared in the feed. d.mu must be held.
+func (d *WebhookDispatcher) alertEvents(alerts []Alert, now time.Time) []WebhookEvent {
+	events := make([]WebhookEvent, 0)
+	seen := make(map[string]bool, len(alerts))
+	for i := range alerts {
+		seen[alerts[i].ID] = true
+		if d.alerts[alerts[i].ID] || !alerts[i].ActiveAt(now) {
+			continue
+		}
+		d.alerts[alerts[i].ID] = true
+		alert := alerts[i]
+		events = append(events, WebhookEvent{Type: WebhookAlert, Alert: &alert})
+	}
+	for id := range d.alerts {
+		if !seen[id] {
+			delete(d.alerts, id)
+		}
+	}
+	return events
+}
+
+// Matches reports whether an event passes the webhook's filters. Filters of
+// different kinds must all match; an alert matches the route and stop
+// filters through its informed entities and never matches a vehicle filter.
+func (w *Webhook) Matches(event WebhookEvent) bool {
+	if len(w.EventTypes) > 0 && !containsString(w.EventTypes, event.Type) {
+		return false
+	}
+	if event.Type == WebhookDelay {
+		threshold := w.DelayMinutes * 60
+		if event.PreviousDelaySeconds >= threshold || event.DelaySeconds < threshold {
+			return false
+		}
+	}
+
+	if event.Alert != nil {
+		if len(w.VehicleIDs) > 0 {
+			return false
+		}
+		routeMatched, stopMatched := len(w.RouteIDs) == 0, len(w.StopIDs) == 0
+		for _, entity := range event.Alert.InformedEntity {
+			routeMatched = routeMatched || containsString(w.RouteIDs, entity.GetRouteId()) || containsString(w.RouteIDs, entity.GetTrip().GetRouteId())
+			stopMatched = stopMatched || containsString(w.StopIDs, entity.GetStopId())
+		}
+		return routeMatched && stopMatched
+	}
+
+	if len(w.RouteIDs) > 0 && !containsString(w.RouteIDs, event.RouteID) {
+		return false
+	}
+	if len(w.StopIDs) > 0 && !containsString(w.StopIDs, event.StopID) {
+		return false
+	}
+	if len(w.VehicleIDs) > 0 && !containsString(w.VehicleIDs, event.VehicleID) {
+		return false
+	}
+	return true
+}
+
+// enqueue adds a delivery, dead-lettering the oldest one when the queue is
+// full. d.mu must be held.
+func (d *WebhookDispatcher) enqueue(delivery WebhookDelivery) {
+	if len(d.queue) >= maxWebhookQueue {
+		oldest := d.queue[0]
+		oldest.LastError = "queue full"
+		d.deadLetter(oldest)
+		d.queue = d.queue[1:]
+	}
+	d.queue = append(d.queue, delivery)
+}
+
+// deadLetter keeps a delivery that won't be attempted again. d.mu must be
+// held.
+func (d *WebhookDispatcher) deadLetter(delivery WebhookDelivery) {
+	webhookDeliveriesTotal.WithLabelValues("dead_lettered").Inc()
+	d.deadLetters = append(d.deadLetters, delivery)
+	if len(d.deadLetters) > maxWebhookDeadLetter {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-maxWebhookDeadLetter:]
+	}
+}
+
+// Deliver sends up to maxWebhookDeliveriesPerPoll deliveries due at now,
+// within webhookDeliverBudget, and waits for them to finish. The poll loop
+// calls it after Observe; deliveries it has no time or room for stay queued
+// without using up an attempt. Failures are rescheduled, doubling the wait
+// each attempt, until they run out of attempts.
+func (d *WebhookDispatcher) Deliver(now time.Time) {
+	d.mu.Lock()
+	due := make([]WebhookDelivery, 0)
+	secrets := make([]string, 0)
+	queue := d.queue[:0]
+	for _, delivery := range d.queue {
+		webhook, ok := d.webhooks[delivery.WebhookID]
+		if !ok {
+			continue
+		}
+		if delivery.NextAttempt.After(now) || len(due) >= maxWebhookDeliveriesPerPoll {
+			queue = append(queue, delivery)
+			continue
+		}
+		due = append(due, delivery)
+		secrets = append(secrets, webhook.secret)
+	}
+	d.queue = queue
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookDeliverBudget)
+	defer cancel()
+	errs := make([]error, len(due))
+	started := 0
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxWebhookConcurrency)
+	for started < len(due) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = d.send(ctx, due[i], secrets[i], now)
+		}(started)
+		started++
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, delivery := range due[started:] {
+		d.enqueue(delivery)
+	}
+	for i, delivery := range due[:started] {
+		attempted := now
+		delivery.Attempts++
+		delivery.LastAttempt = &attempted
+		if errs[i] == nil {
+			webhookDeliveriesTotal.WithLabelValues("delivered").Inc()
+			continue
+		}
+		webhookDeliveriesTotal.WithLabelValues("failed").Inc()
+		delivery.LastError = errs[i].Error()
+		if delivery.Attempts >= d.MaxAttempts {
+			d.deadLetter(delivery)
+			continue
+		}
+		backoff := d.RetryBackoff << (delivery.Attempts - 1)
+		if backoff > maxWebhookBackoff || backoff <= 0 {
+			backoff = maxWebhookBackoff
+		}
+		delivery.NextAttempt = now.Add(backoff)
+		if _, ok := d.webhooks[delivery.WebhookID]; ok {
+			d.enqueue(delivery)
+		}
+	}
+	webhookPendingDeliveries.Set(float64(len(d.queue)))
+}
+
+// send posts an event to a webhook. The X-Webhook-Signature header is the
+// hex HMAC-SHA256 of the X-Webhook-Timestamp header, a dot and the body,
+// keyed with the webhook secret.
+func (d *WebhookDispatcher) send(ctx context.Context, delivery WebhookDelivery, secret string, now time.Time) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-ID", delivery.WebhookID)
+	request.Header.Set("X-Webhook-Delivery", delivery.ID)
+	request.Header.Set("X-Webhook-Event", delivery.Event.Type)
+	request.Header.Set("X-Webhook-Timestamp", timestamp)
+	request.Header.Set("X-Webhook-Signature", "sha256="+signWebhookPayload(secret, timestamp, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return nil
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of a timestamped payload.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookID returns a random identifier for webhooks, events and
+// deliveries.
+func newWebhookID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return make([]string, 0)
+	}
+	return values
+}
+
+// authorizeWebhooks checks the admin token of a request to the webhook
+// endpoints, writing the error when it fails.
+func authorizeWebhooks(w http.ResponseWriter, r *http.Request) bool {
+	if webhookDispatcher.AdminToken == "" {
+		http.Error(w, "Webhooks not configured", http.StatusServiceUnavailable)
+		return false
+	}
+	if !webhookDispatcher.Authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// webhooksHandler lists webhooks on GET and registers one on POST.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+	var response interface{}
+	status := http.StatusOK
+
+	switch r.Method {
+	case http.MethodGet:
+		response = webhookDispatcher.Webhooks()
+	case http.MethodPost:
+		var registration WebhookRegistration
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&registration); err != nil {
+			http.Error(w, "Invalid webhook", http.StatusBadRequest)
+			return
+		}
+		webhook, err := webhookDispatcher.Register(registration, time.Now())
+		if err != nil {
+			http.Error(w, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, status = webhook, http.StatusCreated
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// webhookHandler serves /webhooks/{id} on GET and removes the webhook on
+// DELETE.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/webhooks/")
+
+	switch r.Method {
+	case http.MethodGet:
+		webhook, ok := webhookDispatcher.Webhook(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(webhook)
+		if err != nil {
+			http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if !webhookDispatcher.Remove(id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookDeadLettersHandler serves the deliveries that ran out of attempts,
+// optionally for one webhook_id.
+func webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+	webhookID := r.URL.Query().Get("webhook_id")
+	deliveries := make([]WebhookDelivery, 0)
+	for _, delivery := range webhookDispatcher.DeadLetters() {
+		if webhookID == "" || delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/calvarado2004/vehicle-positions/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// webhookRecorder is a webhook endpoint that checks signatures and records
+// the events posted to each path.
+type webhookRecorder struct {
+	t      *testing.T
+	secret string
+	status int
+
+	mu     sync.Mutex
+	events map[string][]WebhookEvent
+	hits   int
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	expected := "sha256=" + signWebhookPayload(rec.secret, r.Header.Get("X-Webhook-Timestamp"), body)
+	if r.Header.Get("X-Webhook-Signature") != expected {
+		rec.t.Errorf("Expected signature %s, got %s", expected, r.Header.Get("X-Webhook-Signature"))
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		rec.t.Errorf("Failed to decode event: %v", err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.hits++
+	rec.events[r.URL.Path] = append(rec.events[r.URL.Path], event)
+	if rec.status != 0 {
+		w.WriteHeader(rec.status)
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	recorder := &webhookRecorder{t: t, secret: "s3cret", events: make(map[string][]WebhookEvent)}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	dispatcher := NewWebhookDispatcher(newTestIndex(), 2*time.Minute, 5*time.Minute, 3, 30*time.Second)
+	dispatcher.AllowPrivateTargets = true
+	start := time.Date(2023, 10, 16, 8, 2, 0, 0, time.UTC)
+
+	if _, err := dispatcher.Register(WebhookRegistration{URL: "ftp://example.com", Secret: "x"}, start); err == nil {
+		t.Errorf("Expected a non-http URL to be rejected")
+	}
+	if _, err := dispatcher.Register(WebhookRegistration{URL: server.URL, Secret: "x", EventTypes: []string{"bus_exploded"}}, start); err == nil {
+		t.Errorf("Expected an unknown event type to be rejected")
+	}
+	routeHook, err := dispatcher.Register(WebhookRegistration{URL: server.URL + "/route", Secret: "s3cret", RouteIDs: []string{"r1"}}, start)
+	if err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+	if routeHook.DelayMinutes != defaultWebhookDelayMinutes {
+		t.Errorf("Expected the default delay threshold, got %d", routeHook.DelayMinutes)
+	}
+	_, err = dispatcher.Register(WebhookRegistration{URL: server.URL + "/alerts", Secret: "s3cret", EventTypes: []string{WebhookAlert}, StopIDs: []string{"C"}}, start)
+	if err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+
+	trip := &pb.TripDescriptor{TripId: proto.String("t1"), StartDate: proto.String("20231016")}
+	tripUpdates := []TripUpdate{{
+		Trip:    trip,
+		Vehicle: &pb.VehicleDescriptor{Id: proto.String("2301")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{
+			newTestStopTimeUpdate(1, "A", start.Add(-2*time.Minute)),
+			newTestStopTimeUpdate(2, "B", start.Add(time.Minute)),
+		},
+	}, {
+		// Already five minutes late at C when the dispatcher starts.
+		Trip:           &pb.TripDescriptor{TripId: proto.String("t2"), StartDate: proto.String("20231016")},
+		Vehicle:        &pb.VehicleDescriptor{Id: proto.String("2302")},
+		StopTimeUpdate: []*pb.TripUpdate_StopTimeUpdate{newTestStopTimeUpdate(3, "C", start.Add(19*time.Minute))},
+	}}
+	buses := []BusPosition{
+		{ID: "2301", RouteID: "r1", TripID: "t1", Timestamp: start.Unix()},
+		{ID: "2302", RouteID: "r1", TripID: "t2", Timestamp: start.Add(-10 * time.Minute).Unix()},
+	}
+	alerts := []Alert{{ID: "a1", InformedEntity: []*pb.EntitySelector{{StopId: proto.String("C")}}}}
+
+	// Known delays, alerts and stale vehicles aren't news on the first poll.
+	events := dispatcher.Observe(buses, tripUpdates, alerts, start)
+	if len(events) != 1 || events[0].Type != WebhookApproaching || events[0].StopID != "B" || events[0].RouteID != "r1" || events[0].VehicleID != "2301" {
+		t.Fatalf("Expected 2301 approaching B, got %+v", events)
+	}
+	dispatcher.Deliver(start)
+
+	// Six minutes late at B, 2303 stopped reporting and a new alert at C.
+	now := start.Add(time.Minute)
+	tripUpdates[0].StopTimeUpdate[1] = newTestStopTimeUpdate(2, "B", start.Add(7*time.Minute))
+	buses = append(buses, BusPosition{ID: "2303", RouteID: "r1", StopID: "A", Timestamp: now.Add(-6 * time.Minute).Unix()})
+	alerts = append(alerts, Alert{ID: "a2", InformedEntity: []*pb.EntitySelector{{StopId: proto.String("C")}}})
+	events = dispatcher.Observe(buses, tripUpdates, alerts, now)
+	if len(events) != 3 {
+		t.Fatalf("Expected delay, stale and alert events, got %+v", events)
+	}
+	dispatcher.Deliver(now)
+
+	// The delay grew, but not by a whole minute.
+	tripUpdates[0].StopTimeUpdate[1] = newTestStopTimeUpdate(2, "B", start.Add(7*time.Minute+30*time.Second))
+	if events := dispatcher.Observe(buses, tripUpdates, alerts, now.Add(15*time.Second)); len(events) != 0 {
+		t.Errorf("Expected no new events, got %+v", events)
+	}
+
+	// The trip makes up time, then falls six minutes behind again.
+	tripUpdates[0].StopTimeUpdate[1] = newTestStopTimeUpdate(2, "B", start.Add(3*time.Minute))
+	if events := dispatcher.Observe(buses, tripUpdates, alerts, now.Add(30*time.Second)); len(events) != 0 {
+		t.Errorf("Expected no events as the delay shrinks, got %+v", events)
+	}
+	tripUpdates[0].StopTimeUpdate[1] = newTestStopTimeUpdate(2, "B", start.Add(7*time.Minute))
+	events = dispatcher.Observe(buses, tripUpdates, alerts, now.Add(45*time.Second))
+	if len(events) != 1 || events[0].Type != WebhookDelay || events[0].DelaySeconds != 360 || events[0].PreviousDelaySeconds != 120 {
+		t.Errorf("Expected the delay to grow from 2 to 6 minutes, got %+v", events)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	route := recorder.events["/route"]
+	if len(route) != 3 {
+		t.Fatalf("Expected 3 events on the route webhook, got %+v", route)
+	}
+	if route[0].Type != WebhookApproaching {
+		t.Errorf("Expected the approaching event first, got %s", route[0].Type)
+	}
+	types := map[string]WebhookEvent{}
+	for _, event := range route {
+		types[event.Type] = event
+	}
+	if delay := types[WebhookDelay]; delay.DelaySeconds != 360 || delay.PreviousDelaySeconds != 0 || delay.StopID != "B" {
+		t.Errorf("Expected a 6 minute delay at B, got %+v", delay)
+	}
+	if stale := types[WebhookStale]; stale.VehicleID != "2303" || stale.StopName != "FIRST ST" || stale.LastReport == nil {
+		t.Errorf("Expected 2303 to go stale at A, got %+v", stale)
+	}
+	if _, ok := types[WebhookAlert]; ok {
+		t.Errorf("Expected the alert without routes to miss the route filter")
+	}
+
+	alertEvents := recorder.events["/alerts"]
+	if len(alertEvents) != 1 || alertEvents[0].Alert == nil || alertEvents[0].Alert.ID != "a2" {
+		t.Errorf("Expected alert a2 on the alert webhook, got %+v", alertEvents)
+	}
+}
+
+func TestWebhookMatchesDelayThreshold(t *testing.T) {
+	webhook := Webhook{DelayMinutes: 10}
+	for _, test := range []struct {
+		previous, current int
+		expected          bool
+	}{
+		{0, 540, false},
+		{540, 600, true},
+		{0, 720, true},
+		{600, 660, false},
+	} {
+		event := WebhookEvent{Type: WebhookDelay, PreviousDelaySeconds: test.previous, DelaySeconds: test.current}
+		if webhook.Matches(event) != test.expected {
+			t.Errorf("Expected %d -> %d seconds to match %v", test.previous, test.current, test.expected)
+		}
+	}
+}
+
+func TestWebhookRetriesAndDeadLetters(t *testing.T) {
+	recorder := &webhookRecorder{t: t, secret: "s3cret", status: http.StatusServiceUnavailable, events: make(map[string][]WebhookEvent)}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	dispatcher := NewWebhookDispatcher(newTestIndex(), 2*time.Minute, 5*time.Minute, 3, 30*time.Second)
+	dispatcher.AllowPrivateTargets = true
+	start := time.Date(2023, 10, 16, 8, 2, 0, 0, time.UTC)
+	webhook, err := dispatcher.Register(WebhookRegistration{URL: server.URL, Secret: "s3cret"}, start)
+	if err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+
+	dispatcher.Observe(nil, nil, nil, start)
+	dispatcher.Observe(nil, nil, []Alert{{ID: "a1"}}, start)
+
+	// Attempts at 0s, 30s and 90s.
+	for _, offset := range []time.Duration{0, 29 * time.Second, 30 * time.Second, 89 * time.Second, 90 * time.Second, time.Hour} {
+		dispatcher.Deliver(start.Add(offset))
+	}
+
+	recorder.mu.Lock()
+	hits := recorder.hits
+	recorder.mu.Unlock()
+	if hits != 3 {
+		t.Errorf("Expected 3 attempts, got %d", hits)
+	}
+
+	deadLetters := dispatcher.DeadLetters()
+	if len(deadLetters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(deadLetters))
+	}
+	if deadLetters[0].WebhookID != webhook.ID || deadLetters[0].Attempts != 3 || !strings.Contains(deadLetters[0].LastError, "503") {
+		t.Errorf("Expected 3 failed attempts, got %+v", deadLetters[0])
+	}
+}
+
+func TestWebhookTargets(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(newTestIndex(), 2*time.Minute, 5*time.Minute, 3, 30*time.Second)
+	start := time.Date(2023, 10, 16, 8, 2, 0, 0, time.UTC)
+
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://10.0.0.5/hook", "http://169.254.169.254/latest/meta-data", "http://[::1]/hook", "http://localhost/hook"} {
+		if _, err := dispatcher.Register(WebhookRegistration{URL: target, Secret: "x"}, start); err == nil {
+			t.Errorf("Expected %s to be rejected", target)
+		}
+	}
+
+	// A target that passed registration is still refused when connecting.
+	recorder := &webhookRecorder{t: t, secret: "s3cret", events: make(map[string][]WebhookEvent)}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	err := dispatcher.send(context.Background(), WebhookDelivery{URL: server.URL, Event: WebhookEvent{Type: WebhookAlert}}, "s3cret", start)
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("Expected the connection to a loopback address to be refused, got %v", err)
+	}
+	if recorder.hits != 0 {
+		t.Errorf("Expected no request to reach the server, got %d", recorder.hits)
+	}
+}
+
+func TestWebhookAuthorization(t *testing.T) {
+	webhookDispatcher = NewWebhookDispatcher(newTestIndex(), 2*time.Minute, 5*time.Minute, 3, 30*time.Second)
+	defer func() { webhookDispatcher = nil }()
+
+	request := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(`{"URL":"http://example.com","Secret":"x"}`))
+	recorder := httptest.NewRecorder()
+	webhooksHandler(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected webhooks to be disabled without a token, got %d", recorder.Code)
+	}
+
+	webhookDispatcher.AdminToken = "t0ken"
+	request = httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	request.Header.Set("Authorization", "Bearer wrong")
+	recorder = httptest.NewRecorder()
+	webhooksHandler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be refused, got %d", recorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	request.Header.Set("Authorization", "Bearer t0ken")
+	recorder = httptest.NewRecorder()
+	webhooksHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the admin token to be accepted, got %d", recorder.Code)
+	}
+}